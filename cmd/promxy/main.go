@@ -29,6 +29,8 @@ import (
 	kitlog "github.com/go-kit/kit/log"
 	"github.com/jessevdk/go-flags"
 	"github.com/julienschmidt/httprouter"
+	"github.com/opentracing-contrib/go-stdlib/nethttp"
+	opentracing "github.com/opentracing/opentracing-go"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/prometheus/common/log"
@@ -47,11 +49,20 @@ import (
 	"github.com/prometheus/prometheus/util/strutil"
 	"github.com/prometheus/prometheus/web"
 	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
 
 	proxyconfig "github.com/jacksontj/promxy/pkg/config"
+	"github.com/jacksontj/promxy/pkg/headers"
 	"github.com/jacksontj/promxy/pkg/logging"
 	"github.com/jacksontj/promxy/pkg/noop"
+	"github.com/jacksontj/promxy/pkg/promclient"
+	"github.com/jacksontj/promxy/pkg/promxyapi"
 	"github.com/jacksontj/promxy/pkg/proxystorage"
+	"github.com/jacksontj/promxy/pkg/querybudget"
+	"github.com/jacksontj/promxy/pkg/querylog"
+	"github.com/jacksontj/promxy/pkg/storeapi"
+	"github.com/jacksontj/promxy/pkg/storepb"
+	"github.com/jacksontj/promxy/pkg/tracing"
 )
 
 var (
@@ -67,6 +78,7 @@ type cliOpts struct {
 	Version bool `long:"version" short:"v" description:"print out version and exit"`
 
 	BindAddr   string `long:"bind-addr" description:"address for promxy to listen on" default:":8082"`
+	StoreAddr  string `long:"grpc.store-addr" description:"address to serve the Thanos StoreAPI (gRPC) on, so that thanos components can use promxy as a store. If empty the StoreAPI is disabled"`
 	ConfigFile string `long:"config" description:"path to the config file" default:"config.yaml"`
 	LogLevel   string `long:"log-level" description:"Log level" default:"info"`
 	LogFormat  string `long:"log-format" description:"Log format(text|json)" default:"text"`
@@ -77,13 +89,17 @@ type cliOpts struct {
 	MetricsPath string `long:"metrics-path" description:"URL path for the prometheus metrics endpoint." default:"/metrics"`
 
 	ExternalURL     string `long:"web.external-url" description:"The URL under which Prometheus is externally reachable (for example, if Prometheus is served via a reverse proxy). Used for generating relative and absolute links back to Prometheus itself. If the URL has a path portion, it will be used to prefix all HTTP endpoints served by Prometheus. If omitted, relevant URL components will be derived automatically."`
-	EnableLifecycle bool   `long:"web.enable-lifecycle" description:"Enable shutdown and reload via HTTP request."`
+	EnableLifecycle bool   `long:"web.enable-lifecycle" description:"Enable shutdown, reload and servergroup overrides via HTTP request."`
 
 	QueryTimeout        time.Duration `long:"query.timeout" description:"Maximum time a query may take before being aborted." default:"2m"`
 	QueryMaxConcurrency int           `long:"query.max-concurrency" description:"Maximum number of queries executed concurrently." default:"1000"`
 	QueryMaxSamples     int           `long:"query.max-samples" description:"Maximum number of samples a single query can load into memory. Note that queries will fail if they would load more samples than this into memory, so this also limits the number of samples a query can return." default:"50000000"`
 	QueryLookbackDelta  time.Duration `long:"query.lookback-delta" description:"The maximum lookback duration for retrieving metrics during expression evaluations." default:"5m"`
 
+	QueryMaxDownstreamSamples int64 `long:"query.max-downstream-samples" description:"Maximum number of samples a single query may receive from all servergroups before it is aborted (0 is unlimited)." default:"0"`
+	QueryMaxDownstreamBytes   int64 `long:"query.max-downstream-bytes" description:"Maximum number of bytes a single query may receive from all servergroups before it is aborted (0 is unlimited)." default:"0"`
+	QueryMaxInflightBytes     int64 `long:"query.max-inflight-bytes" description:"Maximum number of bytes all in-flight queries together may receive from servergroups, queries which would exceed this are aborted (0 is unlimited)." default:"0"`
+
 	RemoteReadMaxConcurrency int `long:"remote-read.max-concurrency" description:"Maximum number of concurrent remote read calls." default:"10"`
 
 	NotificationQueueCapacity int           `long:"alertmanager.notification-queue-capacity" description:"The capacity of the queue for pending alert manager notifications." default:"10000"`
@@ -92,6 +108,16 @@ type cliOpts struct {
 	ForGracePeriod            time.Duration `long:"rules.alert.for-grace-period" description:"Minimum duration between alert and restored for state. This is maintained only for alerts with configured for time greater than grace period." default:"10m"`
 	ResendDelay               time.Duration `long:"rules.alert.resend-delay" description:"Minimum amount of time to wait before resending an alert to Alertmanager." default:"1m"`
 
+	QueryLogFile          string        `long:"query-log.file" description:"path to write the structured query log to. If empty the query log is disabled"`
+	QueryLogSlowThreshold time.Duration `long:"query-log.slow-threshold" description:"only log queries which take at least this long" default:"0s"`
+	QueryLogSampleRate    float64       `long:"query-log.sample-rate" description:"fraction (0-1) of queries (above the slow threshold) to log" default:"1"`
+	QueryLogMaxSize       int64         `long:"query-log.max-size" description:"size in bytes after which the query log file is rotated" default:"104857600"`
+	QueryLogMaxBackups    int           `long:"query-log.max-backups" description:"number of rotated query log files to keep" default:"3"`
+	QueryLogTenantHeader  string        `long:"query-log.tenant-header" description:"HTTP header to read the tenant of a query from" default:"X-Scope-OrgID"`
+
+	TracingExporter string `long:"tracing.exporter" description:"where to export tracing spans, options (none, log, file, jaeger)" default:"none"`
+	TracingFile     string `long:"tracing.file" description:"path to write tracing spans to when using the file exporter"`
+
 	ShutdownDelay   time.Duration `long:"http.shutdown-delay" description:"time to wait before shutting down the http server, this allows for a grace period for upstreams (e.g. LoadBalancers) to discover the new stopping status through healthchecks" default:"10s"`
 	ShutdownTimeout time.Duration `long:"http.shutdown-timeout" description:"max time to wait for a graceful shutdown of the HTTP server" default:"60s"`
 }
@@ -183,6 +209,12 @@ func main() {
 	klog.ClampLevel(6)
 	klog.SetLogger(logging.NewLogger(logrus.WithField("component", "k8s_client_runtime").Logger))
 
+	tracingCloser, err := tracing.Configure(opts.TracingExporter, opts.TracingFile)
+	if err != nil {
+		logrus.Fatalf("Error configuring tracing: %v", err)
+	}
+	defer tracingCloser.Close()
+
 	// Create base context for this daemon
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -200,13 +232,17 @@ func main() {
 	reloadables = append(reloadables, ps)
 	proxyStorage = ps
 
-	engine := promql.NewEngine(promql.EngineOpts{
+	engineOpts := promql.EngineOpts{
 		Reg:           prometheus.DefaultRegisterer,
 		MaxConcurrent: opts.QueryMaxConcurrency,
 		Timeout:       opts.QueryTimeout,
 		MaxSamples:    opts.QueryMaxSamples,
-	})
+	}
+	engine := promql.NewEngine(engineOpts)
 	engine.NodeReplacer = ps.NodeReplacer
+	// Queries which are evaluated by promxy on behalf of a downstream (e.g. the
+	// thanos_store backend or relabeled servergroups) have the same limits
+	promclient.SetEngineOpts(engineOpts)
 
 	promql.LookbackDelta = opts.QueryLookbackDelta
 
@@ -265,10 +301,38 @@ func main() {
 		logrus.Infof("Notifier manager stopped")
 	}()
 
+	// Set up the query log
+	var queryLogger *querylog.Logger
+	if opts.QueryLogFile != "" {
+		queryLogFile, err := querylog.NewRotatingFile(opts.QueryLogFile, opts.QueryLogMaxSize, opts.QueryLogMaxBackups)
+		if err != nil {
+			logrus.Fatalf("Error opening query log: %v", err)
+		}
+		queryLogger = querylog.NewLogger(queryLogFile, opts.QueryLogSlowThreshold, opts.QueryLogSampleRate)
+		defer queryLogger.Close()
+	}
+
+	// Set up the per-query accounting of data received from servergroups
+	queryLimits := querybudget.Limits{
+		MaxSamples: opts.QueryMaxDownstreamSamples,
+		MaxBytes:   opts.QueryMaxDownstreamBytes,
+	}
+	if opts.QueryMaxInflightBytes > 0 {
+		queryLimits.Global = querybudget.NewMemoryLimiter(opts.QueryMaxInflightBytes)
+	}
+
+	queryFunc := rules.EngineQueryFunc(engine, proxyStorage)
+	if queryLimits.Enabled() {
+		queryFunc = querybudget.WrapQueryFunc(queryFunc, queryLimits)
+	}
+	if queryLogger != nil {
+		queryFunc = querylog.WrapQueryFunc(queryFunc, queryLogger)
+	}
+
 	ruleManager := rules.NewManager(&rules.ManagerOptions{
 		Context:         ctx,         // base context for all background tasks
 		ExternalURL:     externalUrl, // URL listed as URL for "who fired this alert"
-		QueryFunc:       rules.EngineQueryFunc(engine, proxyStorage),
+		QueryFunc:       queryFunc,
 		NotifyFunc:      sendAlerts(notifierManager, externalUrl.String()),
 		TSDB:            noop.NewNoopStorage(), // TODO: use remote_read?
 		Appendable:      proxyStorage,
@@ -357,11 +421,15 @@ func main() {
 	apiRouter := route.New()
 
 	webHandler.Getv1API().Register(apiRouter.WithPrefix(path.Join(webOptions.RoutePrefix, "/api/v1")))
+	apiRouter.Get(path.Join(webOptions.RoutePrefix, "/api/v1/promxy/servergroups"), promxyapi.NewServerGroupsHandler(ps).ServeHTTP)
+	adminAPI := &promxyapi.AdminAPI{ServerGroups: ps, Enabled: opts.EnableLifecycle}
+	adminAPI.Register(apiRouter.WithPrefix(path.Join(webOptions.RoutePrefix, "/api/v1/promxy")))
 
 	// Create our router
 	r := httprouter.New()
 
 	r.HandlerFunc("GET", opts.MetricsPath, promhttp.Handler().ServeHTTP)
+	r.Handler("GET", path.Join(webOptions.RoutePrefix, "/promxy/servergroups"), promxyapi.NewServerGroupsPage(ps))
 
 	stopping := false
 	r.NotFound = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -413,6 +481,22 @@ func main() {
 		}
 	}
 
+	if queryLimits.Enabled() {
+		handler = querybudget.NewHandler(handler, queryLimits)
+	}
+
+	if queryLogger != nil {
+		handler = querylog.NewHandler(handler, queryLogger, opts.QueryLogTenantHeader)
+	}
+
+	// Make the headers of incoming requests available to servergroups' forward_headers
+	handler = headers.NewHandler(handler)
+
+	// Create (or continue) a trace for each incoming request
+	handler = nethttp.Middleware(opentracing.GlobalTracer(), handler, nethttp.OperationNameFunc(func(r *http.Request) string {
+		return "HTTP " + r.Method + " " + r.URL.Path
+	}))
+
 	srv := &http.Server{
 		Addr:        opts.BindAddr,
 		Handler:     handler,
@@ -429,6 +513,22 @@ func main() {
 		}
 	}()
 
+	var grpcSrv *grpc.Server
+	if opts.StoreAddr != "" {
+		lis, err := net.Listen("tcp", opts.StoreAddr)
+		if err != nil {
+			logrus.Fatalf("Error listening on %s for the StoreAPI: %v", opts.StoreAddr, err)
+		}
+		grpcSrv = grpc.NewServer()
+		storepb.RegisterStoreServer(grpcSrv, storeapi.NewServer(ps, ps.StoreInfo))
+		go func() {
+			logrus.Infof("promxy serving the StoreAPI on %s", opts.StoreAddr)
+			if err := grpcSrv.Serve(lis); err != nil {
+				log.Errorf("Error serving the StoreAPI: %v", err)
+			}
+		}()
+	}
+
 	// wait for signals etc.
 	for {
 		select {
@@ -465,6 +565,14 @@ func main() {
 					ctx, cancel = context.WithTimeout(ctx, opts.ShutdownTimeout)
 					defer cancel()
 				}
+				if grpcSrv != nil {
+					// Streams still running at the shutdown timeout are closed
+					go func() {
+						<-ctx.Done()
+						grpcSrv.Stop()
+					}()
+					grpcSrv.GracefulStop()
+				}
 				srv.Shutdown(ctx)
 				return
 			default:
@@ -7,6 +7,7 @@ import (
 	"github.com/prometheus/prometheus/config"
 
 	"github.com/jacksontj/promxy/pkg/servergroup"
+	"github.com/jacksontj/promxy/pkg/shadow"
 
 	yaml "gopkg.in/yaml.v2"
 )
@@ -50,4 +51,8 @@ type Config struct {
 type PromxyConfig struct {
 	// Config for each of the server groups promxy is configured to aggregate
 	ServerGroups []*servergroup.Config `yaml:"server_groups"`
+
+	// Shadow, if set, mirrors a sample of the requests to the server groups to
+	// a set of candidate server groups and compares their results
+	Shadow *shadow.Config `yaml:"shadow,omitempty"`
 }
@@ -0,0 +1,115 @@
+// Package headers sets static and forwarded (from the incoming request) headers
+// on the requests promxy sends to downstreams
+package headers
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+type contextKey struct{}
+
+// NewContext returns a context carrying the headers of the incoming request
+func NewContext(ctx context.Context, h http.Header) context.Context {
+	return context.WithValue(ctx, contextKey{}, h)
+}
+
+// FromContext returns the headers of the incoming request in the context (or nil
+// if there are none)
+func FromContext(ctx context.Context) http.Header {
+	h, _ := ctx.Value(contextKey{}).(http.Header)
+	return h
+}
+
+// NewHandler returns an http.Handler which puts the headers of each request into
+// the request's context, so that they can be forwarded to downstreams
+func NewHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, r.WithContext(NewContext(r.Context(), r.Header)))
+	})
+}
+
+// Injector sets headers on downstream requests
+type Injector struct {
+	// Headers are static headers to set
+	Headers map[string]string
+	// HeaderFiles are headers whose value is read from a file. The files are read for
+	// each request so that they can be rotated
+	HeaderFiles map[string]string
+	// Forward is the list of headers to copy from the incoming request (if set), these
+	// take precedence over Headers and HeaderFiles
+	Forward []string
+}
+
+// Empty returns whether the Injector doesn't set any headers
+func (i *Injector) Empty() bool {
+	return len(i.Headers) == 0 && len(i.HeaderFiles) == 0 && len(i.Forward) == 0
+}
+
+// Apply sets the headers on `h` (for a request with the context `ctx`)
+func (i *Injector) Apply(ctx context.Context, h http.Header) error {
+	for k, v := range i.Headers {
+		h.Set(k, v)
+	}
+	for k, path := range i.HeaderFiles {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("unable to read header %s from %s: %v", k, path, err)
+		}
+		h.Set(k, strings.TrimSpace(string(b)))
+	}
+	if incoming := FromContext(ctx); incoming != nil {
+		for _, k := range i.Forward {
+			if values, ok := incoming[http.CanonicalHeaderKey(k)]; ok {
+				h[http.CanonicalHeaderKey(k)] = values
+			}
+		}
+	}
+	return nil
+}
+
+// GetRequestMetadata implements grpc's credentials.PerRPCCredentials to set the
+// headers as metadata on gRPC calls
+func (i *Injector) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	h := make(http.Header)
+	if err := i.Apply(ctx, h); err != nil {
+		return nil, err
+	}
+	md := make(map[string]string, len(h))
+	for k, v := range h {
+		// gRPC metadata keys are lowercase
+		md[strings.ToLower(k)] = strings.Join(v, ",")
+	}
+	return md, nil
+}
+
+// RequireTransportSecurity implements grpc's credentials.PerRPCCredentials
+func (i *Injector) RequireTransportSecurity() bool { return false }
+
+// NewRoundTripper returns an http.RoundTripper which sets the headers of `i` on
+// each request
+func NewRoundTripper(i *Injector, rt http.RoundTripper) http.RoundTripper {
+	return &roundTripper{i: i, rt: rt}
+}
+
+type roundTripper struct {
+	i  *Injector
+	rt http.RoundTripper
+}
+
+func (r *roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	// RoundTrippers shouldn't modify the request, so we set the headers on a copy
+	h := make(http.Header, len(req.Header))
+	for k, v := range req.Header {
+		h[k] = v
+	}
+	if err := r.i.Apply(req.Context(), h); err != nil {
+		return nil, err
+	}
+	newReq := *req
+	newReq.Header = h
+	return r.rt.RoundTrip(&newReq)
+}
@@ -0,0 +1,86 @@
+package headers
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRoundTripper(t *testing.T) {
+	dir, err := ioutil.TempDir("", "headers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyFile := filepath.Join(dir, "key")
+	if err := ioutil.WriteFile(keyFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var received http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header
+	}))
+	defer srv.Close()
+
+	client := &http.Client{Transport: NewRoundTripper(&Injector{
+		Headers:     map[string]string{"X-Scope-OrgID": "default", "X-Static": "static"},
+		HeaderFiles: map[string]string{"X-Api-Key": keyFile},
+		Forward:     []string{"x-scope-orgid", "Authorization"},
+	}, http.DefaultTransport)}
+
+	// The incoming request's headers are forwarded through the context
+	var downstreamErr error
+	handler := NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req, _ := http.NewRequest("GET", srv.URL, nil)
+		var resp *http.Response
+		resp, downstreamErr = client.Do(req.WithContext(r.Context()))
+		if downstreamErr == nil {
+			resp.Body.Close()
+		}
+	}))
+	incoming := httptest.NewRequest("GET", "/api/v1/query", nil)
+	incoming.Header.Set("X-Scope-OrgID", "tenant-1")
+	incoming.Header.Set("Cookie", "session=1")
+	handler.ServeHTTP(httptest.NewRecorder(), incoming)
+	if downstreamErr != nil {
+		t.Fatal(downstreamErr)
+	}
+
+	for k, v := range map[string]string{
+		"X-Scope-Orgid": "tenant-1",
+		"X-Static":      "static",
+		"X-Api-Key":     "secret",
+		"Authorization": "",
+		"Cookie":        "",
+	} {
+		if actual := received.Get(k); actual != v {
+			t.Errorf("unexpected value for %s: expected %q, actual %q", k, v, actual)
+		}
+	}
+
+	// Without an incoming request only the configured headers are set
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if actual := received.Get("X-Scope-OrgID"); actual != "default" {
+		t.Fatalf("unexpected X-Scope-OrgID %q", actual)
+	}
+}
+
+func TestGetRequestMetadata(t *testing.T) {
+	i := &Injector{Headers: map[string]string{"X-Scope-OrgID": "tenant-1"}}
+	md, err := i.GetRequestMetadata(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if md["x-scope-orgid"] != "tenant-1" {
+		t.Fatalf("unexpected metadata %v", md)
+	}
+}
@@ -0,0 +1,176 @@
+package httpauth
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+)
+
+func TestOAuth2RoundTripper(t *testing.T) {
+	var (
+		tokens    int64
+		expiresIn int64 = 3600
+	)
+	tokenSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		user, secret, _ := r.BasicAuth()
+		if user != "promxy" || r.Form.Get("grant_type") != "client_credentials" || r.Form.Get("audience") != "metrics" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		n := atomic.AddInt64(&tokens, 1)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"access_token":"%s-%d","token_type":"Bearer","expires_in":%d}`, secret, n, atomic.LoadInt64(&expiresIn))
+	}))
+	defer tokenSrv.Close()
+
+	var lastAuth atomic.Value
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lastAuth.Store(r.Header.Get("Authorization"))
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "oauth2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	secretFile := filepath.Join(dir, "secret")
+	if err := ioutil.WriteFile(secretFile, []byte("s1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	client := &http.Client{Transport: NewOAuth2RoundTripper(&OAuth2Config{
+		ClientID:         "promxy",
+		ClientSecretFile: secretFile,
+		TokenURL:         tokenSrv.URL,
+		EndpointParams:   map[string]string{"audience": "metrics"},
+	}, http.DefaultTransport)}
+	get := func(expectedAuth string) {
+		t.Helper()
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if auth := lastAuth.Load().(string); auth != expectedAuth {
+			t.Fatalf("unexpected Authorization: expected %q, actual %q", expectedAuth, auth)
+		}
+	}
+
+	// The token is reused until it (almost) expires
+	get("Bearer s1-1")
+	get("Bearer s1-1")
+
+	// Tokens about to expire are refreshed before they are used
+	atomic.StoreInt64(&expiresIn, 1)
+	if err := ioutil.WriteFile(secretFile, []byte("s2\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// A rotated secret results in a new token
+	get("Bearer s2-2")
+	get("Bearer s2-3")
+}
+
+// verifySigV4 re-signs the request the server received with the same credentials
+// and time, and compares the signatures
+func verifySigV4(r *http.Request, creds *credentials.Credentials, service, region string) error {
+	auth := r.Header.Get("Authorization")
+	signedHeaders := ""
+	for _, part := range strings.Split(auth, ", ") {
+		if strings.HasPrefix(part, "SignedHeaders=") {
+			signedHeaders = strings.TrimPrefix(part, "SignedHeaders=")
+		}
+	}
+	if signedHeaders == "" {
+		return fmt.Errorf("missing signature: %q", auth)
+	}
+	signTime, err := time.Parse("20060102T150405Z", r.Header.Get("X-Amz-Date"))
+	if err != nil {
+		return err
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(r.Method, "http://"+r.Host+r.URL.RequestURI(), nil)
+	if err != nil {
+		return err
+	}
+	for _, h := range strings.Split(signedHeaders, ";") {
+		if h != "host" {
+			req.Header[http.CanonicalHeaderKey(h)] = r.Header[http.CanonicalHeaderKey(h)]
+		}
+	}
+	var bodyReader io.ReadSeeker
+	if len(body) > 0 {
+		bodyReader = bytes.NewReader(body)
+	}
+	if _, err := v4.NewSigner(creds).Sign(req, bodyReader, service, region, signTime); err != nil {
+		return err
+	}
+	if expected := req.Header.Get("Authorization"); expected != auth {
+		return fmt.Errorf("signature mismatch:\nexpected: %s\nactual:   %s", expected, auth)
+	}
+	return nil
+}
+
+func TestSigV4RoundTripper(t *testing.T) {
+	creds := credentials.NewStaticCredentials("AKID", "SECRET", "")
+	var verifyErr error
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		verifyErr = verifySigV4(r, creds, "aps", "us-west-2")
+		if verifyErr != nil {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer srv.Close()
+
+	rt, err := NewSigV4RoundTripper(&SigV4Config{
+		Region:    "us-west-2",
+		AccessKey: "AKID",
+		SecretKey: "SECRET",
+		Service:   "aps",
+	}, http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: rt}
+
+	t.Run("get", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", srv.URL+"/api/v1/query?query=up&time=1", nil)
+		req.Header.Set("X-Scope-OrgID", "tenant-1")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if verifyErr != nil {
+			t.Fatal(verifyErr)
+		}
+	})
+
+	t.Run("post", func(t *testing.T) {
+		resp, err := client.Post(srv.URL+"/api/v1/query", "application/x-www-form-urlencoded", strings.NewReader("query=up&time=1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if verifyErr != nil {
+			t.Fatal(verifyErr)
+		}
+	})
+}
@@ -0,0 +1,117 @@
+// Package httpauth implements http.RoundTrippers which authenticate requests to
+// downstreams (in addition to the bearer/basic auth of prometheus' HTTPClientConfig)
+package httpauth
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	config_util "github.com/prometheus/common/config"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+// OAuth2Config configures the OAuth2 client credentials flow
+type OAuth2Config struct {
+	ClientID         string             `yaml:"client_id"`
+	ClientSecret     config_util.Secret `yaml:"client_secret,omitempty"`
+	ClientSecretFile string             `yaml:"client_secret_file,omitempty"`
+	Scopes           []string           `yaml:"scopes,omitempty"`
+	TokenURL         string             `yaml:"token_url"`
+	EndpointParams   map[string]string  `yaml:"endpoint_params,omitempty"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (c *OAuth2Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain OAuth2Config
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+	if c.ClientID == "" {
+		return fmt.Errorf("oauth2: client_id is required")
+	}
+	if c.TokenURL == "" {
+		return fmt.Errorf("oauth2: token_url is required")
+	}
+	if len(c.ClientSecret) > 0 && len(c.ClientSecretFile) > 0 {
+		return fmt.Errorf("oauth2: at most one of client_secret & client_secret_file must be configured")
+	}
+	return nil
+}
+
+// NewOAuth2RoundTripper returns an http.RoundTripper which sets the Authorization
+// header of each request to a token from the client credentials flow of `cfg`.
+// Tokens are fetched (through `rt`) when they are about to expire
+func NewOAuth2RoundTripper(cfg *OAuth2Config, rt http.RoundTripper) http.RoundTripper {
+	return &oauth2RoundTripper{cfg: cfg, rt: rt}
+}
+
+type oauth2RoundTripper struct {
+	cfg *OAuth2Config
+	rt  http.RoundTripper
+
+	l      sync.Mutex
+	secret string
+	ts     oauth2.TokenSource
+}
+
+// tokenSource returns the TokenSource for the current client secret. If the secret
+// (file) changed a new TokenSource is created
+func (r *oauth2RoundTripper) tokenSource() (oauth2.TokenSource, error) {
+	secret := string(r.cfg.ClientSecret)
+	if r.cfg.ClientSecretFile != "" {
+		b, err := ioutil.ReadFile(r.cfg.ClientSecretFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read oauth2 client secret file %s: %v", r.cfg.ClientSecretFile, err)
+		}
+		secret = strings.TrimSpace(string(b))
+	}
+
+	r.l.Lock()
+	defer r.l.Unlock()
+	if r.ts != nil && secret == r.secret {
+		return r.ts, nil
+	}
+
+	params := make(url.Values, len(r.cfg.EndpointParams))
+	for k, v := range r.cfg.EndpointParams {
+		params.Set(k, v)
+	}
+	ccConfig := &clientcredentials.Config{
+		ClientID:       r.cfg.ClientID,
+		ClientSecret:   secret,
+		TokenURL:       r.cfg.TokenURL,
+		Scopes:         r.cfg.Scopes,
+		EndpointParams: params,
+	}
+	// Tokens are fetched with the same transport (TLS, proxy, etc.) as the requests
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, &http.Client{Transport: r.rt})
+	r.secret = secret
+	r.ts = ccConfig.TokenSource(ctx)
+	return r.ts, nil
+}
+
+func (r *oauth2RoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	ts, err := r.tokenSource()
+	if err != nil {
+		return nil, err
+	}
+	token, err := ts.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	// RoundTrippers shouldn't modify the request, so we set the header on a copy
+	newReq := *req
+	newReq.Header = make(http.Header, len(req.Header)+1)
+	for k, v := range req.Header {
+		newReq.Header[k] = v
+	}
+	token.SetAuthHeader(&newReq)
+	return r.rt.RoundTrip(&newReq)
+}
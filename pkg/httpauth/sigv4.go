@@ -0,0 +1,118 @@
+package httpauth
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	config_util "github.com/prometheus/common/config"
+)
+
+// SigV4Config configures AWS signature version 4 signing of requests. If no
+// access key is set the credentials are loaded from the default chain (environment,
+// shared credentials file `profile`, instance role)
+type SigV4Config struct {
+	Region    string             `yaml:"region,omitempty"`
+	AccessKey string             `yaml:"access_key,omitempty"`
+	SecretKey config_util.Secret `yaml:"secret_key,omitempty"`
+	Profile   string             `yaml:"profile,omitempty"`
+	RoleARN   string             `yaml:"role_arn,omitempty"`
+	// Service is the name of the signed service, defaults to `aps` (Amazon Managed
+	// Service for Prometheus)
+	Service string `yaml:"service,omitempty"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (c *SigV4Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	c.Service = "aps"
+	type plain SigV4Config
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+	if (c.AccessKey == "") != (c.SecretKey == "") {
+		return fmt.Errorf("sigv4: access_key and secret_key must be configured together")
+	}
+	return nil
+}
+
+// NewSigV4RoundTripper returns an http.RoundTripper which signs each request with
+// AWS signature version 4
+func NewSigV4RoundTripper(cfg *SigV4Config, rt http.RoundTripper) (http.RoundTripper, error) {
+	awsCfg := aws.Config{Region: aws.String(cfg.Region)}
+	if cfg.AccessKey != "" {
+		awsCfg.Credentials = credentials.NewStaticCredentials(cfg.AccessKey, string(cfg.SecretKey), "")
+	}
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            awsCfg,
+		Profile:           cfg.Profile,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to create an AWS session: %v", err)
+	}
+	if _, err := sess.Config.Credentials.Get(); err != nil {
+		return nil, fmt.Errorf("unable to load AWS credentials: %v", err)
+	}
+	if sess.Config.Region == nil || *sess.Config.Region == "" {
+		return nil, fmt.Errorf("sigv4: no region configured")
+	}
+
+	creds := sess.Config.Credentials
+	if cfg.RoleARN != "" {
+		creds = stscreds.NewCredentials(sess, cfg.RoleARN)
+	}
+
+	return &sigV4RoundTripper{
+		region:  *sess.Config.Region,
+		service: cfg.Service,
+		signer:  v4.NewSigner(creds),
+		rt:      rt,
+	}, nil
+}
+
+type sigV4RoundTripper struct {
+	region  string
+	service string
+	signer  *v4.Signer
+	rt      http.RoundTripper
+}
+
+func (r *sigV4RoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	// The signature covers the body, so it is read into memory
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// RoundTrippers shouldn't modify the request, so we sign a copy
+	newReq := *req
+	newReq.Header = make(http.Header, len(req.Header)+3)
+	for k, v := range req.Header {
+		newReq.Header[k] = v
+	}
+	// The signer sets the body of the request (a nil body is signed as empty)
+	var bodyReader io.ReadSeeker
+	if len(body) > 0 {
+		bodyReader = bytes.NewReader(body)
+		newReq.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(body)), nil
+		}
+	}
+	if _, err := r.signer.Sign(&newReq, bodyReader, r.service, r.region, time.Now()); err != nil {
+		return nil, err
+	}
+	return r.rt.RoundTrip(&newReq)
+}
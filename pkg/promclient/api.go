@@ -10,9 +10,10 @@ import (
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/pkg/labels"
 	"github.com/prometheus/prometheus/pkg/timestamp"
-	"github.com/prometheus/prometheus/storage/remote"
 
 	"github.com/jacksontj/promxy/pkg/promhttputil"
+	"github.com/jacksontj/promxy/pkg/querybudget"
+	"github.com/jacksontj/promxy/pkg/remote"
 )
 
 // PromAPIV1 implements our internal API interface using *only* the v1 HTTP API
@@ -23,18 +24,27 @@ type PromAPIV1 struct {
 
 // GetValue loads the raw data for a given set of matchers in the time range
 func (p *PromAPIV1) GetValue(ctx context.Context, start, end time.Time, matchers []*labels.Matcher) (model.Value, api.Warnings, error) {
+	query, err := getValueQuery(start, end, matchers)
+	if err != nil {
+		return nil, nil, err
+	}
+	return p.API.Query(ctx, query, end)
+}
+
+// getValueQuery returns the query used to load the raw data for the matchers
+// in the time range through the query API
+func getValueQuery(start, end time.Time, matchers []*labels.Matcher) (string, error) {
 	// http://localhost:8080/api/v1/query?query=scrape_duration_seconds%7Bjob%3D%22prometheus%22%7D&time=1507412244.663&_=1507412096887
 	pql, err := promhttputil.MatcherToString(matchers)
 	if err != nil {
-		return nil, nil, err
+		return "", err
 	}
 
 	// We want to grab only the raw datapoints, so we do that through the query interface
 	// passing in a duration that is at least as long as ours (the added second is to deal
 	// with any rounding error etc since the duration is a floating point and we are casting
 	// to an int64
-	query := pql + fmt.Sprintf("[%ds]", int64(end.Sub(start).Seconds())+1)
-	return p.API.Query(ctx, query, end)
+	return pql + fmt.Sprintf("[%ds]", int64(end.Sub(start).Seconds())+1), nil
 }
 
 // PromAPIRemoteRead implements our internal API interface using a combination of
@@ -77,5 +87,9 @@ func (p *PromAPIRemoteRead) GetValue(ctx context.Context, start, end time.Time,
 		}
 	}
 
+	if err := querybudget.FromContext(ctx).AddSamples(promhttputil.SampleCount(matrix)); err != nil {
+		return nil, nil, err
+	}
+
 	return matrix, nil, nil
 }
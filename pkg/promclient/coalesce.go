@@ -0,0 +1,270 @@
+package promclient
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/prometheus/client_golang/api"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+
+	"github.com/jacksontj/promxy/pkg/headers"
+	"github.com/jacksontj/promxy/pkg/promhttputil"
+	"github.com/jacksontj/promxy/pkg/querybudget"
+	"github.com/jacksontj/promxy/pkg/tracing"
+)
+
+// NewCoalesceAPI returns a CoalesceAPI wrapping the given API. keyHeaders are the
+// headers of the incoming request which are forwarded downstream (see
+// headers.Injector), only requests with the same values of those are shared
+func NewCoalesceAPI(a API, keyHeaders []string) *CoalesceAPI {
+	return &CoalesceAPI{
+		API:        a,
+		keyHeaders: keyHeaders,
+		calls:      make(map[string]*coalescedCall),
+	}
+}
+
+// CoalesceAPI deduplicates identical concurrent requests to the API it wraps.
+// When N callers ask for the same thing at the same time only one downstream
+// call is made and all N callers share the decoded result.
+//
+// Since the result is shared, every caller of a shared call gets its own copy
+// (see promhttputil.CloneValue) so that layers above us (e.g. AddLabelClient)
+// are free to mutate what they get back without affecting other callers.
+//
+// The downstream call is made with a context that is only canceled once *all*
+// callers waiting on it have gone away; this way a single user canceling their
+// request doesn't fail the same request for everyone else.
+//
+// The data received by the call is charged to the budget of the caller which
+// started it as it is received (see querybudget.NewChildContext), the other
+// callers are charged once they get the result. The downstream call is traced as part of the trace of
+// the caller which started it, the spans of the callers which joined it are
+// tagged with tracing.TagCoalesced.
+//
+// Forwarded headers may change what the downstream returns (e.g. the tenant of a
+// multi-tenant downstream), so their values are part of the key of a call.
+type CoalesceAPI struct {
+	API
+
+	keyHeaders []string
+
+	l     sync.Mutex
+	calls map[string]*coalescedCall
+}
+
+type coalescedCall struct {
+	done   chan struct{}
+	cancel context.CancelFunc
+	budget *querybudget.Budget
+	span   opentracing.SpanContext
+
+	waiters int
+
+	v   interface{}
+	w   api.Warnings
+	err error
+}
+
+// detachedContext is a context which keeps the values of its parent but not
+// its deadline or cancellation
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+// do runs `f` for the given key -- joining any in-flight call for the same key.
+// The returned bool is whether the result was shared with other callers
+func (c *CoalesceAPI) do(ctx context.Context, key string, f func(context.Context) (interface{}, api.Warnings, error)) (interface{}, api.Warnings, bool, error) {
+	if len(c.keyHeaders) > 0 {
+		incoming := headers.FromContext(ctx)
+		for _, k := range c.keyHeaders {
+			values, ok := incoming[http.CanonicalHeaderKey(k)]
+			key += fmt.Sprintf("\xff%v%q", ok, values)
+		}
+	}
+
+	c.l.Lock()
+	call, ok := c.calls[key]
+	if !ok {
+		callCtx, budget := querybudget.NewChildContext(detachedContext{ctx}, querybudget.FromContext(ctx))
+		callCtx, cancel := context.WithCancel(callCtx)
+		call = &coalescedCall{
+			done:   make(chan struct{}),
+			cancel: cancel,
+			budget: budget,
+		}
+		if span := opentracing.SpanFromContext(ctx); span != nil {
+			call.span = span.Context()
+		}
+		c.calls[key] = call
+
+		go func() {
+			call.v, call.w, call.err = f(callCtx)
+			c.l.Lock()
+			if c.calls[key] == call {
+				delete(c.calls, key)
+			}
+			c.l.Unlock()
+			cancel()
+			budget.Release()
+			close(call.done)
+		}()
+	} else if span := opentracing.SpanFromContext(ctx); span != nil {
+		span.SetTag(tracing.TagCoalesced, true)
+		if sc, ok := call.span.(tracing.SpanContext); ok {
+			span.LogKV("event", "joined coalesced call", "trace_id", sc.TraceID())
+		}
+	}
+	call.waiters++
+	c.l.Unlock()
+	// The caller which started the call is charged by the call itself
+	leader := !ok
+
+	select {
+	case <-call.done:
+		c.l.Lock()
+		shared := call.waiters > 1
+		c.l.Unlock()
+		budget := querybudget.FromContext(ctx)
+		if leader {
+			// The caller's budget was charged as the data was received
+			if err := budget.Err(); err != nil {
+				return nil, nil, false, err
+			}
+		} else {
+			// Charge the data of the call to the caller's budget
+			if err := budget.AddBytes(int(call.budget.Bytes())); err != nil {
+				return nil, nil, false, err
+			}
+			if err := budget.AddSamples(int(call.budget.Samples())); err != nil {
+				return nil, nil, false, err
+			}
+		}
+		return call.v, call.w, shared, call.err
+
+	case <-ctx.Done():
+		c.l.Lock()
+		call.waiters--
+		// If we were the last one waiting, no one cares about the result anymore.
+		// We also drop the call so that new callers don't join a canceled call
+		if call.waiters == 0 {
+			call.cancel()
+			if c.calls[key] == call {
+				delete(c.calls, key)
+			}
+		}
+		c.l.Unlock()
+		return nil, nil, false, ctx.Err()
+	}
+}
+
+// LabelNames returns all the unique label names present in the block in sorted order.
+func (c *CoalesceAPI) LabelNames(ctx context.Context) ([]string, api.Warnings, error) {
+	v, w, shared, err := c.do(ctx, "label_names", func(ctx context.Context) (interface{}, api.Warnings, error) {
+		return c.API.LabelNames(ctx)
+	})
+	if err != nil {
+		return nil, w, err
+	}
+	ret, _ := v.([]string)
+	if shared && ret != nil {
+		ret = append([]string(nil), ret...)
+	}
+	return ret, w, nil
+}
+
+// LabelValues performs a query for the values of the given label.
+func (c *CoalesceAPI) LabelValues(ctx context.Context, label string) (model.LabelValues, api.Warnings, error) {
+	v, w, shared, err := c.do(ctx, "label_values\xff"+label, func(ctx context.Context) (interface{}, api.Warnings, error) {
+		return c.API.LabelValues(ctx, label)
+	})
+	if err != nil {
+		return nil, w, err
+	}
+	ret, _ := v.(model.LabelValues)
+	if shared && ret != nil {
+		ret = append(model.LabelValues(nil), ret...)
+	}
+	return ret, w, nil
+}
+
+// Query performs a query for the given time.
+func (c *CoalesceAPI) Query(ctx context.Context, query string, ts time.Time) (model.Value, api.Warnings, error) {
+	key := fmt.Sprintf("query\xff%s\xff%d", query, ts.UnixNano())
+	v, w, shared, err := c.do(ctx, key, func(ctx context.Context) (interface{}, api.Warnings, error) {
+		return c.API.Query(ctx, query, ts)
+	})
+	return coalescedValue(v, w, err, shared)
+}
+
+// QueryRange performs a query for the given range.
+func (c *CoalesceAPI) QueryRange(ctx context.Context, query string, r v1.Range) (model.Value, api.Warnings, error) {
+	key := fmt.Sprintf("query_range\xff%s\xff%d\xff%d\xff%d", query, r.Start.UnixNano(), r.End.UnixNano(), r.Step)
+	v, w, shared, err := c.do(ctx, key, func(ctx context.Context) (interface{}, api.Warnings, error) {
+		return c.API.QueryRange(ctx, query, r)
+	})
+	return coalescedValue(v, w, err, shared)
+}
+
+// Series finds series by label matchers.
+func (c *CoalesceAPI) Series(ctx context.Context, matches []string, startTime time.Time, endTime time.Time) ([]model.LabelSet, api.Warnings, error) {
+	key := fmt.Sprintf("series\xff%s\xff%d\xff%d", strings.Join(matches, "\xfe"), startTime.UnixNano(), endTime.UnixNano())
+	v, w, shared, err := c.do(ctx, key, func(ctx context.Context) (interface{}, api.Warnings, error) {
+		return c.API.Series(ctx, matches, startTime, endTime)
+	})
+	if err != nil {
+		return nil, w, err
+	}
+	ret, _ := v.([]model.LabelSet)
+	if shared && ret != nil {
+		cloned := make([]model.LabelSet, len(ret))
+		for i, lset := range ret {
+			cloned[i] = lset.Clone()
+		}
+		ret = cloned
+	}
+	return ret, w, nil
+}
+
+// GetValue loads the raw data for a given set of matchers in the time range
+func (c *CoalesceAPI) GetValue(ctx context.Context, start, end time.Time, matchers []*labels.Matcher) (model.Value, api.Warnings, error) {
+	matcherStrings := make([]string, len(matchers))
+	for i, m := range matchers {
+		matcherStrings[i] = m.String()
+	}
+	key := fmt.Sprintf("get_value\xff%s\xff%d\xff%d", strings.Join(matcherStrings, "\xfe"), start.UnixNano(), end.UnixNano())
+	v, w, shared, err := c.do(ctx, key, func(ctx context.Context) (interface{}, api.Warnings, error) {
+		return c.API.GetValue(ctx, start, end, matchers)
+	})
+	return coalescedValue(v, w, err, shared)
+}
+
+// Key returns a labelset used to determine other api clients that are the "same"
+func (c *CoalesceAPI) Key() model.LabelSet {
+	if apiLabels, ok := c.API.(APILabels); ok {
+		return apiLabels.Key()
+	}
+	return nil
+}
+
+func coalescedValue(v interface{}, w api.Warnings, err error, shared bool) (model.Value, api.Warnings, error) {
+	if err != nil {
+		return nil, w, err
+	}
+	ret, _ := v.(model.Value)
+	if shared {
+		ret = promhttputil.CloneValue(ret)
+	}
+	return ret, w, nil
+}
@@ -0,0 +1,301 @@
+package promclient
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/prometheus/client_golang/api"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+
+	"github.com/jacksontj/promxy/pkg/headers"
+	"github.com/jacksontj/promxy/pkg/promhttputil"
+	"github.com/jacksontj/promxy/pkg/querybudget"
+	"github.com/jacksontj/promxy/pkg/tracing"
+)
+
+func TestCoalesceAPI(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+
+	stub := &stubAPI{
+		queryRange: func() model.Value {
+			atomic.AddInt32(&calls, 1)
+			<-release
+			return model.Matrix{
+				{
+					Metric: model.Metric{model.MetricNameLabel: "testmetric"},
+					Values: []model.SamplePair{{Timestamp: 100, Value: 1}},
+				},
+			}
+		},
+	}
+
+	c := NewCoalesceAPI(stub, nil)
+
+	r := v1.Range{Start: time.Unix(0, 0), End: time.Unix(100, 0), Step: time.Second}
+
+	numCallers := 10
+	results := make([]model.Value, numCallers)
+	var wg sync.WaitGroup
+	for i := 0; i < numCallers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			v, _, err := c.QueryRange(context.TODO(), "testmetric", r)
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			results[i] = v
+		}(i)
+	}
+
+	// Wait for all callers to be waiting on the in-flight call
+	for {
+		c.l.Lock()
+		waiters := 0
+		for _, call := range c.calls {
+			waiters += call.waiters
+		}
+		c.l.Unlock()
+		if waiters == numCallers {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Fatalf("expected 1 downstream call, got %d", calls)
+	}
+
+	// Mutating one result must not affect the others
+	if err := promhttputil.ValueAddLabelSet(results[0], model.LabelSet{"a": "b"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i := 1; i < numCallers; i++ {
+		m := results[i].(model.Matrix)
+		if _, ok := m[0].Metric["a"]; ok {
+			t.Fatalf("mutation of result leaked to caller %d: %v", i, m)
+		}
+	}
+
+	// Once the call is done, a new one is made
+	if _, _, err := c.QueryRange(context.TODO(), "testmetric", r); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if calls != 2 {
+		t.Fatalf("expected 2 downstream calls, got %d", calls)
+	}
+}
+
+func TestCoalesceAPICancel(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	stub := &stubAPI{
+		query: func() model.Value {
+			<-release
+			return nil
+		},
+	}
+
+	c := NewCoalesceAPI(stub, nil)
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	cancel()
+	if _, _, err := c.Query(ctx, "testmetric", time.Unix(100, 0)); err != context.Canceled {
+		t.Fatalf("expected cancel error, got %v", err)
+	}
+
+	// With no remaining waiters the call should no longer be joinable
+	c.l.Lock()
+	defer c.l.Unlock()
+	if len(c.calls) != 0 {
+		t.Fatalf("expected no in-flight calls, got %d", len(c.calls))
+	}
+}
+
+// tenantAPI returns the tenant of the (forwarded) X-Scope-OrgID header
+type tenantAPI struct {
+	API
+	calls   int32
+	release chan struct{}
+}
+
+func (a *tenantAPI) Query(ctx context.Context, query string, ts time.Time) (model.Value, api.Warnings, error) {
+	atomic.AddInt32(&a.calls, 1)
+	<-a.release
+	tenant := headers.FromContext(ctx).Get("X-Scope-OrgID")
+	return model.Vector{{Metric: model.Metric{"tenant": model.LabelValue(tenant)}}}, nil, nil
+}
+
+func TestCoalesceAPIHeaders(t *testing.T) {
+	stub := &tenantAPI{release: make(chan struct{})}
+	c := NewCoalesceAPI(stub, []string{"X-Scope-OrgID"})
+
+	tenants := []string{"a", "b", "a", "b"}
+	results := make([]model.Value, len(tenants))
+	var wg sync.WaitGroup
+	for i, tenant := range tenants {
+		wg.Add(1)
+		go func(i int, tenant string) {
+			defer wg.Done()
+			ctx := headers.NewContext(context.TODO(), http.Header{"X-Scope-Orgid": []string{tenant}})
+			v, _, err := c.Query(ctx, "testmetric", time.Unix(100, 0))
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			results[i] = v
+		}(i, tenant)
+	}
+
+	// Wait for all callers to be waiting on the in-flight calls
+	for {
+		c.l.Lock()
+		waiters := 0
+		for _, call := range c.calls {
+			waiters += call.waiters
+		}
+		c.l.Unlock()
+		if waiters == len(tenants) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(stub.release)
+	wg.Wait()
+
+	// Only the callers of the same tenant share a call
+	if stub.calls != 2 {
+		t.Fatalf("expected 2 downstream calls, got %d", stub.calls)
+	}
+	for i, tenant := range tenants {
+		if got := results[i].(model.Vector)[0].Metric["tenant"]; string(got) != tenant {
+			t.Fatalf("caller of tenant %s got the result of tenant %s", tenant, got)
+		}
+	}
+}
+
+// budgetAPI charges each query 10 samples and 100 bytes (like the HTTP clients do)
+type budgetAPI struct {
+	API
+	release chan struct{}
+	// leader is the budget of the caller which started the call, its bytes
+	// are recorded in leaderBytes while the call is running
+	leader      *querybudget.Budget
+	leaderBytes int64
+}
+
+func (a *budgetAPI) Query(ctx context.Context, query string, ts time.Time) (model.Value, api.Warnings, error) {
+	<-a.release
+	budget := querybudget.FromContext(ctx)
+	if err := budget.AddBytes(100); err != nil {
+		return nil, nil, err
+	}
+	if err := budget.AddSamples(10); err != nil {
+		return nil, nil, err
+	}
+	if a.leader != nil {
+		a.leaderBytes = a.leader.Bytes()
+	}
+	return model.Vector{}, nil, nil
+}
+
+// recordingExporter records the finished spans
+type recordingExporter struct {
+	l     sync.Mutex
+	spans []*tracing.FinishedSpan
+}
+
+func (e *recordingExporter) Export(s *tracing.FinishedSpan) {
+	e.l.Lock()
+	defer e.l.Unlock()
+	e.spans = append(e.spans, s)
+}
+
+func TestCoalesceAPIBudgetAndTracing(t *testing.T) {
+	stub := &budgetAPI{release: make(chan struct{})}
+	c := NewCoalesceAPI(stub, nil)
+	exporter := &recordingExporter{}
+	tracer := tracing.NewTracer(exporter)
+
+	// The last caller's budget is too small for the shared result
+	global := querybudget.NewMemoryLimiter(1000)
+	limits := []querybudget.Limits{{MaxSamples: 100, Global: global}, {MaxSamples: 100, Global: global}, {MaxSamples: 5, Global: global}}
+	budgets := make([]*querybudget.Budget, len(limits))
+	errs := make([]error, len(limits))
+	var wg sync.WaitGroup
+	for i := range limits {
+		ctx, budget := querybudget.NewContext(context.TODO(), limits[i])
+		defer budget.Release()
+		budgets[i] = budget
+		if i == 0 {
+			stub.leader = budget
+		}
+		span := tracer.StartSpan("caller")
+		ctx = opentracing.ContextWithSpan(ctx, span)
+
+		// Start the callers in order, so that the first one starts the call
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer span.Finish()
+			_, _, errs[i] = c.Query(ctx, "testmetric", time.Unix(100, 0))
+		}(i)
+		for {
+			c.l.Lock()
+			waiters := 0
+			for _, call := range c.calls {
+				waiters += call.waiters
+			}
+			c.l.Unlock()
+			if waiters == i+1 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	close(stub.release)
+	wg.Wait()
+
+	// The shared result is charged to every caller's budget
+	for i, budget := range budgets[:2] {
+		if errs[i] != nil {
+			t.Fatalf("%d: unexpected error: %v", i, errs[i])
+		}
+		if budget.Samples() != 10 || budget.Bytes() != 100 {
+			t.Fatalf("%d: expected 10 samples and 100 bytes, got %d and %d", i, budget.Samples(), budget.Bytes())
+		}
+	}
+	if _, ok := errs[2].(*querybudget.ExceededError); !ok {
+		t.Fatalf("expected the budget of the last caller to be exceeded, got %v", errs[2])
+	}
+	// The caller which started the call is charged while it is running
+	if stub.leaderBytes != 100 {
+		t.Fatalf("expected the leader to be charged 100 bytes during the call, got %d", stub.leaderBytes)
+	}
+	// The bytes of every caller are reserved from the global limit
+	if used := global.Used(); used != 300 {
+		t.Fatalf("expected 300 bytes reserved from the global limit, got %d", used)
+	}
+
+	// Only the spans of the callers which joined the call are tagged
+	exporter.l.Lock()
+	defer exporter.l.Unlock()
+	coalesced := 0
+	for _, s := range exporter.spans {
+		if s.Tags[tracing.TagCoalesced] == true {
+			coalesced++
+		}
+	}
+	if coalesced != 2 {
+		t.Fatalf("expected 2 coalesced spans, got %d", coalesced)
+	}
+}
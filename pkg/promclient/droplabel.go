@@ -0,0 +1,138 @@
+package promclient
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/api"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+
+	"github.com/jacksontj/promxy/pkg/promhttputil"
+)
+
+// DropLabelClient proxies a client and removes the given labels from all results.
+// This is used to remove replica labels so that series from replicas can be merged
+type DropLabelClient struct {
+	API
+	Labels []model.LabelName
+}
+
+func (c *DropLabelClient) drop(name model.LabelName) bool {
+	for _, l := range c.Labels {
+		if l == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *DropLabelClient) dropFromValue(v model.Value) {
+	switch vTyped := v.(type) {
+	case model.Vector:
+		for _, item := range vTyped {
+			for _, l := range c.Labels {
+				delete(item.Metric, l)
+			}
+		}
+	case model.Matrix:
+		for _, item := range vTyped {
+			for _, l := range c.Labels {
+				delete(item.Metric, l)
+			}
+		}
+	case promhttputil.CompactMatrix:
+		for _, item := range vTyped {
+			for _, l := range c.Labels {
+				delete(item.Metric, l)
+			}
+		}
+	}
+}
+
+// Key defines the labelset which identifies this client
+func (c *DropLabelClient) Key() model.LabelSet {
+	apiLabels, ok := c.API.(APILabels)
+	if !ok {
+		return nil
+	}
+	key := apiLabels.Key()
+	if key == nil {
+		return nil
+	}
+	ret := key.Clone()
+	for _, l := range c.Labels {
+		delete(ret, l)
+	}
+	return ret
+}
+
+// LabelNames returns all the unique label names present in the block in sorted order.
+func (c *DropLabelClient) LabelNames(ctx context.Context) ([]string, api.Warnings, error) {
+	v, w, err := c.API.LabelNames(ctx)
+	if err != nil {
+		return nil, w, err
+	}
+
+	ret := make([]string, 0, len(v))
+	for _, name := range v {
+		if !c.drop(model.LabelName(name)) {
+			ret = append(ret, name)
+		}
+	}
+	return ret, w, nil
+}
+
+// LabelValues performs a query for the values of the given label.
+func (c *DropLabelClient) LabelValues(ctx context.Context, label string) (model.LabelValues, api.Warnings, error) {
+	if c.drop(model.LabelName(label)) {
+		return nil, nil, nil
+	}
+	return c.API.LabelValues(ctx, label)
+}
+
+// Query performs a query for the given time.
+func (c *DropLabelClient) Query(ctx context.Context, query string, ts time.Time) (model.Value, api.Warnings, error) {
+	v, w, err := c.API.Query(ctx, query, ts)
+	if err != nil {
+		return nil, w, err
+	}
+	c.dropFromValue(v)
+	return v, w, nil
+}
+
+// QueryRange performs a query for the given range.
+func (c *DropLabelClient) QueryRange(ctx context.Context, query string, r v1.Range) (model.Value, api.Warnings, error) {
+	v, w, err := c.API.QueryRange(ctx, query, r)
+	if err != nil {
+		return nil, w, err
+	}
+	c.dropFromValue(v)
+	return v, w, nil
+}
+
+// Series finds series by label matchers.
+func (c *DropLabelClient) Series(ctx context.Context, matches []string, startTime time.Time, endTime time.Time) ([]model.LabelSet, api.Warnings, error) {
+	v, w, err := c.API.Series(ctx, matches, startTime, endTime)
+	if err != nil {
+		return nil, w, err
+	}
+	for _, lset := range v {
+		for _, l := range c.Labels {
+			delete(lset, l)
+		}
+	}
+	// Dropping labels may result in duplicate labelsets
+	return MergeLabelSets(nil, v), w, nil
+}
+
+// GetValue loads the raw data for a given set of matchers in the time range
+func (c *DropLabelClient) GetValue(ctx context.Context, start, end time.Time, matchers []*labels.Matcher) (model.Value, api.Warnings, error) {
+	v, w, err := c.API.GetValue(ctx, start, end, matchers)
+	if err != nil {
+		return nil, w, err
+	}
+	c.dropFromValue(v)
+	return v, w, nil
+}
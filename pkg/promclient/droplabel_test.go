@@ -0,0 +1,61 @@
+package promclient
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/jacksontj/promxy/pkg/promhttputil"
+)
+
+func TestDropLabelClient(t *testing.T) {
+	replica := func(r model.LabelValue, values ...model.SamplePair) API {
+		return &DropLabelClient{
+			API: &AddLabelClient{&stubAPI{
+				labelNames: func() []string { return []string{"__name__", "replica"} },
+				getValue: func() model.Value {
+					return model.Matrix{{
+						Metric: model.Metric{model.MetricNameLabel: "up", "replica": r},
+						Values: values,
+					}}
+				},
+			}, model.LabelSet{"sg": "a", "replica": r}},
+			Labels: []model.LabelName{"replica"},
+		}
+	}
+
+	a := replica("a", model.SamplePair{Timestamp: 0, Value: 1}, model.SamplePair{Timestamp: 15000, Value: 1})
+	b := replica("b", model.SamplePair{Timestamp: 5000, Value: 2}, model.SamplePair{Timestamp: 20000, Value: 2})
+
+	if key := a.(APILabels).Key(); !key.Equal(model.LabelSet{"sg": "a"}) {
+		t.Fatalf("unexpected key: %v", key)
+	}
+
+	names, _, err := a.LabelNames(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		if name == "replica" {
+			t.Fatalf("replica label not removed from label names: %v", names)
+		}
+	}
+
+	m := NewMultiAPIWithMerger([]API{a, b}, promhttputil.DefaultMergeStrategy, promhttputil.DedupMerger(0), nil, 1)
+	v, _, err := m.GetValue(context.TODO(), time.Unix(0, 0), time.Unix(30, 0), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	matrix := v.(*promhttputil.MergedMatrix).Matrix()
+	if len(matrix) != 1 {
+		t.Fatalf("expected replicas to be merged into 1 series: %v", matrix)
+	}
+	if _, ok := matrix[0].Metric["replica"]; ok {
+		t.Fatalf("replica label not removed: %v", matrix[0].Metric)
+	}
+	if len(matrix[0].Values) != 2 || matrix[0].Values[0].Value != matrix[0].Values[1].Value {
+		t.Fatalf("expected points from a single replica: %v", matrix[0].Values)
+	}
+}
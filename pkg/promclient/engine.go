@@ -0,0 +1,187 @@
+package promclient
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/api"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/storage"
+
+	"github.com/jacksontj/promxy/pkg/promhttputil"
+)
+
+// engine (a *promql.Engine) evaluates queries locally for APIs whose results can't
+// be computed by sending the query downstream as-is (e.g. when series are relabeled
+// or the downstream only serves raw data)
+var engine atomic.Value
+
+func init() {
+	SetEngineOpts(promql.EngineOpts{
+		MaxConcurrent: 1000,
+		MaxSamples:    50000000,
+		Timeout:       2 * time.Minute,
+	})
+}
+
+// SetEngineOpts sets the options of the engine used by EvalQuery and EvalQueryRange,
+// this should match the options of promxy's own engine. The metrics of the engine
+// aren't registered (opts.Reg is ignored) as they would collide with those of
+// promxy's engine
+func SetEngineOpts(opts promql.EngineOpts) {
+	opts.Reg = nil
+	engine.Store(promql.NewEngine(opts))
+}
+
+// EvalQuery evaluates the instant query `query` locally, loading all data through `a`
+func EvalQuery(ctx context.Context, a API, query string, ts time.Time) (model.Value, api.Warnings, error) {
+	q, err := engine.Load().(*promql.Engine).NewInstantQuery(apiQueryable(a), query, ts)
+	if err != nil {
+		return nil, nil, err
+	}
+	return execQuery(ctx, q)
+}
+
+// EvalQueryRange evaluates the range query `query` locally, loading all data through `a`
+func EvalQueryRange(ctx context.Context, a API, query string, r v1.Range) (model.Value, api.Warnings, error) {
+	q, err := engine.Load().(*promql.Engine).NewRangeQuery(apiQueryable(a), query, r.Start, r.End, r.Step)
+	if err != nil {
+		return nil, nil, err
+	}
+	return execQuery(ctx, q)
+}
+
+// apiQueryable returns a storage.Queryable which loads all data through `a`
+func apiQueryable(a API) storage.Queryable {
+	return storage.QueryableFunc(func(ctx context.Context, mint, maxt int64) (storage.Querier, error) {
+		return &apiQuerier{
+			ctx:   ctx,
+			start: timestamp.Time(mint),
+			end:   timestamp.Time(maxt),
+			api:   a,
+		}, nil
+	})
+}
+
+// execQuery executes `q`, converting the result to a model.Value
+func execQuery(ctx context.Context, q promql.Query) (model.Value, api.Warnings, error) {
+	defer q.Close()
+	res := q.Exec(ctx)
+	var w api.Warnings
+	for _, warning := range res.Warnings {
+		w = append(w, warning.Error())
+	}
+	if res.Err != nil {
+		return nil, w, res.Err
+	}
+	return ValueToModel(res.Value), w, nil
+}
+
+// apiQuerier implements prometheus' Querier interface on top of an API
+type apiQuerier struct {
+	ctx   context.Context
+	start time.Time
+	end   time.Time
+	api   API
+}
+
+// Select returns a set of series that matches the given label matchers.
+func (q *apiQuerier) Select(selectParams *storage.SelectParams, matchers ...*labels.Matcher) (storage.SeriesSet, storage.Warnings, error) {
+	// Without selectParams this is a metadata (series) call, so only the labels are loaded
+	if selectParams == nil {
+		matcherString, err := promhttputil.MatcherToString(matchers)
+		if err != nil {
+			return nil, nil, err
+		}
+		labelsets, w, err := q.api.Series(q.ctx, []string{matcherString}, q.start, q.end)
+		if err != nil {
+			return nil, promhttputil.WarningsConvert(w), err
+		}
+		matrix := make(promhttputil.CompactMatrix, len(labelsets))
+		for i, lset := range labelsets {
+			matrix[i] = &promhttputil.CompactSeries{Metric: model.Metric(lset)}
+		}
+		return matrix.SeriesSet(), promhttputil.WarningsConvert(w), nil
+	}
+
+	v, w, err := q.api.GetValue(q.ctx, timestamp.Time(selectParams.Start), timestamp.Time(selectParams.End), matchers)
+	if err != nil {
+		return nil, promhttputil.WarningsConvert(w), err
+	}
+	switch vTyped := v.(type) {
+	case nil:
+		v = model.Matrix{}
+	case promhttputil.CompactMatrix:
+		// A single CompactMatrix (e.g. from a StoreAPI) has no duplicate series
+		return vTyped.SeriesSet(), promhttputil.WarningsConvert(w), nil
+	}
+	m, err := promhttputil.NewMergedMatrix(promhttputil.AntiAffinityMerger(0), []model.Value{v})
+	if err != nil {
+		return nil, promhttputil.WarningsConvert(w), err
+	}
+	return m.SeriesSet(), promhttputil.WarningsConvert(w), nil
+}
+
+// LabelValues returns all potential values for a label name.
+func (q *apiQuerier) LabelValues(name string) ([]string, storage.Warnings, error) {
+	v, w, err := q.api.LabelValues(q.ctx, name)
+	if err != nil {
+		return nil, promhttputil.WarningsConvert(w), err
+	}
+	ret := make([]string, len(v))
+	for i, value := range v {
+		ret[i] = string(value)
+	}
+	return ret, promhttputil.WarningsConvert(w), nil
+}
+
+// LabelNames returns all the unique label names present in the block in sorted order.
+func (q *apiQuerier) LabelNames() ([]string, storage.Warnings, error) {
+	v, w, err := q.api.LabelNames(q.ctx)
+	return v, promhttputil.WarningsConvert(w), err
+}
+
+// Close closes the querier.
+func (q *apiQuerier) Close() error { return nil }
+
+// ValueToModel converts a promql.Value (the result of evaluating a query) to a
+// model.Value. Matrices are converted to a promhttputil.CompactMatrix
+func ValueToModel(v promql.Value) model.Value {
+	switch vTyped := v.(type) {
+	case promql.Scalar:
+		return &model.Scalar{Value: model.SampleValue(vTyped.V), Timestamp: model.Time(vTyped.T)}
+	case promql.String:
+		return &model.String{Value: vTyped.V, Timestamp: model.Time(vTyped.T)}
+	case promql.Vector:
+		ret := make(model.Vector, len(vTyped))
+		for i, s := range vTyped {
+			ret[i] = &model.Sample{
+				Metric:    promhttputil.LabelsToMetric(s.Metric),
+				Value:     model.SampleValue(s.V),
+				Timestamp: model.Time(s.T),
+			}
+		}
+		return ret
+	case promql.Matrix:
+		ret := make(promhttputil.CompactMatrix, len(vTyped))
+		for i, s := range vTyped {
+			series := &promhttputil.CompactSeries{
+				Metric:     promhttputil.LabelsToMetric(s.Metric),
+				Timestamps: make([]int64, len(s.Points)),
+				Values:     make([]float64, len(s.Points)),
+			}
+			for j, p := range s.Points {
+				series.Timestamps[j] = p.T
+				series.Values[j] = p.V
+			}
+			ret[i] = series
+		}
+		return ret
+	}
+	return nil
+}
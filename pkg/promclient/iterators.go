@@ -7,6 +7,8 @@ import (
 
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/pkg/labels"
+
+	"github.com/jacksontj/promxy/pkg/promhttputil"
 )
 
 // IteratorsForValue returns SeriesIterators for the value passed in
@@ -28,6 +30,10 @@ func IteratorsForValue(v model.Value) []*SeriesIterator {
 			iterators[i] = NewSeriesIterator(stream)
 		}
 		return iterators
+	case *promhttputil.MergedMatrix:
+		return IteratorsForValue(valueTyped.Matrix())
+	case promhttputil.CompactMatrix:
+		return IteratorsForValue(valueTyped.Matrix())
 	case nil:
 		return nil
 	default:
@@ -0,0 +1,164 @@
+package promclient
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/api"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"golang.org/x/sync/semaphore"
+)
+
+// Limiter holds the request slots of a LimitAPI, it may be shared by multiple
+// LimitAPIs to limit their combined concurrency
+type Limiter struct {
+	sem  *semaphore.Weighted
+	size int64
+
+	l sync.Mutex
+	// wait is the moving average of the time requests waited for a slot, requests
+	// which got a slot right away count as not having waited so it decays once
+	// the limiter isn't saturated anymore
+	wait time.Duration
+}
+
+// NewLimiter returns a Limiter with `n` request slots
+func NewLimiter(n int64) *Limiter {
+	return &Limiter{sem: semaphore.NewWeighted(n), size: n}
+}
+
+// Size returns the number of request slots of the limiter
+func (l *Limiter) Size() int64 {
+	return l.size
+}
+
+// expectedWait returns how long a request is expected to wait for a slot
+func (l *Limiter) expectedWait() time.Duration {
+	l.l.Lock()
+	defer l.l.Unlock()
+	return l.wait
+}
+
+// observeWait adds the wait of a request to the average
+func (l *Limiter) observeWait(took time.Duration) {
+	l.l.Lock()
+	defer l.l.Unlock()
+	if l.wait == 0 {
+		l.wait = took
+	} else {
+		l.wait += (took - l.wait) / 5
+	}
+}
+
+// LimitAPI limits the number of concurrent requests to an API. Requests over the
+// limit are queued until a slot is free or the request's context is done. Requests
+// whose deadline is sooner than the expected wait for a slot fail right away, as
+// they would most likely time out in the queue
+type LimitAPI struct {
+	API
+	// Limiter holds the request slots, each request acquires one of them
+	Limiter *Limiter
+	// Name is used in the error of requests which gave up waiting
+	Name string
+	// ObserveWait, if set, is called with the time (in seconds) each request waited
+	// for a slot
+	ObserveWait func(float64)
+}
+
+// acquire waits for a slot, returning the function to release it
+func (l *LimitAPI) acquire(ctx context.Context) (func(), error) {
+	// Fail fast if the caller's deadline already passed
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	release := func() { l.Limiter.sem.Release(1) }
+	if l.Limiter.sem.TryAcquire(1) {
+		l.Limiter.observeWait(0)
+		if l.ObserveWait != nil {
+			l.ObserveWait(0)
+		}
+		return release, nil
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		if expected := l.Limiter.expectedWait(); time.Until(deadline) < expected {
+			return nil, fmt.Errorf("not waiting for a request slot to %s, the expected wait of %v exceeds the deadline", l.Name, expected)
+		}
+	}
+
+	start := time.Now()
+	err := l.Limiter.sem.Acquire(ctx, 1)
+	took := time.Since(start)
+	l.Limiter.observeWait(took)
+	if l.ObserveWait != nil {
+		l.ObserveWait(took.Seconds())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("gave up waiting for a request slot to %s after %v: %v", l.Name, took, err)
+	}
+	return release, nil
+}
+
+// LabelNames returns all the unique label names present in the block in sorted order.
+func (l *LimitAPI) LabelNames(ctx context.Context) ([]string, api.Warnings, error) {
+	release, err := l.acquire(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer release()
+	return l.API.LabelNames(ctx)
+}
+
+// LabelValues performs a query for the values of the given label.
+func (l *LimitAPI) LabelValues(ctx context.Context, label string) (model.LabelValues, api.Warnings, error) {
+	release, err := l.acquire(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer release()
+	return l.API.LabelValues(ctx, label)
+}
+
+// Query performs a query for the given time.
+func (l *LimitAPI) Query(ctx context.Context, query string, ts time.Time) (model.Value, api.Warnings, error) {
+	release, err := l.acquire(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer release()
+	return l.API.Query(ctx, query, ts)
+}
+
+// QueryRange performs a query for the given range.
+func (l *LimitAPI) QueryRange(ctx context.Context, query string, r v1.Range) (model.Value, api.Warnings, error) {
+	release, err := l.acquire(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer release()
+	return l.API.QueryRange(ctx, query, r)
+}
+
+// Series finds series by label matchers.
+func (l *LimitAPI) Series(ctx context.Context, matches []string, startTime time.Time, endTime time.Time) ([]model.LabelSet, api.Warnings, error) {
+	release, err := l.acquire(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer release()
+	return l.API.Series(ctx, matches, startTime, endTime)
+}
+
+// GetValue loads the raw data for a given set of matchers in the time range
+func (l *LimitAPI) GetValue(ctx context.Context, start, end time.Time, matchers []*labels.Matcher) (model.Value, api.Warnings, error) {
+	release, err := l.acquire(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer release()
+	return l.API.GetValue(ctx, start, end, matchers)
+}
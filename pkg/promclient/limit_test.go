@@ -0,0 +1,123 @@
+package promclient
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestLimitAPI(t *testing.T) {
+	block := make(chan struct{})
+	started := make(chan struct{}, 1)
+	stub := &stubAPI{query: func() model.Value {
+		started <- struct{}{}
+		<-block
+		return model.Vector{}
+	}}
+
+	var waits []float64
+	l := &LimitAPI{
+		API:         stub,
+		Limiter:     NewLimiter(1),
+		Name:        "test",
+		ObserveWait: func(s float64) { waits = append(waits, s) },
+	}
+
+	// Occupy the only slot
+	done := make(chan error)
+	go func() {
+		_, _, err := l.Query(context.TODO(), "up", time.Now())
+		done <- err
+	}()
+	<-started
+
+	// Requests over the limit give up once their context is done
+	ctx, cancel := context.WithTimeout(context.TODO(), 50*time.Millisecond)
+	defer cancel()
+	if _, _, err := l.Query(ctx, "up", time.Now()); err == nil {
+		t.Fatalf("expected an error waiting for a slot")
+	}
+	// A request whose context is already done doesn't wait at all
+	if _, _, err := l.Query(ctx, "up", time.Now()); err != context.DeadlineExceeded {
+		t.Fatalf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+
+	close(block)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// Once the slot is released requests go through again
+	go func() { <-started }()
+	if _, _, err := l.Query(context.TODO(), "up", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(waits) != 3 || waits[1] < 0.05 {
+		t.Fatalf("unexpected waits %v", waits)
+	}
+}
+
+func TestLimitAPIExpectedWait(t *testing.T) {
+	block := make(chan struct{})
+	started := make(chan struct{}, 1)
+	stub := &stubAPI{query: func() model.Value {
+		started <- struct{}{}
+		<-block
+		return model.Vector{}
+	}}
+	l := &LimitAPI{API: stub, Limiter: NewLimiter(1), Name: "test"}
+
+	// Occupy the only slot
+	done := make(chan error)
+	go func() {
+		_, _, err := l.Query(context.TODO(), "up", time.Now())
+		done <- err
+	}()
+	<-started
+	defer func() {
+		close(block)
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	// The first request over the limit waits until its deadline
+	ctx, cancel := context.WithTimeout(context.TODO(), 200*time.Millisecond)
+	defer cancel()
+	if _, _, err := l.Query(ctx, "up", time.Now()); err == nil {
+		t.Fatalf("expected an error waiting for a slot")
+	}
+	if wait := l.Limiter.expectedWait(); wait < 200*time.Millisecond {
+		t.Fatalf("unexpected expected wait %v", wait)
+	}
+
+	// Requests with a shorter deadline than the expected wait fail right away
+	ctx, cancel = context.WithTimeout(context.TODO(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, _, err := l.Query(ctx, "up", time.Now()); err == nil {
+		t.Fatalf("expected an error waiting for a slot")
+	}
+	if took := time.Since(start); took > 50*time.Millisecond {
+		t.Fatalf("request waited %v for a slot", took)
+	}
+}
+
+func TestLimitAPIExpectedWaitDecays(t *testing.T) {
+	stub := &stubAPI{query: func() model.Value { return model.Vector{} }}
+	l := &LimitAPI{API: stub, Limiter: NewLimiter(1), Name: "test"}
+	l.Limiter.observeWait(time.Second)
+
+	// Requests which get a slot right away lower the expected wait
+	for i := 0; i < 10; i++ {
+		if _, _, err := l.Query(context.TODO(), "up", time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if wait := l.Limiter.expectedWait(); wait > 200*time.Millisecond {
+		t.Fatalf("expected wait didn't decay: %v", wait)
+	}
+}
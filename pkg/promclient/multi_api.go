@@ -7,6 +7,7 @@ import (
 	"strings"
 	"time"
 
+	opentracing "github.com/opentracing/opentracing-go"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/api"
 	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
@@ -15,6 +16,8 @@ import (
 	"github.com/prometheus/prometheus/promql"
 
 	"github.com/jacksontj/promxy/pkg/promhttputil"
+	"github.com/jacksontj/promxy/pkg/querybudget"
+	"github.com/jacksontj/promxy/pkg/tracing"
 )
 
 // Since these error types magically add in their own prefixes, we need to get
@@ -57,12 +60,27 @@ func NormalizePromError(err error) error {
 	return err
 }
 
+// budgetErr returns the error of the query's budget if it was exceeded (as that
+// is what cancelled the context) and otherwise `err`
+func budgetErr(ctx context.Context, err error) error {
+	if budgetErr := querybudget.FromContext(ctx).Err(); budgetErr != nil {
+		return budgetErr
+	}
+	return err
+}
+
 // MultiAPIMetricFunc defines a method where a client can record metrics about
 // the specific API calls made through this multi client
 type MultiAPIMetricFunc func(i int, api, status string, took float64)
 
-// NewMultiAPI returns a MultiAPI
+// NewMultiAPI returns a MultiAPI which merges series using the given antiAffinity
 func NewMultiAPI(apis []API, antiAffinity model.Time, metricFunc MultiAPIMetricFunc, requiredCount int) *MultiAPI {
+	return NewMultiAPIWithMerger(apis, promhttputil.DefaultMergeStrategy, promhttputil.AntiAffinityMerger(antiAffinity), metricFunc, requiredCount)
+}
+
+// NewMultiAPIWithMerger returns a MultiAPI which merges vectors and scalars using
+// `strategy` and series using `merger`
+func NewMultiAPIWithMerger(apis []API, strategy promhttputil.MergeStrategy, merger promhttputil.SampleStreamMerger, metricFunc MultiAPIMetricFunc, requiredCount int) *MultiAPI {
 	fingerprintCounts := make(map[model.Fingerprint]int)
 	apiFingerprints := make([]model.Fingerprint, len(apis))
 	for i, api := range apis {
@@ -86,7 +104,8 @@ func NewMultiAPI(apis []API, antiAffinity model.Time, metricFunc MultiAPIMetricF
 	return &MultiAPI{
 		apis:            apis,
 		apiFingerprints: apiFingerprints,
-		antiAffinity:    antiAffinity,
+		strategy:        strategy,
+		merger:          merger,
 		metricFunc:      metricFunc,
 		requiredCount:   requiredCount,
 	}
@@ -96,11 +115,53 @@ func NewMultiAPI(apis []API, antiAffinity model.Time, metricFunc MultiAPIMetricF
 type MultiAPI struct {
 	apis            []API
 	apiFingerprints []model.Fingerprint
-	antiAffinity    model.Time
+	strategy        promhttputil.MergeStrategy
+	merger          promhttputil.SampleStreamMerger
 	metricFunc      MultiAPIMetricFunc
 	requiredCount   int // number "per key" that we require to respond
 }
 
+// mergeValues merges `a` and `b` (recording a tracing span for the merge)
+func (m *MultiAPI) mergeValues(ctx context.Context, a, b model.Value) (model.Value, error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "MultiAPI.merge")
+	defer span.Finish()
+	result, err := promhttputil.MergeValuesWith(m.strategy, m.merger, a, b)
+	span.SetTag(tracing.TagSeries, promhttputil.SeriesCount(result))
+	return result, err
+}
+
+// mergeResults merges all of `results` at once. Matrices are merged lazily (through
+// a promhttputil.MergedMatrix) and all other types are merged pairwise
+func (m *MultiAPI) mergeResults(ctx context.Context, results []model.Value) (model.Value, error) {
+	switch len(results) {
+	case 0:
+		return nil, nil
+	case 1:
+		return results[0], nil
+	}
+
+	allMatrix := true
+	for _, r := range results {
+		if r.Type() != model.ValMatrix {
+			allMatrix = false
+			break
+		}
+	}
+	if allMatrix {
+		return promhttputil.NewMergedMatrix(m.merger, results)
+	}
+
+	result := results[0]
+	for _, r := range results[1:] {
+		var err error
+		result, err = m.mergeValues(ctx, result, r)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
 func (m *MultiAPI) recordMetric(i int, api, status string, took float64) {
 	if m.metricFunc != nil {
 		m.metricFunc(i, api, status, took)
@@ -109,6 +170,9 @@ func (m *MultiAPI) recordMetric(i int, api, status string, took float64) {
 
 // LabelValues performs a query for the values of the given label.
 func (m *MultiAPI) LabelValues(ctx context.Context, label string) (model.LabelValues, api.Warnings, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "MultiAPI.LabelValues")
+	defer span.Finish()
+
 	childContext, childContextCancel := context.WithCancel(ctx)
 	defer childContextCancel()
 
@@ -151,12 +215,16 @@ func (m *MultiAPI) LabelValues(ctx context.Context, label string) (model.LabelVa
 	for i := 0; i < len(m.apis); i++ {
 		select {
 		case <-ctx.Done():
-			return nil, warnings.Warnings(), ctx.Err()
+			return nil, warnings.Warnings(), budgetErr(ctx, ctx.Err())
 
 		case ret := <-resultChans[i]:
 			warnings.AddWarnings(ret.warnings)
 			outstandingRequests[ret.ls]--
 			if ret.err != nil {
+				// If the query exceeded its budget, there is no reason to wait
+				if err := querybudget.FromContext(ctx).Err(); err != nil {
+					return nil, warnings.Warnings(), err
+				}
 				// If there aren't enough outstanding requests to possibly succeed, no reason to wait
 				if (outstandingRequests[ret.ls] + successMap[ret.ls]) < m.requiredCount {
 					return nil, warnings.Warnings(), ret.err
@@ -173,6 +241,12 @@ func (m *MultiAPI) LabelValues(ctx context.Context, label string) (model.LabelVa
 		}
 	}
 
+	// Errors of servergroups with ignore_error are hidden, so make sure that the
+	// query didn't exceed its budget
+	if err := querybudget.FromContext(ctx).Err(); err != nil {
+		return nil, warnings.Warnings(), err
+	}
+
 	// Verify that we hit the requiredCount for all of the buckets
 	for k := range outstandingRequests {
 		if successMap[k] < m.requiredCount {
@@ -187,6 +261,9 @@ func (m *MultiAPI) LabelValues(ctx context.Context, label string) (model.LabelVa
 
 // LabelNames returns all the unique label names present in the block in sorted order.
 func (m *MultiAPI) LabelNames(ctx context.Context) ([]string, api.Warnings, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "MultiAPI.LabelNames")
+	defer span.Finish()
+
 	childContext, childContextCancel := context.WithCancel(ctx)
 	defer childContextCancel()
 
@@ -229,12 +306,16 @@ func (m *MultiAPI) LabelNames(ctx context.Context) ([]string, api.Warnings, erro
 	for i := 0; i < len(m.apis); i++ {
 		select {
 		case <-ctx.Done():
-			return nil, warnings.Warnings(), ctx.Err()
+			return nil, warnings.Warnings(), budgetErr(ctx, ctx.Err())
 
 		case ret := <-resultChans[i]:
 			warnings.AddWarnings(ret.warnings)
 			outstandingRequests[ret.ls]--
 			if ret.err != nil {
+				// If the query exceeded its budget, there is no reason to wait
+				if err := querybudget.FromContext(ctx).Err(); err != nil {
+					return nil, warnings.Warnings(), err
+				}
 				// If there aren't enough outstanding requests to possibly succeed, no reason to wait
 				if (outstandingRequests[ret.ls] + successMap[ret.ls]) < m.requiredCount {
 					return nil, warnings.Warnings(), ret.err
@@ -249,6 +330,12 @@ func (m *MultiAPI) LabelNames(ctx context.Context) ([]string, api.Warnings, erro
 		}
 	}
 
+	// Errors of servergroups with ignore_error are hidden, so make sure that the
+	// query didn't exceed its budget
+	if err := querybudget.FromContext(ctx).Err(); err != nil {
+		return nil, warnings.Warnings(), err
+	}
+
 	// Verify that we hit the requiredCount for all of the buckets
 	for k := range outstandingRequests {
 		if successMap[k] < m.requiredCount {
@@ -268,6 +355,9 @@ func (m *MultiAPI) LabelNames(ctx context.Context) ([]string, api.Warnings, erro
 
 // Query performs a query for the given time.
 func (m *MultiAPI) Query(ctx context.Context, query string, ts time.Time) (model.Value, api.Warnings, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "MultiAPI.Query")
+	defer span.Finish()
+
 	childContext, childContextCancel := context.WithCancel(ctx)
 	defer childContextCancel()
 
@@ -310,12 +400,16 @@ func (m *MultiAPI) Query(ctx context.Context, query string, ts time.Time) (model
 	for i := 0; i < len(m.apis); i++ {
 		select {
 		case <-ctx.Done():
-			return nil, warnings.Warnings(), ctx.Err()
+			return nil, warnings.Warnings(), budgetErr(ctx, ctx.Err())
 
 		case ret := <-resultChans[i]:
 			warnings.AddWarnings(ret.warnings)
 			outstandingRequests[ret.ls]--
 			if ret.err != nil {
+				// If the query exceeded its budget, there is no reason to wait
+				if err := querybudget.FromContext(ctx).Err(); err != nil {
+					return nil, warnings.Warnings(), err
+				}
 				// If there aren't enough outstanding requests to possibly succeed, no reason to wait
 				if (outstandingRequests[ret.ls] + successMap[ret.ls]) < m.requiredCount {
 					return nil, warnings.Warnings(), ret.err
@@ -327,7 +421,7 @@ func (m *MultiAPI) Query(ctx context.Context, query string, ts time.Time) (model
 					result = ret.v
 				} else {
 					var err error
-					result, err = promhttputil.MergeValues(m.antiAffinity, result, ret.v)
+					result, err = m.mergeValues(ctx, result, ret.v)
 					if err != nil {
 						return nil, warnings.Warnings(), err
 					}
@@ -336,6 +430,12 @@ func (m *MultiAPI) Query(ctx context.Context, query string, ts time.Time) (model
 		}
 	}
 
+	// Errors of servergroups with ignore_error are hidden, so make sure that the
+	// query didn't exceed its budget
+	if err := querybudget.FromContext(ctx).Err(); err != nil {
+		return nil, warnings.Warnings(), err
+	}
+
 	// Verify that we hit the requiredCount for all of the buckets
 	for k := range outstandingRequests {
 		if successMap[k] < m.requiredCount {
@@ -348,6 +448,9 @@ func (m *MultiAPI) Query(ctx context.Context, query string, ts time.Time) (model
 
 // QueryRange performs a query for the given range.
 func (m *MultiAPI) QueryRange(ctx context.Context, query string, r v1.Range) (model.Value, api.Warnings, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "MultiAPI.QueryRange")
+	defer span.Finish()
+
 	childContext, childContextCancel := context.WithCancel(ctx)
 	defer childContextCancel()
 
@@ -383,19 +486,23 @@ func (m *MultiAPI) QueryRange(ctx context.Context, query string, r v1.Range) (mo
 	}
 
 	// Wait for results as we get them
-	var result model.Value
+	results := make([]model.Value, 0, len(m.apis))
 	warnings := make(promhttputil.WarningSet)
 	var lastError error
 	successMap := make(map[model.Fingerprint]int) // fingerprint -> success
 	for i := 0; i < len(m.apis); i++ {
 		select {
 		case <-ctx.Done():
-			return nil, warnings.Warnings(), ctx.Err()
+			return nil, warnings.Warnings(), budgetErr(ctx, ctx.Err())
 
 		case ret := <-resultChans[i]:
 			warnings.AddWarnings(ret.warnings)
 			outstandingRequests[ret.ls]--
 			if ret.err != nil {
+				// If the query exceeded its budget, there is no reason to wait
+				if err := querybudget.FromContext(ctx).Err(); err != nil {
+					return nil, warnings.Warnings(), err
+				}
 				// If there aren't enough outstanding requests to possibly succeed, no reason to wait
 				if (outstandingRequests[ret.ls] + successMap[ret.ls]) < m.requiredCount {
 					return nil, warnings.Warnings(), ret.err
@@ -403,19 +510,19 @@ func (m *MultiAPI) QueryRange(ctx context.Context, query string, r v1.Range) (mo
 				lastError = ret.err
 			} else {
 				successMap[ret.ls]++
-				if result == nil {
-					result = ret.v
-				} else {
-					var err error
-					result, err = promhttputil.MergeValues(m.antiAffinity, result, ret.v)
-					if err != nil {
-						return nil, warnings.Warnings(), err
-					}
+				if ret.v != nil {
+					results = append(results, ret.v)
 				}
 			}
 		}
 	}
 
+	// Errors of servergroups with ignore_error are hidden, so make sure that the
+	// query didn't exceed its budget
+	if err := querybudget.FromContext(ctx).Err(); err != nil {
+		return nil, warnings.Warnings(), err
+	}
+
 	// Verify that we hit the requiredCount for all of the buckets
 	for k := range outstandingRequests {
 		if successMap[k] < m.requiredCount {
@@ -423,11 +530,19 @@ func (m *MultiAPI) QueryRange(ctx context.Context, query string, r v1.Range) (mo
 		}
 	}
 
+	// The result is a *MergedMatrix, so the series are merged as the caller iterates over them
+	result, err := m.mergeResults(ctx, results)
+	if err != nil {
+		return nil, warnings.Warnings(), err
+	}
 	return result, warnings.Warnings(), nil
 }
 
 // Series finds series by label matchers.
 func (m *MultiAPI) Series(ctx context.Context, matches []string, startTime time.Time, endTime time.Time) ([]model.LabelSet, api.Warnings, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "MultiAPI.Series")
+	defer span.Finish()
+
 	childContext, childContextCancel := context.WithCancel(ctx)
 	defer childContextCancel()
 
@@ -470,12 +585,16 @@ func (m *MultiAPI) Series(ctx context.Context, matches []string, startTime time.
 	for i := 0; i < len(m.apis); i++ {
 		select {
 		case <-ctx.Done():
-			return nil, warnings.Warnings(), ctx.Err()
+			return nil, warnings.Warnings(), budgetErr(ctx, ctx.Err())
 
 		case ret := <-resultChans[i]:
 			warnings.AddWarnings(ret.warnings)
 			outstandingRequests[ret.ls]--
 			if ret.err != nil {
+				// If the query exceeded its budget, there is no reason to wait
+				if err := querybudget.FromContext(ctx).Err(); err != nil {
+					return nil, warnings.Warnings(), err
+				}
 				// If there aren't enough outstanding requests to possibly succeed, no reason to wait
 				if (outstandingRequests[ret.ls] + successMap[ret.ls]) < m.requiredCount {
 					return nil, warnings.Warnings(), ret.err
@@ -492,6 +611,12 @@ func (m *MultiAPI) Series(ctx context.Context, matches []string, startTime time.
 		}
 	}
 
+	// Errors of servergroups with ignore_error are hidden, so make sure that the
+	// query didn't exceed its budget
+	if err := querybudget.FromContext(ctx).Err(); err != nil {
+		return nil, warnings.Warnings(), err
+	}
+
 	// Verify that we hit the requiredCount for all of the buckets
 	for k := range outstandingRequests {
 		if successMap[k] < m.requiredCount {
@@ -504,6 +629,9 @@ func (m *MultiAPI) Series(ctx context.Context, matches []string, startTime time.
 
 // GetValue fetches a `model.Value` which represents the actual collected data
 func (m *MultiAPI) GetValue(ctx context.Context, start, end time.Time, matchers []*labels.Matcher) (model.Value, api.Warnings, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "MultiAPI.GetValue")
+	defer span.Finish()
+
 	childContext, childContextCancel := context.WithCancel(ctx)
 	defer childContextCancel()
 
@@ -540,19 +668,23 @@ func (m *MultiAPI) GetValue(ctx context.Context, start, end time.Time, matchers
 	}
 
 	// Wait for results as we get them
-	var result model.Value
+	results := make([]model.Value, 0, len(m.apis))
 	warnings := make(promhttputil.WarningSet)
 	var lastError error
 	successMap := make(map[model.Fingerprint]int) // fingerprint -> success
 	for i := 0; i < len(m.apis); i++ {
 		select {
 		case <-ctx.Done():
-			return nil, warnings.Warnings(), ctx.Err()
+			return nil, warnings.Warnings(), budgetErr(ctx, ctx.Err())
 
 		case ret := <-resultChans[i]:
 			warnings.AddWarnings(ret.warnings)
 			outstandingRequests[ret.ls]--
 			if ret.err != nil {
+				// If the query exceeded its budget, there is no reason to wait
+				if err := querybudget.FromContext(ctx).Err(); err != nil {
+					return nil, warnings.Warnings(), err
+				}
 				// If there aren't enough outstanding requests to possibly succeed, no reason to wait
 				if (outstandingRequests[ret.ls] + successMap[ret.ls]) < m.requiredCount {
 					return nil, warnings.Warnings(), ret.err
@@ -560,19 +692,19 @@ func (m *MultiAPI) GetValue(ctx context.Context, start, end time.Time, matchers
 				lastError = ret.err
 			} else {
 				successMap[ret.ls]++
-				if result == nil {
-					result = ret.v
-				} else {
-					var err error
-					result, err = promhttputil.MergeValues(m.antiAffinity, result, ret.v)
-					if err != nil {
-						return nil, warnings.Warnings(), err
-					}
+				if ret.v != nil {
+					results = append(results, ret.v)
 				}
 			}
 		}
 	}
 
+	// Errors of servergroups with ignore_error are hidden, so make sure that the
+	// query didn't exceed its budget
+	if err := querybudget.FromContext(ctx).Err(); err != nil {
+		return nil, warnings.Warnings(), err
+	}
+
 	// Verify that we hit the requiredCount for all of the buckets
 	for k := range outstandingRequests {
 		if successMap[k] < m.requiredCount {
@@ -580,5 +712,9 @@ func (m *MultiAPI) GetValue(ctx context.Context, start, end time.Time, matchers
 		}
 	}
 
+	result, err := m.mergeResults(ctx, results)
+	if err != nil {
+		return nil, warnings.Warnings(), err
+	}
 	return result, warnings.Warnings(), nil
 }
@@ -11,6 +11,8 @@ import (
 	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/pkg/labels"
+
+	"github.com/jacksontj/promxy/pkg/promhttputil"
 )
 
 type stubAPI struct {
@@ -494,3 +496,34 @@ func TestMultiAPIMerging(t *testing.T) {
 		})
 	}
 }
+
+func TestMultiAPIQueryRangeLazy(t *testing.T) {
+	matrix := func(ts ...model.Time) func() model.Value {
+		return func() model.Value {
+			stream := &model.SampleStream{Metric: model.Metric{model.MetricNameLabel: "testmetric"}}
+			for _, t := range ts {
+				stream.Values = append(stream.Values, model.SamplePair{Timestamp: t, Value: 1})
+			}
+			return model.Matrix{stream}
+		}
+	}
+
+	a := NewMultiAPI([]API{
+		&stubAPI{queryRange: matrix(0, 10)},
+		&stubAPI{queryRange: matrix(20, 30)},
+	}, model.Time(0), nil, 1)
+
+	v, _, err := a.QueryRange(context.TODO(), "testmetric", v1.Range{})
+	if err != nil {
+		t.Fatalf("Unexpected Err: %v", err)
+	}
+	merged, ok := v.(*promhttputil.MergedMatrix)
+	if !ok {
+		t.Fatalf("expected a *MergedMatrix got %T", v)
+	}
+
+	expected := matrix(0, 10, 20, 30)()
+	if actual := merged.Matrix(); actual.String() != expected.String() {
+		t.Fatalf("mismatch in value: \nexpected=%v\nactual=%v", expected, actual)
+	}
+}
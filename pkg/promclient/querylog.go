@@ -0,0 +1,106 @@
+package promclient
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/api"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+
+	"github.com/jacksontj/promxy/pkg/promhttputil"
+	"github.com/jacksontj/promxy/pkg/querylog"
+)
+
+// QueryLogAPI records each call to the API it wraps into the query log Entry
+// of the context (if there is one)
+type QueryLogAPI struct {
+	API
+	ServerGroup string
+	Target      string
+}
+
+func (q *QueryLogAPI) record(ctx context.Context, api, query string, start time.Time, series, samples int, w api.Warnings, err error) {
+	e := querylog.FromContext(ctx)
+	if e == nil {
+		return
+	}
+	d := querylog.Downstream{
+		ServerGroup: q.ServerGroup,
+		Target:      q.Target,
+		API:         api,
+		Query:       query,
+		Duration:    time.Since(start).Seconds(),
+		Status:      "success",
+		Series:      series,
+		Samples:     samples,
+		Warnings:    w,
+	}
+	if err != nil {
+		d.Status = "error"
+		d.Error = err.Error()
+	}
+	e.AddDownstream(d)
+}
+
+// LabelNames returns all the unique label names present in the block in sorted order.
+func (q *QueryLogAPI) LabelNames(ctx context.Context) ([]string, api.Warnings, error) {
+	start := time.Now()
+	v, w, err := q.API.LabelNames(ctx)
+	q.record(ctx, "label_names", "", start, len(v), 0, w, err)
+	return v, w, err
+}
+
+// LabelValues performs a query for the values of the given label.
+func (q *QueryLogAPI) LabelValues(ctx context.Context, label string) (model.LabelValues, api.Warnings, error) {
+	start := time.Now()
+	v, w, err := q.API.LabelValues(ctx, label)
+	q.record(ctx, "label_values", label, start, len(v), 0, w, err)
+	return v, w, err
+}
+
+// Query performs a query for the given time.
+func (q *QueryLogAPI) Query(ctx context.Context, query string, ts time.Time) (model.Value, api.Warnings, error) {
+	start := time.Now()
+	v, w, err := q.API.Query(ctx, query, ts)
+	q.record(ctx, "query", query, start, promhttputil.SeriesCount(v), promhttputil.SampleCount(v), w, err)
+	return v, w, err
+}
+
+// QueryRange performs a query for the given range.
+func (q *QueryLogAPI) QueryRange(ctx context.Context, query string, r v1.Range) (model.Value, api.Warnings, error) {
+	start := time.Now()
+	v, w, err := q.API.QueryRange(ctx, query, r)
+	q.record(ctx, "query_range", query, start, promhttputil.SeriesCount(v), promhttputil.SampleCount(v), w, err)
+	return v, w, err
+}
+
+// Series finds series by label matchers.
+func (q *QueryLogAPI) Series(ctx context.Context, matches []string, startTime time.Time, endTime time.Time) ([]model.LabelSet, api.Warnings, error) {
+	start := time.Now()
+	v, w, err := q.API.Series(ctx, matches, startTime, endTime)
+	var query string
+	if len(matches) > 0 {
+		query = matches[0]
+	}
+	q.record(ctx, "series", query, start, len(v), 0, w, err)
+	return v, w, err
+}
+
+// GetValue loads the raw data for a given set of matchers in the time range
+func (q *QueryLogAPI) GetValue(ctx context.Context, start, end time.Time, matchers []*labels.Matcher) (model.Value, api.Warnings, error) {
+	callStart := time.Now()
+	v, w, err := q.API.GetValue(ctx, start, end, matchers)
+	query, _ := promhttputil.MatcherToString(matchers)
+	q.record(ctx, "get_value", query, callStart, promhttputil.SeriesCount(v), promhttputil.SampleCount(v), w, err)
+	return v, w, err
+}
+
+// Key returns a labelset used to determine other api clients that are the "same"
+func (q *QueryLogAPI) Key() model.LabelSet {
+	if apiLabels, ok := q.API.(APILabels); ok {
+		return apiLabels.Key()
+	}
+	return nil
+}
@@ -0,0 +1,634 @@
+package promclient
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/prometheus/client_golang/api"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/relabel"
+	"github.com/prometheus/prometheus/promql"
+
+	"github.com/jacksontj/promxy/pkg/promhttputil"
+)
+
+// allSeriesMatcher selects all series, it is sent downstream when none of the
+// matchers of a request can be
+var allSeriesMatcher, _ = labels.NewMatcher(labels.MatchRegexp, model.MetricNameLabel, ".+")
+
+// maxRelabelTargets bounds the number of label names a templated target label
+// (or labelmap replacement) may expand to
+const maxRelabelTargets = 1000
+
+// RelabelAPI applies relabel configs (like prometheus' metric_relabel_configs) to
+// all series returned by an API.
+// Matchers on labels which the relabeling may change can't be sent downstream, these
+// are instead applied to the relabeled series. Queries which select series with such
+// matchers, whose result may have labels the relabeling changes or which are subject
+// to keep/drop actions are evaluated locally on top of GetValue, all other queries are
+// sent downstream as-is. The label names/values are taken from the (relabeled) series.
+// Note: aggregations sent downstream still count series separately which the
+// relabeling would merge (e.g. by dropping a label which isn't in their result)
+type RelabelAPI struct {
+	API
+	configs []*relabel.Config
+	// targets are the label names which the configs may set
+	targets map[string]struct{}
+}
+
+// NewRelabelAPI returns a RelabelAPI applying `cfgs` to all series of `a`. It returns
+// an error if the label names which `cfgs` may set can't be bounded (see RelabelTargets)
+func NewRelabelAPI(a API, cfgs []*relabel.Config) (*RelabelAPI, error) {
+	targets, err := RelabelTargets(cfgs)
+	if err != nil {
+		return nil, err
+	}
+	r := &RelabelAPI{API: a, configs: cfgs, targets: make(map[string]struct{}, len(targets))}
+	for _, target := range targets {
+		r.targets[target] = struct{}{}
+	}
+	return r, nil
+}
+
+// RelabelTargets returns the label names which the replace, hashmod and labelmap
+// actions of `cfgs` may set. A target label (or labelmap replacement) which is a
+// template may only reference capture groups of the regex which match a bounded
+// set of strings (e.g. `(foo|bar)` but not `(.+)`), otherwise an error is returned
+func RelabelTargets(cfgs []*relabel.Config) ([]string, error) {
+	set := make(map[string]struct{})
+	for _, cfg := range cfgs {
+		var template string
+		switch cfg.Action {
+		case relabel.Replace:
+			template = cfg.TargetLabel
+		case relabel.HashMod:
+			// The target of a hashmod isn't expanded
+			set[cfg.TargetLabel] = struct{}{}
+			continue
+		case relabel.LabelMap:
+			template = cfg.Replacement
+		default:
+			continue
+		}
+		targets, err := expandTemplate(cfg.Regex.Regexp, template)
+		if err != nil {
+			return nil, fmt.Errorf("unable to bound the label names set by the %s action with regex %q: %v", cfg.Action, cfg.Regex.String(), err)
+		}
+		for _, target := range targets {
+			set[target] = struct{}{}
+		}
+	}
+	ret := make([]string, 0, len(set))
+	for target := range set {
+		ret = append(ret, target)
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+// expandTemplate returns all strings `template` may expand to for matches of `re`.
+// Each capture group the template references is expanded to all strings it may
+// match (or the empty string, if it doesn't participate in the match)
+func expandTemplate(re *regexp.Regexp, template string) ([]string, error) {
+	if !strings.Contains(template, "$") {
+		return []string{template}, nil
+	}
+	parsed, err := syntax.Parse(re.String(), syntax.Perl)
+	if err != nil {
+		return nil, err
+	}
+
+	n := re.NumSubexp() + 1
+	var (
+		groups []int
+		values [][]string
+	)
+	combinations := 1
+	for i := 0; i < n; i++ {
+		// Check whether the template references the group by expanding it with
+		// only that group matching
+		match := make([]int, 2*n)
+		for j := range match {
+			match[j] = -1
+		}
+		match[2*i], match[2*i+1] = 0, 1
+		if !strings.Contains(string(re.ExpandString(nil, template, "\x00", match)), "\x00") {
+			continue
+		}
+
+		group := parsed
+		if i > 0 {
+			group = findCapture(parsed, i)
+		}
+		vals, ok := enumerateRegexp(group, maxRelabelTargets)
+		if !ok {
+			return nil, fmt.Errorf("the template %q references a group matching more than %d strings", template, maxRelabelTargets)
+		}
+		vals = append(vals, "")
+		combinations *= len(vals)
+		if combinations > maxRelabelTargets {
+			return nil, fmt.Errorf("the template %q expands to more than %d strings", template, maxRelabelTargets)
+		}
+		groups = append(groups, i)
+		values = append(values, vals)
+	}
+
+	ret := make([]string, 0, combinations)
+	chosen := make([]string, len(groups))
+	var expand func(k int)
+	expand = func(k int) {
+		if k < len(groups) {
+			for _, v := range values[k] {
+				chosen[k] = v
+				expand(k + 1)
+			}
+			return
+		}
+		var src strings.Builder
+		match := make([]int, 2*n)
+		for j := range match {
+			match[j] = -1
+		}
+		for j, group := range groups {
+			match[2*group] = src.Len()
+			src.WriteString(chosen[j])
+			match[2*group+1] = src.Len()
+		}
+		ret = append(ret, string(re.ExpandString(nil, template, src.String(), match)))
+	}
+	expand(0)
+	return ret, nil
+}
+
+// findCapture returns the capture group `n` of `re`
+func findCapture(re *syntax.Regexp, n int) *syntax.Regexp {
+	if re.Op == syntax.OpCapture && re.Cap == n {
+		return re
+	}
+	for _, sub := range re.Sub {
+		if found := findCapture(sub, n); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// enumerateRegexp returns all strings matched by `re` (possibly with duplicates),
+// or false if there are more than `max` of them
+func enumerateRegexp(re *syntax.Regexp, max int) ([]string, bool) {
+	switch re.Op {
+	case syntax.OpNoMatch:
+		return nil, true
+	case syntax.OpEmptyMatch, syntax.OpBeginLine, syntax.OpEndLine, syntax.OpBeginText, syntax.OpEndText, syntax.OpWordBoundary, syntax.OpNoWordBoundary:
+		return []string{""}, true
+	case syntax.OpLiteral:
+		ret := []string{""}
+		for _, r := range re.Rune {
+			runes := []rune{r}
+			if re.Flags&syntax.FoldCase != 0 {
+				for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+					runes = append(runes, f)
+				}
+			}
+			if len(ret)*len(runes) > max {
+				return nil, false
+			}
+			next := make([]string, 0, len(ret)*len(runes))
+			for _, prefix := range ret {
+				for _, r := range runes {
+					next = append(next, prefix+string(r))
+				}
+			}
+			ret = next
+		}
+		return ret, true
+	case syntax.OpCharClass:
+		var ret []string
+		for i := 0; i+1 < len(re.Rune); i += 2 {
+			if len(ret)+int(re.Rune[i+1]-re.Rune[i])+1 > max {
+				return nil, false
+			}
+			for r := re.Rune[i]; r <= re.Rune[i+1]; r++ {
+				ret = append(ret, string(r))
+			}
+		}
+		return ret, true
+	case syntax.OpCapture:
+		return enumerateRegexp(re.Sub[0], max)
+	case syntax.OpQuest:
+		ret, ok := enumerateRegexp(re.Sub[0], max-1)
+		return append(ret, ""), ok
+	case syntax.OpRepeat:
+		if re.Max < 0 {
+			return nil, false
+		}
+		sub, ok := enumerateRegexp(re.Sub[0], max)
+		if !ok {
+			return nil, false
+		}
+		var ret []string
+		repeated := []string{""}
+		for i := 0; i <= re.Max; i++ {
+			if i >= re.Min {
+				if len(ret)+len(repeated) > max {
+					return nil, false
+				}
+				ret = append(ret, repeated...)
+			}
+			if i < re.Max {
+				if repeated, ok = concatStrings(repeated, sub, max); !ok {
+					return nil, false
+				}
+			}
+		}
+		return ret, true
+	case syntax.OpConcat:
+		ret := []string{""}
+		for _, sub := range re.Sub {
+			vals, ok := enumerateRegexp(sub, max)
+			if !ok {
+				return nil, false
+			}
+			if ret, ok = concatStrings(ret, vals, max); !ok {
+				return nil, false
+			}
+		}
+		return ret, true
+	case syntax.OpAlternate:
+		var ret []string
+		for _, sub := range re.Sub {
+			vals, ok := enumerateRegexp(sub, max-len(ret))
+			if !ok {
+				return nil, false
+			}
+			ret = append(ret, vals...)
+		}
+		return ret, true
+	}
+	// Any character, stars and pluses match an unbounded set of strings
+	return nil, false
+}
+
+// concatStrings returns all concatenations of a string of `a` and one of `b`, or
+// false if there are more than `max` of them
+func concatStrings(a, b []string, max int) ([]string, bool) {
+	if len(a)*len(b) > max {
+		return nil, false
+	}
+	ret := make([]string, 0, len(a)*len(b))
+	for _, prefix := range a {
+		for _, suffix := range b {
+			ret = append(ret, prefix+suffix)
+		}
+	}
+	return ret, true
+}
+
+// affected returns whether the relabeling may change the label `name`
+func (r *RelabelAPI) affected(name string) bool {
+	if _, ok := r.targets[name]; ok {
+		return true
+	}
+	for _, cfg := range r.configs {
+		switch cfg.Action {
+		case relabel.LabelDrop:
+			if cfg.Regex.MatchString(name) {
+				return true
+			}
+		case relabel.LabelKeep:
+			if !cfg.Regex.MatchString(name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Key returns a labelset used to determine other api clients that are the "same"
+func (r *RelabelAPI) Key() model.LabelSet {
+	if apiLabels, ok := r.API.(APILabels); ok {
+		return apiLabels.Key()
+	}
+	return nil
+}
+
+// relabelsLabels returns whether the relabeling may change any label
+func (r *RelabelAPI) relabelsLabels() bool {
+	if len(r.targets) > 0 {
+		return true
+	}
+	for _, cfg := range r.configs {
+		if cfg.Action == relabel.LabelDrop || cfg.Action == relabel.LabelKeep {
+			return true
+		}
+	}
+	return false
+}
+
+// evalLocally returns whether `query` has to be evaluated on top of the relabeled
+// series instead of being sent downstream
+func (r *RelabelAPI) evalLocally(ctx context.Context, query string) (bool, error) {
+	// Dropped series can only be filtered out of the relabeled series
+	for _, cfg := range r.configs {
+		if cfg.Action == relabel.Keep || cfg.Action == relabel.Drop {
+			return true, nil
+		}
+	}
+
+	e, err := promql.ParseExpr(query)
+	if err != nil {
+		return false, err
+	}
+	visitor := &relabelVisitor{r: r}
+	if _, err := promql.Walk(ctx, visitor, &promql.EvalStmt{Expr: e}, e, nil, nil); err != nil {
+		return false, err
+	}
+	if visitor.local {
+		return true, nil
+	}
+
+	names, all := outputLabels(e)
+	if all {
+		return r.relabelsLabels(), nil
+	}
+	for _, name := range names {
+		if r.affected(name) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// relabelVisitor checks whether any selector has matchers which can't be sent downstream
+type relabelVisitor struct {
+	r     *RelabelAPI
+	local bool
+}
+
+// Visit checks the matchers of the selectors
+func (v *relabelVisitor) Visit(node promql.Node, path []promql.Node) (promql.Visitor, error) {
+	var matchers []*labels.Matcher
+	switch nodeTyped := node.(type) {
+	case *promql.VectorSelector:
+		matchers = nodeTyped.LabelMatchers
+	case *promql.MatrixSelector:
+		matchers = nodeTyped.LabelMatchers
+	}
+	for _, m := range matchers {
+		if v.r.affected(m.Name) {
+			v.local = true
+		}
+	}
+	return v, nil
+}
+
+// outputLabels returns the label names the result of `e` may have, or true if it
+// may have any label
+func outputLabels(e promql.Expr) ([]string, bool) {
+	switch eTyped := e.(type) {
+	case *promql.VectorSelector, *promql.MatrixSelector:
+		return nil, true
+	case *promql.AggregateExpr:
+		// These keep the labels of the aggregated series
+		if eTyped.Without || eTyped.Op == promql.ItemTopK || eTyped.Op == promql.ItemBottomK {
+			return outputLabels(eTyped.Expr)
+		}
+		names := append([]string(nil), eTyped.Grouping...)
+		if eTyped.Op == promql.ItemCountValues {
+			param, ok := eTyped.Param.(*promql.StringLiteral)
+			if !ok {
+				return nil, true
+			}
+			names = append(names, param.Val)
+		}
+		return names, false
+	case *promql.Call:
+		// These set labels of the result
+		if eTyped.Func.Name == "label_replace" || eTyped.Func.Name == "label_join" {
+			return nil, true
+		}
+		var names []string
+		for _, arg := range eTyped.Args {
+			argNames, all := outputLabels(arg)
+			if all {
+				return nil, true
+			}
+			names = append(names, argNames...)
+		}
+		return names, false
+	case *promql.BinaryExpr:
+		lhs, all := outputLabels(eTyped.LHS)
+		if all {
+			return nil, true
+		}
+		rhs, all := outputLabels(eTyped.RHS)
+		if all {
+			return nil, true
+		}
+		return append(lhs, rhs...), false
+	case *promql.ParenExpr:
+		return outputLabels(eTyped.Expr)
+	case *promql.UnaryExpr:
+		return outputLabels(eTyped.Expr)
+	case *promql.SubqueryExpr:
+		return outputLabels(eTyped.Expr)
+	}
+	// Literals have no labels
+	return nil, false
+}
+
+// splitMatchers splits `matchers` into those which can be sent downstream and those
+// which have to be applied to the relabeled series
+func (r *RelabelAPI) splitMatchers(matchers []*labels.Matcher) (downstream, local []*labels.Matcher) {
+	selective := false
+	for _, m := range matchers {
+		if r.affected(m.Name) {
+			local = append(local, m)
+			continue
+		}
+		downstream = append(downstream, m)
+		if !m.Matches("") {
+			selective = true
+		}
+	}
+	// Downstreams require at least one matcher which doesn't match the empty string
+	if !selective {
+		downstream = append(downstream, allSeriesMatcher)
+	}
+	return downstream, local
+}
+
+// relabel returns the relabeled `m`, or false if the series is dropped
+func (r *RelabelAPI) relabel(m model.Metric, matchers []*labels.Matcher) (model.Metric, bool) {
+	lset := relabel.Process(promhttputil.MetricToLabels(m), r.configs...)
+	if lset == nil {
+		return nil, false
+	}
+	for _, matcher := range matchers {
+		if !matcher.Matches(lset.Get(matcher.Name)) {
+			return nil, false
+		}
+	}
+	return promhttputil.LabelsToMetric(lset), true
+}
+
+// LabelNames returns all the unique label names present in the block in sorted order.
+func (r *RelabelAPI) LabelNames(ctx context.Context) ([]string, api.Warnings, error) {
+	lsets, w, err := r.series(ctx, []*labels.Matcher{allSeriesMatcher}, time.Time{}, time.Now())
+	if err != nil {
+		return nil, w, err
+	}
+	set := make(map[string]struct{})
+	for _, lset := range lsets {
+		for k := range lset {
+			set[string(k)] = struct{}{}
+		}
+	}
+	ret := make([]string, 0, len(set))
+	for name := range set {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return ret, w, nil
+}
+
+// LabelValues performs a query for the values of the given label.
+func (r *RelabelAPI) LabelValues(ctx context.Context, label string) (model.LabelValues, api.Warnings, error) {
+	m, err := labels.NewMatcher(labels.MatchNotEqual, label, "")
+	if err != nil {
+		return nil, nil, err
+	}
+	lsets, w, err := r.series(ctx, []*labels.Matcher{m}, time.Time{}, time.Now())
+	if err != nil {
+		return nil, w, err
+	}
+	set := make(map[model.LabelValue]struct{})
+	for _, lset := range lsets {
+		set[lset[model.LabelName(label)]] = struct{}{}
+	}
+	ret := make(model.LabelValues, 0, len(set))
+	for v := range set {
+		ret = append(ret, v)
+	}
+	sort.Sort(ret)
+	return ret, w, nil
+}
+
+// Query performs a query for the given time.
+func (r *RelabelAPI) Query(ctx context.Context, query string, ts time.Time) (model.Value, api.Warnings, error) {
+	local, err := r.evalLocally(ctx, query)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !local {
+		return r.API.Query(ctx, query, ts)
+	}
+	return EvalQuery(ctx, r, query, ts)
+}
+
+// QueryRange performs a query for the given range.
+func (r *RelabelAPI) QueryRange(ctx context.Context, query string, rng v1.Range) (model.Value, api.Warnings, error) {
+	local, err := r.evalLocally(ctx, query)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !local {
+		return r.API.QueryRange(ctx, query, rng)
+	}
+	return EvalQueryRange(ctx, r, query, rng)
+}
+
+// Series finds series by label matchers.
+func (r *RelabelAPI) Series(ctx context.Context, matches []string, startTime time.Time, endTime time.Time) ([]model.LabelSet, api.Warnings, error) {
+	var (
+		ret []model.LabelSet
+		w   api.Warnings
+	)
+	for _, match := range matches {
+		matchers, err := promql.ParseMetricSelector(match)
+		if err != nil {
+			return nil, w, err
+		}
+		lsets, warnings, err := r.series(ctx, matchers, startTime, endTime)
+		w = append(w, warnings...)
+		if err != nil {
+			return nil, w, err
+		}
+		ret = MergeLabelSets(ret, lsets)
+	}
+	return ret, w, nil
+}
+
+// series returns the relabeled series matching `matchers`
+func (r *RelabelAPI) series(ctx context.Context, matchers []*labels.Matcher, startTime time.Time, endTime time.Time) ([]model.LabelSet, api.Warnings, error) {
+	downstream, local := r.splitMatchers(matchers)
+	match, err := promhttputil.MatcherToString(downstream)
+	if err != nil {
+		return nil, nil, err
+	}
+	v, w, err := r.API.Series(ctx, []string{match}, startTime, endTime)
+	if err != nil {
+		return nil, w, err
+	}
+
+	ret := make([]model.LabelSet, 0, len(v))
+	for _, lset := range v {
+		if m, ok := r.relabel(model.Metric(lset), local); ok {
+			ret = append(ret, model.LabelSet(m))
+		}
+	}
+	// Relabeling may result in duplicate labelsets
+	return MergeLabelSets(nil, ret), w, nil
+}
+
+// GetValue loads the raw data for a given set of matchers in the time range
+func (r *RelabelAPI) GetValue(ctx context.Context, start, end time.Time, matchers []*labels.Matcher) (model.Value, api.Warnings, error) {
+	downstream, local := r.splitMatchers(matchers)
+	v, w, err := r.API.GetValue(ctx, start, end, downstream)
+	if err != nil {
+		return nil, w, err
+	}
+
+	var matrix model.Matrix
+	switch vTyped := v.(type) {
+	case nil:
+	case model.Matrix:
+		matrix = vTyped
+	case promhttputil.CompactMatrix:
+		matrix = vTyped.Matrix()
+	case *promhttputil.MergedMatrix:
+		matrix = vTyped.Matrix()
+	default:
+		return nil, w, fmt.Errorf("unable to relabel %v", v.Type())
+	}
+
+	ret := make(model.Matrix, 0, len(matrix))
+	index := make(map[model.Fingerprint]int, len(matrix))
+	for _, stream := range matrix {
+		m, ok := r.relabel(stream.Metric, local)
+		if !ok {
+			continue
+		}
+		fp := m.Fingerprint()
+		// Relabeling may result in multiple series with the same labels
+		if i, ok := index[fp]; ok {
+			merged, err := promhttputil.MergeSampleStream(0, ret[i], &model.SampleStream{Metric: m, Values: stream.Values})
+			if err != nil {
+				return nil, w, err
+			}
+			ret[i] = merged
+			continue
+		}
+		index[fp] = len(ret)
+		ret = append(ret, &model.SampleStream{Metric: m, Values: stream.Values})
+	}
+	return ret, w, nil
+}
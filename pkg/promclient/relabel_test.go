@@ -0,0 +1,249 @@
+package promclient
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/relabel"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+)
+
+func TestRelabelAPI(t *testing.T) {
+	rec := &queryRecorder{stubAPI: stubAPI{
+		series: func() []model.LabelSet {
+			return []model.LabelSet{
+				{model.MetricNameLabel: "up", "job": "a", "prometheus_replica": "r1"},
+				{model.MetricNameLabel: "up", "job": "a", "prometheus_replica": "r2"},
+				{model.MetricNameLabel: "up", "job": "noisy"},
+			}
+		},
+		getValue: func() model.Value {
+			return model.Matrix{
+				{
+					Metric: model.Metric{model.MetricNameLabel: "up", "job": "a", "prometheus_replica": "r1"},
+					Values: []model.SamplePair{{Timestamp: 1000, Value: 1}, {Timestamp: 3000, Value: 1}},
+				},
+				{
+					Metric: model.Metric{model.MetricNameLabel: "up", "job": "a", "prometheus_replica": "r2"},
+					Values: []model.SamplePair{{Timestamp: 2000, Value: 1}},
+				},
+				{
+					Metric: model.Metric{model.MetricNameLabel: "up", "job": "noisy"},
+					Values: []model.SamplePair{{Timestamp: 1000, Value: 1}},
+				},
+			}
+		},
+	}}
+	r, err := NewRelabelAPI(rec, []*relabel.Config{
+		{Action: relabel.LabelDrop, Regex: relabel.MustNewRegexp("prometheus_replica")},
+		{Action: relabel.Drop, SourceLabels: model.LabelNames{"job"}, Separator: ";", Regex: relabel.MustNewRegexp("noisy")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.TODO()
+
+	nameMatcher, _ := labels.NewMatcher(labels.MatchEqual, model.MetricNameLabel, "up")
+	replicaMatcher, _ := labels.NewMatcher(labels.MatchEqual, "prometheus_replica", "r1")
+	wantMetric := model.Metric{model.MetricNameLabel: "up", "job": "a"}
+
+	t.Run("getvalue", func(t *testing.T) {
+		v, _, err := r.GetValue(ctx, time.Time{}, time.Time{}, []*labels.Matcher{nameMatcher})
+		if err != nil {
+			t.Fatal(err)
+		}
+		matrix := v.(model.Matrix)
+		if len(matrix) != 1 || !reflect.DeepEqual(matrix[0].Metric, wantMetric) {
+			t.Fatalf("unexpected result %v", matrix)
+		}
+		// The series of both replicas are merged
+		if len(matrix[0].Values) != 3 {
+			t.Fatalf("unexpected values %v", matrix[0].Values)
+		}
+
+		// Matchers on dropped labels aren't sent downstream and match the relabeled series
+		v, _, err = r.GetValue(ctx, time.Time{}, time.Time{}, []*labels.Matcher{nameMatcher, replicaMatcher})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rec.matchers) != 1 || rec.matchers[0] != nameMatcher {
+			t.Fatalf("unexpected matchers sent %v", rec.matchers)
+		}
+		if len(v.(model.Matrix)) != 0 {
+			t.Fatalf("unexpected result %v", v)
+		}
+	})
+
+	t.Run("series", func(t *testing.T) {
+		v, _, err := r.Series(ctx, []string{`{prometheus_replica="r1"}`}, time.Time{}, time.Time{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []string{`{__name__=~".+"}`}; !reflect.DeepEqual(rec.matches, want) {
+			t.Fatalf("unexpected matches sent %v", rec.matches)
+		}
+		if len(v) != 0 {
+			t.Fatalf("unexpected result %v", v)
+		}
+
+		v, _, err = r.Series(ctx, []string{`up`}, time.Time{}, time.Time{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(v) != 1 || !v[0].Equal(model.LabelSet(wantMetric)) {
+			t.Fatalf("unexpected result %v", v)
+		}
+	})
+
+	t.Run("labels", func(t *testing.T) {
+		names, _, err := r.LabelNames(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []string{model.MetricNameLabel, "job"}; !reflect.DeepEqual(names, want) {
+			t.Fatalf("unexpected label names %v", names)
+		}
+
+		values, _, err := r.LabelValues(ctx, "job")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := (model.LabelValues{"a"}); !reflect.DeepEqual(values, want) {
+			t.Fatalf("unexpected label values %v", values)
+		}
+	})
+
+	t.Run("query", func(t *testing.T) {
+		v, _, err := r.Query(ctx, `count(up)`, timestamp.Time(3000))
+		if err != nil {
+			t.Fatal(err)
+		}
+		vector := v.(model.Vector)
+		if len(vector) != 1 || vector[0].Value != 1 {
+			t.Fatalf("unexpected result %v", v)
+		}
+	})
+}
+
+func TestRelabelTargets(t *testing.T) {
+	tests := []struct {
+		cfg     relabel.Config
+		targets []string
+		err     bool
+	}{
+		{
+			cfg:     relabel.Config{Action: relabel.Replace, Regex: relabel.MustNewRegexp("(.*)"), TargetLabel: "job"},
+			targets: []string{"job"},
+		},
+		{
+			cfg:     relabel.Config{Action: relabel.HashMod, TargetLabel: "shard$1"},
+			targets: []string{"shard$1"},
+		},
+		{
+			cfg:     relabel.Config{Action: relabel.Replace, Regex: relabel.MustNewRegexp("(a|b)_(.*)"), TargetLabel: "${1}_name"},
+			targets: []string{"_name", "a_name", "b_name"},
+		},
+		{
+			cfg:     relabel.Config{Action: relabel.Replace, Regex: relabel.MustNewRegexp("(?P<env>prod|dev)-[0-9]?"), TargetLabel: "${env}"},
+			targets: []string{"", "dev", "prod"},
+		},
+		{
+			cfg:     relabel.Config{Action: relabel.LabelMap, Regex: relabel.MustNewRegexp("__meta_(zone|region)"), Replacement: "$1"},
+			targets: []string{"", "region", "zone"},
+		},
+		{
+			cfg:     relabel.Config{Action: relabel.LabelMap, Regex: relabel.MustNewRegexp("x[ab]{1,2}"), Replacement: "$0"},
+			targets: []string{"", "xa", "xaa", "xab", "xb", "xba", "xbb"},
+		},
+		{
+			cfg: relabel.Config{Action: relabel.LabelMap, Regex: relabel.MustNewRegexp("__meta_(.+)"), Replacement: "$1"},
+			err: true,
+		},
+		{
+			cfg: relabel.Config{Action: relabel.Replace, Regex: relabel.MustNewRegexp("([a-z]{1,5})"), TargetLabel: "$1"},
+			err: true,
+		},
+		{
+			cfg:     relabel.Config{Action: relabel.LabelDrop, Regex: relabel.MustNewRegexp(".*")},
+			targets: []string{},
+		},
+	}
+
+	for i, test := range tests {
+		cfg := test.cfg
+		targets, err := RelabelTargets([]*relabel.Config{&cfg})
+		if test.err != (err != nil) {
+			t.Fatalf("%d: unexpected error %v", i, err)
+		}
+		if err == nil && !reflect.DeepEqual(targets, test.targets) {
+			t.Fatalf("%d: unexpected targets %q", i, targets)
+		}
+	}
+}
+
+func TestRelabelAPIPassThrough(t *testing.T) {
+	r, err := NewRelabelAPI(&queryRecorder{}, []*relabel.Config{
+		{Action: relabel.LabelDrop, Regex: relabel.MustNewRegexp("prometheus_replica")},
+		{Action: relabel.Replace, SourceLabels: model.LabelNames{"job"}, Separator: ";", Regex: relabel.MustNewRegexp("(.*)-.*"), TargetLabel: "team", Replacement: "$1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query string
+		local bool
+	}{
+		// The result has no (or only unaffected) labels
+		{`sum(up)`, false},
+		{`sum by (job) (rate(up{job="a"}[5m]))`, false},
+		{`count_values("value", up)`, false},
+		{`sum(up) / sum(up offset 1h)`, false},
+		{`vector(1)`, false},
+		{`scalar(sum(up))`, false},
+		// Matchers on affected labels
+		{`sum(up{team="a"})`, true},
+		{`sum(rate(up{prometheus_replica="r1"}[5m]))`, true},
+		// The result has affected labels
+		{`up`, true},
+		{`sum by (team) (up)`, true},
+		{`sum without (instance) (up)`, true},
+		{`topk(1, sum by (job) (up))`, false},
+		{`sum by (job) (up) * on (job) group_left up`, true},
+		{`label_replace(sum(up), "job", "a", "", "")`, true},
+	}
+	for _, test := range tests {
+		local, err := r.evalLocally(context.TODO(), test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if local != test.local {
+			t.Fatalf("%s: expected local=%v", test.query, test.local)
+		}
+	}
+
+	// Queries which aren't evaluated locally are sent downstream as-is
+	rec := &queryRecorder{stubAPI: stubAPI{query: func() model.Value { return model.Vector{} }}}
+	r.API = rec
+	if _, _, err := r.Query(context.TODO(), `sum(up)`, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if rec.query != `sum(up)` {
+		t.Fatalf("query wasn't sent downstream: %q", rec.query)
+	}
+
+	// Keep/drop actions always require local evaluation
+	r, err = NewRelabelAPI(rec, []*relabel.Config{
+		{Action: relabel.Drop, SourceLabels: model.LabelNames{"job"}, Separator: ";", Regex: relabel.MustNewRegexp("noisy")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if local, _ := r.evalLocally(context.TODO(), `sum(up)`); !local {
+		t.Fatalf("expected local evaluation with a drop action")
+	}
+}
@@ -0,0 +1,267 @@
+package promclient
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/api"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql"
+
+	"github.com/jacksontj/promxy/pkg/promhttputil"
+)
+
+// NewRewriteAPI returns a RewriteAPI which maps the metric and label names of
+// queries using `metricNames` and `labelNames` (query name -> downstream name)
+func NewRewriteAPI(a API, metricNames, labelNames map[string]string) *RewriteAPI {
+	reverse := func(m map[string]string) map[string]string {
+		ret := make(map[string]string, len(m))
+		for k, v := range m {
+			ret[v] = k
+		}
+		return ret
+	}
+	return &RewriteAPI{
+		API:                a,
+		metricNames:        metricNames,
+		labelNames:         labelNames,
+		reverseMetricNames: reverse(metricNames),
+		reverseLabelNames:  reverse(labelNames),
+	}
+}
+
+// RewriteAPI maps between the (uniform) metric and label names promxy is queried
+// with and the names a downstream uses. The selectors (and grouping labels) of
+// outgoing queries are rewritten to the downstream's names and the returned series
+// are rewritten back.
+// Note: only equality matchers on the metric name are rewritten, and label names in
+// the arguments of functions (e.g. label_replace) are left as-is
+type RewriteAPI struct {
+	API
+	metricNames, reverseMetricNames map[string]string
+	labelNames, reverseLabelNames   map[string]string
+}
+
+// LabelNames returns all the unique label names present in the block in sorted order.
+func (r *RewriteAPI) LabelNames(ctx context.Context) ([]string, api.Warnings, error) {
+	names, w, err := r.API.LabelNames(ctx)
+	if err != nil {
+		return nil, w, err
+	}
+	set := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		if uniform, ok := r.reverseLabelNames[name]; ok {
+			name = uniform
+		}
+		set[name] = struct{}{}
+	}
+	ret := make([]string, 0, len(set))
+	for name := range set {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return ret, w, nil
+}
+
+// LabelValues performs a query for the values of the given label.
+func (r *RewriteAPI) LabelValues(ctx context.Context, label string) (model.LabelValues, api.Warnings, error) {
+	downstreamLabel := label
+	if name, ok := r.labelNames[label]; ok {
+		downstreamLabel = name
+	}
+	values, w, err := r.API.LabelValues(ctx, downstreamLabel)
+	if err != nil || label != model.MetricNameLabel || len(r.reverseMetricNames) == 0 {
+		return values, w, err
+	}
+
+	ret := make(model.LabelValues, len(values))
+	for i, v := range values {
+		if uniform, ok := r.reverseMetricNames[string(v)]; ok {
+			v = model.LabelValue(uniform)
+		}
+		ret[i] = v
+	}
+	sort.Sort(ret)
+	return ret, w, nil
+}
+
+// Query performs a query for the given time.
+func (r *RewriteAPI) Query(ctx context.Context, query string, ts time.Time) (model.Value, api.Warnings, error) {
+	query, err := r.rewriteQuery(ctx, query)
+	if err != nil {
+		return nil, nil, err
+	}
+	val, w, err := r.API.Query(ctx, query, ts)
+	if err != nil {
+		return nil, w, err
+	}
+	r.rewriteValue(val)
+	return val, w, nil
+}
+
+// QueryRange performs a query for the given range.
+func (r *RewriteAPI) QueryRange(ctx context.Context, query string, rng v1.Range) (model.Value, api.Warnings, error) {
+	query, err := r.rewriteQuery(ctx, query)
+	if err != nil {
+		return nil, nil, err
+	}
+	val, w, err := r.API.QueryRange(ctx, query, rng)
+	if err != nil {
+		return nil, w, err
+	}
+	r.rewriteValue(val)
+	return val, w, nil
+}
+
+// Series finds series by label matchers.
+func (r *RewriteAPI) Series(ctx context.Context, matches []string, startTime time.Time, endTime time.Time) ([]model.LabelSet, api.Warnings, error) {
+	rewrittenMatches := make([]string, len(matches))
+	for i, match := range matches {
+		matchers, err := promql.ParseMetricSelector(match)
+		if err != nil {
+			return nil, nil, err
+		}
+		if rewrittenMatches[i], err = promhttputil.MatcherToString(r.rewriteMatchers(matchers)); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	v, w, err := r.API.Series(ctx, rewrittenMatches, startTime, endTime)
+	if err != nil {
+		return nil, w, err
+	}
+	for _, lset := range v {
+		r.rewriteMetric(model.Metric(lset))
+	}
+	return v, w, nil
+}
+
+// GetValue loads the raw data for a given set of matchers in the time range
+func (r *RewriteAPI) GetValue(ctx context.Context, start, end time.Time, matchers []*labels.Matcher) (model.Value, api.Warnings, error) {
+	val, w, err := r.API.GetValue(ctx, start, end, r.rewriteMatchers(matchers))
+	if err != nil {
+		return nil, w, err
+	}
+	r.rewriteValue(val)
+	return val, w, nil
+}
+
+// rewriteQuery rewrites `query` to the downstream's names
+func (r *RewriteAPI) rewriteQuery(ctx context.Context, query string) (string, error) {
+	e, err := promql.ParseExpr(query)
+	if err != nil {
+		return "", err
+	}
+	if _, err := promql.Walk(ctx, &rewriteVisitor{r}, &promql.EvalStmt{Expr: e}, e, nil, nil); err != nil {
+		return "", err
+	}
+	return e.String(), nil
+}
+
+// rewriteMatchers returns `matchers` rewritten to the downstream's names. The
+// matchers passed in aren't modified as they may be shared
+func (r *RewriteAPI) rewriteMatchers(matchers []*labels.Matcher) []*labels.Matcher {
+	ret := make([]*labels.Matcher, len(matchers))
+	for i, m := range matchers {
+		name, value := m.Name, m.Value
+		if downstream, ok := r.labelNames[name]; ok {
+			name = downstream
+		}
+		if name == model.MetricNameLabel && (m.Type == labels.MatchEqual || m.Type == labels.MatchNotEqual) {
+			if downstream, ok := r.metricNames[value]; ok {
+				value = downstream
+			}
+		}
+		if name == m.Name && value == m.Value {
+			ret[i] = m
+			continue
+		}
+		// The type and value are unchanged so this can't fail
+		ret[i], _ = labels.NewMatcher(m.Type, name, value)
+	}
+	return ret
+}
+
+// rewriteLabelNames rewrites the label names of grouping/matching clauses
+func (r *RewriteAPI) rewriteLabelNames(names []string) []string {
+	ret := make([]string, len(names))
+	for i, name := range names {
+		if downstream, ok := r.labelNames[name]; ok {
+			name = downstream
+		}
+		ret[i] = name
+	}
+	return ret
+}
+
+// rewriteMetric rewrites `m` (in place) from the downstream's names
+func (r *RewriteAPI) rewriteMetric(m model.Metric) {
+	// All renamed labels are removed before any are added back, as the mapping
+	// may swap names
+	renamed := make(model.Metric)
+	for downstream, uniform := range r.reverseLabelNames {
+		if v, ok := m[model.LabelName(downstream)]; ok {
+			delete(m, model.LabelName(downstream))
+			renamed[model.LabelName(uniform)] = v
+		}
+	}
+	for k, v := range renamed {
+		m[k] = v
+	}
+	if name, ok := m[model.MetricNameLabel]; ok {
+		if uniform, ok := r.reverseMetricNames[string(name)]; ok {
+			m[model.MetricNameLabel] = model.LabelValue(uniform)
+		}
+	}
+}
+
+// rewriteValue rewrites the series of `val` (in place) from the downstream's names
+func (r *RewriteAPI) rewriteValue(val model.Value) {
+	switch valTyped := val.(type) {
+	case model.Vector:
+		for _, s := range valTyped {
+			r.rewriteMetric(s.Metric)
+		}
+	case model.Matrix:
+		for _, s := range valTyped {
+			r.rewriteMetric(s.Metric)
+		}
+	case promhttputil.CompactMatrix:
+		for _, s := range valTyped {
+			r.rewriteMetric(s.Metric)
+		}
+	}
+}
+
+// rewriteVisitor implements the promql.Visitor interface to rewrite a query to
+// the names of a RewriteAPI's downstream
+type rewriteVisitor struct {
+	r *RewriteAPI
+}
+
+// Visit rewrites the selectors and grouping/matching labels of `node`
+func (v *rewriteVisitor) Visit(node promql.Node, path []promql.Node) (promql.Visitor, error) {
+	switch nodeTyped := node.(type) {
+	case *promql.VectorSelector:
+		nodeTyped.LabelMatchers = v.r.rewriteMatchers(nodeTyped.LabelMatchers)
+		if downstream, ok := v.r.metricNames[nodeTyped.Name]; ok {
+			nodeTyped.Name = downstream
+		}
+	case *promql.MatrixSelector:
+		nodeTyped.LabelMatchers = v.r.rewriteMatchers(nodeTyped.LabelMatchers)
+		if downstream, ok := v.r.metricNames[nodeTyped.Name]; ok {
+			nodeTyped.Name = downstream
+		}
+	case *promql.AggregateExpr:
+		nodeTyped.Grouping = v.r.rewriteLabelNames(nodeTyped.Grouping)
+	case *promql.BinaryExpr:
+		if nodeTyped.VectorMatching != nil {
+			nodeTyped.VectorMatching.MatchingLabels = v.r.rewriteLabelNames(nodeTyped.VectorMatching.MatchingLabels)
+			nodeTyped.VectorMatching.Include = v.r.rewriteLabelNames(nodeTyped.VectorMatching.Include)
+		}
+	}
+	return v, nil
+}
@@ -0,0 +1,160 @@
+package promclient
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/api"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+// queryRecorder is a stubAPI which records the queries and matchers it is called with
+type queryRecorder struct {
+	stubAPI
+	query    string
+	matches  []string
+	matchers []*labels.Matcher
+	label    string
+}
+
+func (q *queryRecorder) LabelValues(ctx context.Context, label string) (model.LabelValues, api.Warnings, error) {
+	q.label = label
+	return q.stubAPI.LabelValues(ctx, label)
+}
+
+func (q *queryRecorder) Query(ctx context.Context, query string, ts time.Time) (model.Value, api.Warnings, error) {
+	q.query = query
+	return q.stubAPI.Query(ctx, query, ts)
+}
+
+func (q *queryRecorder) QueryRange(ctx context.Context, query string, r v1.Range) (model.Value, api.Warnings, error) {
+	q.query = query
+	return q.stubAPI.QueryRange(ctx, query, r)
+}
+
+func (q *queryRecorder) Series(ctx context.Context, matches []string, startTime time.Time, endTime time.Time) ([]model.LabelSet, api.Warnings, error) {
+	q.matches = matches
+	return q.stubAPI.Series(ctx, matches, startTime, endTime)
+}
+
+func (q *queryRecorder) GetValue(ctx context.Context, start, end time.Time, matchers []*labels.Matcher) (model.Value, api.Warnings, error) {
+	q.matchers = matchers
+	return q.stubAPI.GetValue(ctx, start, end, matchers)
+}
+
+func TestRewriteAPI(t *testing.T) {
+	downstreamVector := func() model.Value {
+		return model.Vector{
+			&model.Sample{Metric: model.Metric{model.MetricNameLabel: "legacy_requests", "host": "a", "job": "j"}},
+		}
+	}
+	rec := &queryRecorder{stubAPI: stubAPI{
+		labelNames: func() []string { return []string{"host", "instance", "job"} },
+		labelValues: func() model.LabelValues {
+			return model.LabelValues{"legacy_requests", "up"}
+		},
+		query:      downstreamVector,
+		queryRange: downstreamVector,
+		series: func() []model.LabelSet {
+			return []model.LabelSet{{model.MetricNameLabel: "legacy_requests", "host": "a"}}
+		},
+		getValue: downstreamVector,
+	}}
+	r := NewRewriteAPI(rec, map[string]string{"http_requests_total": "legacy_requests"}, map[string]string{"instance": "host"})
+	ctx := context.TODO()
+
+	wantMetric := model.Metric{model.MetricNameLabel: "http_requests_total", "instance": "a", "job": "j"}
+
+	t.Run("query", func(t *testing.T) {
+		v, _, err := r.Query(ctx, `sum by (instance) (rate(http_requests_total{instance="a"}[5m])) / on(instance) up`, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := `sum by(host) (rate(legacy_requests{host="a"}[5m])) / on(host) up`; rec.query != want {
+			t.Fatalf("unexpected query sent\nexpected: %s\nactual:   %s", want, rec.query)
+		}
+		if m := v.(model.Vector)[0].Metric; !reflect.DeepEqual(m, wantMetric) {
+			t.Fatalf("unexpected result metric %v", m)
+		}
+	})
+
+	t.Run("query_range", func(t *testing.T) {
+		if _, _, err := r.QueryRange(ctx, `{__name__="http_requests_total",job="j"}`, v1.Range{Step: time.Minute}); err != nil {
+			t.Fatal(err)
+		}
+		if want := `{__name__="legacy_requests",job="j"}`; rec.query != want {
+			t.Fatalf("unexpected query sent\nexpected: %s\nactual:   %s", want, rec.query)
+		}
+	})
+
+	t.Run("series", func(t *testing.T) {
+		v, _, err := r.Series(ctx, []string{`http_requests_total{instance="a"}`}, time.Time{}, time.Time{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []string{`{host="a",__name__="legacy_requests"}`}; !reflect.DeepEqual(rec.matches, want) {
+			t.Fatalf("unexpected matches sent %v", rec.matches)
+		}
+		if want := (model.LabelSet{model.MetricNameLabel: "http_requests_total", "instance": "a"}); !v[0].Equal(want) {
+			t.Fatalf("unexpected result %v", v[0])
+		}
+	})
+
+	t.Run("getvalue", func(t *testing.T) {
+		nameMatcher, _ := labels.NewMatcher(labels.MatchEqual, model.MetricNameLabel, "http_requests_total")
+		instanceMatcher, _ := labels.NewMatcher(labels.MatchRegexp, "instance", "a|b")
+		matchers := []*labels.Matcher{nameMatcher, instanceMatcher}
+		v, _, err := r.GetValue(ctx, time.Time{}, time.Time{}, matchers)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rec.matchers[0].Value != "legacy_requests" || rec.matchers[1].Name != "host" || rec.matchers[1].Value != "a|b" {
+			t.Fatalf("unexpected matchers sent %v", rec.matchers)
+		}
+		// The caller's matchers must not be modified
+		if nameMatcher.Value != "http_requests_total" || instanceMatcher.Name != "instance" {
+			t.Fatalf("matchers were modified")
+		}
+		if m := v.(model.Vector)[0].Metric; !reflect.DeepEqual(m, wantMetric) {
+			t.Fatalf("unexpected result metric %v", m)
+		}
+	})
+
+	t.Run("labels", func(t *testing.T) {
+		names, _, err := r.LabelNames(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []string{"instance", "job"}; !reflect.DeepEqual(names, want) {
+			t.Fatalf("unexpected label names %v", names)
+		}
+
+		values, _, err := r.LabelValues(ctx, model.MetricNameLabel)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := (model.LabelValues{"http_requests_total", "up"}); !reflect.DeepEqual(values, want) {
+			t.Fatalf("unexpected label values %v", values)
+		}
+
+		if _, _, err := r.LabelValues(ctx, "instance"); err != nil {
+			t.Fatal(err)
+		}
+		if rec.label != "host" {
+			t.Fatalf("unexpected label sent %s", rec.label)
+		}
+	})
+}
+
+func TestRewriteAPISwap(t *testing.T) {
+	r := NewRewriteAPI(&stubAPI{}, nil, map[string]string{"a": "b", "b": "a"})
+	m := model.Metric{"a": "1", "b": "2"}
+	r.rewriteMetric(m)
+	if want := (model.Metric{"a": "2", "b": "1"}); !reflect.DeepEqual(m, want) {
+		t.Fatalf("unexpected metric %v", m)
+	}
+}
@@ -0,0 +1,180 @@
+package promclient
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/api"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+
+	"github.com/jacksontj/promxy/pkg/promhttputil"
+	"github.com/jacksontj/promxy/pkg/querybudget"
+)
+
+const (
+	epQuery      = "/api/v1/query"
+	epQueryRange = "/api/v1/query_range"
+)
+
+// StreamingAPI implements Query, QueryRange and GetValue against the v1 HTTP API
+// by decoding the responses as they are read (see promhttputil.DecodeQueryResponse)
+// instead of reading the whole body into memory and then unmarshaling it.
+// Matrix results are returned as a promhttputil.CompactMatrix (except from Query).
+// All other calls are passed through to the wrapped API
+type StreamingAPI struct {
+	API
+	// Client is used to build the URLs of the requests
+	Client api.Client
+	// HTTPClient is used to do the requests
+	HTTPClient *http.Client
+	// SampleLimit is the max number of samples in a single response (0 is unlimited)
+	SampleLimit int
+}
+
+// Query performs a query for the given time.
+func (s *StreamingAPI) Query(ctx context.Context, query string, ts time.Time) (model.Value, api.Warnings, error) {
+	args := url.Values{}
+	args.Set("query", query)
+	if !ts.IsZero() {
+		args.Set("time", formatTime(ts))
+	}
+	v, w, err := s.do(ctx, epQuery, args)
+	if err != nil {
+		return nil, w, err
+	}
+	// Callers of Query expect a model.Matrix
+	if compact, ok := v.(promhttputil.CompactMatrix); ok {
+		v = compact.Matrix()
+	}
+	return v, w, nil
+}
+
+// QueryRange performs a query for the given range.
+func (s *StreamingAPI) QueryRange(ctx context.Context, query string, r v1.Range) (model.Value, api.Warnings, error) {
+	args := url.Values{}
+	args.Set("query", query)
+	args.Set("start", formatTime(r.Start))
+	args.Set("end", formatTime(r.End))
+	args.Set("step", strconv.FormatFloat(r.Step.Seconds(), 'f', -1, 64))
+	return s.do(ctx, epQueryRange, args)
+}
+
+// GetValue loads the raw data for a given set of matchers in the time range
+func (s *StreamingAPI) GetValue(ctx context.Context, start, end time.Time, matchers []*labels.Matcher) (model.Value, api.Warnings, error) {
+	query, err := getValueQuery(start, end, matchers)
+	if err != nil {
+		return nil, nil, err
+	}
+	args := url.Values{}
+	args.Set("query", query)
+	args.Set("time", formatTime(end))
+	return s.do(ctx, epQuery, args)
+}
+
+// do sends the request to `ep` (as a POST, falling back to a GET on a 405 the same
+// as the prometheus client) and decodes the response. Errors are returned as a
+// *v1.Error the same as the prometheus client so that NormalizePromError works
+func (s *StreamingAPI) do(ctx context.Context, ep string, args url.Values) (model.Value, api.Warnings, error) {
+	u := s.Client.URL(ep, nil)
+	q := u.Query()
+	for k, v := range args {
+		q[k] = v
+	}
+
+	req, err := http.NewRequest(http.MethodPost, u.String(), strings.NewReader(q.Encode()))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := s.HTTPClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode == http.StatusMethodNotAllowed {
+		resp.Body.Close()
+		u.RawQuery = q.Encode()
+		req, err = http.NewRequest(http.MethodGet, u.String(), nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		if resp, err = s.HTTPClient.Do(req.WithContext(ctx)); err != nil {
+			return nil, nil, err
+		}
+	}
+	defer resp.Body.Close()
+
+	// Account the response against the query's budget as it is read
+	var body io.Reader = resp.Body
+	budget := querybudget.FromContext(ctx)
+	if budget != nil {
+		body = &budgetReader{r: resp.Body, b: budget}
+	}
+
+	code := resp.StatusCode
+	if code/100 != 2 && !apiError(code) {
+		body, _ := ioutil.ReadAll(body)
+		errorType, errorMsg := v1.ErrServer, fmt.Sprintf("server error: %d", code)
+		if code/100 == 4 {
+			errorType, errorMsg = v1.ErrClient, fmt.Sprintf("client error: %d", code)
+		}
+		return nil, nil, &v1.Error{Type: errorType, Msg: errorMsg, Detail: string(body)}
+	}
+
+	result, err := promhttputil.DecodeQueryResponse(body, s.SampleLimit)
+	if err != nil {
+		if budgetErr := budget.Err(); budgetErr != nil {
+			return nil, nil, budgetErr
+		}
+		if _, ok := err.(*promhttputil.SampleLimitError); ok {
+			return nil, nil, err
+		}
+		return nil, nil, &v1.Error{Type: v1.ErrBadResponse, Msg: err.Error()}
+	}
+	w := api.Warnings(result.Warnings)
+
+	if apiError(code) != (result.Status == promhttputil.StatusError) {
+		return nil, w, &v1.Error{Type: v1.ErrBadResponse, Msg: "inconsistent body for response code"}
+	}
+	if result.Status == promhttputil.StatusError {
+		return nil, w, &v1.Error{Type: v1.ErrorType(result.ErrorType), Msg: result.Error}
+	}
+	if err := budget.AddSamples(promhttputil.SampleCount(result.Value)); err != nil {
+		return nil, w, err
+	}
+	return result.Value, w, nil
+}
+
+// budgetReader adds all bytes read to the query's budget, failing the read once
+// the budget is exceeded
+type budgetReader struct {
+	r io.Reader
+	b *querybudget.Budget
+}
+
+func (r *budgetReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if budgetErr := r.b.AddBytes(n); budgetErr != nil {
+			return n, budgetErr
+		}
+	}
+	return n, err
+}
+
+// apiError returns whether the status code is one the prometheus API uses for errors
+func apiError(code int) bool {
+	return code == http.StatusUnprocessableEntity || code == http.StatusBadRequest
+}
+
+func formatTime(t time.Time) string {
+	return strconv.FormatFloat(float64(t.Unix())+float64(t.Nanosecond())/1e9, 'f', -1, 64)
+}
@@ -0,0 +1,135 @@
+package promclient
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/api"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/prometheus/promql"
+
+	"github.com/jacksontj/promxy/pkg/promhttputil"
+	"github.com/jacksontj/promxy/pkg/querybudget"
+)
+
+func TestStreamingAPI(t *testing.T) {
+	const matrixBody = `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"__name__":"up"},"values":[[1,"1"],[2,"1"]]}]}}`
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		limit   int
+		limits  *querybudget.Limits
+		check   func(t *testing.T, err error)
+	}{
+		{
+			name: "success",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				if r.FormValue("query") != "up" || r.FormValue("nocache") != "1" {
+					t.Errorf("unexpected request %v", r.Form)
+				}
+				w.Write([]byte(matrixBody))
+			},
+		},
+		// Like the prometheus client, a 405 to the POST falls back to a GET
+		{
+			name: "get fallback",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodGet {
+					w.WriteHeader(http.StatusMethodNotAllowed)
+					return
+				}
+				w.Write([]byte(matrixBody))
+			},
+		},
+		// Error bodies are kept in the error so that NormalizePromError works
+		{
+			name: "timeout",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				w.Write([]byte(`{"status":"error","errorType":"timeout","error":"query timed out in expression evaluation"}`))
+			},
+			check: func(t *testing.T, err error) {
+				if _, ok := NormalizePromError(err).(promql.ErrQueryTimeout); !ok {
+					t.Fatalf("expected a timeout, got %v", err)
+				}
+			},
+		},
+		{
+			name: "bad_data",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"status":"error","errorType":"bad_data","error":"parse error"}`))
+			},
+			check: func(t *testing.T, err error) {
+				if typedErr, ok := err.(*v1.Error); !ok || typedErr.Type != v1.ErrBadData {
+					t.Fatalf("expected a bad_data error, got %v", err)
+				}
+			},
+		},
+		{
+			name: "sample limit",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(matrixBody))
+			},
+			limit: 1,
+			check: func(t *testing.T, err error) {
+				if _, ok := err.(*promhttputil.SampleLimitError); !ok {
+					t.Fatalf("expected a SampleLimitError, got %v", err)
+				}
+			},
+		},
+		// The response counts towards the query's budget as it is read
+		{
+			name: "query budget",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(matrixBody))
+			},
+			limits: &querybudget.Limits{MaxBytes: 10},
+			check: func(t *testing.T, err error) {
+				if _, ok := err.(*querybudget.ExceededError); !ok {
+					t.Fatalf("expected an ExceededError, got %v", err)
+				}
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			srv := httptest.NewServer(test.handler)
+			defer srv.Close()
+
+			client, err := api.NewClient(api.Config{Address: srv.URL})
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := &StreamingAPI{
+				Client:      NewClientArgsWrap(client, map[string]string{"nocache": "1"}),
+				HTTPClient:  http.DefaultClient,
+				SampleLimit: test.limit,
+			}
+
+			ctx := context.TODO()
+			if test.limits != nil {
+				var budget *querybudget.Budget
+				ctx, budget = querybudget.NewContext(ctx, *test.limits)
+				defer budget.Release()
+			}
+
+			v, _, err := s.QueryRange(ctx, "up", v1.Range{Start: time.Unix(1, 0), End: time.Unix(2, 0), Step: time.Second})
+			if test.check != nil {
+				test.check(t, err)
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if n := promhttputil.SampleCount(v); n != 2 {
+				t.Fatalf("expected 2 samples, got %d", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,292 @@
+package promclient
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/api"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+
+	"github.com/jacksontj/promxy/pkg/promhttputil"
+)
+
+// Tier is a single tier of a TieredAPI
+type Tier struct {
+	API
+	// TimeRange returns the time range (at `now`) this tier has data for, a zero
+	// start or end means the range is unbounded on that side
+	TimeRange func(now time.Time) (start, end time.Time)
+	// Resolution is the resolution of the data of the tier (0 for raw data)
+	Resolution time.Duration
+}
+
+// NewTieredAPI returns a TieredAPI for `tiers`
+func NewTieredAPI(tiers []Tier) *TieredAPI {
+	apis := make([]API, len(tiers))
+	for i, tier := range tiers {
+		apis[i] = tier.API
+	}
+	return &TieredAPI{
+		tiers: tiers,
+		multi: NewMultiAPI(apis, 0, nil, 1),
+	}
+}
+
+// TieredAPI stitches together tiers which have the same series for different time
+// ranges and/or resolutions (e.g. a short-term prometheus and downsampled long-term
+// stores). Each part of a query's time range is assigned to a single authoritative
+// tier (see ranges), queries are cut at the tier boundaries, each sub-range is only
+// sent to the tier authoritative for it and the results are concatenated (instead
+// of merging the overlapping data of all tiers)
+type TieredAPI struct {
+	tiers []Tier
+	// metadata calls (which aren't time-based) go to all tiers
+	multi *MultiAPI
+}
+
+// tierRange is the time range [start, end] (in ms) a tier is authoritative for
+type tierRange struct {
+	api        API
+	start, end int64
+}
+
+// ranges returns the ranges within [start, end] (in ms) each tier is authoritative
+// for, in time order. For a query with a `step` the coarsest tiers whose resolution
+// still satisfies the step have priority, finer tiers fill in what they don't cover
+// (tiers with a resolution coarser than the step are only used as a last resort).
+// Without a step the finest tiers have priority. Between tiers of the same
+// resolution the one with the most recent start wins
+func (t *TieredAPI) ranges(start, end int64, step time.Duration) []tierRange {
+	now := time.Now()
+	windows := make([]tierRange, len(t.tiers))
+	for i, tier := range t.tiers {
+		tierStart, tierEnd := tier.TimeRange(now)
+		windows[i] = tierRange{api: tier.API, start: math.MinInt64, end: math.MaxInt64}
+		if !tierStart.IsZero() {
+			windows[i].start = timestamp.FromTime(tierStart)
+		}
+		if !tierEnd.IsZero() {
+			windows[i].end = timestamp.FromTime(tierEnd)
+		}
+	}
+
+	order := make([]int, len(t.tiers))
+	for i := range order {
+		order[i] = i
+	}
+	eligible := func(i int) bool { return step > 0 && t.tiers[i].Resolution <= step }
+	sort.SliceStable(order, func(i, j int) bool {
+		a, b := t.tiers[order[i]], t.tiers[order[j]]
+		if eligibleA, eligibleB := eligible(order[i]), eligible(order[j]); eligibleA != eligibleB {
+			return eligibleA
+		}
+		if a.Resolution != b.Resolution {
+			// Eligible tiers are ordered coarsest first, all others finest first
+			return (a.Resolution > b.Resolution) == eligible(order[i])
+		}
+		return windows[order[i]].start > windows[order[j]].start
+	})
+
+	// Assign each tier (in order) the parts of the range not covered yet
+	uncovered := []tierRange{{start: start, end: end}}
+	var ret []tierRange
+	for _, i := range order {
+		w := windows[i]
+		remaining := make([]tierRange, 0, len(uncovered))
+		for _, u := range uncovered {
+			s, e := u.start, u.end
+			if w.start > s {
+				s = w.start
+			}
+			if w.end < e {
+				e = w.end
+			}
+			if s > e {
+				remaining = append(remaining, u)
+				continue
+			}
+			ret = append(ret, tierRange{api: w.api, start: s, end: e})
+			if u.start < s {
+				remaining = append(remaining, tierRange{start: u.start, end: s - 1})
+			}
+			if e < u.end {
+				remaining = append(remaining, tierRange{start: e + 1, end: u.end})
+			}
+		}
+		uncovered = remaining
+	}
+
+	sort.Slice(ret, func(i, j int) bool { return ret[i].start < ret[j].start })
+	return ret
+}
+
+// LabelNames returns all the unique label names present in the block in sorted order.
+func (t *TieredAPI) LabelNames(ctx context.Context) ([]string, api.Warnings, error) {
+	return t.multi.LabelNames(ctx)
+}
+
+// LabelValues performs a query for the values of the given label.
+func (t *TieredAPI) LabelValues(ctx context.Context, label string) (model.LabelValues, api.Warnings, error) {
+	return t.multi.LabelValues(ctx, label)
+}
+
+// Series finds series by label matchers.
+func (t *TieredAPI) Series(ctx context.Context, matches []string, startTime time.Time, endTime time.Time) ([]model.LabelSet, api.Warnings, error) {
+	ranges := t.ranges(timestamp.FromTime(startTime), timestamp.FromTime(endTime), 0)
+	results := make([][]model.LabelSet, len(ranges))
+	w, err := t.each(ranges, func(i int, r tierRange) (api.Warnings, error) {
+		v, w, err := r.api.Series(ctx, matches, timestamp.Time(r.start), timestamp.Time(r.end))
+		results[i] = v
+		return w, err
+	})
+	if err != nil {
+		return nil, w, err
+	}
+
+	var ret []model.LabelSet
+	for _, result := range results {
+		ret = MergeLabelSets(ret, result)
+	}
+	return ret, w, nil
+}
+
+// Query performs a query for the given time.
+func (t *TieredAPI) Query(ctx context.Context, query string, ts time.Time) (model.Value, api.Warnings, error) {
+	ms := timestamp.FromTime(ts)
+	ranges := t.ranges(ms, ms, 0)
+	if len(ranges) == 0 {
+		return nil, nil, nil
+	}
+	return ranges[0].api.Query(ctx, query, ts)
+}
+
+// QueryRange performs a query for the given range.
+func (t *TieredAPI) QueryRange(ctx context.Context, query string, r v1.Range) (model.Value, api.Warnings, error) {
+	start := timestamp.FromTime(r.Start)
+	step := int64(r.Step / time.Millisecond)
+	if step <= 0 {
+		return nil, nil, fmt.Errorf("invalid step %v", r.Step)
+	}
+
+	// Each sub-range has to start and end on one of the steps of the query
+	ranges := t.ranges(start, timestamp.FromTime(r.End), r.Step)
+	stepRanges := make([]tierRange, 0, len(ranges))
+	for _, tr := range ranges {
+		tr.start = start + (tr.start-start+step-1)/step*step
+		tr.end = start + (tr.end-start)/step*step
+		if tr.start <= tr.end {
+			stepRanges = append(stepRanges, tr)
+		}
+	}
+
+	results := make([]model.Value, len(stepRanges))
+	w, err := t.each(stepRanges, func(i int, tr tierRange) (api.Warnings, error) {
+		v, w, err := tr.api.QueryRange(ctx, query, v1.Range{
+			Start: timestamp.Time(tr.start),
+			End:   timestamp.Time(tr.end),
+			Step:  r.Step,
+		})
+		results[i] = v
+		return w, err
+	})
+	if err != nil {
+		return nil, w, err
+	}
+	v, err := concatMatrices(results)
+	return v, w, err
+}
+
+// GetValue loads the raw data for a given set of matchers in the time range
+func (t *TieredAPI) GetValue(ctx context.Context, start, end time.Time, matchers []*labels.Matcher) (model.Value, api.Warnings, error) {
+	ranges := t.ranges(timestamp.FromTime(start), timestamp.FromTime(end), 0)
+	results := make([]model.Value, len(ranges))
+	w, err := t.each(ranges, func(i int, r tierRange) (api.Warnings, error) {
+		v, w, err := r.api.GetValue(ctx, timestamp.Time(r.start), timestamp.Time(r.end), matchers)
+		results[i] = v
+		return w, err
+	})
+	if err != nil {
+		return nil, w, err
+	}
+	v, err := concatMatrices(results)
+	return v, w, err
+}
+
+// each calls `f` concurrently for all `ranges`, returning the warnings of all
+// calls and the first error
+func (t *TieredAPI) each(ranges []tierRange, f func(int, tierRange) (api.Warnings, error)) (api.Warnings, error) {
+	var (
+		wg       sync.WaitGroup
+		lock     sync.Mutex
+		firstErr error
+	)
+	warnings := make(promhttputil.WarningSet)
+	for i, r := range ranges {
+		wg.Add(1)
+		go func(i int, r tierRange) {
+			defer wg.Done()
+			w, err := f(i, r)
+			lock.Lock()
+			defer lock.Unlock()
+			warnings.AddWarnings(w)
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}(i, r)
+	}
+	wg.Wait()
+	return warnings.Warnings(), firstErr
+}
+
+// concatMatrices concatenates the series of `values` (matrices of consecutive
+// time ranges, in order)
+func concatMatrices(values []model.Value) (model.Value, error) {
+	ret := make(model.Matrix, 0)
+	index := make(map[model.Fingerprint]*model.SampleStream)
+	for _, v := range values {
+		var matrix model.Matrix
+		switch vTyped := v.(type) {
+		case nil:
+			continue
+		case model.Matrix:
+			matrix = vTyped
+		case promhttputil.CompactMatrix:
+			matrix = vTyped.Matrix()
+		case *promhttputil.MergedMatrix:
+			matrix = vTyped.Matrix()
+		default:
+			return nil, fmt.Errorf("unable to concatenate %v", v.Type())
+		}
+
+		for _, stream := range matrix {
+			fp := stream.Metric.Fingerprint()
+			existing, ok := index[fp]
+			if !ok {
+				// Results may be shared (e.g. by the CoalesceAPI), so they are copied
+				// instead of appended to
+				existing = &model.SampleStream{
+					Metric: stream.Metric,
+					Values: append(make([]model.SamplePair, 0, len(stream.Values)), stream.Values...),
+				}
+				index[fp] = existing
+				ret = append(ret, existing)
+				continue
+			}
+			// The ranges don't overlap, but make sure the points stay in order
+			for _, p := range stream.Values {
+				if n := len(existing.Values); n > 0 && p.Timestamp <= existing.Values[n-1].Timestamp {
+					continue
+				}
+				existing.Values = append(existing.Values, p)
+			}
+		}
+	}
+	return ret, nil
+}
@@ -0,0 +1,147 @@
+package promclient
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/api"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+// tierAPI returns a series with a point (with value `value`) at each step of the
+// requested range and records the requested ranges
+type tierAPI struct {
+	stubAPI
+	value  model.SampleValue
+	ranges []v1.Range
+}
+
+func (s *tierAPI) Query(ctx context.Context, query string, ts time.Time) (model.Value, api.Warnings, error) {
+	return model.Vector{{Metric: model.Metric{"a": "b"}, Value: s.value, Timestamp: model.TimeFromUnixNano(ts.UnixNano())}}, nil, nil
+}
+
+func (s *tierAPI) QueryRange(ctx context.Context, query string, r v1.Range) (model.Value, api.Warnings, error) {
+	s.ranges = append(s.ranges, r)
+	stream := &model.SampleStream{Metric: model.Metric{"a": "b"}}
+	for t := r.Start; !t.After(r.End); t = t.Add(r.Step) {
+		stream.Values = append(stream.Values, model.SamplePair{Timestamp: model.TimeFromUnixNano(t.UnixNano()), Value: s.value})
+	}
+	return model.Matrix{stream}, nil, nil
+}
+
+func (s *tierAPI) GetValue(ctx context.Context, start, end time.Time, matchers []*labels.Matcher) (model.Value, api.Warnings, error) {
+	return s.QueryRange(ctx, "", v1.Range{Start: start, End: end, Step: time.Second})
+}
+
+func fixedTimeRange(start, end time.Time) func(time.Time) (time.Time, time.Time) {
+	return func(time.Time) (time.Time, time.Time) { return start, end }
+}
+
+func TestTieredAPI(t *testing.T) {
+	// The tiers overlap in [1000, 2000], where the hot tier is authoritative
+	cold := &tierAPI{value: 1}
+	hot := &tierAPI{value: 2}
+	tiered := NewTieredAPI([]Tier{
+		{API: cold, TimeRange: fixedTimeRange(time.Time{}, time.Unix(2000, 0))},
+		{API: hot, TimeRange: fixedTimeRange(time.Unix(1000, 0), time.Time{})},
+	})
+	ctx := context.TODO()
+
+	t.Run("QueryRange", func(t *testing.T) {
+		v, _, err := tiered.QueryRange(ctx, "", v1.Range{Start: time.Unix(0, 0), End: time.Unix(3000, 0), Step: time.Minute})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The sub-ranges are aligned to the steps of the query
+		if len(cold.ranges) != 1 || !cold.ranges[0].End.Equal(time.Unix(960, 0)) {
+			t.Fatalf("unexpected cold ranges %v", cold.ranges)
+		}
+		if len(hot.ranges) != 1 || !hot.ranges[0].Start.Equal(time.Unix(1020, 0)) || !hot.ranges[0].End.Equal(time.Unix(3000, 0)) {
+			t.Fatalf("unexpected hot ranges %v", hot.ranges)
+		}
+
+		matrix := v.(model.Matrix)
+		if len(matrix) != 1 || len(matrix[0].Values) != 51 {
+			t.Fatalf("unexpected result %v", v)
+		}
+		for _, p := range matrix[0].Values {
+			expected := model.SampleValue(1)
+			if p.Timestamp >= 1000000 {
+				expected = 2
+			}
+			if p.Value != expected {
+				t.Fatalf("unexpected value at %v: %v", p.Timestamp, p.Value)
+			}
+		}
+	})
+
+	t.Run("Query", func(t *testing.T) {
+		for ts, expected := range map[int64]model.SampleValue{500: 1, 1500: 2, 5000: 2} {
+			v, _, err := tiered.Query(ctx, "", time.Unix(ts, 0))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v.(model.Vector)[0].Value != expected {
+				t.Fatalf("unexpected result at %d: %v", ts, v)
+			}
+		}
+	})
+
+	t.Run("GetValue", func(t *testing.T) {
+		cold.ranges, hot.ranges = nil, nil
+		if _, _, err := tiered.GetValue(ctx, time.Unix(1500, 0), time.Unix(1600, 0), nil); err != nil {
+			t.Fatal(err)
+		}
+		// Only the authoritative tier is queried
+		if len(cold.ranges) != 0 || len(hot.ranges) != 1 {
+			t.Fatalf("unexpected ranges cold=%v hot=%v", cold.ranges, hot.ranges)
+		}
+	})
+}
+
+func TestTieredAPIResolution(t *testing.T) {
+	// raw has the last 15d, 5m has the last 90d and 1h everything until 1d ago
+	now := time.Now()
+	raw := &tierAPI{value: 1}
+	fiveMinute := &tierAPI{value: 2}
+	hour := &tierAPI{value: 3}
+	tiered := NewTieredAPI([]Tier{
+		{API: raw, TimeRange: fixedTimeRange(now.Add(-15*24*time.Hour), time.Time{})},
+		{API: fiveMinute, TimeRange: fixedTimeRange(now.Add(-90*24*time.Hour), time.Time{}), Resolution: 5 * time.Minute},
+		{API: hour, TimeRange: fixedTimeRange(time.Time{}, now.Add(-24*time.Hour)), Resolution: time.Hour},
+	})
+	ctx := context.TODO()
+	r := v1.Range{Start: now.Add(-100 * 24 * time.Hour), End: now, Step: time.Hour}
+
+	// With a 1h step the 1h tier is used for as long as it has data, the 5m tier
+	// fills in the most recent day
+	if _, _, err := tiered.QueryRange(ctx, "", r); err != nil {
+		t.Fatal(err)
+	}
+	if len(raw.ranges) != 0 || len(fiveMinute.ranges) != 1 || len(hour.ranges) != 1 {
+		t.Fatalf("unexpected ranges raw=%v 5m=%v 1h=%v", raw.ranges, fiveMinute.ranges, hour.ranges)
+	}
+	if !fiveMinute.ranges[0].Start.After(now.Add(-24*time.Hour)) || hour.ranges[0].End.After(now.Add(-24*time.Hour)) {
+		t.Fatalf("unexpected ranges 5m=%v 1h=%v", fiveMinute.ranges, hour.ranges)
+	}
+
+	// With a 1m step only raw data satisfies the step, the 5m and 1h tiers are only
+	// used for what raw doesn't cover
+	raw.ranges, fiveMinute.ranges, hour.ranges = nil, nil, nil
+	r.Step = time.Minute
+	if _, _, err := tiered.QueryRange(ctx, "", r); err != nil {
+		t.Fatal(err)
+	}
+	if len(raw.ranges) != 1 || len(fiveMinute.ranges) != 1 || len(hour.ranges) != 1 {
+		t.Fatalf("unexpected ranges raw=%v 5m=%v 1h=%v", raw.ranges, fiveMinute.ranges, hour.ranges)
+	}
+	if raw.ranges[0].Start.Before(now.Add(-15*24*time.Hour - time.Second)) {
+		t.Fatalf("unexpected raw range %v", raw.ranges)
+	}
+	if hour.ranges[0].End.After(now.Add(-90 * 24 * time.Hour)) {
+		t.Fatalf("unexpected 1h range %v", hour.ranges)
+	}
+}
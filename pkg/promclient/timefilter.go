@@ -109,3 +109,49 @@ func (tf *RelativeTimeFilter) GetValue(ctx context.Context, start, end time.Time
 
 	return tf.API.GetValue(ctx, start, end, matchers)
 }
+
+// DynamicTimeFilter will filter queries out (return nil,nil) for all queries outside
+// the time range returned by Window (e.g. a periodically discovered time range)
+type DynamicTimeFilter struct {
+	API
+	Window func() (start, end time.Time)
+}
+
+// Query performs a query for the given time.
+func (tf *DynamicTimeFilter) Query(ctx context.Context, query string, ts time.Time) (model.Value, api.Warnings, error) {
+	tfStart, tfEnd := tf.Window()
+	if (!tfStart.IsZero() && ts.Before(tfStart)) || (!tfEnd.IsZero() && ts.After(tfEnd)) {
+		return nil, nil, nil
+	}
+
+	return tf.API.Query(ctx, query, ts)
+}
+
+// QueryRange performs a query for the given range.
+func (tf *DynamicTimeFilter) QueryRange(ctx context.Context, query string, r v1.Range) (model.Value, api.Warnings, error) {
+	tfStart, tfEnd := tf.Window()
+	if (!tfStart.IsZero() && r.End.Before(tfStart)) || (!tfEnd.IsZero() && r.Start.After(tfEnd)) {
+		return nil, nil, nil
+	}
+
+	return tf.API.QueryRange(ctx, query, r)
+}
+
+// Series finds series by label matchers.
+func (tf *DynamicTimeFilter) Series(ctx context.Context, matches []string, startTime time.Time, endTime time.Time) ([]model.LabelSet, api.Warnings, error) {
+	tfStart, tfEnd := tf.Window()
+	if (!tfStart.IsZero() && endTime.Before(tfStart)) || (!tfEnd.IsZero() && startTime.After(tfEnd)) {
+		return nil, nil, nil
+	}
+	return tf.API.Series(ctx, matches, startTime, endTime)
+}
+
+// GetValue loads the raw data for a given set of matchers in the time range
+func (tf *DynamicTimeFilter) GetValue(ctx context.Context, start, end time.Time, matchers []*labels.Matcher) (model.Value, api.Warnings, error) {
+	tfStart, tfEnd := tf.Window()
+	if (!tfStart.IsZero() && end.Before(tfStart)) || (!tfEnd.IsZero() && start.After(tfEnd)) {
+		return nil, nil, nil
+	}
+
+	return tf.API.GetValue(ctx, start, end, matchers)
+}
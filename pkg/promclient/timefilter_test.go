@@ -145,3 +145,31 @@ func TestRelativeTimeFilter(t *testing.T) {
 	})
 
 }
+
+func TestDynamicTimeFilter(t *testing.T) {
+	now := time.Now()
+
+	start := now.Add(time.Hour * -2)
+	end := now.Add(time.Hour * -1)
+
+	api := &DynamicTimeFilter{
+		API:    &recoverAPI{nil},
+		Window: func() (time.Time, time.Time) { return start, end },
+	}
+	timefilterTest(t, api, timeFilterTestCase{
+		validTimes: []time.Time{
+			start,
+			end,
+		},
+		invalidTimes: []time.Time{
+			now,
+			start.Add(time.Minute * -1),
+		},
+		validRanges: []v1.Range{
+			{Start: start.Add(time.Hour * -1), End: end},
+		},
+		invalidRanges: []v1.Range{
+			{Start: now, End: now},
+		},
+	})
+}
@@ -0,0 +1,109 @@
+package promclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/api"
+	"github.com/prometheus/common/model"
+)
+
+// TimeRangeDiscoverer discovers the time range a downstream has data for. A zero
+// start or end means the range is unbounded on that side
+type TimeRangeDiscoverer interface {
+	TimeRange(ctx context.Context) (start, end time.Time, err error)
+}
+
+// RuntimeInfoTimeRange discovers the time range of a prometheus downstream from
+// the storage retention in its /api/v1/status/runtimeinfo
+type RuntimeInfoTimeRange struct {
+	Client api.Client
+}
+
+// TimeRange returns the time range the downstream has data for
+func (r *RuntimeInfoTimeRange) TimeRange(ctx context.Context) (time.Time, time.Time, error) {
+	req, err := http.NewRequest(http.MethodGet, r.Client.URL("/api/v1/status/runtimeinfo", nil).String(), nil)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	resp, body, _, err := r.Client.Do(ctx, req)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return time.Time{}, time.Time{}, fmt.Errorf("unexpected status code %d from runtimeinfo", resp.StatusCode)
+	}
+
+	var result struct {
+		Data struct {
+			StorageRetention string `json:"storageRetention"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	retention, err := parseRetention(result.Data.StorageRetention)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	if retention == 0 {
+		return time.Time{}, time.Time{}, nil
+	}
+	return time.Now().Add(-retention), time.Time{}, nil
+}
+
+// parseRetention returns the time based retention of a prometheus storageRetention
+// (e.g. "15d", "15d or 512MiB" or "512MiB"). If the retention is only size based
+// 0 is returned
+func parseRetention(s string) (time.Duration, error) {
+	for _, part := range strings.Split(s, " or ") {
+		part = strings.TrimSpace(part)
+		if strings.HasSuffix(part, "B") {
+			continue
+		}
+		d, err := model.ParseDuration(part)
+		if err != nil {
+			return 0, fmt.Errorf("unable to parse storageRetention %q: %v", s, err)
+		}
+		return time.Duration(d), nil
+	}
+	return 0, nil
+}
+
+// QueryTimeRange discovers the time range of a downstream through a query which
+// returns the unix timestamp (in seconds) of the oldest data of the downstream,
+// e.g. `prometheus_tsdb_lowest_timestamp_seconds`
+type QueryTimeRange struct {
+	API   API
+	Query string
+}
+
+// TimeRange returns the time range the downstream has data for
+func (q *QueryTimeRange) TimeRange(ctx context.Context) (time.Time, time.Time, error) {
+	v, _, err := q.API.Query(ctx, q.Query, time.Now())
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	oldest := math.Inf(1)
+	switch vTyped := v.(type) {
+	case *model.Scalar:
+		oldest = float64(vTyped.Value)
+	case model.Vector:
+		for _, s := range vTyped {
+			oldest = math.Min(oldest, float64(s.Value))
+		}
+	default:
+		return time.Time{}, time.Time{}, fmt.Errorf("unexpected result type %T for time range query", v)
+	}
+	if math.IsInf(oldest, 1) || math.IsNaN(oldest) {
+		return time.Time{}, time.Time{}, fmt.Errorf("time range query returned no data")
+	}
+	sec, frac := math.Modf(oldest)
+	return time.Unix(int64(sec), int64(frac*float64(time.Second))), time.Time{}, nil
+}
@@ -0,0 +1,73 @@
+package promclient
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/api"
+	"github.com/prometheus/common/model"
+)
+
+func TestParseRetention(t *testing.T) {
+	tests := map[string]time.Duration{
+		"15d":           15 * 24 * time.Hour,
+		"15d or 512MiB": 15 * 24 * time.Hour,
+		"512MiB":        0,
+	}
+	for s, expected := range tests {
+		d, err := parseRetention(s)
+		if err != nil {
+			t.Fatalf("unexpected error for %q: %v", s, err)
+		}
+		if d != expected {
+			t.Fatalf("expected %v for %q, got %v", expected, s, d)
+		}
+	}
+	if _, err := parseRetention("foo"); err == nil {
+		t.Fatalf("expected an error for an invalid retention")
+	}
+}
+
+func TestRuntimeInfoTimeRange(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/status/runtimeinfo" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"status":"success","data":{"storageRetention":"1d"}}`))
+	}))
+	defer srv.Close()
+
+	client, err := api.NewClient(api.Config{Address: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start, end, err := (&RuntimeInfoTimeRange{Client: client}).TimeRange(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 24*time.Hour || d > 25*time.Hour || !end.IsZero() {
+		t.Fatalf("unexpected time range %v - %v", start, end)
+	}
+}
+
+func TestQueryTimeRange(t *testing.T) {
+	stub := &stubAPI{query: func() model.Value {
+		return model.Vector{{Value: 2000}, {Value: 1000.5}}
+	}}
+	start, end, err := (&QueryTimeRange{API: stub, Query: "prometheus_tsdb_lowest_timestamp_seconds"}).TimeRange(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !start.Equal(time.Unix(1000, 5e8)) || !end.IsZero() {
+		t.Fatalf("unexpected time range %v - %v", start, end)
+	}
+
+	stub.query = func() model.Value { return model.Vector{} }
+	if _, _, err := (&QueryTimeRange{API: stub}).TimeRange(context.TODO()); err == nil {
+		t.Fatalf("expected an error without data")
+	}
+}
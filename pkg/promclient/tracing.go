@@ -0,0 +1,103 @@
+package promclient
+
+import (
+	"context"
+	"time"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/prometheus/client_golang/api"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+
+	"github.com/jacksontj/promxy/pkg/promhttputil"
+	"github.com/jacksontj/promxy/pkg/tracing"
+)
+
+// TracingAPI creates a tracing span for each call to the API it wraps
+type TracingAPI struct {
+	API
+	ServerGroup string
+	Target      string
+}
+
+func (t *TracingAPI) startSpan(ctx context.Context, operation string) (opentracing.Span, context.Context) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, operation)
+	span.SetTag(tracing.TagServerGroup, t.ServerGroup)
+	span.SetTag(tracing.TagTarget, t.Target)
+	return span, ctx
+}
+
+func finishSpan(span opentracing.Span, seriesCount int, err error) {
+	if err != nil {
+		ext.Error.Set(span, true)
+		span.LogKV("error", err)
+	} else {
+		span.SetTag(tracing.TagSeries, seriesCount)
+	}
+	span.Finish()
+}
+
+// LabelNames returns all the unique label names present in the block in sorted order.
+func (t *TracingAPI) LabelNames(ctx context.Context) ([]string, api.Warnings, error) {
+	span, ctx := t.startSpan(ctx, "promclient.LabelNames")
+	v, w, err := t.API.LabelNames(ctx)
+	finishSpan(span, len(v), err)
+	return v, w, err
+}
+
+// LabelValues performs a query for the values of the given label.
+func (t *TracingAPI) LabelValues(ctx context.Context, label string) (model.LabelValues, api.Warnings, error) {
+	span, ctx := t.startSpan(ctx, "promclient.LabelValues")
+	span.SetTag("label", label)
+	v, w, err := t.API.LabelValues(ctx, label)
+	finishSpan(span, len(v), err)
+	return v, w, err
+}
+
+// Query performs a query for the given time.
+func (t *TracingAPI) Query(ctx context.Context, query string, ts time.Time) (model.Value, api.Warnings, error) {
+	span, ctx := t.startSpan(ctx, "promclient.Query")
+	span.SetTag(tracing.TagQuery, query)
+	v, w, err := t.API.Query(ctx, query, ts)
+	finishSpan(span, promhttputil.SeriesCount(v), err)
+	return v, w, err
+}
+
+// QueryRange performs a query for the given range.
+func (t *TracingAPI) QueryRange(ctx context.Context, query string, r v1.Range) (model.Value, api.Warnings, error) {
+	span, ctx := t.startSpan(ctx, "promclient.QueryRange")
+	span.SetTag(tracing.TagQuery, query)
+	v, w, err := t.API.QueryRange(ctx, query, r)
+	finishSpan(span, promhttputil.SeriesCount(v), err)
+	return v, w, err
+}
+
+// Series finds series by label matchers.
+func (t *TracingAPI) Series(ctx context.Context, matches []string, startTime time.Time, endTime time.Time) ([]model.LabelSet, api.Warnings, error) {
+	span, ctx := t.startSpan(ctx, "promclient.Series")
+	span.SetTag(tracing.TagQuery, matches)
+	v, w, err := t.API.Series(ctx, matches, startTime, endTime)
+	finishSpan(span, len(v), err)
+	return v, w, err
+}
+
+// GetValue loads the raw data for a given set of matchers in the time range
+func (t *TracingAPI) GetValue(ctx context.Context, start, end time.Time, matchers []*labels.Matcher) (model.Value, api.Warnings, error) {
+	span, ctx := t.startSpan(ctx, "promclient.GetValue")
+	if pql, err := promhttputil.MatcherToString(matchers); err == nil {
+		span.SetTag(tracing.TagQuery, pql)
+	}
+	v, w, err := t.API.GetValue(ctx, start, end, matchers)
+	finishSpan(span, promhttputil.SeriesCount(v), err)
+	return v, w, err
+}
+
+// Key returns a labelset used to determine other api clients that are the "same"
+func (t *TracingAPI) Key() model.LabelSet {
+	if apiLabels, ok := t.API.(APILabels); ok {
+		return apiLabels.Key()
+	}
+	return nil
+}
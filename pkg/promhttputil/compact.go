@@ -0,0 +1,138 @@
+package promhttputil
+
+import (
+	"sort"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/storage"
+)
+
+// CompactSeries is a single series stored as columnar timestamp and value
+// arrays (instead of a list of model.SamplePair)
+type CompactSeries struct {
+	Metric     model.Metric
+	Timestamps []int64
+	Values     []float64
+}
+
+// CompactMatrix is a matrix value of CompactSeries, this is what DecodeResponse
+// returns for matrix results so that the points can be merged and iterated
+// over without allocating intermediate model objects
+type CompactMatrix []*CompactSeries
+
+// Type implements model.Value
+func (m CompactMatrix) Type() model.ValueType { return model.ValMatrix }
+
+// String implements model.Value
+func (m CompactMatrix) String() string { return m.Matrix().String() }
+
+// Matrix converts the CompactMatrix to a model.Matrix
+func (m CompactMatrix) Matrix() model.Matrix {
+	ret := make(model.Matrix, len(m))
+	for i, series := range m {
+		values := make([]model.SamplePair, len(series.Timestamps))
+		for j, t := range series.Timestamps {
+			values[j] = model.SamplePair{Timestamp: model.Time(t), Value: model.SampleValue(series.Values[j])}
+		}
+		ret[i] = &model.SampleStream{Metric: series.Metric, Values: values}
+	}
+	return ret
+}
+
+// SeriesSet returns a SeriesSet (sorted by labels) of the series.
+// Note: this re-orders the series in `m`
+func (m CompactMatrix) SeriesSet() storage.SeriesSet {
+	return &compactSeriesSet{m: m, labels: sortCompactMatrix(m), offset: -1}
+}
+
+// sortCompactMatrix sorts the series in `m` by their labels, returning the labels of each
+func sortCompactMatrix(m CompactMatrix) []labels.Labels {
+	lbls := make([]labels.Labels, len(m))
+	for i, series := range m {
+		lbls[i] = MetricToLabels(series.Metric)
+	}
+	sort.Sort(&compactMatrixSorter{m, lbls})
+	return lbls
+}
+
+type compactMatrixSorter struct {
+	m      CompactMatrix
+	labels []labels.Labels
+}
+
+func (s *compactMatrixSorter) Len() int { return len(s.m) }
+func (s *compactMatrixSorter) Less(i, j int) bool {
+	return labels.Compare(s.labels[i], s.labels[j]) < 0
+}
+func (s *compactMatrixSorter) Swap(i, j int) {
+	s.m[i], s.m[j] = s.m[j], s.m[i]
+	s.labels[i], s.labels[j] = s.labels[j], s.labels[i]
+}
+
+// compactSeriesSet is a storage.SeriesSet over a (sorted) CompactMatrix
+type compactSeriesSet struct {
+	m      CompactMatrix
+	labels []labels.Labels
+	offset int
+}
+
+func (s *compactSeriesSet) Next() bool {
+	if s.offset < len(s.m)-1 {
+		s.offset++
+		return true
+	}
+	s.offset = len(s.m)
+	return false
+}
+
+func (s *compactSeriesSet) At() storage.Series {
+	return &compactSeries{labels: s.labels[s.offset], series: s.m[s.offset]}
+}
+
+func (s *compactSeriesSet) Err() error { return nil }
+
+type compactSeries struct {
+	labels labels.Labels
+	series *CompactSeries
+}
+
+func (s *compactSeries) Labels() labels.Labels { return s.labels }
+
+func (s *compactSeries) Iterator() storage.SeriesIterator {
+	return &compactSeriesIterator{t: s.series.Timestamps, v: s.series.Values, offset: -1}
+}
+
+// compactSeriesIterator is a storage.SeriesIterator over columnar timestamps and values
+type compactSeriesIterator struct {
+	t      []int64
+	v      []float64
+	offset int
+}
+
+func (s *compactSeriesIterator) Seek(t int64) bool {
+	if s.offset < 0 {
+		s.offset = 0
+	}
+	for ; s.offset < len(s.t); s.offset++ {
+		if s.t[s.offset] >= t {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *compactSeriesIterator) At() (int64, float64) {
+	return s.t[s.offset], s.v[s.offset]
+}
+
+func (s *compactSeriesIterator) Next() bool {
+	if s.offset < len(s.t)-1 {
+		s.offset++
+		return true
+	}
+	s.offset = len(s.t)
+	return false
+}
+
+func (s *compactSeriesIterator) Err() error { return nil }
@@ -0,0 +1,309 @@
+package promhttputil
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/prometheus/common/model"
+)
+
+// decodeBufferSize is the size of the buffer used to read responses
+const decodeBufferSize = 64 * 1024
+
+// QueryResponse is a decoded response of the prometheus query API
+type QueryResponse struct {
+	Status    Status
+	ErrorType ErrorType
+	Error     string
+	Warnings  []string
+	Value     model.Value
+}
+
+// SampleLimitError is returned by DecodeQueryResponse when a response has more
+// samples than the limit
+type SampleLimitError struct {
+	Limit int
+}
+
+func (e *SampleLimitError) Error() string {
+	return fmt.Sprintf("response exceeded the sample limit of %d", e.Limit)
+}
+
+// DecodeQueryResponse decodes a response of the prometheus query API (query
+// or query_range) incrementally as it is read from `r`. Matrix results are
+// decoded directly into a CompactMatrix, so the response is never held in memory
+// and no model.SamplePairs are allocated.
+// If `sampleLimit` is > 0, decoding stops with a SampleLimitError as soon as the
+// response has more than that many samples
+func DecodeQueryResponse(r io.Reader, sampleLimit int) (*QueryResponse, error) {
+	d := &responseDecoder{
+		iter:        jsoniter.Parse(jsoniter.ConfigDefault, r, decodeBufferSize),
+		sampleLimit: sampleLimit,
+	}
+	return d.decode()
+}
+
+type responseDecoder struct {
+	iter        *jsoniter.Iterator
+	sampleLimit int
+	samples     int
+
+	resultType string
+	matrix     CompactMatrix
+	vector     model.Vector
+	// scalar and string results are a single [timestamp, value] pair
+	hasPair bool
+	pairT   int64
+	pairV   string
+}
+
+func (d *responseDecoder) decode() (*QueryResponse, error) {
+	iter := d.iter
+	resp := &QueryResponse{}
+	for field := iter.ReadObject(); field != ""; field = iter.ReadObject() {
+		switch field {
+		case "status":
+			resp.Status = Status(iter.ReadString())
+		case "errorType":
+			resp.ErrorType = ErrorType(iter.ReadString())
+		case "error":
+			resp.Error = iter.ReadString()
+		case "warnings":
+			for iter.ReadArray() {
+				resp.Warnings = append(resp.Warnings, iter.ReadString())
+			}
+		case "data":
+			d.decodeData()
+		default:
+			iter.Skip()
+		}
+	}
+	if iter.Error != nil && iter.Error != io.EOF {
+		return nil, iter.Error
+	}
+
+	switch resp.Status {
+	case StatusSuccess:
+	case StatusError:
+		return resp, nil
+	default:
+		return nil, fmt.Errorf("unknown response status %q", resp.Status)
+	}
+
+	switch d.resultType {
+	case model.ValMatrix.String():
+		if d.matrix == nil {
+			d.matrix = make(CompactMatrix, 0)
+		}
+		resp.Value = d.matrix
+	case model.ValVector.String():
+		if d.vector == nil {
+			d.vector = make(model.Vector, 0)
+		}
+		resp.Value = d.vector
+	case model.ValScalar.String():
+		if !d.hasPair {
+			return nil, fmt.Errorf("missing scalar result")
+		}
+		v, err := parseSampleValue(d.pairV)
+		if err != nil {
+			return nil, err
+		}
+		resp.Value = &model.Scalar{Value: model.SampleValue(v), Timestamp: model.Time(d.pairT)}
+	case model.ValString.String():
+		if !d.hasPair {
+			return nil, fmt.Errorf("missing string result")
+		}
+		resp.Value = &model.String{Value: d.pairV, Timestamp: model.Time(d.pairT)}
+	default:
+		return nil, fmt.Errorf("unknown result type %q", d.resultType)
+	}
+	return resp, nil
+}
+
+func (d *responseDecoder) decodeData() {
+	iter := d.iter
+	for field := iter.ReadObject(); field != ""; field = iter.ReadObject() {
+		switch field {
+		case "resultType":
+			d.resultType = iter.ReadString()
+		case "result":
+			d.decodeResult()
+		default:
+			iter.Skip()
+		}
+	}
+}
+
+// decodeResult decodes the result, which is either a list of series (matrix and
+// vector) or a single [timestamp, value] pair (scalar and string). As the
+// resultType isn't guaranteed to be before the result in the response, the
+// format of the result is determined from the result itself
+func (d *responseDecoder) decodeResult() {
+	iter := d.iter
+	if iter.WhatIsNext() != jsoniter.ArrayValue {
+		iter.Skip()
+		return
+	}
+	for i := 0; iter.ReadArray(); i++ {
+		if i == 0 && iter.WhatIsNext() != jsoniter.ObjectValue {
+			d.hasPair = true
+			d.pairT = d.readTimestamp()
+			if !iter.ReadArray() {
+				iter.ReportError("decode result", "expected [timestamp, value]")
+				return
+			}
+			d.pairV = iter.ReadString()
+			if iter.ReadArray() {
+				iter.ReportError("decode result", "expected [timestamp, value]")
+			}
+			return
+		}
+		d.decodeSeries()
+	}
+}
+
+// decodeSeries decodes a single series, which has either "values" (matrix) or
+// a "value" (vector)
+func (d *responseDecoder) decodeSeries() {
+	iter := d.iter
+	var (
+		metric model.Metric
+		series *CompactSeries
+		sample *model.Sample
+	)
+	for field := iter.ReadObject(); field != ""; field = iter.ReadObject() {
+		switch field {
+		case "metric":
+			metric = make(model.Metric)
+			for name := iter.ReadObject(); name != ""; name = iter.ReadObject() {
+				metric[model.LabelName(name)] = model.LabelValue(iter.ReadString())
+			}
+		case "values":
+			series = &CompactSeries{}
+			for iter.ReadArray() {
+				t, v := d.readPoint()
+				series.Timestamps = append(series.Timestamps, t)
+				series.Values = append(series.Values, v)
+				if !d.addSample() {
+					return
+				}
+			}
+		case "value":
+			t, v := d.readPoint()
+			sample = &model.Sample{Timestamp: model.Time(t), Value: model.SampleValue(v)}
+			if !d.addSample() {
+				return
+			}
+		default:
+			iter.Skip()
+		}
+	}
+
+	if metric == nil {
+		metric = make(model.Metric)
+	}
+	if series != nil {
+		series.Metric = metric
+		d.matrix = append(d.matrix, series)
+	}
+	if sample != nil {
+		sample.Metric = metric
+		d.vector = append(d.vector, sample)
+	}
+}
+
+// addSample counts a decoded sample, returning false if the sample limit is exceeded
+func (d *responseDecoder) addSample() bool {
+	d.samples++
+	if d.sampleLimit > 0 && d.samples > d.sampleLimit {
+		// Set the error directly (instead of ReportError) so it is returned as-is
+		if d.iter.Error == nil {
+			d.iter.Error = &SampleLimitError{Limit: d.sampleLimit}
+		}
+		return false
+	}
+	return true
+}
+
+// readPoint reads a single [timestamp, "value"] pair
+func (d *responseDecoder) readPoint() (int64, float64) {
+	iter := d.iter
+	if !iter.ReadArray() {
+		iter.ReportError("decode point", "expected [timestamp, value]")
+		return 0, 0
+	}
+	t := d.readTimestamp()
+	if !iter.ReadArray() {
+		iter.ReportError("decode point", "expected [timestamp, value]")
+		return 0, 0
+	}
+	v, err := parseSampleValue(iter.ReadString())
+	if err != nil {
+		iter.ReportError("decode point", err.Error())
+		return 0, 0
+	}
+	if iter.ReadArray() {
+		iter.ReportError("decode point", "expected [timestamp, value]")
+	}
+	return t, v
+}
+
+func (d *responseDecoder) readTimestamp() int64 {
+	t, err := parseTimestamp(d.iter.ReadNumber())
+	if err != nil {
+		d.iter.ReportError("decode timestamp", err.Error())
+	}
+	return t
+}
+
+// parseTimestamp parses a timestamp in seconds (as formatted by prometheus, e.g.
+// 1435781451.781) into milliseconds without going through a float
+func parseTimestamp(n json.Number) (int64, error) {
+	s := string(n)
+	if strings.ContainsAny(s, "eE") {
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return 0, err
+		}
+		return int64(math.Round(f * 1000)), nil
+	}
+
+	i := strings.IndexByte(s, '.')
+	if i < 0 {
+		sec, err := strconv.ParseInt(s, 10, 64)
+		return sec * 1000, err
+	}
+	sec, err := strconv.ParseInt(s[:i], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	frac := s[i+1:]
+	if len(frac) > 3 {
+		frac = frac[:3]
+	}
+	var ms int64
+	if frac != "" {
+		if ms, err = strconv.ParseInt(frac, 10, 64); err != nil {
+			return 0, err
+		}
+	}
+	for j := len(frac); j < 3; j++ {
+		ms *= 10
+	}
+	if strings.HasPrefix(s, "-") {
+		return sec*1000 - ms, nil
+	}
+	return sec*1000 + ms, nil
+}
+
+// parseSampleValue parses a sample value (which prometheus formats as a string
+// so that it can contain NaN and +-Inf)
+func parseSampleValue(s string) (float64, error) {
+	return strconv.ParseFloat(s, 64)
+}
@@ -0,0 +1,169 @@
+package promhttputil
+
+import (
+	"encoding/json"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestDecodeQueryResponse(t *testing.T) {
+	tests := []struct {
+		name  string
+		body  string
+		limit int
+		r     *QueryResponse
+		err   bool
+	}{
+		{
+			name: "matrix",
+			body: `{"status":"success","data":{"resultType":"matrix","result":[` +
+				`{"metric":{"__name__":"up","job":"a"},"values":[[1435781430.781,"1"],[1435781445,"NaN"]]},` +
+				`{"metric":{},"values":[[1435781430.7,"+Inf"]]}]}}`,
+			r: &QueryResponse{
+				Status: StatusSuccess,
+				Value: CompactMatrix{
+					{
+						Metric:     model.Metric{"__name__": "up", "job": "a"},
+						Timestamps: []int64{1435781430781, 1435781445000},
+						Values:     []float64{1, math.NaN()},
+					},
+					{
+						Metric:     model.Metric{},
+						Timestamps: []int64{1435781430700},
+						Values:     []float64{math.Inf(1)},
+					},
+				},
+			},
+		},
+		// The result type doesn't have to come before the result
+		{
+			name: "vector",
+			body: `{"data":{"result":[{"metric":{"job":"a"},"value":[1435781430.781,"2"]}],"resultType":"vector"},"status":"success","warnings":["w"]}`,
+			r: &QueryResponse{
+				Status:   StatusSuccess,
+				Warnings: []string{"w"},
+				Value: model.Vector{
+					{Metric: model.Metric{"job": "a"}, Value: 2, Timestamp: 1435781430781},
+				},
+			},
+		},
+		{
+			name: "empty matrix",
+			body: `{"status":"success","data":{"resultType":"matrix","result":[]}}`,
+			r:    &QueryResponse{Status: StatusSuccess, Value: CompactMatrix{}},
+		},
+		{
+			name: "scalar",
+			body: `{"status":"success","data":{"resultType":"scalar","result":[1435781430.781,"1.5"]}}`,
+			r:    &QueryResponse{Status: StatusSuccess, Value: &model.Scalar{Value: 1.5, Timestamp: 1435781430781}},
+		},
+		{
+			name: "string",
+			body: `{"status":"success","data":{"resultType":"string","result":[1435781430,"foo"]}}`,
+			r:    &QueryResponse{Status: StatusSuccess, Value: &model.String{Value: "foo", Timestamp: 1435781430000}},
+		},
+		{
+			name: "error",
+			body: `{"status":"error","errorType":"timeout","error":"query timed out"}`,
+			r:    &QueryResponse{Status: StatusError, ErrorType: ErrorTimeout, Error: "query timed out"},
+		},
+		{
+			name:  "under sample limit",
+			body:  `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{},"values":[[1,"1"],[2,"1"]]}]}}`,
+			limit: 2,
+			r: &QueryResponse{
+				Status: StatusSuccess,
+				Value:  CompactMatrix{{Metric: model.Metric{}, Timestamps: []int64{1000, 2000}, Values: []float64{1, 1}}},
+			},
+		},
+		{
+			name:  "over sample limit",
+			body:  `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{},"values":[[1,"1"],[2,"1"],[3,"1"]]}]}}`,
+			limit: 2,
+			err:   true,
+		},
+		{
+			name: "truncated",
+			body: `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{},"values":[[1,"1"],[2`,
+			err:  true,
+		},
+		{
+			name: "bad value",
+			body: `{"status":"success","data":{"resultType":"vector","result":[{"metric":{},"value":[1,"abc"]}]}}`,
+			err:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r, err := DecodeQueryResponse(strings.NewReader(test.body), test.limit)
+			if (err != nil) != test.err {
+				t.Fatalf("mismatch in err expected=%v actual=%v", test.err, err)
+			}
+			if test.err {
+				return
+			}
+			// NaN != NaN, so compare the string representations
+			if r.Value != nil && test.r.Value != nil {
+				if r.Value.String() != test.r.Value.String() {
+					t.Fatalf("mismatch in value\nexpected=%v\nactual=%v", test.r.Value, r.Value)
+				}
+				r.Value, test.r.Value = nil, nil
+			}
+			if !reflect.DeepEqual(r, test.r) {
+				t.Fatalf("mismatch\nexpected=%#v\nactual=%#v", test.r, r)
+			}
+		})
+	}
+}
+
+func TestDecodeQueryResponseSampleLimit(t *testing.T) {
+	body := `{"status":"success","data":{"resultType":"vector","result":[{"metric":{},"value":[1,"1"]},{"metric":{},"value":[1,"1"]}]}}`
+	_, err := DecodeQueryResponse(strings.NewReader(body), 1)
+	if _, ok := err.(*SampleLimitError); !ok {
+		t.Fatalf("expected a SampleLimitError, got %v", err)
+	}
+}
+
+func TestParseTimestamp(t *testing.T) {
+	tests := map[string]int64{
+		"1435781430":      1435781430000,
+		"1435781430.781":  1435781430781,
+		"1435781430.7":    1435781430700,
+		"1435781430.7819": 1435781430781,
+		"-1.5":            -1500,
+		"1.435781430e9":   1435781430000,
+	}
+	for in, expected := range tests {
+		actual, err := parseTimestamp(json.Number(in))
+		if err != nil {
+			t.Fatalf("unexpected error parsing %s: %v", in, err)
+		}
+		if actual != expected {
+			t.Fatalf("mismatch parsing %s expected=%d actual=%d", in, expected, actual)
+		}
+	}
+}
+
+func TestCompactMatrixSeriesSet(t *testing.T) {
+	m := CompactMatrix{
+		{Metric: model.Metric{"a": "2"}, Timestamps: []int64{1, 2}, Values: []float64{1, 2}},
+		{Metric: model.Metric{"a": "1"}, Timestamps: []int64{3}, Values: []float64{3}},
+	}
+	expected := model.Matrix{
+		{Metric: model.Metric{"a": "1"}, Values: []model.SamplePair{{Timestamp: 3, Value: 3}}},
+		{Metric: model.Metric{"a": "2"}, Values: []model.SamplePair{{Timestamp: 1, Value: 1}, {Timestamp: 2, Value: 2}}},
+	}
+
+	merged, err := NewMergedMatrix(AntiAffinityMerger(0), []model.Value{m})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual := merged.Matrix(); !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("mismatch\nexpected=%v\nactual=%v", expected, actual)
+	}
+}
@@ -0,0 +1,157 @@
+package promhttputil
+
+import (
+	"fmt"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage"
+)
+
+// initialDedupPenalty is the penalty used by DedupSampleStream before the
+// interval between points of a series is known
+const initialDedupPenalty = model.Time(5000)
+
+// SampleStreamMerger merges the points of a single series from multiple downstreams
+type SampleStreamMerger interface {
+	// Merge merges SampleStreams `a` and `b`
+	Merge(a, b *model.SampleStream) (*model.SampleStream, error)
+	// MergeIterators returns an iterator which lazily merges all of `its`
+	MergeIterators(its []storage.SeriesIterator) storage.SeriesIterator
+}
+
+// AntiAffinityMerger returns a SampleStreamMerger which uses MergeSampleStream.
+// When merging iterators a point is only added if it is more than antiAffinityBuffer
+// after the last point, unless it is from the same downstream as the last point
+func AntiAffinityMerger(antiAffinityBuffer model.Time) SampleStreamMerger {
+	return &antiAffinityMerger{antiAffinityBuffer}
+}
+
+type antiAffinityMerger struct {
+	antiAffinityBuffer model.Time
+}
+
+func (m *antiAffinityMerger) Merge(a, b *model.SampleStream) (*model.SampleStream, error) {
+	return MergeSampleStream(m.antiAffinityBuffer, a, b)
+}
+
+func (m *antiAffinityMerger) MergeIterators(its []storage.SeriesIterator) storage.SeriesIterator {
+	return newMergeIterator(its, func(delta model.Time, first bool) model.Time {
+		return m.antiAffinityBuffer
+	})
+}
+
+// DedupMerger returns a SampleStreamMerger which uses DedupSampleStream
+func DedupMerger(penalty model.Time) SampleStreamMerger {
+	return &dedupMerger{penalty}
+}
+
+type dedupMerger struct {
+	penalty model.Time
+}
+
+func (m *dedupMerger) Merge(a, b *model.SampleStream) (*model.SampleStream, error) {
+	return DedupSampleStream(m.penalty, a, b)
+}
+
+func (m *dedupMerger) MergeIterators(its []storage.SeriesIterator) storage.SeriesIterator {
+	return newMergeIterator(its, m.getPenalty)
+}
+
+// getPenalty returns the penalty for the downstreams which weren't used for a
+// point, given the interval between the last 2 points
+func (m *dedupMerger) getPenalty(delta model.Time, first bool) model.Time {
+	switch {
+	case m.penalty > 0:
+		return m.penalty
+	case first:
+		return initialDedupPenalty
+	default:
+		return 2 * delta
+	}
+}
+
+// DedupSampleStream merges SampleStreams `a` and `b` of the same series from 2
+// replicas. Unlike MergeSampleStream, which interleaves points from both replicas,
+// this sticks to the points of a single replica for as long as it has data and only
+// switches to the other replica once there is a gap larger than `penalty`.
+// Interleaving points from replicas which scrape at different offsets results
+// in artefacts (such as sawtooth patterns in `rate()`), which this avoids.
+//
+// If `penalty` is 0 the gap is 2x the interval between the last 2 points, this is
+// the same approach that Thanos uses for its deduplication.
+//
+// Note: no adjustment is made to the values at a switchover, so if the replicas
+// have diverging counter values a switch to a replica with a lower value will
+// look like a counter reset (as it would when querying that replica directly).
+func DedupSampleStream(penalty model.Time, a, b *model.SampleStream) (*model.SampleStream, error) {
+	if a.Metric.Fingerprint() != b.Metric.Fingerprint() {
+		return nil, fmt.Errorf("cannot merge mismatch fingerprints")
+	}
+
+	// if either set of values are empty, return the one with data
+	if len(a.Values) == 0 {
+		return b, nil
+	} else if len(b.Values) == 0 {
+		return a, nil
+	}
+
+	m := &dedupMerger{penalty}
+	newValues := make([]model.SamplePair, 0, len(a.Values))
+
+	var (
+		aOffset, bOffset int
+		aPenalty         model.Time
+		bPenalty         model.Time
+	)
+	for {
+		// Skip any points which are at or before the last point we added (plus
+		// the penalty for the replica we aren't currently using)
+		if len(newValues) > 0 {
+			lastTime := newValues[len(newValues)-1].Timestamp
+			for aOffset < len(a.Values) && a.Values[aOffset].Timestamp <= lastTime+aPenalty {
+				aOffset++
+			}
+			for bOffset < len(b.Values) && b.Values[bOffset].Timestamp <= lastTime+bPenalty {
+				bOffset++
+			}
+		}
+
+		aOk := aOffset < len(a.Values)
+		bOk := bOffset < len(b.Values)
+		if !aOk && !bOk {
+			break
+		}
+
+		// Pick the replica with the earliest next point. As the replica not used
+		// for the last point is penalized this will be the current replica unless
+		// it has a gap larger than the penalty
+		useA := aOk && (!bOk || a.Values[aOffset].Timestamp <= b.Values[bOffset].Timestamp)
+
+		var value model.SamplePair
+		if useA {
+			value = a.Values[aOffset]
+		} else {
+			value = b.Values[bOffset]
+		}
+
+		// Penalize the replica we didn't use based on the interval of the series
+		var otherPenalty model.Time
+		if len(newValues) > 0 {
+			otherPenalty = m.getPenalty(value.Timestamp-newValues[len(newValues)-1].Timestamp, false)
+		} else {
+			otherPenalty = m.getPenalty(0, true)
+		}
+		if useA {
+			aPenalty, bPenalty = 0, otherPenalty
+		} else {
+			aPenalty, bPenalty = otherPenalty, 0
+		}
+
+		newValues = append(newValues, value)
+	}
+
+	return &model.SampleStream{
+		Metric: a.Metric,
+		Values: newValues,
+	}, nil
+}
@@ -0,0 +1,112 @@
+package promhttputil
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/common/model"
+)
+
+// points returns SamplePairs from a list of (time in seconds, value) pairs
+func points(tv ...float64) []model.SamplePair {
+	ret := make([]model.SamplePair, 0, len(tv)/2)
+	for i := 0; i < len(tv); i += 2 {
+		ret = append(ret, model.SamplePair{
+			Timestamp: model.TimeFromUnixNano(int64(tv[i] * 1e9)),
+			Value:     model.SampleValue(tv[i+1]),
+		})
+	}
+	return ret
+}
+
+func TestDedupSampleStream(t *testing.T) {
+	metric := model.Metric{model.MetricNameLabel: "requests_total"}
+
+	tests := []struct {
+		name    string
+		penalty model.Time
+		a       []model.SamplePair
+		b       []model.SamplePair
+		r       []model.SamplePair
+	}{
+		{
+			name: "empty",
+			a:    points(0, 1, 15, 2),
+			b:    nil,
+			r:    points(0, 1, 15, 2),
+		},
+		// Replicas scraping at different offsets shouldn't be interleaved
+		{
+			name: "offset replicas",
+			a:    points(0, 0, 15, 15, 30, 30, 45, 45),
+			b:    points(5, 5, 20, 20, 35, 35, 50, 50),
+			r:    points(0, 0, 15, 15, 30, 30, 45, 45),
+		},
+		// The same result regardless of which replica is merged first
+		{
+			name: "offset replicas reversed",
+			a:    points(5, 5, 20, 20, 35, 35, 50, 50),
+			b:    points(0, 0, 15, 15, 30, 30, 45, 45),
+			r:    points(0, 0, 15, 15, 30, 30, 45, 45),
+		},
+		// A gap in the current replica switches to the other, which is then used
+		// for as long as it has data
+		{
+			name: "switch on gap",
+			a:    points(0, 0, 15, 15, 30, 30, 90, 90, 105, 105),
+			b:    points(5, 5, 20, 20, 35, 35, 50, 50, 65, 65, 80, 80, 95, 95, 110, 110),
+			r:    points(0, 0, 15, 15, 30, 30, 65, 65, 80, 80, 95, 95, 110, 110),
+		},
+		// A gap smaller than the penalty doesn't switch replicas
+		{
+			name:    "gap within penalty",
+			penalty: model.TimeFromUnix(60),
+			a:       points(0, 0, 15, 15, 30, 30, 75, 75),
+			b:       points(5, 5, 20, 20, 35, 35, 50, 50, 65, 65, 80, 80),
+			r:       points(0, 0, 15, 15, 30, 30, 75, 75),
+		},
+		// Counter reset on the current replica is kept, and not hidden by
+		// points from the other replica
+		{
+			name: "counter reset on current replica",
+			a:    points(0, 100, 15, 110, 30, 0, 45, 10),
+			b:    points(5, 105, 20, 115, 35, 125, 50, 135),
+			r:    points(0, 100, 15, 110, 30, 0, 45, 10),
+		},
+		// Counter reset at the switchover: replica b restarted and has a lower
+		// counter, the switch shows up as a single reset (as it would querying b)
+		{
+			name: "counter reset at switchover",
+			a:    points(0, 100, 15, 110, 30, 120),
+			b:    points(5, 1, 20, 2, 35, 3, 50, 4, 65, 5, 80, 6),
+			r:    points(0, 100, 15, 110, 30, 120, 65, 5, 80, 6),
+		},
+		// Replicas with the same counter values have no reset at the switchover
+		{
+			name: "counter switchover without reset",
+			a:    points(0, 0, 15, 15, 30, 30),
+			b:    points(5, 5, 20, 20, 35, 35, 50, 50, 65, 65, 80, 80),
+			r:    points(0, 0, 15, 15, 30, 30, 65, 65, 80, 80),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, err := DedupSampleStream(test.penalty,
+				&model.SampleStream{Metric: metric, Values: test.a},
+				&model.SampleStream{Metric: metric, Values: test.b},
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(result.Values, test.r) {
+				t.Fatalf("mismatch\nexpected=%v\nactual=%v", test.r, result.Values)
+			}
+			for i := 1; i < len(result.Values); i++ {
+				if result.Values[i].Timestamp <= result.Values[i-1].Timestamp {
+					t.Fatalf("points out of order: %v", result.Values)
+				}
+			}
+		})
+	}
+}
@@ -63,15 +63,92 @@ func ValueAddLabelSet(a model.Value, l model.LabelSet) error {
 				item.Metric[k] = v
 			}
 		}
+
+	case CompactMatrix:
+		for _, item := range aTyped {
+			if item.Metric == nil {
+				item.Metric = make(model.Metric, len(l))
+			}
+			for k, v := range l {
+				item.Metric[k] = v
+			}
+		}
 	}
 
 	return nil
 
 }
 
+// CloneValue returns a copy of `a` that can be mutated (e.g. by ValueAddLabelSet or
+// MergeValues) without affecting the original. Note: the underlying SamplePairs
+// of a Matrix (and points of a CompactMatrix) are *not* copied as nothing modifies
+// them in place
+func CloneValue(a model.Value) model.Value {
+	switch aTyped := a.(type) {
+	case *model.Scalar:
+		tmp := *aTyped
+		return &tmp
+
+	case *model.String:
+		tmp := *aTyped
+		return &tmp
+
+	case model.Vector:
+		ret := make(model.Vector, len(aTyped))
+		for i, item := range aTyped {
+			ret[i] = &model.Sample{
+				Metric:    item.Metric.Clone(),
+				Value:     item.Value,
+				Timestamp: item.Timestamp,
+			}
+		}
+		return ret
+
+	case model.Matrix:
+		ret := make(model.Matrix, len(aTyped))
+		for i, item := range aTyped {
+			ret[i] = &model.SampleStream{
+				Metric: item.Metric.Clone(),
+				Values: item.Values,
+			}
+		}
+		return ret
+
+	case CompactMatrix:
+		ret := make(CompactMatrix, len(aTyped))
+		for i, item := range aTyped {
+			ret[i] = &CompactSeries{
+				Metric:     item.Metric.Clone(),
+				Timestamps: item.Timestamps,
+				Values:     item.Values,
+			}
+		}
+		return ret
+
+	case *MergedMatrix:
+		ret := &MergedMatrix{
+			merger: aTyped.merger,
+			values: make([]model.Value, len(aTyped.values)),
+			labels: aTyped.labels,
+		}
+		for i, v := range aTyped.values {
+			ret.values[i] = CloneValue(v)
+		}
+		return ret
+	}
+
+	return a
+}
+
 // MergeValues merges values `a` and `b` with the given antiAffinityBuffer
-// TODO: always make copies? Now we sometimes return one, or make a copy, or do nothing
 func MergeValues(antiAffinityBuffer model.Time, a, b model.Value) (model.Value, error) {
+	return MergeValuesWith(DefaultMergeStrategy, AntiAffinityMerger(antiAffinityBuffer), a, b)
+}
+
+// MergeValuesWith merges values `a` and `b`, using `strategy` to pick between
+// Scalars or Vector samples and `merger` to merge any SampleStreams which exist in both
+// TODO: always make copies? Now we sometimes return one, or make a copy, or do nothing
+func MergeValuesWith(strategy MergeStrategy, merger SampleStreamMerger, a, b model.Value) (model.Value, error) {
 	if a == nil {
 		return b, nil
 	}
@@ -82,17 +159,19 @@ func MergeValues(antiAffinityBuffer model.Time, a, b model.Value) (model.Value,
 		return nil, fmt.Errorf("mismatch type %v!=%v", a.Type(), b.Type())
 	}
 
+	// Pairwise merging is done on model.Matrix
+	if aCompact, ok := a.(CompactMatrix); ok {
+		a = aCompact.Matrix()
+	}
+	if bCompact, ok := b.(CompactMatrix); ok {
+		b = bCompact.Matrix()
+	}
+
 	switch aTyped := a.(type) {
-	// TODO: more logic? for now we assume both are correct if they exist
-	// In the case where it is a single datapoint, we're going to assume that
-	// either is valid, we just need one
+	// In the case where it is a single datapoint, the strategy picks which to use
 	case *model.Scalar:
 		bTyped := b.(*model.Scalar)
-
-		if aTyped.Value != 0 && aTyped.Timestamp != 0 {
-			return aTyped, nil
-		}
-		return bTyped, nil
+		return strategy.MergeScalar(aTyped, bTyped), nil
 
 	// In the case where it is a single datapoint, we're going to assume that
 	// either is valid, we just need one
@@ -114,12 +193,9 @@ func MergeValues(antiAffinityBuffer model.Time, a, b model.Value) (model.Value,
 		addItem := func(item *model.Sample) {
 			finger := item.Metric.Fingerprint()
 
-			// If we've seen this fingerPrint before, lets make sure that a value exists
+			// If we've seen this fingerPrint before, the strategy picks which sample to use
 			if index, ok := fingerPrintMap[finger]; ok {
-				// TODO: better? For now we only replace if we have no value (which seems reasonable)
-				if newValue[index].Value == model.SampleValue(0) {
-					newValue[index].Value = item.Value
-				}
+				newValue[index] = strategy.MergeSample(newValue[index], item)
 			} else {
 				newValue = append(newValue, item)
 				fingerPrintMap[finger] = len(newValue) - 1
@@ -147,7 +223,7 @@ func MergeValues(antiAffinityBuffer model.Time, a, b model.Value) (model.Value,
 			// If we've seen this fingerPrint before, lets make sure that a value exists
 			if index, ok := fingerPrintMap[finger]; ok {
 				// TODO: check this error? For now the only one is sig collision, which we check
-				newValue[index], _ = MergeSampleStream(antiAffinityBuffer, newValue[index], stream)
+				newValue[index], _ = merger.Merge(newValue[index], stream)
 			} else {
 				newValue = append(newValue, stream)
 				fingerPrintMap[finger] = len(newValue) - 1
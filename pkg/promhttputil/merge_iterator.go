@@ -0,0 +1,427 @@
+package promhttputil
+
+import (
+	"container/heap"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/storage"
+)
+
+// MetricToLabels converts a model.Metric to (sorted) labels.Labels
+func MetricToLabels(m model.Metric) labels.Labels {
+	ret := make(labels.Labels, 0, len(m))
+	for k, v := range m {
+		ret = append(ret, labels.Label{Name: string(k), Value: string(v)})
+	}
+	sort.Sort(ret)
+	return ret
+}
+
+// LabelsToMetric converts labels.Labels to a model.Metric
+func LabelsToMetric(l labels.Labels) model.Metric {
+	ret := make(model.Metric, len(l))
+	for _, lbl := range l {
+		ret[model.LabelName(lbl.Name)] = model.LabelValue(lbl.Value)
+	}
+	return ret
+}
+
+// MergedMatrix is a matrix value which is the merge of the results from multiple
+// downstreams. The series are merged lazily (as they are iterated over through
+// SeriesSet) instead of being merged into a new model.Matrix up-front
+type MergedMatrix struct {
+	merger SampleStreamMerger
+	values []model.Value
+	labels [][]labels.Labels
+}
+
+// NewMergedMatrix returns a MergedMatrix of `values` (which must all be a
+// model.Matrix, CompactMatrix or *MergedMatrix) using `merger` to merge series
+// which exist in more than one of the values.
+// Note: the series in any model.Matrix or CompactMatrix in `values` are re-ordered
+func NewMergedMatrix(merger SampleStreamMerger, values []model.Value) (*MergedMatrix, error) {
+	m := &MergedMatrix{
+		merger: merger,
+		values: values,
+		labels: make([][]labels.Labels, len(values)),
+	}
+	for i, v := range values {
+		switch vTyped := v.(type) {
+		case model.Matrix:
+			m.labels[i] = sortMatrix(vTyped)
+		case CompactMatrix:
+			m.labels[i] = sortCompactMatrix(vTyped)
+		case *MergedMatrix:
+		default:
+			return nil, fmt.Errorf("unable to merge %v into a matrix", reflect.TypeOf(v))
+		}
+	}
+	return m, nil
+}
+
+// Type implements model.Value
+func (m *MergedMatrix) Type() model.ValueType { return model.ValMatrix }
+
+// String implements model.Value
+func (m *MergedMatrix) String() string { return m.Matrix().String() }
+
+// SeriesSet returns a SeriesSet (sorted by labels) of the merged series
+func (m *MergedMatrix) SeriesSet() storage.SeriesSet {
+	if len(m.values) == 1 {
+		return m.seriesSet(0)
+	}
+	sets := make([]storage.SeriesSet, len(m.values))
+	for i := range m.values {
+		sets[i] = m.seriesSet(i)
+	}
+	return NewMergeSeriesSet(m.merger, sets)
+}
+
+func (m *MergedMatrix) seriesSet(i int) storage.SeriesSet {
+	switch vTyped := m.values[i].(type) {
+	case *MergedMatrix:
+		return vTyped.SeriesSet()
+	case CompactMatrix:
+		return &compactSeriesSet{m: vTyped, labels: m.labels[i], offset: -1}
+	}
+	return &matrixSeriesSet{m: m.values[i].(model.Matrix), labels: m.labels[i], offset: -1}
+}
+
+// Matrix returns the merged series as a model.Matrix
+func (m *MergedMatrix) Matrix() model.Matrix {
+	ret := make(model.Matrix, 0)
+	set := m.SeriesSet()
+	for set.Next() {
+		series := set.At()
+		stream := &model.SampleStream{Metric: LabelsToMetric(series.Labels())}
+		it := series.Iterator()
+		for it.Next() {
+			t, v := it.At()
+			stream.Values = append(stream.Values, model.SamplePair{Timestamp: model.Time(t), Value: model.SampleValue(v)})
+		}
+		ret = append(ret, stream)
+	}
+	return ret
+}
+
+// sortMatrix sorts the series in `m` by their labels, returning the labels of each
+func sortMatrix(m model.Matrix) []labels.Labels {
+	lbls := make([]labels.Labels, len(m))
+	for i, stream := range m {
+		lbls[i] = MetricToLabels(stream.Metric)
+	}
+	sort.Sort(&matrixSorter{m, lbls})
+	return lbls
+}
+
+type matrixSorter struct {
+	m      model.Matrix
+	labels []labels.Labels
+}
+
+func (s *matrixSorter) Len() int           { return len(s.m) }
+func (s *matrixSorter) Less(i, j int) bool { return labels.Compare(s.labels[i], s.labels[j]) < 0 }
+func (s *matrixSorter) Swap(i, j int) {
+	s.m[i], s.m[j] = s.m[j], s.m[i]
+	s.labels[i], s.labels[j] = s.labels[j], s.labels[i]
+}
+
+// matrixSeriesSet is a storage.SeriesSet over a (sorted) model.Matrix
+type matrixSeriesSet struct {
+	m      model.Matrix
+	labels []labels.Labels
+	offset int
+}
+
+func (s *matrixSeriesSet) Next() bool {
+	if s.offset < len(s.m)-1 {
+		s.offset++
+		return true
+	}
+	s.offset = len(s.m)
+	return false
+}
+
+func (s *matrixSeriesSet) At() storage.Series {
+	return &sampleStreamSeries{labels: s.labels[s.offset], values: s.m[s.offset].Values}
+}
+
+func (s *matrixSeriesSet) Err() error { return nil }
+
+type sampleStreamSeries struct {
+	labels labels.Labels
+	values []model.SamplePair
+}
+
+func (s *sampleStreamSeries) Labels() labels.Labels { return s.labels }
+
+func (s *sampleStreamSeries) Iterator() storage.SeriesIterator {
+	return &sampleStreamIterator{values: s.values, offset: -1}
+}
+
+// sampleStreamIterator is a storage.SeriesIterator over a list of SamplePairs
+type sampleStreamIterator struct {
+	values []model.SamplePair
+	offset int
+}
+
+func (s *sampleStreamIterator) Seek(t int64) bool {
+	if s.offset < 0 {
+		s.offset = 0
+	}
+	for ; s.offset < len(s.values); s.offset++ {
+		if int64(s.values[s.offset].Timestamp) >= t {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *sampleStreamIterator) At() (int64, float64) {
+	return int64(s.values[s.offset].Timestamp), float64(s.values[s.offset].Value)
+}
+
+func (s *sampleStreamIterator) Next() bool {
+	if s.offset < len(s.values)-1 {
+		s.offset++
+		return true
+	}
+	s.offset = len(s.values)
+	return false
+}
+
+func (s *sampleStreamIterator) Err() error { return nil }
+
+// NewMergeSeriesSet returns a SeriesSet which lazily merges `sets` (which must
+// each be sorted by labels). Series which exist in more than one set are merged
+// with `merger`
+func NewMergeSeriesSet(merger SampleStreamMerger, sets []storage.SeriesSet) storage.SeriesSet {
+	return &mergeSeriesSet{merger: merger, sets: sets}
+}
+
+type mergeSeriesSet struct {
+	merger  SampleStreamMerger
+	sets    []storage.SeriesSet
+	h       seriesSetHeap
+	started bool
+	cur     storage.Series
+	err     error
+}
+
+func (s *mergeSeriesSet) Next() bool {
+	if s.err != nil {
+		return false
+	}
+
+	if !s.started {
+		s.started = true
+		for _, set := range s.sets {
+			s.push(set)
+		}
+	}
+	if len(s.h) == 0 {
+		return false
+	}
+
+	// Pop all sets whose current series has the lowest labels
+	lbls := s.h[0].At().Labels()
+	series := make([]storage.Series, 0, 1)
+	popped := make([]storage.SeriesSet, 0, 1)
+	for len(s.h) > 0 && labels.Equal(s.h[0].At().Labels(), lbls) {
+		set := heap.Pop(&s.h).(storage.SeriesSet)
+		series = append(series, set.At())
+		popped = append(popped, set)
+	}
+	for _, set := range popped {
+		s.push(set)
+	}
+	if s.err != nil {
+		return false
+	}
+
+	if len(series) == 1 {
+		s.cur = series[0]
+	} else {
+		s.cur = &mergedSeries{merger: s.merger, labels: lbls, series: series}
+	}
+	return true
+}
+
+// push advances `set` and adds it to the heap (if it has a next series)
+func (s *mergeSeriesSet) push(set storage.SeriesSet) {
+	if set.Next() {
+		heap.Push(&s.h, set)
+	} else if err := set.Err(); err != nil {
+		s.err = err
+	}
+}
+
+func (s *mergeSeriesSet) At() storage.Series { return s.cur }
+
+func (s *mergeSeriesSet) Err() error { return s.err }
+
+type seriesSetHeap []storage.SeriesSet
+
+func (h seriesSetHeap) Len() int      { return len(h) }
+func (h seriesSetHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h seriesSetHeap) Less(i, j int) bool {
+	return labels.Compare(h[i].At().Labels(), h[j].At().Labels()) < 0
+}
+
+func (h *seriesSetHeap) Push(x interface{}) {
+	*h = append(*h, x.(storage.SeriesSet))
+}
+
+func (h *seriesSetHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[0 : n-1]
+	return x
+}
+
+// mergedSeries is a series which exists in multiple downstreams
+type mergedSeries struct {
+	merger SampleStreamMerger
+	labels labels.Labels
+	series []storage.Series
+}
+
+func (s *mergedSeries) Labels() labels.Labels { return s.labels }
+
+func (s *mergedSeries) Iterator() storage.SeriesIterator {
+	its := make([]storage.SeriesIterator, len(s.series))
+	for i, series := range s.series {
+		its[i] = series.Iterator()
+	}
+	return s.merger.MergeIterators(its)
+}
+
+// penaltyFunc returns the penalty for the iterators which didn't produce the
+// last point, given the interval between the last 2 points (`first` is set if
+// there was no point before the last one)
+type penaltyFunc func(delta model.Time, first bool) model.Time
+
+// mergeIterator merges N iterators of the same series. Each point is taken from
+// the iterator with the earliest next point, skipping any points which are within
+// a penalty of the last point; the iterator which produced the last point has
+// no penalty so all of its points are used (until there is a larger gap than the
+// penalty in its data)
+type mergeIterator struct {
+	h       iteratorHeap
+	its     []storage.SeriesIterator
+	penalty penaltyFunc
+
+	started bool
+	first   bool
+	lastT   int64
+	lastV   float64
+	err     error
+}
+
+func newMergeIterator(its []storage.SeriesIterator, penalty penaltyFunc) *mergeIterator {
+	return &mergeIterator{its: its, penalty: penalty, first: true}
+}
+
+func (m *mergeIterator) Next() bool {
+	if m.err != nil {
+		return false
+	}
+	if !m.started {
+		m.started = true
+		for i, it := range m.its {
+			m.push(&iteratorHeapItem{it: it, index: i})
+		}
+	} else {
+		// Skip any points within the penalty of the last point
+		for len(m.h) > 0 && m.h[0].t <= m.lastT+int64(m.h[0].penalty) {
+			item := heap.Pop(&m.h).(*iteratorHeapItem)
+			m.push(item)
+		}
+	}
+	if m.err != nil || len(m.h) == 0 {
+		return false
+	}
+
+	// The top of the heap is our next point
+	chosen := m.h[0]
+	t, v := chosen.t, chosen.v
+
+	var otherPenalty model.Time
+	if m.started && !m.first {
+		otherPenalty = m.penalty(model.Time(t-m.lastT), false)
+	} else {
+		otherPenalty = m.penalty(0, true)
+	}
+	for _, item := range m.h {
+		item.penalty = otherPenalty
+	}
+	chosen.penalty = 0
+	m.first = false
+
+	m.lastT, m.lastV = t, v
+	return true
+}
+
+// push advances the item's iterator and adds it to the heap (if it has a next point)
+func (m *mergeIterator) push(item *iteratorHeapItem) {
+	if item.it.Next() {
+		item.t, item.v = item.it.At()
+		heap.Push(&m.h, item)
+	} else if err := item.it.Err(); err != nil {
+		m.err = err
+	}
+}
+
+func (m *mergeIterator) Seek(t int64) bool {
+	if m.started && !m.first && m.lastT >= t {
+		return true
+	}
+	for m.Next() {
+		if m.lastT >= t {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *mergeIterator) At() (int64, float64) { return m.lastT, m.lastV }
+
+func (m *mergeIterator) Err() error { return m.err }
+
+type iteratorHeapItem struct {
+	it      storage.SeriesIterator
+	index   int
+	t       int64
+	v       float64
+	penalty model.Time
+}
+
+type iteratorHeap []*iteratorHeapItem
+
+func (h iteratorHeap) Len() int      { return len(h) }
+func (h iteratorHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+// Less orders by timestamp, preferring the earlier iterator for identical timestamps
+func (h iteratorHeap) Less(i, j int) bool {
+	if h[i].t == h[j].t {
+		return h[i].index < h[j].index
+	}
+	return h[i].t < h[j].t
+}
+
+func (h *iteratorHeap) Push(x interface{}) {
+	*h = append(*h, x.(*iteratorHeapItem))
+}
+
+func (h *iteratorHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[0 : n-1]
+	return x
+}
@@ -0,0 +1,123 @@
+package promhttputil
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestMergedMatrix(t *testing.T) {
+	stream := func(name string, values []model.SamplePair) *model.SampleStream {
+		return &model.SampleStream{Metric: model.Metric{model.MetricNameLabel: model.LabelValue(name)}, Values: values}
+	}
+
+	tests := []struct {
+		name   string
+		merger SampleStreamMerger
+		values []model.Value
+		r      model.Matrix
+	}{
+		// Series only in one downstream are passed through, and sorted by labels
+		{
+			name:   "disjoint",
+			merger: AntiAffinityMerger(model.TimeFromUnix(10)),
+			values: []model.Value{
+				model.Matrix{stream("c", points(0, 1)), stream("a", points(0, 1))},
+				model.Matrix{stream("b", points(0, 2))},
+			},
+			r: model.Matrix{stream("a", points(0, 1)), stream("b", points(0, 2)), stream("c", points(0, 1))},
+		},
+		// Anti-affinity only fills holes which are larger than the buffer
+		{
+			name:   "anti-affinity",
+			merger: AntiAffinityMerger(model.TimeFromUnix(10)),
+			values: []model.Value{
+				model.Matrix{stream("a", points(0, 1, 15, 1, 30, 1, 90, 1))},
+				model.Matrix{stream("a", points(5, 2, 20, 2, 35, 2, 50, 2, 65, 2))},
+				model.Matrix{stream("a", points(1, 3, 16, 3, 31, 3, 46, 3, 91, 3))},
+			},
+			r: model.Matrix{stream("a", points(0, 1, 15, 1, 30, 1, 46, 3, 65, 2, 90, 1))},
+		},
+		// Identical points are deduplicated
+		{
+			name:   "identical",
+			merger: AntiAffinityMerger(0),
+			values: []model.Value{
+				model.Matrix{stream("a", points(0, 1, 15, 1))},
+				model.Matrix{stream("a", points(0, 1, 15, 1))},
+			},
+			r: model.Matrix{stream("a", points(0, 1, 15, 1))},
+		},
+		// The iterator merge for dedup matches DedupSampleStream
+		{
+			name:   "dedup",
+			merger: DedupMerger(0),
+			values: []model.Value{
+				model.Matrix{stream("a", points(0, 0, 15, 15, 30, 30, 90, 90, 105, 105))},
+				model.Matrix{stream("a", points(5, 5, 20, 20, 35, 35, 50, 50, 65, 65, 80, 80, 95, 95, 110, 110))},
+			},
+			r: model.Matrix{stream("a", points(0, 0, 15, 15, 30, 30, 65, 65, 80, 80, 95, 95, 110, 110))},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m, err := NewMergedMatrix(test.merger, test.values)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result := m.Matrix(); !reflect.DeepEqual(result, test.r) {
+				t.Fatalf("mismatch\nexpected=%v\nactual=%v", test.r, result)
+			}
+
+			// Nesting a MergedMatrix gives the same result
+			nested, err := NewMergedMatrix(test.merger, []model.Value{m})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result := nested.Matrix(); !reflect.DeepEqual(result, test.r) {
+				t.Fatalf("nested mismatch\nexpected=%v\nactual=%v", test.r, result)
+			}
+		})
+	}
+
+	if _, err := NewMergedMatrix(AntiAffinityMerger(0), []model.Value{model.Vector{}}); err == nil {
+		t.Fatalf("expected error merging a vector into a matrix")
+	}
+}
+
+func TestMergeIteratorSeek(t *testing.T) {
+	m, err := NewMergedMatrix(AntiAffinityMerger(0), []model.Value{
+		model.Matrix{{Metric: model.Metric{"a": "1"}, Values: points(0, 1, 15, 1, 30, 1)}},
+		model.Matrix{{Metric: model.Metric{"a": "1"}, Values: points(10, 2, 20, 2)}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	set := m.SeriesSet()
+	if !set.Next() {
+		t.Fatalf("missing series")
+	}
+	it := set.At().Iterator()
+	if !it.Seek(12000) {
+		t.Fatalf("seek failed")
+	}
+	if ts, v := it.At(); ts != 15000 || v != 1 {
+		t.Fatalf("unexpected point after seek: %d %f", ts, v)
+	}
+	// Seeking backwards stays at the current point
+	if !it.Seek(0) {
+		t.Fatalf("seek failed")
+	}
+	if ts, _ := it.At(); ts != 15000 {
+		t.Fatalf("unexpected point after backwards seek: %d", ts)
+	}
+	if it.Seek(31000) {
+		t.Fatalf("expected seek past the end to fail")
+	}
+	if set.Next() {
+		t.Fatalf("unexpected extra series")
+	}
+}
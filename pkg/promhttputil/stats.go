@@ -0,0 +1,55 @@
+package promhttputil
+
+import "github.com/prometheus/common/model"
+
+// SeriesCount returns the number of series contained in the value
+func SeriesCount(a model.Value) int {
+	switch aTyped := a.(type) {
+	case *model.Scalar, *model.String:
+		return 1
+	case model.Vector:
+		return len(aTyped)
+	case model.Matrix:
+		return len(aTyped)
+	case CompactMatrix:
+		return len(aTyped)
+	case *MergedMatrix:
+		count := 0
+		for set := aTyped.SeriesSet(); set.Next(); {
+			count++
+		}
+		return count
+	}
+	return 0
+}
+
+// SampleCount returns the number of samples contained in the value
+func SampleCount(a model.Value) int {
+	switch aTyped := a.(type) {
+	case *model.Scalar, *model.String:
+		return 1
+	case model.Vector:
+		return len(aTyped)
+	case model.Matrix:
+		count := 0
+		for _, stream := range aTyped {
+			count += len(stream.Values)
+		}
+		return count
+	case CompactMatrix:
+		count := 0
+		for _, series := range aTyped {
+			count += len(series.Timestamps)
+		}
+		return count
+	case *MergedMatrix:
+		// To avoid doing the merge just to count, this is the count of samples
+		// from all downstreams (before merging)
+		count := 0
+		for _, v := range aTyped.values {
+			count += SampleCount(v)
+		}
+		return count
+	}
+	return 0
+}
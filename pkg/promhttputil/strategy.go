@@ -0,0 +1,166 @@
+package promhttputil
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/value"
+)
+
+// MergeStrategy decides which value to use when multiple downstreams return a
+// value for the same series of a Vector (or for a Scalar)
+type MergeStrategy interface {
+	// MergeSample returns the sample to use out of `a` and `b` (which are
+	// for the same series). `a` is the result of all previous merges
+	MergeSample(a, b *model.Sample) *model.Sample
+	// MergeScalar returns the scalar to use out of `a` and `b`. `a` is the
+	// result of all previous merges
+	MergeScalar(a, b *model.Scalar) *model.Scalar
+}
+
+// Names of the built-in MergeStrategies
+const (
+	MergeStrategyReplaceZero = "replace_zero"
+	MergeStrategyNewest      = "newest"
+	MergeStrategyFirst       = "first"
+	MergeStrategyNonStale    = "non_stale"
+	MergeStrategyMax         = "max"
+	MergeStrategyMin         = "min"
+)
+
+// DefaultMergeStrategy is the MergeStrategy used if none is configured
+var DefaultMergeStrategy MergeStrategy = ReplaceZeroMergeStrategy{}
+
+var mergeStrategies = map[string]MergeStrategy{
+	MergeStrategyReplaceZero: ReplaceZeroMergeStrategy{},
+	MergeStrategyNewest:      NewestMergeStrategy{},
+	MergeStrategyFirst:       FirstMergeStrategy{},
+	MergeStrategyNonStale:    NonStaleMergeStrategy{},
+	MergeStrategyMax:         MaxMergeStrategy{},
+	MergeStrategyMin:         MinMergeStrategy{},
+}
+
+// GetMergeStrategy returns the built-in MergeStrategy with the given name
+func GetMergeStrategy(name string) (MergeStrategy, error) {
+	if s, ok := mergeStrategies[name]; ok {
+		return s, nil
+	}
+	names := make([]string, 0, len(mergeStrategies))
+	for n := range mergeStrategies {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return nil, fmt.Errorf("unknown merge strategy %q, options are %v", name, names)
+}
+
+// ReplaceZeroMergeStrategy is promxy's original behavior: for vectors the value
+// of `a` is replaced only if it is 0, for scalars `a` is used unless it is 0.
+// Note: this means that a legitimate value of 0 can be replaced by another value
+type ReplaceZeroMergeStrategy struct{}
+
+// MergeSample implements MergeStrategy
+func (ReplaceZeroMergeStrategy) MergeSample(a, b *model.Sample) *model.Sample {
+	if a.Value == model.SampleValue(0) {
+		return &model.Sample{Metric: a.Metric, Value: b.Value, Timestamp: a.Timestamp}
+	}
+	return a
+}
+
+// MergeScalar implements MergeStrategy
+func (ReplaceZeroMergeStrategy) MergeScalar(a, b *model.Scalar) *model.Scalar {
+	if a.Value != 0 && a.Timestamp != 0 {
+		return a
+	}
+	return b
+}
+
+// NewestMergeStrategy uses the value with the newest timestamp
+type NewestMergeStrategy struct{}
+
+// MergeSample implements MergeStrategy
+func (NewestMergeStrategy) MergeSample(a, b *model.Sample) *model.Sample {
+	if b.Timestamp > a.Timestamp {
+		return b
+	}
+	return a
+}
+
+// MergeScalar implements MergeStrategy
+func (NewestMergeStrategy) MergeScalar(a, b *model.Scalar) *model.Scalar {
+	if b.Timestamp > a.Timestamp {
+		return b
+	}
+	return a
+}
+
+// FirstMergeStrategy uses the value from the first downstream to respond
+type FirstMergeStrategy struct{}
+
+// MergeSample implements MergeStrategy
+func (FirstMergeStrategy) MergeSample(a, b *model.Sample) *model.Sample { return a }
+
+// MergeScalar implements MergeStrategy
+func (FirstMergeStrategy) MergeScalar(a, b *model.Scalar) *model.Scalar { return a }
+
+// NonStaleMergeStrategy uses the first value which isn't a stale marker
+type NonStaleMergeStrategy struct{}
+
+// isStale returns whether v is a stale marker, a genuine NaN is not stale
+func isStale(v model.SampleValue) bool {
+	return value.IsStaleNaN(float64(v))
+}
+
+// MergeSample implements MergeStrategy
+func (NonStaleMergeStrategy) MergeSample(a, b *model.Sample) *model.Sample {
+	if isStale(a.Value) && !isStale(b.Value) {
+		return b
+	}
+	return a
+}
+
+// MergeScalar implements MergeStrategy
+func (NonStaleMergeStrategy) MergeScalar(a, b *model.Scalar) *model.Scalar {
+	if isStale(a.Value) && !isStale(b.Value) {
+		return b
+	}
+	return a
+}
+
+// MaxMergeStrategy uses the largest value (ignoring stale markers), this is useful for gauges
+type MaxMergeStrategy struct{}
+
+// MergeSample implements MergeStrategy
+func (MaxMergeStrategy) MergeSample(a, b *model.Sample) *model.Sample {
+	if isStale(a.Value) || (!isStale(b.Value) && b.Value > a.Value) {
+		return b
+	}
+	return a
+}
+
+// MergeScalar implements MergeStrategy
+func (MaxMergeStrategy) MergeScalar(a, b *model.Scalar) *model.Scalar {
+	if isStale(a.Value) || (!isStale(b.Value) && b.Value > a.Value) {
+		return b
+	}
+	return a
+}
+
+// MinMergeStrategy uses the smallest value (ignoring stale markers), this is useful for gauges
+type MinMergeStrategy struct{}
+
+// MergeSample implements MergeStrategy
+func (MinMergeStrategy) MergeSample(a, b *model.Sample) *model.Sample {
+	if isStale(a.Value) || (!isStale(b.Value) && b.Value < a.Value) {
+		return b
+	}
+	return a
+}
+
+// MergeScalar implements MergeStrategy
+func (MinMergeStrategy) MergeScalar(a, b *model.Scalar) *model.Scalar {
+	if isStale(a.Value) || (!isStale(b.Value) && b.Value < a.Value) {
+		return b
+	}
+	return a
+}
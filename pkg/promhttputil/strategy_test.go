@@ -0,0 +1,78 @@
+package promhttputil
+
+import (
+	"math"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/value"
+)
+
+func TestMergeStrategies(t *testing.T) {
+	staleNaN := model.SampleValue(math.Float64frombits(value.StaleNaN))
+	nan := model.SampleValue(math.NaN())
+
+	tests := []struct {
+		strategy string
+		a, b     model.SamplePair
+		r        model.SamplePair
+	}{
+		// replace_zero keeps the original behavior, including replacing a legitimate 0
+		{MergeStrategyReplaceZero, model.SamplePair{Timestamp: 100, Value: 0}, model.SamplePair{Timestamp: 100, Value: 5}, model.SamplePair{Timestamp: 100, Value: 5}},
+		{MergeStrategyReplaceZero, model.SamplePair{Timestamp: 100, Value: 1}, model.SamplePair{Timestamp: 100, Value: 5}, model.SamplePair{Timestamp: 100, Value: 1}},
+
+		{MergeStrategyNewest, model.SamplePair{Timestamp: 100, Value: 0}, model.SamplePair{Timestamp: 200, Value: 5}, model.SamplePair{Timestamp: 200, Value: 5}},
+		{MergeStrategyNewest, model.SamplePair{Timestamp: 200, Value: 0}, model.SamplePair{Timestamp: 100, Value: 5}, model.SamplePair{Timestamp: 200, Value: 0}},
+
+		{MergeStrategyFirst, model.SamplePair{Timestamp: 100, Value: 0}, model.SamplePair{Timestamp: 200, Value: 5}, model.SamplePair{Timestamp: 100, Value: 0}},
+
+		{MergeStrategyNonStale, model.SamplePair{Timestamp: 100, Value: staleNaN}, model.SamplePair{Timestamp: 100, Value: 5}, model.SamplePair{Timestamp: 100, Value: 5}},
+		{MergeStrategyNonStale, model.SamplePair{Timestamp: 100, Value: 0}, model.SamplePair{Timestamp: 100, Value: 5}, model.SamplePair{Timestamp: 100, Value: 0}},
+		// A genuine NaN (e.g. 0/0) is a value, not a stale marker
+		{MergeStrategyNonStale, model.SamplePair{Timestamp: 100, Value: nan}, model.SamplePair{Timestamp: 100, Value: 5}, model.SamplePair{Timestamp: 100, Value: nan}},
+
+		{MergeStrategyMax, model.SamplePair{Timestamp: 100, Value: 1}, model.SamplePair{Timestamp: 100, Value: 5}, model.SamplePair{Timestamp: 100, Value: 5}},
+		{MergeStrategyMax, model.SamplePair{Timestamp: 100, Value: 1}, model.SamplePair{Timestamp: 100, Value: staleNaN}, model.SamplePair{Timestamp: 100, Value: 1}},
+
+		{MergeStrategyMin, model.SamplePair{Timestamp: 100, Value: 1}, model.SamplePair{Timestamp: 100, Value: 5}, model.SamplePair{Timestamp: 100, Value: 1}},
+		{MergeStrategyMin, model.SamplePair{Timestamp: 100, Value: staleNaN}, model.SamplePair{Timestamp: 100, Value: 5}, model.SamplePair{Timestamp: 100, Value: 5}},
+	}
+
+	metric := model.Metric{model.MetricNameLabel: "foo"}
+	for i, test := range tests {
+		strategy, err := GetMergeStrategy(test.strategy)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Vectors
+		v, err := MergeValuesWith(strategy, nil,
+			model.Vector{{Metric: metric, Timestamp: test.a.Timestamp, Value: test.a.Value}},
+			model.Vector{{Metric: metric, Timestamp: test.b.Timestamp, Value: test.b.Value}},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		vector := v.(model.Vector)
+		if len(vector) != 1 || !test.r.Equal(&model.SamplePair{Timestamp: vector[0].Timestamp, Value: vector[0].Value}) {
+			t.Fatalf("%d %s: vector mismatch expected=%v actual=%v", i, test.strategy, test.r, vector)
+		}
+
+		// Scalars
+		v, err = MergeValuesWith(strategy, nil,
+			&model.Scalar{Timestamp: test.a.Timestamp, Value: test.a.Value},
+			&model.Scalar{Timestamp: test.b.Timestamp, Value: test.b.Value},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		scalar := v.(*model.Scalar)
+		if !test.r.Equal(&model.SamplePair{Timestamp: scalar.Timestamp, Value: scalar.Value}) {
+			t.Fatalf("%d %s: scalar mismatch expected=%v actual=%v", i, test.strategy, test.r, scalar)
+		}
+	}
+
+	if _, err := GetMergeStrategy("foo"); err == nil {
+		t.Fatalf("expected error for unknown strategy")
+	}
+}
@@ -0,0 +1,136 @@
+package promxyapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/common/route"
+	"github.com/sirupsen/logrus"
+
+	"github.com/jacksontj/promxy/pkg/servergroup"
+)
+
+// AdminAPI allows runtime overrides of the servergroups (disabling servergroups
+// or targets and pinning servergroups to a single target)
+type AdminAPI struct {
+	ServerGroups ServerGroupLister
+	// Enabled gates all admin endpoints (same as prometheus' lifecycle API)
+	Enabled bool
+}
+
+// Register registers the admin endpoints on the router `r`. Servergroups are
+// addressed by their name (see servergroup.Config.Name)
+func (a *AdminAPI) Register(r *route.Router) {
+	r.Post("/servergroups/:name/disable", a.wrap("disable", a.disable))
+	r.Post("/servergroups/:name/enable", a.wrap("enable", a.enable))
+	r.Post("/servergroups/:name/pin", a.wrap("pin", a.pin))
+	r.Post("/servergroups/:name/unpin", a.wrap("unpin", a.unpin))
+}
+
+type errorResponse struct {
+	Status string `json:"status"`
+	Error  string `json:"error"`
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(&errorResponse{Status: "error", Error: err.Error()})
+}
+
+type adminFunc func(sg *servergroup.ServerGroup, target string, ttl time.Duration) error
+
+// wrap handles the gating, argument parsing and audit logging for all admin endpoints
+func (a *AdminAPI) wrap(action string, f adminFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !a.Enabled {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("Lifecycle API is not enabled."))
+			return
+		}
+
+		name := route.Param(r.Context(), "name")
+		var sg *servergroup.ServerGroup
+		for _, s := range a.ServerGroups.ServerGroups() {
+			if s.Cfg.GetName() != name {
+				continue
+			}
+			if sg != nil {
+				writeError(w, http.StatusConflict, fmt.Errorf("servergroup name %q is ambiguous, set a unique name in its config", name))
+				return
+			}
+			sg = s
+		}
+		if sg == nil {
+			writeError(w, http.StatusNotFound, fmt.Errorf("unknown servergroup %q", name))
+			return
+		}
+
+		var ttl time.Duration
+		if s := r.FormValue("ttl"); s != "" {
+			d, err := model.ParseDuration(s)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("invalid ttl %q: %v", s, err))
+				return
+			}
+			ttl = time.Duration(d)
+		}
+		target := r.FormValue("target")
+
+		if err := f(sg, target, ttl); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"action":      action,
+			"servergroup": name,
+			"target":      target,
+			"ttl":         ttl.String(),
+			"remote_addr": r.RemoteAddr,
+			"user_agent":  r.UserAgent(),
+		}).Warn("Servergroup override changed")
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&response{
+			Status: "success",
+			Data:   sg.Overrides(),
+		})
+	}
+}
+
+// disable disables the servergroup, or a single target if `target` is set
+func (a *AdminAPI) disable(sg *servergroup.ServerGroup, target string, ttl time.Duration) error {
+	if target == "" {
+		sg.SetDisabled(true, ttl)
+	} else {
+		sg.SetTargetDisabled(target, true, ttl)
+	}
+	return nil
+}
+
+// enable re-enables the servergroup, or a single target if `target` is set
+func (a *AdminAPI) enable(sg *servergroup.ServerGroup, target string, _ time.Duration) error {
+	if target == "" {
+		sg.SetDisabled(false, 0)
+	} else {
+		sg.SetTargetDisabled(target, false, 0)
+	}
+	return nil
+}
+
+func (a *AdminAPI) pin(sg *servergroup.ServerGroup, target string, ttl time.Duration) error {
+	if target == "" {
+		return fmt.Errorf("target is required")
+	}
+	sg.SetPinned(target, ttl)
+	return nil
+}
+
+func (a *AdminAPI) unpin(sg *servergroup.ServerGroup, _ string, _ time.Duration) error {
+	sg.SetPinned("", 0)
+	return nil
+}
@@ -0,0 +1,93 @@
+package promxyapi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/common/route"
+
+	"github.com/jacksontj/promxy/pkg/servergroup"
+)
+
+func TestAdminAPI(t *testing.T) {
+	sg := servergroup.New()
+	defer sg.Cancel()
+	sg.Cfg = &servergroup.Config{Name: "a"}
+	// Servergroups without a name are addressed by their labels
+	labeled := servergroup.New()
+	defer labeled.Cancel()
+	labeled.Cfg = &servergroup.Config{Labels: model.LabelSet{"sg": "c"}}
+	// Names must be unique to be addressable
+	duplicate := []*servergroup.ServerGroup{servergroup.New(), servergroup.New()}
+	for _, d := range duplicate {
+		defer d.Cancel()
+		d.Cfg = &servergroup.Config{Name: "b"}
+	}
+
+	a := &AdminAPI{ServerGroups: staticLister{sg, labeled, duplicate[0], duplicate[1]}}
+	r := route.New()
+	a.Register(r.WithPrefix("/api/v1/promxy"))
+
+	do := func(path string) int {
+		resp := httptest.NewRecorder()
+		r.ServeHTTP(resp, httptest.NewRequest("POST", path, nil))
+		return resp.Code
+	}
+
+	if code := do("/api/v1/promxy/servergroups/a/disable"); code != http.StatusForbidden {
+		t.Fatalf("expected forbidden with admin API disabled, got %d", code)
+	}
+
+	a.Enabled = true
+	tests := []struct {
+		path  string
+		code  int
+		check func(servergroup.Overrides) bool
+	}{
+		{"/api/v1/promxy/servergroups/0/disable", http.StatusNotFound, nil},
+		{"/api/v1/promxy/servergroups/b/disable", http.StatusConflict, nil},
+		{"/api/v1/promxy/servergroups/a/disable?ttl=foo", http.StatusBadRequest, nil},
+		{"/api/v1/promxy/servergroups/a/pin", http.StatusBadRequest, nil},
+		{
+			"/api/v1/promxy/servergroups/a/disable?target=host:9090&ttl=1h", http.StatusOK,
+			func(o servergroup.Overrides) bool {
+				return o.DisabledTargets["host:9090"] != nil && !o.DisabledTargets["host:9090"].Expires.IsZero()
+			},
+		},
+		{
+			"/api/v1/promxy/servergroups/a/enable?target=host:9090", http.StatusOK,
+			func(o servergroup.Overrides) bool { return o.Empty() },
+		},
+		{
+			"/api/v1/promxy/servergroups/a/pin?target=host:9091", http.StatusOK,
+			func(o servergroup.Overrides) bool { return o.Pinned != nil && o.Pinned.Target == "host:9091" },
+		},
+		{
+			"/api/v1/promxy/servergroups/a/unpin", http.StatusOK,
+			func(o servergroup.Overrides) bool { return o.Pinned == nil },
+		},
+		{
+			"/api/v1/promxy/servergroups/a/disable", http.StatusOK,
+			func(o servergroup.Overrides) bool { return o.Disabled != nil },
+		},
+	}
+
+	for i, test := range tests {
+		if code := do(test.path); code != test.code {
+			t.Fatalf("%d: expected code %d got %d", i, test.code, code)
+		}
+		if test.check != nil && !test.check(sg.Overrides()) {
+			t.Fatalf("%d: unexpected overrides: %+v", i, sg.Overrides())
+		}
+	}
+
+	if code := do("/api/v1/promxy/servergroups/" + url.PathEscape(`{sg="c"}`) + "/disable"); code != http.StatusOK {
+		t.Fatalf("expected servergroup to be addressed by its labels, got %d", code)
+	}
+	if o := labeled.Overrides(); o.Disabled == nil {
+		t.Fatalf("unexpected overrides: %+v", o)
+	}
+}
@@ -0,0 +1,181 @@
+package promxyapi
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+
+	"github.com/jacksontj/promxy/pkg/servergroup"
+)
+
+// ServerGroupLister returns the currently configured servergroups
+type ServerGroupLister interface {
+	ServerGroups() []*servergroup.ServerGroup
+}
+
+// ServerGroupStatus is the status of a single servergroup
+type ServerGroupStatus struct {
+	Name              string                               `json:"name"`
+	Labels            model.LabelSet                       `json:"labels"`
+	RemoteRead        bool                                 `json:"remoteRead"`
+	AbsoluteTimeRange *servergroup.AbsoluteTimeRangeConfig `json:"absoluteTimeRange,omitempty"`
+	RelativeTimeRange *RelativeTimeRange                   `json:"relativeTimeRange,omitempty"`
+	LastSync          *time.Time                           `json:"lastSync,omitempty"`
+	Overrides         servergroup.Overrides                `json:"overrides"`
+	Targets           []*TargetStatus                      `json:"targets"`
+}
+
+// RelativeTimeRange is the JSON representation of a servergroup.RelativeTimeRangeConfig
+type RelativeTimeRange struct {
+	Start string `json:"start,omitempty"`
+	End   string `json:"end,omitempty"`
+}
+
+// TargetStatus is the status of a single discovered target of a servergroup
+type TargetStatus struct {
+	URL              string        `json:"url,omitempty"`
+	DiscoveredLabels labels.Labels `json:"discoveredLabels"`
+	Labels           labels.Labels `json:"labels"`
+	Dropped          bool          `json:"dropped"`
+	Disabled         bool          `json:"disabled"`
+	Pinned           bool          `json:"pinned"`
+	*servergroup.TargetStatsSnapshot
+}
+
+// ServerGroupsStatus returns the status of all servergroups
+func ServerGroupsStatus(sgs []*servergroup.ServerGroup) []*ServerGroupStatus {
+	ret := make([]*ServerGroupStatus, len(sgs))
+	for i, sg := range sgs {
+		s := &ServerGroupStatus{
+			Name:              sg.Cfg.GetName(),
+			Labels:            sg.Cfg.Labels,
+			RemoteRead:        sg.Cfg.RemoteRead,
+			AbsoluteTimeRange: sg.Cfg.AbsoluteTimeRangeConfig,
+			Overrides:         sg.Overrides(),
+			Targets:           make([]*TargetStatus, 0),
+		}
+		if tr := sg.Cfg.RelativeTimeRangeConfig; tr != nil {
+			s.RelativeTimeRange = &RelativeTimeRange{}
+			if tr.Start != nil {
+				s.RelativeTimeRange.Start = tr.Start.String()
+			}
+			if tr.End != nil {
+				s.RelativeTimeRange.End = tr.End.String()
+			}
+		}
+
+		state := sg.State()
+		if state == nil {
+			ret[i] = s
+			continue
+		}
+		if !state.LastSync.IsZero() {
+			lastSync := state.LastSync
+			s.LastSync = &lastSync
+		}
+		for _, t := range state.DiscoveredTargets {
+			ts := &TargetStatus{
+				URL:              t.URL,
+				DiscoveredLabels: t.DiscoveredLabels,
+				Labels:           t.Labels,
+				Dropped:          len(t.Labels) == 0,
+			}
+			if !ts.Dropped {
+				host := t.Labels.Get(model.AddressLabel)
+				ts.Disabled = s.Overrides.TargetDisabled(host)
+				ts.Pinned = s.Overrides.Pinned != nil && s.Overrides.Pinned.Target == host
+			}
+			if t.Stats != nil {
+				snap := t.Stats.Snapshot()
+				ts.TargetStatsSnapshot = &snap
+			}
+			s.Targets = append(s.Targets, ts)
+		}
+		ret[i] = s
+	}
+	return ret
+}
+
+type response struct {
+	Status string      `json:"status"`
+	Data   interface{} `json:"data,omitempty"`
+}
+
+// NewServerGroupsHandler returns an http.Handler which serves the status of
+// all servergroups as JSON (in the same envelope as the prometheus API)
+func NewServerGroupsHandler(l ServerGroupLister) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&response{
+			Status: "success",
+			Data:   ServerGroupsStatus(l.ServerGroups()),
+		})
+	})
+}
+
+// NewServerGroupsPage returns an http.Handler which renders the status of all
+// servergroups as an HTML page
+func NewServerGroupsPage(l ServerGroupLister) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := serverGroupsTemplate.Execute(w, ServerGroupsStatus(l.ServerGroups())); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+var serverGroupsTemplate = template.Must(template.New("servergroups").Funcs(template.FuncMap{
+	"formatTime": func(t time.Time) string {
+		if t.IsZero() {
+			return "never"
+		}
+		return t.UTC().Format(time.RFC3339)
+	},
+	"percent": func(f float64) float64 {
+		return f * 100
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>Promxy Server Groups</title>
+<style>
+body { font-family: sans-serif; margin: 20px; }
+table { border-collapse: collapse; width: 100%; margin-bottom: 30px; }
+th, td { border: 1px solid #ddd; padding: 4px 8px; text-align: left; vertical-align: top; }
+.up { color: #3c763d; }
+.down { color: #a94442; }
+.unknown, .dropped { color: #777; }
+</style>
+</head>
+<body>
+<h1>Server Groups</h1>
+{{range .}}
+<h2>Server Group {{.Name}}</h2>
+<p>
+remote_read: {{.RemoteRead}}
+{{with .AbsoluteTimeRange}}| absolute_time_range: {{formatTime .Start}} - {{formatTime .End}}{{end}}
+{{with .RelativeTimeRange}}| relative_time_range: {{.Start}} - {{.End}}{{end}}
+| last sync: {{if .LastSync}}{{formatTime .LastSync}}{{else}}never{{end}}
+{{with .Overrides.Disabled}}| <span class="down">disabled{{if not .Expires.IsZero}} until {{formatTime .Expires}}{{end}}</span>{{end}}
+{{with .Overrides.Pinned}}| pinned to {{.Target}}{{if not .Expires.IsZero}} until {{formatTime .Expires}}{{end}}{{end}}
+</p>
+<table>
+<tr><th>Target</th><th>Health</th><th>Latency (s)</th><th>Error Rate (%)</th><th>Last Request</th><th>Labels</th><th>Discovered Labels</th></tr>
+{{range .Targets}}
+{{if .Dropped}}
+<tr class="dropped"><td>dropped</td><td></td><td></td><td></td><td></td><td></td><td>{{.DiscoveredLabels}}</td></tr>
+{{else}}
+<tr><td>{{.URL}}{{if .Disabled}} (disabled){{end}}{{if .Pinned}} (pinned){{end}}</td>
+{{with .TargetStatsSnapshot}}<td class="{{.Health}}">{{.Health}}</td><td>{{printf "%.3f" .Latency}}</td><td>{{printf "%.1f" (percent .ErrorRate)}}</td><td>{{formatTime .LastRequest}}</td>{{else}}<td></td><td></td><td></td><td></td>{{end}}
+<td>{{.Labels}}</td><td>{{.DiscoveredLabels}}</td></tr>
+{{end}}
+{{end}}
+</table>
+{{end}}
+</body>
+</html>
+`))
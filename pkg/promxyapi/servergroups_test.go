@@ -0,0 +1,81 @@
+package promxyapi
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/jacksontj/promxy/pkg/servergroup"
+)
+
+type staticLister []*servergroup.ServerGroup
+
+func (s staticLister) ServerGroups() []*servergroup.ServerGroup { return s }
+
+func TestServerGroupsHandler(t *testing.T) {
+	cfg := &servergroup.Config{}
+	if err := yaml.Unmarshal([]byte(`
+static_configs:
+  - targets: [localhost:9090, localhost:9091]
+labels:
+  sg: a
+relabel_configs:
+  - source_labels: [__address__]
+    regex: localhost:9091
+    action: drop
+`), cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	sg := servergroup.New()
+	defer sg.Cancel()
+	if err := sg.ApplyConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	<-sg.Ready
+
+	resp := httptest.NewRecorder()
+	NewServerGroupsHandler(staticLister{sg}).ServeHTTP(resp, httptest.NewRequest("GET", "/api/v1/promxy/servergroups", nil))
+
+	var body struct {
+		Status string               `json:"status"`
+		Data   []*ServerGroupStatus `json:"data"`
+	}
+	if err := json.Unmarshal(resp.Body.Bytes(), &body); err != nil {
+		t.Fatalf("unable to unmarshal response %q: %v", resp.Body.String(), err)
+	}
+	if body.Status != "success" || len(body.Data) != 1 {
+		t.Fatalf("unexpected response: %s", resp.Body.String())
+	}
+
+	s := body.Data[0]
+	if s.Labels["sg"] != "a" || s.LastSync == nil {
+		t.Fatalf("unexpected servergroup status: %s", resp.Body.String())
+	}
+	if len(s.Targets) != 2 {
+		t.Fatalf("expected 2 discovered targets, got %d", len(s.Targets))
+	}
+	for _, target := range s.Targets {
+		switch target.DiscoveredLabels.Get("__address__") {
+		case "localhost:9090":
+			if target.Dropped || target.URL != "http://localhost:9090" || target.TargetStatsSnapshot == nil || target.Health != servergroup.HealthUnknown {
+				t.Fatalf("unexpected target status: %+v", target)
+			}
+		case "localhost:9091":
+			if !target.Dropped {
+				t.Fatalf("expected target to be dropped: %+v", target)
+			}
+		default:
+			t.Fatalf("unexpected target: %+v", target)
+		}
+	}
+
+	resp = httptest.NewRecorder()
+	NewServerGroupsPage(staticLister{sg}).ServeHTTP(resp, httptest.NewRequest("GET", "/promxy/servergroups", nil))
+	if !strings.Contains(resp.Body.String(), "http://localhost:9090") {
+		t.Fatalf("target missing from page: %s", resp.Body.String())
+	}
+}
@@ -75,6 +75,16 @@ func (h *ProxyQuerier) Select(selectParams *storage.SelectParams, matchers ...*l
 		return nil, warnings, errors.Cause(err)
 	}
 
+	// Merged results from multiple downstreams are iterated over directly, which
+	// merges the series lazily as prometheus consumes them
+	if merged, ok := result.(*promhttputil.MergedMatrix); ok {
+		return merged.SeriesSet(), warnings, nil
+	}
+	// Compact (streamed) results are iterated over without converting them to a model.Matrix
+	if compact, ok := result.(promhttputil.CompactMatrix); ok {
+		return compact.SeriesSet(), warnings, nil
+	}
+
 	iterators := promclient.IteratorsForValue(result)
 
 	series := make([]storage.Series, len(iterators))
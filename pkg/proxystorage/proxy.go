@@ -3,10 +3,13 @@ package proxystorage
 import (
 	"context"
 	"fmt"
+	"math"
 	"reflect"
+	"sort"
 	"sync/atomic"
 	"time"
 
+	opentracing "github.com/opentracing/opentracing-go"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/api"
 	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
@@ -24,12 +27,15 @@ import (
 	"github.com/jacksontj/promxy/pkg/promclient"
 	"github.com/jacksontj/promxy/pkg/proxyquerier"
 	"github.com/jacksontj/promxy/pkg/servergroup"
+	"github.com/jacksontj/promxy/pkg/shadow"
+	"github.com/jacksontj/promxy/pkg/storepb"
 )
 
 const MetricNameWorkaroundLabel = "__name"
 
 type proxyStorageState struct {
 	sgs            []*servergroup.ServerGroup
+	shadowSgs      []*servergroup.ServerGroup
 	client         promclient.API
 	cfg            *proxyconfig.PromxyConfig
 	remoteStorage  *remote.Storage
@@ -51,11 +57,20 @@ func (p *proxyStorageState) Ready() {
 	}
 }
 
-// Cancel this state
+// Cancel this state. Any servergroups which have been carried over into `n`
+// are left running
 func (p *proxyStorageState) Cancel(n *proxyStorageState) {
-	if p.sgs != nil {
-		for _, sg := range p.sgs {
-			sg.Cancel()
+	if p.sgs != nil || p.shadowSgs != nil {
+		inUse := make(map[*servergroup.ServerGroup]struct{})
+		if n != nil {
+			for _, sg := range n.allServerGroups() {
+				inUse[sg] = struct{}{}
+			}
+		}
+		for _, sg := range p.allServerGroups() {
+			if _, ok := inUse[sg]; !ok {
+				sg.Cancel()
+			}
 		}
 	}
 	// We call close if the new one is nil, or if the appanders don't match
@@ -66,6 +81,12 @@ func (p *proxyStorageState) Cancel(n *proxyStorageState) {
 	}
 }
 
+// allServerGroups returns the primary and the shadow servergroups
+func (p *proxyStorageState) allServerGroups() []*servergroup.ServerGroup {
+	ret := make([]*servergroup.ServerGroup, 0, len(p.sgs)+len(p.shadowSgs))
+	return append(append(ret, p.sgs...), p.shadowSgs...)
+}
+
 // NewProxyStorage creates a new ProxyStorage
 func NewProxyStorage() (*ProxyStorage, error) {
 	return &ProxyStorage{}, nil
@@ -85,30 +106,73 @@ func (p *ProxyStorage) GetState() *proxyStorageState {
 	return &proxyStorageState{}
 }
 
+// ServerGroups returns the servergroups of the current config
+func (p *ProxyStorage) ServerGroups() []*servergroup.ServerGroup {
+	return p.GetState().sgs
+}
+
 // ApplyConfig updates the current state of this ProxyStorage
 func (p *ProxyStorage) ApplyConfig(c *proxyconfig.Config) error {
 	oldState := p.GetState() // Fetch the old state
 
 	failed := false
 
-	apis := make([]promclient.API, len(c.ServerGroups))
+	// Index the running servergroups by their config hash, so that we only
+	// (re)build the servergroups whose config actually changed. This way
+	// unchanged servergroups keep their discovery managers (and targets)
+	// across reloads
+	existing := make(map[string][]*servergroup.ServerGroup)
+	for _, sg := range oldState.allServerGroups() {
+		h, err := sg.Cfg.Hash()
+		if err != nil {
+			continue
+		}
+		existing[h] = append(existing[h], sg)
+	}
+
+	// buildServerGroups returns the servergroups of `cfgs` and the client of all
+	// of them. Servergroups which are rebuilt keep the overrides (and the limiters)
+	// of the servergroup with the same name in `old`
+	buildServerGroups := func(cfgs []*servergroup.Config, old []*servergroup.ServerGroup) ([]*servergroup.ServerGroup, promclient.API) {
+		oldByName := serverGroupsByName(old)
+		apis := make([]promclient.API, len(cfgs))
+		sgs := make([]*servergroup.ServerGroup, len(cfgs))
+		for i, sgCfg := range cfgs {
+			if sg := takeServerGroup(existing, sgCfg); sg != nil {
+				logrus.Debugf("Reusing unchanged server group %d", i)
+				sgs[i] = sg
+				apis[i] = sg
+				continue
+			}
+
+			tmp := servergroup.New()
+			if oldSg := oldByName[sgCfg.GetName()]; oldSg != nil {
+				tmp.CopyOverrides(oldSg)
+				tmp.CopyLimiters(oldSg)
+			}
+			if err := tmp.ApplyConfig(sgCfg); err != nil {
+				failed = true
+				logrus.Errorf("Error applying config to server group: %s", err)
+			}
+			sgs[i] = tmp
+			apis[i] = tmp
+		}
+		apis = tierAPIs(sgs, apis)
+		return sgs, promclient.NewTimeTruncate(promclient.NewMultiAPI(apis, model.TimeFromUnix(0), nil, len(apis)))
+	}
+
 	newState := &proxyStorageState{
-		sgs: make([]*servergroup.ServerGroup, len(c.ServerGroups)),
 		cfg: &c.PromxyConfig,
 	}
-	for i, sgCfg := range c.ServerGroups {
-		tmp := servergroup.New()
-		if err := tmp.ApplyConfig(sgCfg); err != nil {
-			failed = true
-			logrus.Errorf("Error applying config to server group: %s", err)
-		}
-		newState.sgs[i] = tmp
-		apis[i] = tmp
+	newState.sgs, newState.client = buildServerGroups(c.ServerGroups, oldState.sgs)
+	if c.Shadow != nil {
+		var candidate promclient.API
+		newState.shadowSgs, candidate = buildServerGroups(c.Shadow.ServerGroups, oldState.shadowSgs)
+		newState.client = shadow.NewAPI(newState.client, candidate, c.Shadow)
 	}
-	newState.client = promclient.NewTimeTruncate(promclient.NewMultiAPI(apis, model.TimeFromUnix(0), nil, len(apis)))
 
 	if failed {
-		newState.Cancel(nil)
+		newState.Cancel(oldState)
 		return fmt.Errorf("error applying config to one or more server group(s)")
 	}
 
@@ -140,15 +204,77 @@ func (p *ProxyStorage) ApplyConfig(c *proxyconfig.Config) error {
 		newState.appender = &appenderStub{}
 	}
 
-	newState.Ready()        // Wait for the newstate to be ready
-	p.state.Store(newState) // Store the new state
-	if oldState != nil && oldState.appender != newState.appender {
-		oldState.Cancel(newState) // Cancel the old one
+	newState.Ready()          // Wait for the newstate to be ready
+	p.state.Store(newState)   // Store the new state
+	oldState.Cancel(newState) // Cancel the old one
+
+	return nil
+}
+
+// tierAPIs replaces the apis of all servergroups with the same tier_group by a
+// single TieredAPI of those servergroups
+func tierAPIs(sgs []*servergroup.ServerGroup, apis []promclient.API) []promclient.API {
+	ret := make([]promclient.API, 0, len(apis))
+	tiers := make(map[string][]promclient.Tier)
+	positions := make(map[string]int) // tier_group -> index in ret
+	for i, sg := range sgs {
+		group := sg.Cfg.TierGroup
+		if group == "" {
+			ret = append(ret, apis[i])
+			continue
+		}
+		if _, ok := positions[group]; !ok {
+			positions[group] = len(ret)
+			ret = append(ret, nil)
+		}
+		tiers[group] = append(tiers[group], promclient.Tier{
+			API:        apis[i],
+			TimeRange:  sg.Cfg.GetTimeRange,
+			Resolution: sg.Cfg.Resolution,
+		})
 	}
+	for group, i := range positions {
+		ret[i] = promclient.NewTieredAPI(tiers[group])
+	}
+	return ret
+}
 
+// takeServerGroup removes and returns a servergroup from `existing` whose config
+// is identical to `cfg` (nil if there is none)
+func takeServerGroup(existing map[string][]*servergroup.ServerGroup, cfg *servergroup.Config) *servergroup.ServerGroup {
+	h, err := cfg.Hash()
+	if err != nil {
+		return nil
+	}
+	for i, sg := range existing[h] {
+		// The hash doesn't include secrets (they are masked when marshaled),
+		// so we need to double-check that the configs are actually the same
+		if reflect.DeepEqual(sg.Cfg, cfg) {
+			existing[h] = append(existing[h][:i], existing[h][i+1:]...)
+			return sg
+		}
+	}
 	return nil
 }
 
+// serverGroupsByName indexes `sgs` by their name, names which are shared by
+// more than one servergroup are ambiguous so they are left out
+func serverGroupsByName(sgs []*servergroup.ServerGroup) map[string]*servergroup.ServerGroup {
+	ret := make(map[string]*servergroup.ServerGroup, len(sgs))
+	ambiguous := make(map[string]bool)
+	for _, sg := range sgs {
+		name := sg.Cfg.GetName()
+		if _, ok := ret[name]; ok {
+			ambiguous[name] = true
+		}
+		ret[name] = sg
+	}
+	for name := range ambiguous {
+		delete(ret, name)
+	}
+	return ret
+}
+
 // Querier returns a new Querier on the storage.
 func (p *ProxyStorage) Querier(ctx context.Context, mint, maxt int64) (storage.Querier, error) {
 	state := p.GetState()
@@ -162,6 +288,65 @@ func (p *ProxyStorage) Querier(ctx context.Context, mint, maxt int64) (storage.Q
 	}, nil
 }
 
+// StoreInfo returns the Thanos StoreAPI meta information of the storage: the
+// label sets and time ranges of the servergroups
+func (p *ProxyStorage) StoreInfo() *storepb.InfoResponse {
+	now := time.Now()
+	info := &storepb.InfoResponse{
+		MinTime:   math.MaxInt64,
+		MaxTime:   math.MinInt64,
+		StoreType: storepb.StoreType_QUERY,
+	}
+
+	var common model.LabelSet
+	for i, sg := range p.ServerGroups() {
+		start, end := sg.Cfg.GetTimeRange(now)
+		minTime, maxTime := int64(math.MinInt64), int64(math.MaxInt64)
+		if !start.IsZero() {
+			minTime = timestamp.FromTime(start)
+		}
+		if !end.IsZero() {
+			maxTime = timestamp.FromTime(end)
+		}
+		if minTime < info.MinTime {
+			info.MinTime = minTime
+		}
+		if maxTime > info.MaxTime {
+			info.MaxTime = maxTime
+		}
+
+		info.LabelSets = append(info.LabelSets, &storepb.LabelSet{Labels: labelSetToProto(sg.Cfg.Labels)})
+
+		// The labels of the store are the labels all servergroups have in common
+		if i == 0 {
+			common = sg.Cfg.Labels.Clone()
+			continue
+		}
+		for k, v := range common {
+			if sg.Cfg.Labels[k] != v {
+				delete(common, k)
+			}
+		}
+	}
+	info.Labels = labelSetToProto(common)
+
+	// Without servergroups there is no data
+	if info.MinTime > info.MaxTime {
+		info.MinTime, info.MaxTime = 0, 0
+	}
+	return info
+}
+
+// labelSetToProto returns the (sorted) StoreAPI labels of `ls`
+func labelSetToProto(ls model.LabelSet) []*storepb.Label {
+	ret := make([]*storepb.Label, 0, len(ls))
+	for k, v := range ls {
+		ret = append(ret, &storepb.Label{Name: string(k), Value: string(v)})
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+	return ret
+}
+
 // StartTime returns the oldest timestamp stored in the storage.
 func (p *ProxyStorage) StartTime() (int64, error) {
 	return 0, nil
@@ -182,6 +367,7 @@ func (p *ProxyStorage) Close() error { return nil }
 // There are a few ground rules for this:
 //      - Children cannot be AggregateExpr: aggregates have their own combining logic, so its not safe to send a subquery with additional aggregations
 //      - offsets within the subtree must match: if they don't then we'll get mismatched data, so we wait until we are far enough down the tree that they converge
+//        (e.g. for `rate(x[5m]) - rate(x[5m] offset 1w)` each side is sent downstream on its own, with its own time shift)
 //      - Don't reduce accuracy/granularity: the intention of this is to get the correct data faster, meaning correctness overrules speed.
 func (p *ProxyStorage) NodeReplacer(ctx context.Context, s *promql.EvalStmt, node promql.Node) (promql.Node, error) {
 	isAgg := func(node promql.Node) bool {
@@ -198,16 +384,48 @@ func (p *ProxyStorage) NodeReplacer(ctx context.Context, s *promql.EvalStmt, nod
 	// rules around combining). We'll skip this node and let a lower layer take this on
 	aggFinder := &BooleanFinder{Func: isAgg}
 	offsetFinder := &OffsetFinder{}
-
-	visitor := NewMultiVisitor([]promql.Visitor{aggFinder, offsetFinder})
+	// If the data of a child was already fetched (this subtree was replaced
+	// already, e.g. within a subquery) there is nothing left to do
+	fetchedFinder := &BooleanFinder{Func: func(node promql.Node) bool {
+		vs, ok := node.(*promql.VectorSelector)
+		return ok && vs.HasSeries()
+	}}
+
+	// A binary op with `on` matches series regardless of the labels of the
+	// servergroup (which are only added to the downstream's result), so series
+	// of different servergroups may match. A one-to-one op also drops those labels.
+	// So it can't be sent downstream, the labels must be there before the op
+	onMatchingFinder := &BooleanFinder{Func: func(node promql.Node) bool {
+		b, ok := node.(*promql.BinaryExpr)
+		return ok && b.VectorMatching != nil && b.VectorMatching.On
+	}}
+
+	// scalar() depends on all of the series of its arg (e.g. it is NaN for more than
+	// one series), so it can't be calculated by each servergroup on its own
+	scalarFinder := &BooleanFinder{Func: func(node promql.Node) bool {
+		c, ok := node.(*promql.Call)
+		return ok && c.Func.Name == "scalar"
+	}}
+
+	visitor := NewMultiVisitor([]promql.Visitor{aggFinder, offsetFinder, fetchedFinder, onMatchingFinder, scalarFinder})
 
 	if _, err := promql.Walk(ctx, visitor, s, node, nil, nil); err != nil {
 		return nil, err
 	}
 
+	if fetchedFinder.Found > 0 {
+		return nil, nil
+	}
+
+	// The subtree of a subquery is replaced with the times of the subquery (see
+	// below), so the remaining rules don't apply to the subquery itself
+	if (onMatchingFinder.Found > 0 || scalarFinder.Found > 0) && !isSubQuery(node) {
+		return nil, nil
+	}
+
 	if aggFinder.Found > 0 {
 		// If there was a single agg and that was us, then we're okay
-		if !((isAgg(node) || isSubQuery(node)) && aggFinder.Found == 1) {
+		if !((isAgg(node) && aggFinder.Found == 1) || isSubQuery(node)) {
 			return nil, nil
 		}
 	}
@@ -218,7 +436,7 @@ func (p *ProxyStorage) NodeReplacer(ctx context.Context, s *promql.EvalStmt, nod
 
 	// If we couldn't find an offset, then something is wrong-- lets skip
 	// Also if there was an error, skip
-	if !offsetFinder.Found || offsetFinder.Error != nil {
+	if (!offsetFinder.Found || offsetFinder.Error != nil) && !isSubQuery(node) {
 		return nil, nil
 	}
 	offset = offsetFinder.Offset
@@ -233,14 +451,20 @@ func (p *ProxyStorage) NodeReplacer(ctx context.Context, s *promql.EvalStmt, nod
 		return err
 	}
 
+	span, ctx := opentracing.StartSpanFromContext(ctx, "NodeReplacer")
+	span.SetTag("node", reflect.TypeOf(node).String())
+	defer span.Finish()
+
 	state := p.GetState()
 	switch n := node.(type) {
 
 	// SubqueryExprs are special, since they are effectively a MatrixSelector that is treated
 	// very specially inside the promql engine. To handle this we
 	//    (1) create a new eval statement with the subquery times
-	//    (2) run NodeReplacer on that new statement
-	//    (3) replace the subnode with the replaced RawMatrix
+	//    (2) run NodeReplacer on that new statement (on the whole subtree, as the
+	//        children must be fetched with the subquery times as well)
+	//    (3) replace the subnode with the replaced RawMatrix (or the replaced subtree
+	//        which the engine evaluates at each step of the subquery)
 	case *promql.SubqueryExpr:
 		logrus.Debugf("SubqueryExpr %v", n)
 		subStmt := &promql.EvalStmt{
@@ -257,19 +481,17 @@ func (p *ProxyStorage) NodeReplacer(ctx context.Context, s *promql.EvalStmt, nod
 			subStmt.Start = subStmt.Start.Add(subStmt.Interval)
 		}
 
-		subNode, err := p.NodeReplacer(ctx, subStmt, subStmt.Expr)
+		subNode, err := promql.Walk(ctx, NewMultiVisitor(nil), subStmt, subStmt.Expr, nil, p.NodeReplacer)
 		if err != nil {
 			return nil, err
 		}
 		switch subNodeTyped := subNode.(type) {
-		case *promql.AggregateExpr:
-			n.Expr = promql.NewRawMatrixFromVector(subNodeTyped.Expr.(*promql.VectorSelector))
 		case *promql.MatrixSelector:
 			n.Expr = promql.NewRawMatrixFromMatrix(subNodeTyped)
 		case *promql.VectorSelector:
 			n.Expr = promql.NewRawMatrixFromVector(subNodeTyped)
-		case nil:
-			break
+		case promql.Expr:
+			n.Expr = subNodeTyped
 		default:
 			panic(fmt.Sprintf("Unhandled SubqueryExpr return type: %T", subNode))
 		}
@@ -393,6 +615,7 @@ func (p *ProxyStorage) NodeReplacer(ctx context.Context, s *promql.EvalStmt, nod
 
 			// To aggregate count_values we simply sum(count_values(key, metric)) by (key)
 		case promql.ItemCountValues:
+			removeOffset()
 
 			// First we must fetch the data into a vectorselector
 			if s.Interval > 0 {
@@ -409,21 +632,29 @@ func (p *ProxyStorage) NodeReplacer(ctx context.Context, s *promql.EvalStmt, nod
 				return nil, errors.Cause(err)
 			}
 
-			iterators := promclient.IteratorsForValue(result)
-
-			series := make([]storage.Series, len(iterators))
-			for i, iterator := range iterators {
-				series[i] = &proxyquerier.Series{iterator}
+			series, err := seriesForValue(result)
+			if err != nil {
+				return nil, err
 			}
 
 			ret := &promql.VectorSelector{Offset: offset}
+			if s.Interval > 0 {
+				// The result has a point for each step, so the lookback must not
+				// extend a point to the following steps
+				ret.LookbackDelta = s.Interval - time.Duration(1)
+			}
 			ret.SetSeries(series, promhttputil.WarningsConvert(warnings))
 
-			// Replace with sum(count_values()) BY (label)
+			// Replace with sum(count_values()) BY (label), the label of the values
+			// must be kept (so it is only added to the grouping of a `by`)
+			grouping := n.Grouping
+			if !n.Without {
+				grouping = append(grouping, n.Param.(*promql.StringLiteral).Val)
+			}
 			return &promql.AggregateExpr{
 				Op:       promql.ItemSum,
 				Expr:     ret,
-				Grouping: append(n.Grouping, n.Param.(*promql.StringLiteral).Val),
+				Grouping: grouping,
 				Without:  n.Without,
 			}, nil
 
@@ -444,14 +675,17 @@ func (p *ProxyStorage) NodeReplacer(ctx context.Context, s *promql.EvalStmt, nod
 		}
 
 		if result != nil {
-			iterators := promclient.IteratorsForValue(result)
-
-			series := make([]storage.Series, len(iterators))
-			for i, iterator := range iterators {
-				series[i] = &proxyquerier.Series{iterator}
+			series, err := seriesForValue(result)
+			if err != nil {
+				return nil, err
 			}
 
 			ret := &promql.VectorSelector{Offset: offset}
+			if s.Interval > 0 {
+				// The result has a point for each step, so the lookback must not
+				// extend a point to the following steps
+				ret.LookbackDelta = s.Interval - time.Duration(1)
+			}
 			ret.SetSeries(series, promhttputil.WarningsConvert(warnings))
 			n.Expr = ret
 
@@ -462,6 +696,12 @@ func (p *ProxyStorage) NodeReplacer(ctx context.Context, s *promql.EvalStmt, nod
 	// prometheus node to answer
 	case *promql.Call:
 		logrus.Debugf("call %v %v", n, n.Type())
+		switch n.Func.Name {
+		// absent() isn't composable, a series missing from one servergroup may
+		// exist in another one
+		case "absent":
+			return nil, nil
+		}
 		removeOffset()
 
 		var result model.Value
@@ -481,22 +721,18 @@ func (p *ProxyStorage) NodeReplacer(ctx context.Context, s *promql.EvalStmt, nod
 			return nil, errors.Cause(err)
 		}
 
-		iterators := promclient.IteratorsForValue(result)
-		series := make([]storage.Series, len(iterators))
-		for i, iterator := range iterators {
-			series[i] = &proxyquerier.Series{iterator}
+		series, err := seriesForValue(result)
+		if err != nil {
+			return nil, err
 		}
 
 		ret := &promql.VectorSelector{Offset: offset}
-		ret.SetSeries(series, promhttputil.WarningsConvert(warnings))
-
-		// the "scalar()" function is a bit tricky. It can return a scalar or a vector.
-		// So to handle this instead of returning the vector directly (as its just the values selected)
-		// we can set it as the args (the vector of data) and the promql engine handles the types properly
-		if n.Func.Name == "scalar" {
-			n.Args[0] = ret
-			return nil, nil
+		if s.Interval > 0 {
+			// The result has a point for each step, so the lookback must not
+			// extend a point to the following steps
+			ret.LookbackDelta = s.Interval - time.Duration(1)
 		}
+		ret.SetSeries(series, promhttputil.WarningsConvert(warnings))
 		return ret, nil
 
 	// If we are simply fetching a Vector then we can fetch the data using the same step that
@@ -527,10 +763,9 @@ func (p *ProxyStorage) NodeReplacer(ctx context.Context, s *promql.EvalStmt, nod
 			return nil, errors.Cause(err)
 		}
 
-		iterators := promclient.IteratorsForValue(result)
-		series := make([]storage.Series, len(iterators))
-		for i, iterator := range iterators {
-			series[i] = &proxyquerier.Series{iterator}
+		series, err := seriesForValue(result)
+		if err != nil {
+			return nil, err
 		}
 		n.Offset = offset
 		n.SetSeries(series, promhttputil.WarningsConvert(warnings))
@@ -546,3 +781,30 @@ func (p *ProxyStorage) NodeReplacer(ctx context.Context, s *promql.EvalStmt, nod
 	}
 	return nil, nil
 }
+
+// seriesForValue returns the series of a value fetched by the NodeReplacer. The
+// series of merged results are merged lazily as the engine iterates over them
+func seriesForValue(v model.Value) ([]storage.Series, error) {
+	var set storage.SeriesSet
+	switch vTyped := v.(type) {
+	case *promhttputil.MergedMatrix:
+		set = vTyped.SeriesSet()
+	case promhttputil.CompactMatrix:
+		set = vTyped.SeriesSet()
+	default:
+		iterators := promclient.IteratorsForValue(v)
+		series := make([]storage.Series, len(iterators))
+		for i, iterator := range iterators {
+			series[i] = &proxyquerier.Series{iterator}
+		}
+		return series, nil
+	}
+
+	// The series must not be nil, as a VectorSelector without series is fetched
+	// by the engine
+	series := make([]storage.Series, 0)
+	for set.Next() {
+		series = append(series, set.At())
+	}
+	return series, set.Err()
+}
@@ -0,0 +1,417 @@
+package proxystorage
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/api"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql"
+	yaml "gopkg.in/yaml.v2"
+
+	proxyconfig "github.com/jacksontj/promxy/pkg/config"
+)
+
+func loadConfig(t *testing.T, s string) *proxyconfig.Config {
+	cfg := &proxyconfig.Config{}
+	if err := yaml.Unmarshal([]byte(s), cfg); err != nil {
+		t.Fatalf("unable to load config: %v", err)
+	}
+	return cfg
+}
+
+func TestApplyConfigReuse(t *testing.T) {
+	baseCfg := `
+promxy:
+  server_groups:
+    - static_configs:
+        - targets: [localhost:9090]
+      labels:
+        sg: a
+    - static_configs:
+        - targets: [localhost:9091]
+      labels:
+        sg: b
+`
+	changedCfg := `
+promxy:
+  server_groups:
+    - static_configs:
+        - targets: [localhost:9090]
+      labels:
+        sg: a
+    - static_configs:
+        - targets: [localhost:9092]
+      labels:
+        sg: b
+`
+
+	ps, err := NewProxyStorage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ps.ApplyConfig(loadConfig(t, baseCfg)); err != nil {
+		t.Fatalf("unable to apply config: %v", err)
+	}
+	first := ps.GetState().sgs
+
+	// Applying the same config should reuse all servergroups
+	if err := ps.ApplyConfig(loadConfig(t, baseCfg)); err != nil {
+		t.Fatalf("unable to apply config: %v", err)
+	}
+	second := ps.GetState().sgs
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("servergroup %d was rebuilt with no config change", i)
+		}
+	}
+
+	// Changing one servergroup should only rebuild that one
+	if err := ps.ApplyConfig(loadConfig(t, changedCfg)); err != nil {
+		t.Fatalf("unable to apply config: %v", err)
+	}
+	third := ps.GetState().sgs
+	if third[0] != second[0] {
+		t.Fatalf("unchanged servergroup was rebuilt")
+	}
+	if third[1] == second[1] {
+		t.Fatalf("changed servergroup was not rebuilt")
+	}
+	if targets := third[1].State().Targets; len(targets) != 1 || targets[0] != "localhost:9092" {
+		t.Fatalf("unexpected targets for changed servergroup: %v", targets)
+	}
+}
+
+func TestApplyConfigOverrides(t *testing.T) {
+	baseCfg := `
+promxy:
+  server_groups:
+    - static_configs:
+        - targets: [localhost:9090]
+      labels:
+        sg: a
+    - static_configs:
+        - targets: [localhost:9091]
+      name: b
+`
+	// The servergroups are re-ordered and "b" is changed (so it is rebuilt)
+	changedCfg := `
+promxy:
+  server_groups:
+    - static_configs:
+        - targets: [localhost:9092]
+      name: b
+    - static_configs:
+        - targets: [localhost:9090]
+      labels:
+        sg: a
+`
+
+	ps, err := NewProxyStorage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ps.ApplyConfig(loadConfig(t, baseCfg)); err != nil {
+		t.Fatalf("unable to apply config: %v", err)
+	}
+	sgs := ps.GetState().sgs
+	sgs[0].SetTargetDisabled("localhost:9090", true, 0)
+	sgs[1].SetPinned("localhost:9092", time.Hour)
+
+	if err := ps.ApplyConfig(loadConfig(t, changedCfg)); err != nil {
+		t.Fatalf("unable to apply config: %v", err)
+	}
+	sgs = ps.GetState().sgs
+	if o := sgs[1].Overrides(); !o.TargetDisabled("localhost:9090") {
+		t.Fatalf("overrides of reused servergroup were lost: %+v", o)
+	}
+	if o := sgs[0].Overrides(); o.Pinned == nil || o.Pinned.Target != "localhost:9092" || o.Pinned.Expires.IsZero() {
+		t.Fatalf("overrides of rebuilt servergroup were lost: %+v", o)
+	}
+}
+
+func TestStoreInfo(t *testing.T) {
+	cfg := `
+promxy:
+  server_groups:
+    - static_configs:
+        - targets: [localhost:9090]
+      labels:
+        region: us
+        sg: a
+      absolute_time_range:
+        start: '2020-01-01T00:00:00Z'
+        end: '2020-02-01T00:00:00Z'
+    - static_configs:
+        - targets: [localhost:9091]
+      labels:
+        region: us
+        sg: b
+      absolute_time_range:
+        start: '2019-01-01T00:00:00Z'
+        end: '2020-01-01T00:00:00Z'
+`
+	ps, err := NewProxyStorage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ps.ApplyConfig(loadConfig(t, cfg)); err != nil {
+		t.Fatalf("unable to apply config: %v", err)
+	}
+
+	info := ps.StoreInfo()
+	// The store covers the time range of all servergroups
+	if info.MinTime != 1546300800000 || info.MaxTime != 1580515200000 {
+		t.Fatalf("unexpected time range %d-%d", info.MinTime, info.MaxTime)
+	}
+	// Only the labels all servergroups have in common are the labels of the store
+	if len(info.Labels) != 1 || info.Labels[0].Name != "region" || info.Labels[0].Value != "us" {
+		t.Fatalf("unexpected labels %v", info.Labels)
+	}
+	if len(info.LabelSets) != 2 || len(info.LabelSets[1].Labels) != 2 || info.LabelSets[1].Labels[1].Value != "b" {
+		t.Fatalf("unexpected label sets %v", info.LabelSets)
+	}
+}
+
+// recordingAPI records the queries sent downstream and returns empty results
+type recordingAPI struct {
+	l       sync.Mutex
+	queries []recordedQuery
+}
+
+type recordedQuery struct {
+	query      string
+	start, end time.Time
+}
+
+func (r *recordingAPI) record(q recordedQuery) {
+	r.l.Lock()
+	defer r.l.Unlock()
+	r.queries = append(r.queries, q)
+}
+
+// Queries returns the recorded queries sorted by query
+func (r *recordingAPI) Queries() []recordedQuery {
+	r.l.Lock()
+	defer r.l.Unlock()
+	queries := append([]recordedQuery(nil), r.queries...)
+	sort.Slice(queries, func(i, j int) bool { return queries[i].query < queries[j].query })
+	return queries
+}
+
+func (r *recordingAPI) LabelNames(ctx context.Context) ([]string, api.Warnings, error) {
+	return nil, nil, nil
+}
+
+func (r *recordingAPI) LabelValues(ctx context.Context, label string) (model.LabelValues, api.Warnings, error) {
+	return nil, nil, nil
+}
+
+func (r *recordingAPI) Query(ctx context.Context, query string, ts time.Time) (model.Value, api.Warnings, error) {
+	r.record(recordedQuery{query, ts, ts})
+	return model.Vector{}, nil, nil
+}
+
+func (r *recordingAPI) QueryRange(ctx context.Context, query string, rng v1.Range) (model.Value, api.Warnings, error) {
+	r.record(recordedQuery{query, rng.Start, rng.End})
+	return model.Matrix{}, nil, nil
+}
+
+func (r *recordingAPI) Series(ctx context.Context, matches []string, startTime time.Time, endTime time.Time) ([]model.LabelSet, api.Warnings, error) {
+	return nil, nil, nil
+}
+
+func (r *recordingAPI) GetValue(ctx context.Context, start, end time.Time, matchers []*labels.Matcher) (model.Value, api.Warnings, error) {
+	return model.Matrix{}, nil, nil
+}
+
+// replaceNodes runs the NodeReplacer over the query (as the engine does) and
+// returns the resulting expression and the queries sent downstream
+func replaceNodes(t *testing.T, q string, start, end time.Time, interval time.Duration) (promql.Expr, []recordedQuery) {
+	expr, err := promql.ParseExpr(q)
+	if err != nil {
+		t.Fatalf("unable to parse %s: %v", q, err)
+	}
+	client := &recordingAPI{}
+	ps := &ProxyStorage{}
+	ps.state.Store(&proxyStorageState{client: client})
+
+	s := &promql.EvalStmt{Expr: expr, Start: start, End: end, Interval: interval}
+	node, err := promql.Walk(context.TODO(), NewMultiVisitor(nil), s, expr, nil, ps.NodeReplacer)
+	if err != nil {
+		t.Fatalf("unable to replace nodes of %s: %v", q, err)
+	}
+	return node.(promql.Expr), client.Queries()
+}
+
+func queryStrings(queries []recordedQuery) []string {
+	ret := make([]string, len(queries))
+	for i, q := range queries {
+		ret[i] = q.query
+	}
+	return ret
+}
+
+func TestNodeReplacerSubqueryOffset(t *testing.T) {
+	start := time.Unix(10000, 0)
+	_, queries := replaceNodes(t, "max_over_time(foo[5m:1m] offset 1h)", start, start, 0)
+
+	// The subquery (with its offset) must be evaluated by promxy, only the
+	// selector within it is sent downstream with the times of the subquery
+	if len(queries) != 1 || queries[0].query != "foo" {
+		t.Fatalf("unexpected queries %v", queryStrings(queries))
+	}
+	if want := start.Add(-time.Hour); !queries[0].end.Equal(want) {
+		t.Fatalf("unexpected end of subquery, expected %v got %v", want, queries[0].end)
+	}
+}
+
+func TestNodeReplacerLookbackDelta(t *testing.T) {
+	start := time.Unix(10000, 0)
+	for _, q := range []string{"sum(foo)", "rate(foo[1m])", `count_values("value", foo)`} {
+		t.Run(q, func(t *testing.T) {
+			expr, _ := replaceNodes(t, q, start, start.Add(time.Hour), 30*time.Second)
+
+			vs, ok := expr.(*promql.VectorSelector)
+			if agg, isAgg := expr.(*promql.AggregateExpr); isAgg {
+				vs, ok = agg.Expr.(*promql.VectorSelector)
+			}
+			if !ok {
+				t.Fatalf("node wasn't replaced: %v", expr)
+			}
+			// Each step must only see the point of the downstream's result at that step
+			if vs.LookbackDelta != 30*time.Second-1 {
+				t.Fatalf("unexpected lookback delta %v", vs.LookbackDelta)
+			}
+		})
+	}
+}
+
+func TestNodeReplacerCountValuesGrouping(t *testing.T) {
+	tests := []struct {
+		q        string
+		grouping []string
+	}{
+		{`count_values("value", foo)`, []string{"value"}},
+		{`count_values by (job) ("value", foo)`, []string{"job", "value"}},
+		// the value label must not be aggregated away by a `without`
+		{`count_values without (instance) ("value", foo)`, []string{"instance"}},
+	}
+
+	start := time.Unix(10000, 0)
+	for _, test := range tests {
+		t.Run(test.q, func(t *testing.T) {
+			expr, _ := replaceNodes(t, test.q, start, start, 0)
+			agg, ok := expr.(*promql.AggregateExpr)
+			if !ok || agg.Op != promql.ItemSum {
+				t.Fatalf("node wasn't replaced: %v", expr)
+			}
+			if len(agg.Grouping) != len(test.grouping) {
+				t.Fatalf("unexpected grouping expected %v got %v", test.grouping, agg.Grouping)
+			}
+			for i, l := range test.grouping {
+				if agg.Grouping[i] != l {
+					t.Fatalf("unexpected grouping expected %v got %v", test.grouping, agg.Grouping)
+				}
+			}
+		})
+	}
+}
+
+func TestNodeReplacerNotComposable(t *testing.T) {
+	tests := []struct {
+		q       string
+		queries []string
+	}{
+		// A series absent from one servergroup may exist in another one
+		{"absent(foo)", []string{"foo"}},
+		// scalar() depends on the series of all servergroups
+		{"scalar(foo)", []string{"foo"}},
+		{"topk(scalar(bar), foo)", []string{"bar", "foo"}},
+		{"sum(foo) * scalar(sum(bar))", []string{"sum(bar)", "sum(foo)"}},
+	}
+
+	start := time.Unix(10000, 0)
+	for _, test := range tests {
+		t.Run(test.q, func(t *testing.T) {
+			_, queries := replaceNodes(t, test.q, start, start, 0)
+			got := queryStrings(queries)
+			if len(got) != len(test.queries) {
+				t.Fatalf("unexpected queries expected %v got %v", test.queries, got)
+			}
+			for i, q := range test.queries {
+				if got[i] != q {
+					t.Fatalf("unexpected queries expected %v got %v", test.queries, got)
+				}
+			}
+		})
+	}
+}
+
+func TestNodeReplacerOnMatching(t *testing.T) {
+	start := time.Unix(10000, 0)
+	_, queries := replaceNodes(t, "sum(foo + on(job) bar)", start, start, 0)
+
+	// The labels of the servergroups must be there before matching with on()
+	got := queryStrings(queries)
+	if len(got) != 2 || got[0] != "bar" || got[1] != "foo" {
+		t.Fatalf("unexpected queries %v", got)
+	}
+}
+
+func TestNodeReplacerSubqueryChildren(t *testing.T) {
+	tests := []struct {
+		q       string
+		queries []string
+	}{
+		{"max_over_time(sum(foo)[5m:1m])", []string{"sum(foo)"}},
+		{"max_over_time(max(sum(foo))[5m:1m])", []string{"sum(foo)"}},
+		{"max_over_time((foo + on(job) bar)[5m:1m])", []string{"bar", "foo"}},
+		{"max_over_time((foo - foo offset 1h)[5m:1m])", []string{"foo", "foo"}},
+		{"max_over_time(vector(scalar(foo))[5m:1m])", []string{"foo"}},
+	}
+
+	start := time.Unix(10000, 0)
+	for _, test := range tests {
+		t.Run(test.q, func(t *testing.T) {
+			_, queries := replaceNodes(t, test.q, start, start, 0)
+			got := queryStrings(queries)
+			if len(got) != len(test.queries) {
+				t.Fatalf("unexpected queries expected %v got %v", test.queries, got)
+			}
+			for i, q := range queries {
+				if q.query != test.queries[i] {
+					t.Fatalf("unexpected queries expected %v got %v", test.queries, got)
+				}
+				// Everything within the subquery is fetched (once) for the
+				// range of the subquery, not for the time of the outer query
+				if !q.start.Before(start) {
+					t.Fatalf("%s was fetched with the time of the outer query", q.query)
+				}
+			}
+		})
+	}
+}
+
+func TestNodeReplacerCountValuesOffset(t *testing.T) {
+	start := time.Unix(10000, 0)
+	expr, queries := replaceNodes(t, `count_values("value", foo offset 1h)`, start, start, 0)
+
+	// The offset is applied by the time of the downstream query only
+	if len(queries) != 1 || queries[0].query != `count_values("value", foo)` {
+		t.Fatalf("unexpected queries %v", queryStrings(queries))
+	}
+	if want := start.Add(-time.Hour); !queries[0].start.Equal(want) {
+		t.Fatalf("unexpected query time, expected %v got %v", want, queries[0].start)
+	}
+	if vs := expr.(*promql.AggregateExpr).Expr.(*promql.VectorSelector); vs.Offset != time.Hour {
+		t.Fatalf("unexpected offset of the result %v", vs.Offset)
+	}
+}
@@ -50,10 +50,17 @@ type OffsetFinder struct {
 }
 
 // Visit runs on each node in the tree
-func (o *OffsetFinder) Visit(node promql.Node, _ []promql.Node) (promql.Visitor, error) {
+func (o *OffsetFinder) Visit(node promql.Node, path []promql.Node) (promql.Visitor, error) {
 	o.l.Lock()
 	defer o.l.Unlock()
 	switch n := node.(type) {
+	case *promql.SubqueryExpr:
+		// The offset of a subquery is lost when String()ing the node, so we can't
+		// send a subquery with an offset downstream (the subquery itself handles it)
+		if n.Offset != 0 && len(path) > 0 {
+			o.Error = fmt.Errorf("subquery with offset %v", n.Offset)
+		}
+
 	case *promql.VectorSelector:
 		if !o.Found {
 			o.Offset = n.Offset
@@ -0,0 +1,51 @@
+package querybudget
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/rules"
+)
+
+// NewHandler returns an http.Handler which gives all query and query_range API
+// calls it passes through to `h` a Budget with the given limits
+func NewHandler(h http.Handler, limits Limits) http.Handler {
+	return &handler{h: h, limits: limits}
+}
+
+type handler struct {
+	h      http.Handler
+	limits Limits
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/api/v1/query"):
+	case strings.HasSuffix(r.URL.Path, "/api/v1/query_range"):
+	default:
+		h.h.ServeHTTP(w, r)
+		return
+	}
+
+	ctx, b := NewContext(r.Context(), h.limits)
+	defer b.Release()
+	h.h.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// WrapQueryFunc wraps a rules.QueryFunc to give each rule evaluation a Budget
+// with the given limits
+func WrapQueryFunc(f rules.QueryFunc, limits Limits) rules.QueryFunc {
+	return func(ctx context.Context, q string, t time.Time) (promql.Vector, error) {
+		ctx, b := NewContext(ctx, limits)
+		defer b.Release()
+		v, err := f(ctx, q, t)
+		// Return the budget error instead of the cancellation it caused
+		if budgetErr := b.Err(); err != nil && budgetErr != nil {
+			return nil, budgetErr
+		}
+		return v, err
+	}
+}
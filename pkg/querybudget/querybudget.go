@@ -0,0 +1,257 @@
+// Package querybudget implements accounting of the data promxy receives from
+// downstreams while evaluating a query. Each query gets a Budget (carried through
+// the context) which the downstream clients add the bytes and samples they receive
+// to. Once the budget is exceeded the query's context is cancelled (aborting all
+// of its in-flight downstream requests) and the query fails with an ExceededError.
+package querybudget
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	inflightBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "promxy_query_inflight_bytes",
+		Help: "Bytes received from downstreams by the queries currently being evaluated",
+	})
+	exceededTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "promxy_query_budget_exceeded_total",
+		Help: "Number of queries aborted for exceeding a limit",
+	}, []string{"limit"})
+)
+
+func init() {
+	prometheus.MustRegister(inflightBytes, exceededTotal)
+}
+
+type contextKey struct{}
+
+// Limits are the limits applied to each query
+type Limits struct {
+	// MaxSamples is the max number of samples a query may receive from all
+	// downstreams (0 is unlimited)
+	MaxSamples int64
+	// MaxBytes is the max number of bytes a query may receive from all
+	// downstreams (0 is unlimited)
+	MaxBytes int64
+	// Global, if set, limits the bytes received by all in-flight queries
+	Global *MemoryLimiter
+}
+
+// Enabled returns whether any limit is set
+func (l Limits) Enabled() bool {
+	return l.MaxSamples > 0 || l.MaxBytes > 0 || l.Global != nil
+}
+
+// ExceededError is the error a query fails with once it exceeds its budget
+type ExceededError struct {
+	Limit string
+	Max   int64
+}
+
+func (e *ExceededError) Error() string {
+	if e.Limit == "global_bytes" {
+		return fmt.Sprintf("query aborted: the in-flight data of all queries exceeded the limit of %d bytes", e.Max)
+	}
+	return fmt.Sprintf("query aborted: data received from downstreams exceeded the limit of %d %s", e.Max, e.Limit)
+}
+
+// NewContext returns a (cancellable) context carrying a new Budget with the given
+// limits. The Budget must be released once the query is complete
+func NewContext(ctx context.Context, limits Limits) (context.Context, *Budget) {
+	ctx, cancel := context.WithCancel(ctx)
+	b := &Budget{limits: limits, cancel: cancel}
+	return context.WithValue(ctx, contextKey{}, b), b
+}
+
+// NewChildContext returns a (cancellable) context carrying a new Budget with the
+// limits of `parent`, for data received on behalf of `parent` (e.g. by a request
+// shared with other queries). The parent is charged for the data as it is received
+// and tracks its in-flight bytes (for as long as it isn't released). Exceeding the
+// limits of the parent only cancels the parent's query. The child Budget must be
+// released once it is complete
+func NewChildContext(ctx context.Context, parent *Budget) (context.Context, *Budget) {
+	ctx, b := NewContext(ctx, parent.Limits())
+	b.parent = parent
+	return ctx, b
+}
+
+// FromContext returns the Budget in the context (or nil if there is none)
+func FromContext(ctx context.Context) *Budget {
+	b, _ := ctx.Value(contextKey{}).(*Budget)
+	return b
+}
+
+// Budget tracks the data received from downstreams for a single query
+type Budget struct {
+	limits Limits
+	cancel context.CancelFunc
+	// parent, if set, is charged for all data of the budget (see NewChildContext)
+	parent *Budget
+
+	samples int64
+	bytes   int64
+
+	l   sync.Mutex
+	err error
+	// inflight is the number of bytes tracked as in-flight (and reserved from
+	// the global limiter)
+	inflight int64
+	released bool
+}
+
+// AddSamples records `n` samples received from a downstream, returning an error
+// if this exceeds the budget
+func (b *Budget) AddSamples(n int) error {
+	if b == nil {
+		return nil
+	}
+	if b.parent != nil {
+		// Exceeding the parent's budget only fails the parent's query
+		b.parent.AddSamples(n)
+	}
+	samples := atomic.AddInt64(&b.samples, int64(n))
+	if b.limits.MaxSamples > 0 && samples > b.limits.MaxSamples {
+		return b.exceeded(&ExceededError{Limit: "samples", Max: b.limits.MaxSamples})
+	}
+	return b.Err()
+}
+
+// AddBytes records `n` bytes received from a downstream, returning an error if
+// this exceeds the budget (or the global limit)
+func (b *Budget) AddBytes(n int) error {
+	if b == nil {
+		return nil
+	}
+	if b.parent != nil {
+		b.parent.chargeBytes(int64(n))
+	}
+	bytes := atomic.AddInt64(&b.bytes, int64(n))
+	if ok, _ := b.reserve(int64(n)); !ok {
+		return b.exceeded(&ExceededError{Limit: "global_bytes", Max: b.limits.Global.limit})
+	}
+	if b.limits.MaxBytes > 0 && bytes > b.limits.MaxBytes {
+		return b.exceeded(&ExceededError{Limit: "bytes", Max: b.limits.MaxBytes})
+	}
+	return b.Err()
+}
+
+// chargeBytes counts `n` bytes received on behalf of the budget by a child budget,
+// these are reserved from the global limiter by the child
+func (b *Budget) chargeBytes(n int64) {
+	if b.parent != nil {
+		b.parent.chargeBytes(n)
+	}
+	if bytes := atomic.AddInt64(&b.bytes, n); b.limits.MaxBytes > 0 && bytes > b.limits.MaxBytes {
+		b.exceeded(&ExceededError{Limit: "bytes", Max: b.limits.MaxBytes})
+	}
+}
+
+// reserve tracks `n` in-flight bytes, reserving them from the global limiter (if
+// there is one). The bytes of a child budget are tracked by its parent, unless the
+// parent has been released. Once the budget is released nothing more is tracked, so
+// nothing can leak from requests which are still finishing.
+// It returns false if the global limit is exceeded, and whether the bytes are tracked
+func (b *Budget) reserve(n int64) (ok, tracked bool) {
+	b.l.Lock()
+	defer b.l.Unlock()
+	if b.released {
+		return true, false
+	}
+	if b.parent != nil {
+		if ok, tracked := b.parent.reserve(n); !ok || tracked {
+			return ok, tracked
+		}
+	}
+	if b.limits.Global != nil && !b.limits.Global.reserve(n) {
+		return false, false
+	}
+	b.inflight += n
+	inflightBytes.Add(float64(n))
+	return true, true
+}
+
+// Limits returns the limits of the budget (no limits for a nil Budget)
+func (b *Budget) Limits() Limits {
+	if b == nil {
+		return Limits{}
+	}
+	return b.limits
+}
+
+// Samples returns the number of samples received so far
+func (b *Budget) Samples() int64 { return atomic.LoadInt64(&b.samples) }
+
+// Bytes returns the number of bytes received so far
+func (b *Budget) Bytes() int64 { return atomic.LoadInt64(&b.bytes) }
+
+// Err returns the error if the budget has been exceeded
+func (b *Budget) Err() error {
+	if b == nil {
+		return nil
+	}
+	b.l.Lock()
+	defer b.l.Unlock()
+	return b.err
+}
+
+// exceeded records the (first) error and cancels the query
+func (b *Budget) exceeded(err *ExceededError) error {
+	b.l.Lock()
+	if b.err == nil {
+		b.err = err
+		exceededTotal.WithLabelValues(err.Limit).Inc()
+	}
+	ret := b.err
+	b.l.Unlock()
+	b.cancel()
+	return ret
+}
+
+// Release cancels the query's context and returns its bytes to the global limit
+func (b *Budget) Release() {
+	b.cancel()
+	b.l.Lock()
+	defer b.l.Unlock()
+	if b.released {
+		return
+	}
+	b.released = true
+	if b.limits.Global != nil {
+		b.limits.Global.release(b.inflight)
+	}
+	inflightBytes.Sub(float64(b.inflight))
+}
+
+// NewMemoryLimiter returns a MemoryLimiter allowing `limit` bytes in-flight
+func NewMemoryLimiter(limit int64) *MemoryLimiter {
+	return &MemoryLimiter{limit: limit}
+}
+
+// MemoryLimiter limits the bytes received by all in-flight queries
+type MemoryLimiter struct {
+	limit int64
+	used  int64
+}
+
+// reserve reserves `n` bytes, returning false (and reserving nothing) if that
+// would exceed the limit
+func (m *MemoryLimiter) reserve(n int64) bool {
+	if atomic.AddInt64(&m.used, n) > m.limit {
+		atomic.AddInt64(&m.used, -n)
+		return false
+	}
+	return true
+}
+
+func (m *MemoryLimiter) release(n int64) {
+	atomic.AddInt64(&m.used, -n)
+}
+
+// Used returns the bytes currently reserved
+func (m *MemoryLimiter) Used() int64 { return atomic.LoadInt64(&m.used) }
@@ -0,0 +1,167 @@
+package querybudget
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/promql"
+)
+
+func TestBudget(t *testing.T) {
+	ctx, b := NewContext(context.TODO(), Limits{MaxSamples: 10, MaxBytes: 100})
+	defer b.Release()
+
+	if FromContext(ctx) != b {
+		t.Fatalf("missing budget in context")
+	}
+	if err := b.AddSamples(10); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := b.AddBytes(100); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ctx.Err() != nil {
+		t.Fatalf("context cancelled before the budget was exceeded")
+	}
+
+	err := b.AddSamples(1)
+	if exceeded, ok := err.(*ExceededError); !ok || exceeded.Limit != "samples" {
+		t.Fatalf("expected the samples limit to be exceeded, got %v", err)
+	}
+	if ctx.Err() == nil {
+		t.Fatalf("context not cancelled once the budget was exceeded")
+	}
+	// The first error is kept
+	if err := b.AddBytes(1); err != b.Err() {
+		t.Fatalf("expected the first error, got %v", err)
+	}
+}
+
+func TestNilBudget(t *testing.T) {
+	b := FromContext(context.TODO())
+	if err := b.AddSamples(1); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := b.AddBytes(1); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := b.Err(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestMemoryLimiter(t *testing.T) {
+	global := NewMemoryLimiter(100)
+	limits := Limits{Global: global}
+
+	_, a := NewContext(context.TODO(), limits)
+	_, b := NewContext(context.TODO(), limits)
+
+	if err := a.AddBytes(60); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	err := b.AddBytes(60)
+	if exceeded, ok := err.(*ExceededError); !ok || exceeded.Limit != "global_bytes" {
+		t.Fatalf("expected the global limit to be exceeded, got %v", err)
+	}
+	if used := global.Used(); used != 60 {
+		t.Fatalf("expected 60 bytes in use, got %d", used)
+	}
+
+	// Releasing returns the bytes, and nothing is reserved after the release
+	a.Release()
+	a.AddBytes(10)
+	b.Release()
+	if used := global.Used(); used != 0 {
+		t.Fatalf("expected 0 bytes in use, got %d", used)
+	}
+
+	_, c := NewContext(context.TODO(), limits)
+	defer c.Release()
+	if err := c.AddBytes(100); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestChildBudget(t *testing.T) {
+	global := NewMemoryLimiter(100)
+	parentCtx, parent := NewContext(context.TODO(), Limits{MaxBytes: 50, Global: global})
+	defer parent.Release()
+	childCtx, child := NewChildContext(context.TODO(), parent)
+
+	// The parent is charged as the child receives data
+	if err := child.AddBytes(40); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := child.AddSamples(5); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if parent.Bytes() != 40 || parent.Samples() != 5 {
+		t.Fatalf("expected the parent to be charged 40 bytes and 5 samples, got %d and %d", parent.Bytes(), parent.Samples())
+	}
+
+	// Exceeding the parent's budget only cancels the parent
+	if err := parent.AddBytes(20); err == nil {
+		t.Fatalf("expected the parent's budget to be exceeded")
+	}
+	if parentCtx.Err() == nil {
+		t.Fatalf("parent context wasn't cancelled")
+	}
+	if err := child.AddBytes(1); err != nil || childCtx.Err() != nil {
+		t.Fatalf("child failed with its parent: %v", err)
+	}
+
+	// The global limit applies to the child
+	err := child.AddBytes(50)
+	if exceeded, ok := err.(*ExceededError); !ok || exceeded.Limit != "global_bytes" {
+		t.Fatalf("expected the global limit to be exceeded, got %v", err)
+	}
+	if childCtx.Err() == nil {
+		t.Fatalf("child context wasn't cancelled")
+	}
+
+	// The in-flight bytes of the child are tracked by the parent
+	child.Release()
+	if used := global.Used(); used != 61 {
+		t.Fatalf("expected 61 bytes in use, got %d", used)
+	}
+	parent.Release()
+	if used := global.Used(); used != 0 {
+		t.Fatalf("expected 0 bytes in use, got %d", used)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	var budget *Budget
+	h := NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		budget = FromContext(r.Context())
+	}), Limits{MaxSamples: 1})
+
+	for path, expected := range map[string]bool{
+		"/api/v1/query":       true,
+		"/api/v1/query_range": true,
+		"/api/v1/series":      false,
+	} {
+		budget = nil
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+		if (budget != nil) != expected {
+			t.Fatalf("mismatch in budget for %s expected=%v", path, expected)
+		}
+	}
+}
+
+func TestWrapQueryFunc(t *testing.T) {
+	f := WrapQueryFunc(func(ctx context.Context, q string, ts time.Time) (promql.Vector, error) {
+		FromContext(ctx).AddSamples(2)
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}, Limits{MaxSamples: 1})
+
+	_, err := f(context.TODO(), "up", time.Now())
+	if _, ok := err.(*ExceededError); !ok {
+		t.Fatalf("expected an ExceededError, got %v", err)
+	}
+}
@@ -0,0 +1,124 @@
+package querylog
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/rules"
+)
+
+// NewHandler returns an http.Handler which creates a query log Entry for all
+// query and query_range API calls it passes through to `h`
+func NewHandler(h http.Handler, logger *Logger, tenantHeader string) http.Handler {
+	return &handler{
+		h:            h,
+		logger:       logger,
+		tenantHeader: tenantHeader,
+	}
+}
+
+type handler struct {
+	h            http.Handler
+	logger       *Logger
+	tenantHeader string
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var isRange bool
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/api/v1/query"):
+	case strings.HasSuffix(r.URL.Path, "/api/v1/query_range"):
+		isRange = true
+	default:
+		h.h.ServeHTTP(w, r)
+		return
+	}
+
+	start := time.Now()
+	e := &Entry{
+		Time:   start.UTC(),
+		Source: "http",
+		Query:  r.FormValue("query"),
+	}
+	if h.tenantHeader != "" {
+		e.Tenant = r.Header.Get(h.tenantHeader)
+	}
+	if isRange {
+		e.Start, _ = parseTime(r.FormValue("start"))
+		e.End, _ = parseTime(r.FormValue("end"))
+		if step, err := parseDuration(r.FormValue("step")); err == nil {
+			e.Step = step.Seconds()
+		}
+	} else {
+		if ts := r.FormValue("time"); ts != "" {
+			e.Start, _ = parseTime(ts)
+		} else {
+			e.Start = start
+		}
+		e.End = e.Start
+	}
+
+	sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+	h.h.ServeHTTP(sw, r.WithContext(NewContext(r.Context(), e)))
+
+	e.Status = sw.status
+	e.Duration = time.Since(start).Seconds()
+	h.logger.Log(e)
+}
+
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// WrapQueryFunc wraps a rules.QueryFunc to create a query log Entry for each
+// rule evaluation
+func WrapQueryFunc(f rules.QueryFunc, logger *Logger) rules.QueryFunc {
+	return func(ctx context.Context, q string, t time.Time) (promql.Vector, error) {
+		start := time.Now()
+		e := &Entry{
+			Time:   start.UTC(),
+			Source: "rule",
+			Query:  q,
+			Start:  t,
+			End:    t,
+		}
+		v, err := f(NewContext(ctx, e), q, t)
+		if err != nil {
+			e.Error = err.Error()
+		}
+		e.Duration = time.Since(start).Seconds()
+		logger.Log(e)
+		return v, err
+	}
+}
+
+// parseTime parses times the same way the prometheus API does
+func parseTime(s string) (time.Time, error) {
+	if t, err := strconv.ParseFloat(s, 64); err == nil {
+		s, ns := math.Modf(t)
+		ns = math.Round(ns*1000) / 1000
+		return time.Unix(int64(s), int64(ns*float64(time.Second))).UTC(), nil
+	}
+	return time.Parse(time.RFC3339Nano, s)
+}
+
+// parseDuration parses durations the same way the prometheus API does
+func parseDuration(s string) (time.Duration, error) {
+	if d, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.Duration(d * float64(time.Second)), nil
+	}
+	d, err := model.ParseDuration(s)
+	return time.Duration(d), err
+}
@@ -0,0 +1,134 @@
+// Package querylog implements promxy's structured query log. Each PromQL evaluation
+// gets an Entry (carried through the context) which downstream calls record
+// themselves into. Once the evaluation is complete the Entry is written out as a
+// single JSON line.
+package querylog
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+type contextKey struct{}
+
+// NewContext returns a context carrying the given Entry
+func NewContext(ctx context.Context, e *Entry) context.Context {
+	return context.WithValue(ctx, contextKey{}, e)
+}
+
+// FromContext returns the Entry in the context (or nil if there is none)
+func FromContext(ctx context.Context) *Entry {
+	e, _ := ctx.Value(contextKey{}).(*Entry)
+	return e
+}
+
+// Entry is a single line in the query log
+type Entry struct {
+	Time     time.Time `json:"time"`
+	Tenant   string    `json:"tenant,omitempty"`
+	Source   string    `json:"source,omitempty"`
+	Query    string    `json:"query"`
+	Start    time.Time `json:"start,omitempty"`
+	End      time.Time `json:"end,omitempty"`
+	Step     float64   `json:"step,omitempty"`
+	Status   int       `json:"status,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Duration float64   `json:"duration"`
+
+	l           sync.Mutex
+	Warnings    []string     `json:"warnings,omitempty"`
+	Downstreams []Downstream `json:"downstreams,omitempty"`
+}
+
+// Downstream is the record of a single call made to a servergroup target
+// while evaluating the query
+type Downstream struct {
+	ServerGroup string   `json:"servergroup"`
+	Target      string   `json:"target"`
+	API         string   `json:"api"`
+	Query       string   `json:"query,omitempty"`
+	Duration    float64  `json:"duration"`
+	Status      string   `json:"status"`
+	Error       string   `json:"error,omitempty"`
+	Series      int      `json:"series"`
+	Samples     int      `json:"samples"`
+	Warnings    []string `json:"warnings,omitempty"`
+}
+
+// AddDownstream records a downstream call on the entry
+func (e *Entry) AddDownstream(d Downstream) {
+	e.l.Lock()
+	defer e.l.Unlock()
+	e.Downstreams = append(e.Downstreams, d)
+	e.Warnings = append(e.Warnings, d.Warnings...)
+}
+
+// Logger writes query log entries to an io.Writer
+type Logger struct {
+	SlowQueryThreshold time.Duration
+	SampleRate         float64
+
+	l    sync.Mutex
+	w    io.Writer
+	rand *rand.Rand
+}
+
+// NewLogger returns a Logger which logs all entries at least as slow as
+// slowQueryThreshold, sampled at sampleRate (0-1)
+func NewLogger(w io.Writer, slowQueryThreshold time.Duration, sampleRate float64) *Logger {
+	return &Logger{
+		SlowQueryThreshold: slowQueryThreshold,
+		SampleRate:         sampleRate,
+		w:                  w,
+		rand:               rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Log writes the entry to the log (if it passes the threshold and sampling)
+func (l *Logger) Log(e *Entry) {
+	if time.Duration(e.Duration*float64(time.Second)) < l.SlowQueryThreshold {
+		return
+	}
+	// Sample before marshaling, so that dropped entries are cheap
+	if !l.sampled() {
+		return
+	}
+
+	e.l.Lock()
+	b, err := json.Marshal(e)
+	e.l.Unlock()
+	if err != nil {
+		logrus.Errorf("Unable to marshal query log entry: %v", err)
+		return
+	}
+
+	l.l.Lock()
+	defer l.l.Unlock()
+	if _, err := l.w.Write(append(b, '\n')); err != nil {
+		logrus.Errorf("Unable to write query log entry: %v", err)
+	}
+}
+
+// sampled returns whether an entry should be logged based on the SampleRate
+func (l *Logger) sampled() bool {
+	if l.SampleRate >= 1 {
+		return true
+	}
+	l.l.Lock()
+	defer l.l.Unlock()
+	return l.rand.Float64() < l.SampleRate
+}
+
+// Close closes the underlying writer (if it is closable)
+func (l *Logger) Close() error {
+	if c, ok := l.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package querylog
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHandler(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger := NewLogger(buf, 0, 1)
+
+	h := NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e := FromContext(r.Context())
+		if e == nil {
+			return
+		}
+		e.AddDownstream(Downstream{
+			ServerGroup: `{sg="a"}`,
+			Target:      "host:9090",
+			API:         "query_range",
+			Query:       "sum(up)",
+			Status:      "success",
+			Series:      1,
+			Samples:     10,
+			Warnings:    []string{"partial"},
+		})
+	}), logger, "X-Scope-OrgID")
+
+	req := httptest.NewRequest("GET", "/api/v1/query_range?query=sum(up)&start=0&end=100&step=10", nil)
+	req.Header.Set("X-Scope-OrgID", "tenant1")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	var e Entry
+	if err := json.Unmarshal(buf.Bytes(), &e); err != nil {
+		t.Fatalf("unable to unmarshal entry %q: %v", buf.String(), err)
+	}
+
+	if e.Query != "sum(up)" || e.Tenant != "tenant1" || e.Step != 10 || e.Status != http.StatusOK {
+		t.Fatalf("unexpected entry: %+v", &e)
+	}
+	if !e.End.Equal(time.Unix(100, 0)) {
+		t.Fatalf("unexpected end time: %v", e.End)
+	}
+	if len(e.Downstreams) != 1 || e.Downstreams[0].Samples != 10 {
+		t.Fatalf("unexpected downstreams: %+v", e.Downstreams)
+	}
+	if len(e.Warnings) != 1 {
+		t.Fatalf("unexpected warnings: %+v", e.Warnings)
+	}
+
+	// Non-query endpoints aren't logged
+	buf.Reset()
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/v1/labels", nil))
+	if buf.Len() != 0 {
+		t.Fatalf("unexpected log entry: %s", buf.String())
+	}
+}
+
+func TestLoggerFilter(t *testing.T) {
+	tests := []struct {
+		threshold  time.Duration
+		sampleRate float64
+		duration   float64
+		logged     bool
+	}{
+		{0, 1, 0.1, true},
+		{time.Second, 1, 0.1, false},
+		{time.Second, 1, 2, true},
+		{0, 0, 2, false},
+	}
+
+	for i, test := range tests {
+		buf := &bytes.Buffer{}
+		NewLogger(buf, test.threshold, test.sampleRate).Log(&Entry{Duration: test.duration})
+		if (buf.Len() > 0) != test.logged {
+			t.Fatalf("%d: expected logged=%v got %q", i, test.logged, buf.String())
+		}
+	}
+}
+
+func TestLoggerSampleBeforeMarshal(t *testing.T) {
+	logger := NewLogger(&bytes.Buffer{}, 0, 0)
+	e := &Entry{Query: "sum(up)", Downstreams: make([]Downstream, 100)}
+	// Entries which are dropped by sampling aren't marshaled
+	if allocs := testing.AllocsPerRun(100, func() { logger.Log(e) }); allocs != 0 {
+		t.Fatalf("expected no allocations for a dropped entry, got %v", allocs)
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "querylog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "query.log")
+	f, err := NewRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	for _, line := range []string{"aaaaaaaa\n", "bbbbbbbb\n", "cccccccc\n", "dddddddd\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := map[string]string{
+		path:        "dddddddd\n",
+		path + ".1": "cccccccc\n",
+		path + ".2": "bbbbbbbb\n",
+	}
+	for p, content := range expected {
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != content {
+			t.Fatalf("mismatch in %s expected=%q actual=%q", p, content, string(b))
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("expected only 2 backups")
+	}
+}
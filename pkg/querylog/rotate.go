@@ -0,0 +1,98 @@
+package querylog
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// NewRotatingFile opens (or creates) the file at path. Once the file grows past
+// maxSize bytes it is rotated to path.1 (path.1 to path.2, etc.) keeping at most
+// maxBackups old files.
+func NewRotatingFile(path string, maxSize int64, maxBackups int) (*RotatingFile, error) {
+	r := &RotatingFile{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// RotatingFile is an io.WriteCloser that rotates the underlying file based on size
+type RotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	l    sync.Mutex
+	f    *os.File
+	size int64
+}
+
+func (r *RotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f = f
+	r.size = info.Size()
+	return nil
+}
+
+func (r *RotatingFile) backupName(i int) string {
+	return fmt.Sprintf("%s.%d", r.path, i)
+}
+
+func (r *RotatingFile) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+
+	if r.maxBackups > 0 {
+		// Shift all the backups down by one, the oldest falls off the end
+		os.Remove(r.backupName(r.maxBackups))
+		for i := r.maxBackups - 1; i > 0; i-- {
+			os.Rename(r.backupName(i), r.backupName(i+1))
+		}
+		if err := os.Rename(r.path, r.backupName(1)); err != nil {
+			return err
+		}
+	} else {
+		if err := os.Remove(r.path); err != nil {
+			return err
+		}
+	}
+
+	return r.open()
+}
+
+// Write writes p to the file, rotating first if p would put us over maxSize
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.l.Lock()
+	defer r.l.Unlock()
+
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// Close closes the underlying file
+func (r *RotatingFile) Close() error {
+	r.l.Lock()
+	defer r.l.Unlock()
+	return r.f.Close()
+}
@@ -66,6 +66,17 @@ func NewClient(index int, conf *ClientConfig) (*Client, error) {
 	}, nil
 }
 
+// NewClientWithHTTPClient creates a new Client which sends its requests with the
+// given http.Client (instead of one created from conf.HTTPClientConfig)
+func NewClientWithHTTPClient(index int, conf *ClientConfig, client *http.Client) *Client {
+	return &Client{
+		index:   index,
+		url:     conf.URL,
+		client:  client,
+		timeout: time.Duration(conf.Timeout),
+	}
+}
+
 type recoverableError struct {
 	error
 }
@@ -1,22 +1,33 @@
 package servergroup
 
 import (
+	"crypto/sha256"
 	"fmt"
+	"strings"
 	"time"
 
 	config_util "github.com/prometheus/common/config"
 	"github.com/prometheus/common/model"
 	sd_config "github.com/prometheus/prometheus/discovery/config"
 	"github.com/prometheus/prometheus/pkg/relabel"
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/jacksontj/promxy/pkg/httpauth"
+	"github.com/jacksontj/promxy/pkg/promclient"
+	"github.com/jacksontj/promxy/pkg/promhttputil"
 )
 
 var (
 	// DefaultConfig is the Default base promxy configuration
 	DefaultConfig = Config{
-		AntiAffinity:   time.Second * 10,
-		Scheme:         "http",
-		RemoteReadPath: "api/v1/read",
-		Timeout:        0,
+		AntiAffinity:     time.Second * 10,
+		Scheme:           "http",
+		RemoteReadPath:   "api/v1/read",
+		Timeout:          0,
+		CoalesceRequests: true,
+		DedupStrategy:    DedupAntiAffinity,
+		Backend:          BackendPrometheus,
+		MergeStrategy:    promhttputil.MergeStrategyReplaceZero,
 		HTTPConfig: HTTPClientConfig{
 			DialTimeout: time.Millisecond * 200, // Default dial timeout of 200ms
 		},
@@ -55,6 +66,9 @@ type Config struct {
 	// Labels is a set of labels that will be added to all metrics retrieved
 	// from this server group
 	Labels model.LabelSet `json:"labels"`
+	// Name identifies this server group in the admin API (and across config
+	// reloads), it defaults to the server group's labels (e.g. `{sg="localhost_9090"}`)
+	Name string `yaml:"name,omitempty"`
 	// RelabelConfigs are similar in function and identical in configuration as prometheus'
 	// relabel config for scrape jobs. The difference here being that the source labels
 	// you can pull from are from the downstream servergroup target and the labels you are
@@ -82,6 +96,17 @@ type Config struct {
 	// So in reality its "the same", the difference is in prometheus these apply to the labels/targets of a scrape job,
 	// in promxy they apply to the prometheus hosts in the servergroup - but the behavior is the same.
 	RelabelConfigs []*relabel.Config `yaml:"relabel_configs,omitempty"`
+	// MetricRelabelConfigs are applied to all series returned by the targets of this
+	// servergroup (the same as prometheus' metric_relabel_configs are applied to scraped
+	// series). The relabeling is applied after the labels of the target and of the
+	// servergroup (`labels`) are added, so it may use or change them.
+	// Matchers on labels which the relabeling may change are applied to the relabeled
+	// series. Queries which use such matchers, whose result may have labels the
+	// relabeling changes or which are subject to keep/drop actions are evaluated by
+	// promxy on top of the relabeled data instead of being sent to the targets.
+	// The target_label of replace (and the replacement of labelmap) may only reference
+	// capture groups matching a bounded set of strings, e.g. `(foo|bar)` but not `(.+)`
+	MetricRelabelConfigs []*relabel.Config `yaml:"metric_relabel_configs,omitempty"`
 	// Hosts is a set of ServiceDiscoveryConfig options that allow promxy to discover
 	// all hosts in the server_group
 	Hosts sd_config.ServiceDiscoveryConfig `yaml:",inline"`
@@ -91,6 +116,16 @@ type Config struct {
 	// the main use-case for this is to add `nocache=1` to VictoriaMetrics downstreams
 	// (see https://github.com/jacksontj/promxy/issues/202)
 	QueryParams map[string]string `yaml:"query_params"`
+	// Headers are added to all requests to the hosts in this servergroup (e.g. the
+	// `X-Scope-OrgID` tenant header of Cortex/Mimir)
+	Headers map[string]string `yaml:"headers,omitempty"`
+	// HeaderFiles are headers whose values are read from files (on each request, so
+	// that secrets can be rotated) which are added to all requests to the hosts
+	HeaderFiles map[string]string `yaml:"header_files,omitempty"`
+	// ForwardHeaders is the list of headers which are copied from the incoming HTTP
+	// request to the requests to the hosts in this servergroup. A forwarded header
+	// takes precedence over the same header in headers/header_files
+	ForwardHeaders []string `yaml:"forward_headers,omitempty"`
 	// TODO cache this as a model.Time after unmarshal
 	// AntiAffinity defines how large of a gap in the timeseries will cause promxy
 	// to merge series from 2 hosts in a server_group. This required for a couple reasons
@@ -109,11 +144,90 @@ type Config struct {
 	// time does not include the time to read the response body.
 	Timeout time.Duration `yaml:"timeout,omitempty"`
 
+	// SampleLimit is the max number of samples promxy will accept in a single response
+	// from a target in this servergroup. Responses are decoded as they are read, so a
+	// response over the limit fails without being loaded into memory (0 is unlimited)
+	SampleLimit int `yaml:"sample_limit,omitempty"`
+
+	// MaxConcurrentRequests is the max number of concurrent requests promxy sends to
+	// each target in this servergroup, further requests are queued until a request
+	// finishes or their context is done. Requests whose deadline is sooner than the
+	// average wait for a slot fail without being queued (0 is unlimited)
+	MaxConcurrentRequests int `yaml:"max_concurrent_requests,omitempty"`
+	// MaxConcurrentRequestsTotal is the max number of concurrent requests promxy sends
+	// to all targets in this servergroup combined (0 is unlimited)
+	MaxConcurrentRequestsTotal int `yaml:"max_concurrent_requests_total,omitempty"`
+
+	// TimeRangeDiscovery, if set, periodically discovers the time range each target
+	// has data for. Queries outside of a target's time range aren't sent to it
+	TimeRangeDiscovery *TimeRangeDiscoveryConfig `yaml:"time_range_discovery,omitempty"`
+
+	// TierGroup makes this servergroup one tier of a time-tiered set: all servergroups
+	// with the same tier_group have the same series, but for different time ranges
+	// (as defined by their relative_time_range/absolute_time_range), for example a
+	// short-term prometheus and a long-term store. Queries are cut at the boundaries of
+	// the tiers, each part is only sent to the tier authoritative for it (where tiers
+	// overlap, the one with the most recent start) and the results are concatenated
+	TierGroup string `yaml:"tier_group,omitempty"`
+
+	// Resolution is the resolution of the data in this servergroup (e.g. 5m for a
+	// downsampled long-term store), 0 means raw data. Within a tier_group range queries
+	// go to the coarsest servergroup whose resolution still satisfies the query's step,
+	// with finer servergroups filling in the time ranges the coarse one doesn't cover
+	Resolution time.Duration `yaml:"resolution,omitempty"`
+
+	// QueryRewrite maps the metric and label names promxy is queried with to the
+	// names the targets in this servergroup use. Selectors of outgoing queries are
+	// rewritten and the names of the returned series are mapped back, so servergroups
+	// with different naming schemes can be queried with a single one
+	QueryRewrite *QueryRewriteConfig `yaml:"query_rewrite,omitempty"`
+
+	// Backend defines the API promxy uses to talk to the hosts in this servergroup.
+	//   prometheus (default): the prometheus HTTP API
+	//   thanos_store: the Thanos StoreAPI (gRPC), e.g. a sidecar or store gateway.
+	//     Raw data is loaded through streamed Series calls and queries are
+	//     evaluated by promxy on top of that data
+	Backend Backend `yaml:"backend"`
+
+	// DedupStrategy defines how series from the targets in this servergroup are merged.
+	//   anti_affinity (default): interleave points from all targets, only adding
+	//     points which are more than `anti_affinity` apart
+	//   replica_label: remove `replica_label` from all series and use the points of
+	//     a single target for as long as it has data, only switching to another target
+	//     after a gap larger than `dedup_penalty` (this is the same approach as Thanos).
+	//     This avoids the artefacts (e.g. sawtooth `rate()`) of interleaving points from
+	//     replicas which scrape at different offsets
+	DedupStrategy DedupStrategy `yaml:"dedup_strategy"`
+	// ReplicaLabel is the label which differentiates the replicas in this servergroup.
+	// This may be a label of the series or of the target (after relabeling)
+	ReplicaLabel string `yaml:"replica_label,omitempty"`
+	// DedupPenalty is the size of a gap in the data of a target after which the
+	// replica_label strategy will switch to another target. If unset this is 2x the
+	// interval between the last 2 points of the series
+	DedupPenalty time.Duration `yaml:"dedup_penalty,omitempty"`
+
+	// MergeStrategy defines which value is used when multiple targets in this servergroup
+	// return a value for the same series of an instant vector (or for a scalar).
+	//   replace_zero (default): use the first value, replacing it if it is 0
+	//   newest: use the value with the newest timestamp
+	//   first: use the value from the first target to respond
+	//   non_stale: use the first value which isn't a stale marker
+	//   max: use the largest value (useful for gauges)
+	//   min: use the smallest value (useful for gauges)
+	MergeStrategy string `yaml:"merge_strategy"`
+
 	// IgnoreError will hide all errors from this given servergroup effectively making
 	// the responses from this servergroup "not required" for the result.
 	// Note: this allows you to make the tradeoff between availability of queries and consistency of results
 	IgnoreError bool `yaml:"ignore_error"`
 
+	// CoalesceRequests will deduplicate identical concurrent requests to a given target
+	// in this servergroup. This is most useful when many users load the same dashboard
+	// at the same time, as all of those identical queries will share a single downstream
+	// request (and response). Requests are only shared if they have the same values of
+	// the ForwardHeaders.
+	CoalesceRequests bool `yaml:"coalesce_requests"`
+
 	// RelativeTimeRangeConfig defines a relative time range that this servergroup will respond to
 	// An example use-case would be if a specific servergroup was long-term storage, it might only
 	// have data 3d old and retain 90d of data.
@@ -125,16 +239,90 @@ type Config struct {
 	*AbsoluteTimeRangeConfig `yaml:"absolute_time_range"`
 }
 
+// DedupStrategy defines how series from the targets in a servergroup are merged
+type DedupStrategy string
+
+// Backend is the API used to talk to the hosts in a servergroup
+type Backend string
+
+// Available Backend options
+const (
+	BackendPrometheus  Backend = "prometheus"
+	BackendThanosStore Backend = "thanos_store"
+)
+
+// Available DedupStrategy options
+const (
+	DedupAntiAffinity DedupStrategy = "anti_affinity"
+	DedupReplicaLabel DedupStrategy = "replica_label"
+)
+
 // GetScheme returns the scheme for this servergroup
 func (c *Config) GetScheme() string {
 	return c.Scheme
 }
 
+// GetName returns the name of this servergroup
+func (c *Config) GetName() string {
+	if c.Name != "" {
+		return c.Name
+	}
+	return c.Labels.String()
+}
+
+// GetTimeRange returns the time range (at `now`) this servergroup has data for,
+// based on the absolute_time_range and relative_time_range. A zero start or end
+// means the range is unbounded on that side
+func (c *Config) GetTimeRange(now time.Time) (start, end time.Time) {
+	if c.AbsoluteTimeRangeConfig != nil {
+		start, end = c.AbsoluteTimeRangeConfig.Start, c.AbsoluteTimeRangeConfig.End
+	}
+	if c.RelativeTimeRangeConfig != nil {
+		if c.RelativeTimeRangeConfig.Start != nil {
+			if relStart := now.Add(*c.RelativeTimeRangeConfig.Start); start.IsZero() || relStart.After(start) {
+				start = relStart
+			}
+		}
+		if c.RelativeTimeRangeConfig.End != nil {
+			if relEnd := now.Add(*c.RelativeTimeRangeConfig.End); end.IsZero() || relEnd.Before(end) {
+				end = relEnd
+			}
+		}
+	}
+	return start, end
+}
+
 // GetAntiAffinity returns the AntiAffinity time for this servergroup
 func (c *Config) GetAntiAffinity() model.Time {
 	return model.TimeFromUnix(int64((c.AntiAffinity).Seconds()))
 }
 
+// GetMergeStrategy returns the MergeStrategy for this servergroup
+func (c *Config) GetMergeStrategy() promhttputil.MergeStrategy {
+	if strategy, err := promhttputil.GetMergeStrategy(c.MergeStrategy); err == nil {
+		return strategy
+	}
+	return promhttputil.DefaultMergeStrategy
+}
+
+// GetSampleStreamMerger returns the SampleStreamMerger for the DedupStrategy of this servergroup
+func (c *Config) GetSampleStreamMerger() promhttputil.SampleStreamMerger {
+	if c.DedupStrategy == DedupReplicaLabel {
+		return promhttputil.DedupMerger(model.Time(c.DedupPenalty / time.Millisecond))
+	}
+	return promhttputil.AntiAffinityMerger(c.GetAntiAffinity())
+}
+
+// Hash returns a hash of the config, this is used to determine if a servergroup's
+// config has changed between reloads
+func (c *Config) Hash() (string, error) {
+	b, err := yaml.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(b)), nil
+}
+
 // UnmarshalYAML implements the yaml.Unmarshaler interface.
 func (c *Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	*c = DefaultConfig
@@ -142,13 +330,106 @@ func (c *Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	// To make unmarshal fill the plain data struct rather than calling UnmarshalYAML
 	// again, we have to hide it using a type indirection.
 	type plain Config
-	return unmarshal((*plain)(c))
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+
+	switch c.DedupStrategy {
+	case DedupAntiAffinity:
+	case DedupReplicaLabel:
+		if c.ReplicaLabel == "" {
+			return fmt.Errorf("replica_label is required for dedup_strategy %s", DedupReplicaLabel)
+		}
+	default:
+		return fmt.Errorf("unknown dedup_strategy %q", c.DedupStrategy)
+	}
+
+	if _, err := promhttputil.GetMergeStrategy(c.MergeStrategy); err != nil {
+		return err
+	}
+
+	if c.Resolution < 0 {
+		return fmt.Errorf("resolution must be >= 0")
+	}
+
+	for name := range c.Headers {
+		if !validHeaderName(name) {
+			return fmt.Errorf("invalid header name %q", name)
+		}
+	}
+	for name := range c.HeaderFiles {
+		if !validHeaderName(name) {
+			return fmt.Errorf("invalid header name %q", name)
+		}
+	}
+	for _, name := range c.ForwardHeaders {
+		if !validHeaderName(name) {
+			return fmt.Errorf("invalid header name %q", name)
+		}
+	}
+
+	if err := c.HTTPConfig.validate(); err != nil {
+		return err
+	}
+
+	if c.QueryRewrite != nil {
+		if err := c.QueryRewrite.validate(); err != nil {
+			return err
+		}
+	}
+
+	if c.SampleLimit < 0 {
+		return fmt.Errorf("sample_limit must be >= 0")
+	}
+
+	// The label names the relabeling may set must be known to tell which matchers
+	// can be sent downstream
+	if _, err := promclient.RelabelTargets(c.MetricRelabelConfigs); err != nil {
+		return fmt.Errorf("invalid metric_relabel_configs: %v", err)
+	}
+
+	if c.MaxConcurrentRequests < 0 || c.MaxConcurrentRequestsTotal < 0 {
+		return fmt.Errorf("max_concurrent_requests and max_concurrent_requests_total must be >= 0")
+	}
+
+	switch c.Backend {
+	case BackendPrometheus:
+	case BackendThanosStore:
+		if c.RemoteRead {
+			return fmt.Errorf("remote_read is not supported with backend %s", BackendThanosStore)
+		}
+	default:
+		return fmt.Errorf("unknown backend %q", c.Backend)
+	}
+	return nil
 }
 
 // HTTPClientConfig extends prometheus' HTTPClientConfig
 type HTTPClientConfig struct {
 	DialTimeout time.Duration                `yaml:"dial_timeout"`
 	HTTPConfig  config_util.HTTPClientConfig `yaml:",inline"`
+	// OAuth2 authenticates requests with tokens from the OAuth2 client credentials flow
+	OAuth2 *httpauth.OAuth2Config `yaml:"oauth2,omitempty"`
+	// SigV4 signs requests with AWS signature version 4
+	SigV4 *httpauth.SigV4Config `yaml:"sigv4,omitempty"`
+}
+
+func (c *HTTPClientConfig) validate() error {
+	authMethods := 0
+	for _, configured := range []bool{
+		len(c.HTTPConfig.BearerToken) > 0 || len(c.HTTPConfig.BearerTokenFile) > 0,
+		c.HTTPConfig.BasicAuth != nil,
+		c.OAuth2 != nil,
+		c.SigV4 != nil,
+	} {
+		if configured {
+			authMethods++
+		}
+	}
+	if authMethods > 1 {
+		return fmt.Errorf("at most one of bearer_token, basic_auth, oauth2 & sigv4 must be configured")
+	}
+	return nil
 }
 
 // RelativeTimeRangeConfig configures durations relative from "now" to define
@@ -197,3 +478,77 @@ func (tr *AbsoluteTimeRangeConfig) validate() error {
 	}
 	return nil
 }
+
+// TimeRangeDiscoveryConfig configures the discovery of the time range each target
+// of a servergroup has data for
+type TimeRangeDiscoveryConfig struct {
+	// Interval is how often the time ranges are discovered
+	Interval time.Duration `yaml:"interval"`
+	// Query, if set, is a query returning the unix timestamp (in seconds) of the
+	// oldest data of a target (e.g. `prometheus_tsdb_lowest_timestamp_seconds`).
+	// Otherwise the time range is based on the storage retention of prometheus
+	// targets (from /api/v1/status/runtimeinfo) or the Info of thanos_store targets
+	Query string `yaml:"query"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (c *TimeRangeDiscoveryConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	c.Interval = 5 * time.Minute
+	type plain TimeRangeDiscoveryConfig
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+	if c.Interval <= 0 {
+		return fmt.Errorf("time_range_discovery: interval must be > 0")
+	}
+	return nil
+}
+
+// QueryRewriteConfig configures the metric and label names to rewrite in queries
+// to a servergroup (queried name -> target's name)
+type QueryRewriteConfig struct {
+	MetricNames map[string]string `yaml:"metric_names"`
+	LabelNames  map[string]string `yaml:"label_names"`
+}
+
+func (c *QueryRewriteConfig) validate() error {
+	targets := make(map[string]string, len(c.MetricNames))
+	for from, to := range c.MetricNames {
+		if !model.IsValidMetricName(model.LabelValue(from)) || !model.IsValidMetricName(model.LabelValue(to)) {
+			return fmt.Errorf("query_rewrite: invalid metric name mapping %q -> %q", from, to)
+		}
+		// The mapping has to be reversible to rewrite the results back
+		if existing, ok := targets[to]; ok {
+			return fmt.Errorf("query_rewrite: metric names %q and %q both map to %q", existing, from, to)
+		}
+		targets[to] = from
+	}
+
+	targets = make(map[string]string, len(c.LabelNames))
+	for from, to := range c.LabelNames {
+		if !model.LabelName(from).IsValid() || !model.LabelName(to).IsValid() {
+			return fmt.Errorf("query_rewrite: invalid label name mapping %q -> %q", from, to)
+		}
+		if from == model.MetricNameLabel || to == model.MetricNameLabel {
+			return fmt.Errorf("query_rewrite: %s can't be rewritten", model.MetricNameLabel)
+		}
+		if existing, ok := targets[to]; ok {
+			return fmt.Errorf("query_rewrite: label names %q and %q both map to %q", existing, from, to)
+		}
+		targets[to] = from
+	}
+	return nil
+}
+
+// validHeaderName returns whether `name` is a valid HTTP header name (an RFC 7230 token)
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if r <= ' ' || r >= 0x7f || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, r) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,202 @@
+package servergroup
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/jacksontj/promxy/pkg/promclient"
+)
+
+// Override is a single runtime override, which is active until Expires (if set)
+type Override struct {
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+func newOverride(ttl time.Duration) *Override {
+	o := &Override{}
+	if ttl > 0 {
+		o.Expires = time.Now().Add(ttl)
+	}
+	return o
+}
+
+func (o *Override) expired(now time.Time) bool {
+	return o != nil && !o.Expires.IsZero() && !now.Before(o.Expires)
+}
+
+// PinOverride forces a servergroup to only query a single target
+type PinOverride struct {
+	Override
+	Target string `json:"target"`
+}
+
+// Overrides are the runtime overrides for a servergroup. These are set through
+// the admin API and are layered on top of the targets from service discovery
+type Overrides struct {
+	// Disabled removes all targets of the servergroup from queries
+	Disabled *Override `json:"disabled,omitempty"`
+	// DisabledTargets removes individual targets (by host) from queries
+	DisabledTargets map[string]*Override `json:"disabledTargets,omitempty"`
+	// Pinned forces queries to a single target
+	Pinned *PinOverride `json:"pinned,omitempty"`
+}
+
+// Empty returns whether there are no overrides set
+func (o *Overrides) Empty() bool {
+	return o.Disabled == nil && len(o.DisabledTargets) == 0 && o.Pinned == nil
+}
+
+// TargetDisabled returns whether the given target is disabled
+func (o *Overrides) TargetDisabled(target string) bool {
+	if o.Disabled != nil {
+		return true
+	}
+	_, ok := o.DisabledTargets[target]
+	return ok
+}
+
+// overrideSet holds the overrides of a ServerGroup
+type overrideSet struct {
+	l         sync.Mutex
+	overrides Overrides
+}
+
+// get returns a copy of the currently active overrides, removing any which
+// have expired
+func (s *overrideSet) get(sgName string) Overrides {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	now := time.Now()
+	if s.overrides.Disabled.expired(now) {
+		logrus.WithFields(logrus.Fields{"servergroup": sgName}).Info("Servergroup disable override expired")
+		s.overrides.Disabled = nil
+	}
+	if s.overrides.Pinned != nil && s.overrides.Pinned.expired(now) {
+		logrus.WithFields(logrus.Fields{"servergroup": sgName, "target": s.overrides.Pinned.Target}).Info("Servergroup pin override expired")
+		s.overrides.Pinned = nil
+	}
+
+	ret := Overrides{
+		Disabled: s.overrides.Disabled,
+		Pinned:   s.overrides.Pinned,
+	}
+	for target, o := range s.overrides.DisabledTargets {
+		if o.expired(now) {
+			logrus.WithFields(logrus.Fields{"servergroup": sgName, "target": target}).Info("Target disable override expired")
+			delete(s.overrides.DisabledTargets, target)
+			continue
+		}
+		if ret.DisabledTargets == nil {
+			ret.DisabledTargets = make(map[string]*Override, len(s.overrides.DisabledTargets))
+		}
+		ret.DisabledTargets[target] = o
+	}
+	return ret
+}
+
+func (s *overrideSet) setDisabled(disabled bool, ttl time.Duration) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	if disabled {
+		s.overrides.Disabled = newOverride(ttl)
+	} else {
+		s.overrides.Disabled = nil
+	}
+}
+
+func (s *overrideSet) setTargetDisabled(target string, disabled bool, ttl time.Duration) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	if disabled {
+		if s.overrides.DisabledTargets == nil {
+			s.overrides.DisabledTargets = make(map[string]*Override)
+		}
+		s.overrides.DisabledTargets[target] = newOverride(ttl)
+	} else {
+		delete(s.overrides.DisabledTargets, target)
+	}
+}
+
+func (s *overrideSet) setPinned(target string, ttl time.Duration) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	if target == "" {
+		s.overrides.Pinned = nil
+	} else {
+		s.overrides.Pinned = &PinOverride{Override: *newOverride(ttl), Target: target}
+	}
+}
+
+// Overrides returns the currently active runtime overrides
+func (s *ServerGroup) Overrides() Overrides {
+	return s.overrides.get(s.Cfg.GetName())
+}
+
+// CopyOverrides replaces the overrides of the servergroup with the active
+// overrides of `from`. This is used to keep the overrides of a servergroup
+// which is rebuilt on a config reload
+func (s *ServerGroup) CopyOverrides(from *ServerGroup) {
+	o := from.Overrides()
+	s.overrides.l.Lock()
+	defer s.overrides.l.Unlock()
+	s.overrides.overrides = o
+}
+
+// SetDisabled disables (or re-enables) the whole servergroup. A non-zero ttl
+// will cause the override to expire after that duration
+func (s *ServerGroup) SetDisabled(disabled bool, ttl time.Duration) {
+	s.overrides.setDisabled(disabled, ttl)
+}
+
+// SetTargetDisabled disables (or re-enables) a single target (by host) of the
+// servergroup. A non-zero ttl will cause the override to expire after that duration
+func (s *ServerGroup) SetTargetDisabled(target string, disabled bool, ttl time.Duration) {
+	s.overrides.setTargetDisabled(target, disabled, ttl)
+}
+
+// SetPinned forces all queries to the given target (by host), an empty target
+// removes the pin. If the pinned target is not currently discovered (or is
+// disabled) the pin is ignored. A non-zero ttl will cause the override to
+// expire after that duration
+func (s *ServerGroup) SetPinned(target string, ttl time.Duration) {
+	s.overrides.setPinned(target, ttl)
+}
+
+// apiClient returns the API client for the current state with all active overrides applied
+func (s *ServerGroup) apiClient() promclient.API {
+	state := s.State()
+	o := s.Overrides()
+	if o.Empty() {
+		return state.apiClient
+	}
+
+	// Determine which of the discovered targets are still enabled
+	enabled := make([]int, 0, len(state.Targets))
+	if o.Disabled == nil {
+		for i, target := range state.Targets {
+			if !o.TargetDisabled(target) {
+				enabled = append(enabled, i)
+			}
+		}
+		if o.Pinned != nil {
+			for _, i := range enabled {
+				if state.Targets[i] == o.Pinned.Target {
+					enabled = []int{i}
+					break
+				}
+			}
+		}
+	}
+
+	apiClients := make([]promclient.API, len(enabled))
+	for i, idx := range enabled {
+		apiClients[i] = state.apiClients[idx]
+	}
+	metricFunc := func(i int, api, status string, took float64) {
+		state.metricFunc(enabled[i], api, status, took)
+	}
+	return s.newMultiAPI(apiClients, metricFunc)
+}
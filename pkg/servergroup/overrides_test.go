@@ -0,0 +1,79 @@
+package servergroup
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/api"
+
+	"github.com/jacksontj/promxy/pkg/promclient"
+)
+
+// nameAPI returns its name as the only label name
+type nameAPI struct {
+	promclient.API
+	name string
+}
+
+func (n *nameAPI) LabelNames(ctx context.Context) ([]string, api.Warnings, error) {
+	return []string{n.name}, nil, nil
+}
+
+func TestOverrides(t *testing.T) {
+	targets := []string{"a", "b", "c"}
+	apiClients := make([]promclient.API, len(targets))
+	for i, target := range targets {
+		apiClients[i] = &nameAPI{name: target}
+	}
+
+	sg := &ServerGroup{Cfg: &Config{}}
+	sg.state.Store(&ServerGroupState{
+		Targets:    targets,
+		apiClients: apiClients,
+		metricFunc: func(i int, api, status string, took float64) {},
+		apiClient:  sg.newMultiAPI(apiClients, nil),
+	})
+
+	check := func(expected string) {
+		t.Helper()
+		v, _, err := sg.LabelNames(context.TODO())
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(v)
+		if actual := strings.Join(v, ","); actual != expected {
+			t.Fatalf("expected %q got %q", expected, actual)
+		}
+	}
+
+	check("a,b,c")
+
+	sg.SetTargetDisabled("b", true, 0)
+	check("a,c")
+
+	sg.SetPinned("c", 0)
+	check("c")
+
+	// Pinning a disabled target is ignored
+	sg.SetPinned("b", 0)
+	check("a,c")
+	sg.SetPinned("", 0)
+
+	sg.SetDisabled(true, 0)
+	check("")
+	sg.SetDisabled(false, 0)
+
+	sg.SetTargetDisabled("b", false, 0)
+	check("a,b,c")
+
+	// Overrides expire after their TTL
+	sg.SetTargetDisabled("a", true, time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	check("a,b,c")
+	if o := sg.Overrides(); !o.Empty() {
+		t.Fatalf("expected no overrides, got %+v", o)
+	}
+}
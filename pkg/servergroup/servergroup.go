@@ -7,6 +7,7 @@ import (
 	"net/url"
 	"path"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -20,10 +21,17 @@ import (
 	"github.com/prometheus/prometheus/discovery"
 	"github.com/prometheus/prometheus/pkg/labels"
 	"github.com/prometheus/prometheus/pkg/relabel"
-	"github.com/prometheus/prometheus/storage/remote"
 	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 
+	"github.com/jacksontj/promxy/pkg/headers"
+	"github.com/jacksontj/promxy/pkg/httpauth"
 	"github.com/jacksontj/promxy/pkg/promclient"
+	"github.com/jacksontj/promxy/pkg/remote"
+	"github.com/jacksontj/promxy/pkg/storeapi"
+	"github.com/jacksontj/promxy/pkg/storepb"
+	"github.com/jacksontj/promxy/pkg/tracing"
 
 	sd_config "github.com/prometheus/prometheus/discovery/config"
 )
@@ -34,10 +42,16 @@ var (
 		Name: "server_group_request_duration_seconds",
 		Help: "Summary of calls to servergroup instances",
 	}, []string{"host", "call", "status"})
+
+	queueWaitHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "server_group_request_queue_wait_seconds",
+		Help:    "Time requests waited for a slot of the max_concurrent_requests (host) or max_concurrent_requests_total (empty host) limits",
+		Buckets: []float64{.001, .005, .01, .05, .1, .5, 1, 5, 10, 30},
+	}, []string{"server_group", "host"})
 )
 
 func init() {
-	prometheus.MustRegister(serverGroupSummary)
+	prometheus.MustRegister(serverGroupSummary, queueWaitHistogram)
 }
 
 // New creates a new servergroup
@@ -69,8 +83,29 @@ func New() *ServerGroup {
 // ServerGroupState encapsulates the state of a serverGroup from service discovery
 type ServerGroupState struct {
 	// Targets is the list of target URLs for this discovery round
-	Targets   []string
-	apiClient promclient.API
+	Targets []string
+	// DiscoveredTargets is the list of all targets from this discovery round
+	// (including those dropped by relabeling)
+	DiscoveredTargets []*Target
+	// LastSync is the time of this discovery round
+	LastSync time.Time
+
+	// apiClients are the clients for each of the Targets
+	apiClients []promclient.API
+	metricFunc promclient.MultiAPIMetricFunc
+	apiClient  promclient.API
+}
+
+// Target is a single target discovered for a servergroup
+type Target struct {
+	// URL of the target (empty if the target was dropped)
+	URL string
+	// DiscoveredLabels are the labels of the target before relabeling
+	DiscoveredLabels labels.Labels
+	// Labels are the labels of the target after relabeling (empty if the target was dropped)
+	Labels labels.Labels
+	// Stats are the recent request stats for this target (nil if the target was dropped)
+	Stats *TargetStats
 }
 
 // ServerGroup encapsulates a set of prometheus downstreams to query/aggregate
@@ -86,14 +121,108 @@ type ServerGroup struct {
 	client        *http.Client
 	targetManager *discovery.Manager
 
+	// grpc connections to the hosts (for the thanos_store backend), by host
+	grpcDialOpts []grpc.DialOption
+	grpcLock     sync.Mutex
+	grpcConns    map[string]*grpc.ClientConn
+
+	// discovered time ranges of the targets (for time_range_discovery), by host
+	timeRangeLock        sync.RWMutex
+	timeRangeDiscoverers map[string]promclient.TimeRangeDiscoverer
+	timeRanges           map[string][2]time.Time
+	timeRangeCh          chan struct{}
+
+	// limiters of the concurrency limits of the servergroup and of each host
+	limit        *promclient.Limiter
+	targetLock   sync.Mutex
+	targetLimits map[string]*promclient.Limiter
+
 	OriginalURLs []string
 
-	state atomic.Value
+	state     atomic.Value
+	stats     targetStatsSet
+	overrides overrideSet
 }
 
 // Cancel stops backround processes (e.g. discovery manager)
 func (s *ServerGroup) Cancel() {
 	s.ctxCancel()
+	s.closeGRPCConns(nil)
+}
+
+// grpcConn returns the (shared) grpc connection to `host`
+func (s *ServerGroup) grpcConn(host string) (*grpc.ClientConn, error) {
+	s.grpcLock.Lock()
+	defer s.grpcLock.Unlock()
+	if conn, ok := s.grpcConns[host]; ok {
+		return conn, nil
+	}
+	// Dial doesn't block, the connection is established in the background
+	conn, err := grpc.Dial(host, s.grpcDialOpts...)
+	if err != nil {
+		return nil, err
+	}
+	if s.grpcConns == nil {
+		s.grpcConns = make(map[string]*grpc.ClientConn)
+	}
+	s.grpcConns[host] = conn
+	return conn, nil
+}
+
+// targetLimit returns the limiter of the concurrent requests to `host`
+func (s *ServerGroup) targetLimit(host string) *promclient.Limiter {
+	s.targetLock.Lock()
+	defer s.targetLock.Unlock()
+	if limiter, ok := s.targetLimits[host]; ok && limiter.Size() == int64(s.Cfg.MaxConcurrentRequests) {
+		return limiter
+	}
+	if s.targetLimits == nil {
+		s.targetLimits = make(map[string]*promclient.Limiter)
+	}
+	limiter := promclient.NewLimiter(int64(s.Cfg.MaxConcurrentRequests))
+	s.targetLimits[host] = limiter
+	return limiter
+}
+
+// CopyLimiters makes the servergroup share the limiters of `from`. This is used
+// to keep the limiters of a servergroup which is rebuilt on a config reload, the
+// limiters whose limit changed are replaced once the config is applied
+func (s *ServerGroup) CopyLimiters(from *ServerGroup) {
+	s.limit = from.limit
+
+	from.targetLock.Lock()
+	targetLimits := make(map[string]*promclient.Limiter, len(from.targetLimits))
+	for host, limiter := range from.targetLimits {
+		targetLimits[host] = limiter
+	}
+	from.targetLock.Unlock()
+
+	s.targetLock.Lock()
+	defer s.targetLock.Unlock()
+	s.targetLimits = targetLimits
+}
+
+// pruneTargetLimits removes the limiters of all hosts not in `keep`
+func (s *ServerGroup) pruneTargetLimits(keep map[string]struct{}) {
+	s.targetLock.Lock()
+	defer s.targetLock.Unlock()
+	for host := range s.targetLimits {
+		if _, ok := keep[host]; !ok {
+			delete(s.targetLimits, host)
+		}
+	}
+}
+
+// closeGRPCConns closes the grpc connections to all hosts not in `keep`
+func (s *ServerGroup) closeGRPCConns(keep map[string]struct{}) {
+	s.grpcLock.Lock()
+	defer s.grpcLock.Unlock()
+	for host, conn := range s.grpcConns {
+		if _, ok := keep[host]; !ok {
+			conn.Close()
+			delete(s.grpcConns, host)
+		}
+	}
 }
 
 // Sync updates the targets from our discovery manager
@@ -104,7 +233,9 @@ SYNC_LOOP:
 	for targetGroupMap := range syncCh {
 		logrus.Debug("Updating targets from discovery manager")
 		targets := make([]string, 0)
+		discoveredTargets := make([]*Target, 0)
 		apiClients := make([]promclient.API, 0)
+		timeRangeDiscoverers := make(map[string]promclient.TimeRangeDiscoverer)
 
 		for _, targetGroupList := range targetGroupMap {
 			for _, targetGroup := range targetGroupList {
@@ -122,11 +253,13 @@ SYNC_LOOP:
 					}
 
 					lset := labels.New(lbls...)
+					discoveredLabels := lset
 					logrus.Tracef("Potential target pre-relabel: %v", lset)
 					lset = relabel.Process(lset, s.Cfg.RelabelConfigs...)
 					logrus.Tracef("Potential target post-relabel: %v", lset)
 					// Check if the target was dropped, if so we skip it
 					if len(lset) == 0 {
+						discoveredTargets = append(discoveredTargets, &Target{DiscoveredLabels: discoveredLabels})
 						continue
 					}
 
@@ -142,18 +275,51 @@ SYNC_LOOP:
 						Path:   s.Cfg.PathPrefix,
 					}
 					targets = append(targets, u.Host)
+					discoveredTargets = append(discoveredTargets, &Target{
+						URL:              u.String(),
+						DiscoveredLabels: discoveredLabels,
+						Labels:           lset,
+					})
+
+					var (
+						apiClient           promclient.API
+						timeRangeDiscoverer promclient.TimeRangeDiscoverer
+					)
+					switch s.Cfg.Backend {
+					case BackendThanosStore:
+						conn, err := s.grpcConn(u.Host)
+						if err != nil {
+							logrus.Errorf("Error creating grpc connection to %s: %v", u.Host, err)
+							continue SYNC_LOOP
+						}
+						storeClient := storeapi.NewClient(storepb.NewStoreClient(conn))
+						apiClient = storeClient
+						timeRangeDiscoverer = storeClient
+					default:
+						client, err := api.NewClient(api.Config{Address: u.String(), RoundTripper: s.client.Transport})
+						if err != nil {
+							panic(err) // TODO: shouldn't be possible? If this happens I guess we log and skip?
+						}
 
-					client, err := api.NewClient(api.Config{Address: u.String(), RoundTripper: s.client.Transport})
-					if err != nil {
-						panic(err) // TODO: shouldn't be possible? If this happens I guess we log and skip?
-					}
+						if len(s.Cfg.QueryParams) > 0 {
+							client = promclient.NewClientArgsWrap(client, s.Cfg.QueryParams)
+						}
 
-					if len(s.Cfg.QueryParams) > 0 {
-						client = promclient.NewClientArgsWrap(client, s.Cfg.QueryParams)
+						apiClient = &promclient.StreamingAPI{
+							API:         &promclient.PromAPIV1{v1.NewAPI(client)},
+							Client:      client,
+							HTTPClient:  s.client,
+							SampleLimit: s.Cfg.SampleLimit,
+						}
+						timeRangeDiscoverer = &promclient.RuntimeInfoTimeRange{Client: client}
 					}
 
-					var apiClient promclient.API
-					apiClient = &promclient.PromAPIV1{v1.NewAPI(client)}
+					if s.Cfg.TimeRangeDiscovery != nil {
+						if s.Cfg.TimeRangeDiscovery.Query != "" {
+							timeRangeDiscoverer = &promclient.QueryTimeRange{API: apiClient, Query: s.Cfg.TimeRangeDiscovery.Query}
+						}
+						timeRangeDiscoverers[u.Host] = timeRangeDiscoverer
+					}
 
 					if s.Cfg.RemoteRead {
 						u.Path = path.Join(u.Path, s.Cfg.RemoteReadPath)
@@ -162,14 +328,48 @@ SYNC_LOOP:
 							// TODO: from context?
 							Timeout: model.Duration(time.Minute * 2),
 						}
-						remoteStorageClient, err := remote.NewClient(1, cfg)
-						if err != nil {
-							panic(err)
-						}
+						// The requests share the transport (auth, headers and tracing) of the
+						// other requests to the target
+						remoteStorageClient := remote.NewClientWithHTTPClient(1, cfg, s.client)
 
 						apiClient = &promclient.PromAPIRemoteRead{apiClient, remoteStorageClient}
 					}
 
+					// Limit the concurrent requests to this target and to the whole servergroup.
+					// This is inside of the CoalesceAPI so that shared requests only use one slot
+					if s.limit != nil {
+						apiClient = &promclient.LimitAPI{
+							API:         apiClient,
+							Limiter:     s.limit,
+							Name:        s.Cfg.Labels.String(),
+							ObserveWait: queueWaitHistogram.WithLabelValues(s.Cfg.Labels.String(), "").Observe,
+						}
+					}
+					if s.Cfg.MaxConcurrentRequests > 0 {
+						apiClient = &promclient.LimitAPI{
+							API:         apiClient,
+							Limiter:     s.targetLimit(u.Host),
+							Name:        u.Host,
+							ObserveWait: queueWaitHistogram.WithLabelValues(s.Cfg.Labels.String(), u.Host).Observe,
+						}
+					}
+
+					// Optionally share identical concurrent requests to this target
+					if s.Cfg.CoalesceRequests {
+						apiClient = promclient.NewCoalesceAPI(apiClient, s.Cfg.ForwardHeaders)
+					}
+
+					apiClient = &promclient.QueryLogAPI{
+						API:         apiClient,
+						ServerGroup: s.Cfg.Labels.String(),
+						Target:      u.Host,
+					}
+					apiClient = &promclient.TracingAPI{
+						API:         apiClient,
+						ServerGroup: s.Cfg.Labels.String(),
+						Target:      u.Host,
+					}
+
 					// Optionally add time range layers
 					if s.Cfg.AbsoluteTimeRangeConfig != nil {
 						apiClient = &promclient.AbsoluteTimeFilter{
@@ -187,9 +387,25 @@ SYNC_LOOP:
 						}
 					}
 
+					if s.Cfg.TimeRangeDiscovery != nil {
+						host := u.Host
+						apiClient = &promclient.DynamicTimeFilter{
+							API:    apiClient,
+							Window: func() (time.Time, time.Time) { return s.discoveredTimeRange(host) },
+						}
+					}
+
+					if s.Cfg.QueryRewrite != nil {
+						apiClient = promclient.NewRewriteAPI(apiClient, s.Cfg.QueryRewrite.MetricNames, s.Cfg.QueryRewrite.LabelNames)
+					}
+
 					// We remove all private labels after we set the target entry
 					modelLabelSet := make(model.LabelSet, len(lset))
 					for _, lbl := range lset {
+						// The replica label is removed so that all replicas share the same key
+						if s.Cfg.DedupStrategy == DedupReplicaLabel && lbl.Name == s.Cfg.ReplicaLabel {
+							continue
+						}
 						if !strings.HasPrefix(string(lbl.Name), model.ReservedLabelPrefix) {
 							modelLabelSet[model.LabelName(lbl.Name)] = model.LabelValue(lbl.Value)
 						}
@@ -198,6 +414,25 @@ SYNC_LOOP:
 					// Add labels
 					apiClient = &promclient.AddLabelClient{apiClient, modelLabelSet.Merge(s.Cfg.Labels)}
 
+					// The relabeling is applied after the labels of the target and the
+					// servergroup are added, so that it may use (or change) them
+					if len(s.Cfg.MetricRelabelConfigs) > 0 {
+						relabelAPI, err := promclient.NewRelabelAPI(apiClient, s.Cfg.MetricRelabelConfigs)
+						if err != nil {
+							logrus.Errorf("Error creating relabel client for %s: %v", u.Host, err)
+							continue SYNC_LOOP
+						}
+						apiClient = relabelAPI
+					}
+
+					// Remove the replica label from all series so that replicas are merged
+					if s.Cfg.DedupStrategy == DedupReplicaLabel {
+						apiClient = &promclient.DropLabelClient{
+							API:    apiClient,
+							Labels: []model.LabelName{model.LabelName(s.Cfg.ReplicaLabel)},
+						}
+					}
+
 					// If debug logging is enabled, wrap the client with a debugAPI client
 					// Since these are called in the reverse order of what we add, we want
 					// to make sure that this is the last wrap of the client
@@ -210,18 +445,46 @@ SYNC_LOOP:
 			}
 		}
 
+		// Close the grpc connections (and drop the limits) of hosts which are no longer targets
+		keep := make(map[string]struct{}, len(targets))
+		for _, target := range targets {
+			keep[target] = struct{}{}
+		}
+		if s.Cfg.Backend == BackendThanosStore {
+			s.closeGRPCConns(keep)
+		}
+		s.pruneTargetLimits(keep)
+
+		if s.Cfg.TimeRangeDiscovery != nil {
+			s.setTimeRangeDiscoverers(timeRangeDiscoverers)
+		}
+
+		targetStats := s.stats.update(targets)
+		for _, t := range discoveredTargets {
+			if t.URL == "" {
+				continue
+			}
+			for i, target := range targets {
+				if t.Labels.Get(model.AddressLabel) == target && t.Stats == nil {
+					t.Stats = targetStats[i]
+					break
+				}
+			}
+		}
+
 		apiClientMetricFunc := func(i int, api, status string, took float64) {
 			serverGroupSummary.WithLabelValues(targets[i], api, status).Observe(took)
+			targetStats[i].observe(status, took)
 		}
 
 		logrus.Debugf("Updating targets from discovery manager: %v", targets)
 		newState := &ServerGroupState{
-			Targets:   targets,
-			apiClient: promclient.NewMultiAPI(apiClients, s.Cfg.GetAntiAffinity(), apiClientMetricFunc, 1),
-		}
-
-		if s.Cfg.IgnoreError {
-			newState.apiClient = &promclient.IgnoreErrorAPI{newState.apiClient}
+			Targets:           targets,
+			DiscoveredTargets: discoveredTargets,
+			LastSync:          time.Now(),
+			apiClients:        apiClients,
+			metricFunc:        apiClientMetricFunc,
+			apiClient:         s.newMultiAPI(apiClients, apiClientMetricFunc),
 		}
 
 		s.state.Store(newState)
@@ -233,6 +496,90 @@ SYNC_LOOP:
 	}
 }
 
+// discoveredTimeRange returns the last discovered time range of `host`. If there is
+// none (yet) the range is unbounded
+func (s *ServerGroup) discoveredTimeRange(host string) (time.Time, time.Time) {
+	s.timeRangeLock.RLock()
+	defer s.timeRangeLock.RUnlock()
+	r := s.timeRanges[host]
+	return r[0], r[1]
+}
+
+// setTimeRangeDiscoverers sets the discoverers of the current targets and triggers
+// a discovery of their time ranges
+func (s *ServerGroup) setTimeRangeDiscoverers(discoverers map[string]promclient.TimeRangeDiscoverer) {
+	s.timeRangeLock.Lock()
+	s.timeRangeDiscoverers = discoverers
+	for host := range s.timeRanges {
+		if _, ok := discoverers[host]; !ok {
+			delete(s.timeRanges, host)
+		}
+	}
+	s.timeRangeLock.Unlock()
+
+	select {
+	case s.timeRangeCh <- struct{}{}:
+	default:
+	}
+}
+
+// discoverTimeRanges discovers the time ranges of all targets every `interval`
+// (and whenever the targets change) until the servergroup is cancelled
+func (s *ServerGroup) discoverTimeRanges(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		case <-s.timeRangeCh:
+		}
+
+		s.timeRangeLock.RLock()
+		discoverers := s.timeRangeDiscoverers
+		s.timeRangeLock.RUnlock()
+
+		var wg sync.WaitGroup
+		for host, discoverer := range discoverers {
+			wg.Add(1)
+			go func(host string, discoverer promclient.TimeRangeDiscoverer) {
+				defer wg.Done()
+				ctx, cancel := context.WithTimeout(s.ctx, interval)
+				defer cancel()
+				start, end, err := discoverer.TimeRange(ctx)
+
+				s.timeRangeLock.Lock()
+				defer s.timeRangeLock.Unlock()
+				// The target may have been removed in the meantime
+				if _, ok := s.timeRangeDiscoverers[host]; !ok {
+					return
+				}
+				// Without a time range the target is queried for all time ranges, as
+				// a stale range could hide data
+				if err != nil {
+					logrus.Warnf("Error discovering the time range of %s: %v", host, err)
+					delete(s.timeRanges, host)
+					return
+				}
+				logrus.Debugf("Discovered time range of %s: %v - %v", host, start, end)
+				s.timeRanges[host] = [2]time.Time{start, end}
+			}(host, discoverer)
+		}
+		wg.Wait()
+	}
+}
+
+// newMultiAPI returns the API client for querying all of `apiClients`
+func (s *ServerGroup) newMultiAPI(apiClients []promclient.API, metricFunc promclient.MultiAPIMetricFunc) promclient.API {
+	var apiClient promclient.API
+	apiClient = promclient.NewMultiAPIWithMerger(apiClients, s.Cfg.GetMergeStrategy(), s.Cfg.GetSampleStreamMerger(), metricFunc, 1)
+	if s.Cfg.IgnoreError {
+		apiClient = &promclient.IgnoreErrorAPI{apiClient}
+	}
+	return apiClient
+}
+
 // ApplyConfig applies new configuration to the ServerGroup
 // TODO: move config + client into state object to be swapped with atomics
 func (s *ServerGroup) ApplyConfig(cfg *Config) error {
@@ -258,6 +605,18 @@ func (s *ServerGroup) ApplyConfig(cfg *Config) error {
 		ResponseHeaderTimeout: cfg.Timeout,
 	}
 
+	// SigV4 signs the final request (including the headers set by the other round
+	// trippers), so it wraps the transport directly
+	if cfg.HTTPConfig.SigV4 != nil {
+		if rt, err = httpauth.NewSigV4RoundTripper(cfg.HTTPConfig.SigV4, rt); err != nil {
+			return err
+		}
+	}
+
+	if cfg.HTTPConfig.OAuth2 != nil {
+		rt = httpauth.NewOAuth2RoundTripper(cfg.HTTPConfig.OAuth2, rt)
+	}
+
 	// If a bearer token is provided, create a round tripper that will set the
 	// Authorization header correctly on each request.
 	if len(cfg.HTTPConfig.HTTPConfig.BearerToken) > 0 {
@@ -270,8 +629,45 @@ func (s *ServerGroup) ApplyConfig(cfg *Config) error {
 		rt = config_util.NewBasicAuthRoundTripper(cfg.HTTPConfig.HTTPConfig.BasicAuth.Username, cfg.HTTPConfig.HTTPConfig.BasicAuth.Password, cfg.HTTPConfig.HTTPConfig.BasicAuth.PasswordFile, rt)
 	}
 
+	headerInjector := &headers.Injector{
+		Headers:     cfg.Headers,
+		HeaderFiles: cfg.HeaderFiles,
+		Forward:     cfg.ForwardHeaders,
+	}
+	if !headerInjector.Empty() {
+		rt = headers.NewRoundTripper(headerInjector, rt)
+	}
+
+	// Propagate any tracing spans to the downstream requests
+	rt = tracing.NewRoundTripper(rt)
+
 	s.client = &http.Client{Transport: rt}
 
+	// The limiter is kept if the limit didn't change, so that the requests in
+	// flight keep counting against it
+	if cfg.MaxConcurrentRequestsTotal <= 0 {
+		s.limit = nil
+	} else if s.limit == nil || s.limit.Size() != int64(cfg.MaxConcurrentRequestsTotal) {
+		s.limit = promclient.NewLimiter(int64(cfg.MaxConcurrentRequestsTotal))
+	}
+
+	if cfg.TimeRangeDiscovery != nil && s.timeRangeCh == nil {
+		s.timeRanges = make(map[string][2]time.Time)
+		s.timeRangeCh = make(chan struct{}, 1)
+		go s.discoverTimeRanges(cfg.TimeRangeDiscovery.Interval)
+	}
+
+	if cfg.Backend == BackendThanosStore {
+		s.grpcDialOpts = []grpc.DialOption{grpc.WithInsecure()}
+		if cfg.Scheme == "https" {
+			s.grpcDialOpts = []grpc.DialOption{grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig))}
+		}
+		// The headers are sent as gRPC metadata
+		if !headerInjector.Empty() {
+			s.grpcDialOpts = append(s.grpcDialOpts, grpc.WithPerRPCCredentials(headerInjector))
+		}
+	}
+
 	if err := s.targetManager.ApplyConfig(map[string]sd_config.ServiceDiscoveryConfig{"foo": cfg.Hosts}); err != nil {
 		return err
 	}
@@ -289,30 +685,30 @@ func (s *ServerGroup) State() *ServerGroupState {
 
 // GetValue loads the raw data for a given set of matchers in the time range
 func (s *ServerGroup) GetValue(ctx context.Context, start, end time.Time, matchers []*labels.Matcher) (model.Value, api.Warnings, error) {
-	return s.State().apiClient.GetValue(ctx, start, end, matchers)
+	return s.apiClient().GetValue(ctx, start, end, matchers)
 }
 
 // Query performs a query for the given time.
 func (s *ServerGroup) Query(ctx context.Context, query string, ts time.Time) (model.Value, api.Warnings, error) {
-	return s.State().apiClient.Query(ctx, query, ts)
+	return s.apiClient().Query(ctx, query, ts)
 }
 
 // QueryRange performs a query for the given range.
 func (s *ServerGroup) QueryRange(ctx context.Context, query string, r v1.Range) (model.Value, api.Warnings, error) {
-	return s.State().apiClient.QueryRange(ctx, query, r)
+	return s.apiClient().QueryRange(ctx, query, r)
 }
 
 // LabelValues performs a query for the values of the given label.
 func (s *ServerGroup) LabelValues(ctx context.Context, label string) (model.LabelValues, api.Warnings, error) {
-	return s.State().apiClient.LabelValues(ctx, label)
+	return s.apiClient().LabelValues(ctx, label)
 }
 
 // LabelNames returns all the unique label names present in the block in sorted order.
 func (s *ServerGroup) LabelNames(ctx context.Context) ([]string, api.Warnings, error) {
-	return s.State().apiClient.LabelNames(ctx)
+	return s.apiClient().LabelNames(ctx)
 }
 
 // Series finds series by label matchers.
 func (s *ServerGroup) Series(ctx context.Context, matches []string, startTime, endTime time.Time) ([]model.LabelSet, api.Warnings, error) {
-	return s.State().apiClient.Series(ctx, matches, startTime, endTime)
+	return s.apiClient().Series(ctx, matches, startTime, endTime)
 }
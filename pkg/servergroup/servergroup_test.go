@@ -0,0 +1,263 @@
+package servergroup
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/prompb"
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/jacksontj/promxy/pkg/headers"
+	"github.com/jacksontj/promxy/pkg/tracing"
+)
+
+// newRemoteReadServer returns a server answering remote_read requests with
+// `series`, the requests are sent to `requests`
+func newRemoteReadServer(t *testing.T, requests chan<- *http.Request, series ...*prompb.TimeSeries) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/read" {
+			http.NotFound(w, r)
+			return
+		}
+		requests <- r
+		data, err := proto.Marshal(&prompb.ReadResponse{Results: []*prompb.QueryResult{{Timeseries: series}}})
+		if err != nil {
+			t.Errorf("unable to marshal response: %v", err)
+		}
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.Header().Set("Content-Encoding", "snappy")
+		w.Write(snappy.Encode(nil, data))
+	}))
+}
+
+// remoteRead loads data through the remote_read API of a servergroup (with the
+// given config) in front of `srv` and returns the request `srv` received
+func remoteRead(ctx context.Context, t *testing.T, cfg string) *http.Request {
+	requests := make(chan *http.Request, 1)
+	srv := newRemoteReadServer(t, requests)
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+
+	c := &Config{}
+	cfg = "static_configs:\n  - targets: [" + u.Host + "]\nremote_read: true\n" + cfg
+	if err := yaml.Unmarshal([]byte(cfg), c); err != nil {
+		t.Fatalf("unable to load config: %v", err)
+	}
+
+	sg := New()
+	defer sg.Cancel()
+	if err := sg.ApplyConfig(c); err != nil {
+		t.Fatalf("unable to apply config: %v", err)
+	}
+	select {
+	case <-sg.Ready:
+	case <-time.After(30 * time.Second):
+		t.Fatal("servergroup didn't sync")
+	}
+
+	matcher, err := labels.NewMatcher(labels.MatchEqual, labels.MetricName, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := sg.GetValue(ctx, time.Unix(0, 0), time.Unix(100, 0), []*labels.Matcher{matcher}); err != nil {
+		t.Fatalf("unable to remote_read: %v", err)
+	}
+	select {
+	case r := <-requests:
+		return r
+	default:
+		t.Fatal("no remote_read request was received")
+	}
+	return nil
+}
+
+func TestRemoteReadAuth(t *testing.T) {
+	tests := []struct {
+		name   string
+		cfg    string
+		header string
+	}{
+		{
+			name:   "basic_auth",
+			cfg:    "http_client:\n  basic_auth:\n    username: user\n    password: pass\n",
+			header: "Basic dXNlcjpwYXNz",
+		},
+		{
+			name:   "bearer_token",
+			cfg:    "http_client:\n  bearer_token: token\n",
+			header: "Bearer token",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := remoteRead(context.TODO(), t, test.cfg)
+			if got := r.Header.Get("Authorization"); got != test.header {
+				t.Fatalf("expected Authorization %q got %q", test.header, got)
+			}
+		})
+	}
+}
+
+func TestRemoteReadSigV4(t *testing.T) {
+	r := remoteRead(context.TODO(), t, "http_client:\n  sigv4:\n    region: us-east-1\n    access_key: AKID\n    secret_key: SECRET\n")
+	if got := r.Header.Get("Authorization"); !strings.HasPrefix(got, "AWS4-HMAC-SHA256 Credential=AKID/") {
+		t.Fatalf("remote_read request wasn't signed: %q", got)
+	}
+}
+
+func TestRemoteReadHeaders(t *testing.T) {
+	f, err := ioutil.TempFile("", "header")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("from-file\n")
+	f.Close()
+
+	cfg := "headers:\n  X-Static: static\nheader_files:\n  X-File: " + f.Name() + "\nforward_headers: [X-Scope-OrgID]\n"
+	ctx := headers.NewContext(context.TODO(), http.Header{"X-Scope-Orgid": []string{"tenant"}})
+	r := remoteRead(ctx, t, cfg)
+
+	for k, v := range map[string]string{"X-Static": "static", "X-File": "from-file", "X-Scope-OrgID": "tenant"} {
+		if got := r.Header.Get(k); got != v {
+			t.Fatalf("expected %s %q got %q", k, v, got)
+		}
+	}
+}
+
+// nopExporter drops all spans
+type nopExporter struct{}
+
+func (nopExporter) Export(*tracing.FinishedSpan) {}
+
+func TestRemoteReadTracing(t *testing.T) {
+	// The spans of promxy's layers are started from the global tracer
+	opentracing.SetGlobalTracer(tracing.NewTracer(nopExporter{}))
+	defer opentracing.SetGlobalTracer(opentracing.NoopTracer{})
+
+	span := opentracing.StartSpan("test")
+	defer span.Finish()
+
+	r := remoteRead(opentracing.ContextWithSpan(context.TODO(), span), t, "")
+	traceID := span.Context().(tracing.SpanContext).TraceID()
+	if got := r.Header.Get(tracing.TraceParentHeader); !strings.Contains(got, traceID) {
+		t.Fatalf("trace %s wasn't propagated to the remote_read request: %q", traceID, got)
+	}
+}
+
+func TestApplyConfigLimiters(t *testing.T) {
+	load := func(cfg string) *Config {
+		c := &Config{}
+		if err := yaml.Unmarshal([]byte("static_configs:\n  - targets: [localhost:9090]\n"+cfg), c); err != nil {
+			t.Fatalf("unable to load config: %v", err)
+		}
+		return c
+	}
+
+	sg := New()
+	defer sg.Cancel()
+	if err := sg.ApplyConfig(load("max_concurrent_requests_total: 2\nmax_concurrent_requests: 1\n")); err != nil {
+		t.Fatal(err)
+	}
+	limit, targetLimit := sg.limit, sg.targetLimit("localhost:9090")
+
+	// Reloading with the same limits keeps the limiters
+	if err := sg.ApplyConfig(load("max_concurrent_requests_total: 2\nmax_concurrent_requests: 1\n")); err != nil {
+		t.Fatal(err)
+	}
+	if sg.limit != limit || sg.targetLimit("localhost:9090") != targetLimit {
+		t.Fatalf("limiters were replaced although the limits didn't change")
+	}
+
+	// So does a servergroup rebuilt from it
+	rebuilt := New()
+	defer rebuilt.Cancel()
+	rebuilt.CopyLimiters(sg)
+	if err := rebuilt.ApplyConfig(load("max_concurrent_requests_total: 2\nmax_concurrent_requests: 1\n")); err != nil {
+		t.Fatal(err)
+	}
+	if rebuilt.limit != limit || rebuilt.targetLimit("localhost:9090") != targetLimit {
+		t.Fatalf("limiters weren't kept by the rebuilt servergroup")
+	}
+
+	// Changing the limits replaces them
+	if err := sg.ApplyConfig(load("max_concurrent_requests_total: 3\nmax_concurrent_requests: 2\n")); err != nil {
+		t.Fatal(err)
+	}
+	if sg.limit == limit || sg.limit.Size() != 3 {
+		t.Fatalf("servergroup limiter wasn't replaced")
+	}
+	if l := sg.targetLimit("localhost:9090"); l == targetLimit || l.Size() != 2 {
+		t.Fatalf("target limiter wasn't replaced")
+	}
+
+	// Removing the limit drops the limiter
+	if err := sg.ApplyConfig(load("")); err != nil {
+		t.Fatal(err)
+	}
+	if sg.limit != nil {
+		t.Fatalf("servergroup limiter wasn't removed")
+	}
+}
+
+func TestMetricRelabelServerGroupLabels(t *testing.T) {
+	requests := make(chan *http.Request, 1)
+	srv := newRemoteReadServer(t, requests, &prompb.TimeSeries{
+		Labels:  []prompb.Label{{Name: "__name__", Value: "foo"}},
+		Samples: []prompb.Sample{{Timestamp: 1000, Value: 1}},
+	})
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+
+	c := &Config{}
+	cfg := "static_configs:\n  - targets: [" + u.Host + "]\nremote_read: true\nlabels:\n  sg: a\n" + `
+metric_relabel_configs:
+  - source_labels: [sg]
+    target_label: team
+`
+	if err := yaml.Unmarshal([]byte(cfg), c); err != nil {
+		t.Fatalf("unable to load config: %v", err)
+	}
+
+	sg := New()
+	defer sg.Cancel()
+	if err := sg.ApplyConfig(c); err != nil {
+		t.Fatalf("unable to apply config: %v", err)
+	}
+	select {
+	case <-sg.Ready:
+	case <-time.After(30 * time.Second):
+		t.Fatal("servergroup didn't sync")
+	}
+
+	// The relabeling sees the labels of the servergroup
+	matcher, err := labels.NewMatcher(labels.MatchEqual, "team", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, _, err := sg.GetValue(context.TODO(), time.Unix(0, 0), time.Unix(100, 0), []*labels.Matcher{matcher})
+	if err != nil {
+		t.Fatal(err)
+	}
+	matrix, ok := v.(model.Matrix)
+	if !ok {
+		t.Fatalf("unexpected result %v", v)
+	}
+	want := model.Metric{model.MetricNameLabel: "foo", "sg": "a", "team": "a"}
+	if len(matrix) != 1 || !matrix[0].Metric.Equal(want) {
+		t.Fatalf("unexpected result %v", matrix)
+	}
+}
@@ -0,0 +1,117 @@
+package servergroup
+
+import (
+	"sync"
+	"time"
+)
+
+// statsAlpha is the weight given to each new request in the moving averages
+const statsAlpha = 0.1
+
+// TargetHealth describes the health of a target based on recent requests
+type TargetHealth string
+
+// Target health states
+const (
+	HealthUnknown TargetHealth = "unknown"
+	HealthUp      TargetHealth = "up"
+	HealthDown    TargetHealth = "down"
+)
+
+// TargetStats tracks recent request statistics for a single target. These are
+// the same requests that are recorded in the server_group_request_duration_seconds
+// summary, but kept as moving averages so we can show them in the status API
+type TargetStats struct {
+	l           sync.Mutex
+	requests    int64
+	errors      int64
+	latency     float64
+	errorRate   float64
+	lastStatus  string
+	lastRequest time.Time
+}
+
+func (t *TargetStats) observe(status string, took float64) {
+	t.l.Lock()
+	defer t.l.Unlock()
+
+	isError := 0.0
+	if status != "success" {
+		isError = 1
+		t.errors++
+	}
+
+	if t.requests == 0 {
+		t.latency = took
+		t.errorRate = isError
+	} else {
+		t.latency += statsAlpha * (took - t.latency)
+		t.errorRate += statsAlpha * (isError - t.errorRate)
+	}
+	t.requests++
+	t.lastStatus = status
+	t.lastRequest = time.Now()
+}
+
+// TargetStatsSnapshot is a point-in-time copy of a target's TargetStats
+type TargetStatsSnapshot struct {
+	Health      TargetHealth `json:"health"`
+	Requests    int64        `json:"requests"`
+	Errors      int64        `json:"errors"`
+	Latency     float64      `json:"latencySeconds"`
+	ErrorRate   float64      `json:"errorRate"`
+	LastRequest time.Time    `json:"lastRequest,omitempty"`
+}
+
+// Snapshot returns the current stats
+func (t *TargetStats) Snapshot() TargetStatsSnapshot {
+	t.l.Lock()
+	defer t.l.Unlock()
+
+	snap := TargetStatsSnapshot{
+		Health:      HealthUnknown,
+		Requests:    t.requests,
+		Errors:      t.errors,
+		Latency:     t.latency,
+		ErrorRate:   t.errorRate,
+		LastRequest: t.lastRequest,
+	}
+	switch {
+	case t.requests == 0:
+	case t.lastStatus == "success":
+		snap.Health = HealthUp
+	default:
+		snap.Health = HealthDown
+	}
+	return snap
+}
+
+// targetStatsSet holds the TargetStats for all targets of a servergroup. Stats
+// are kept across discovery updates for any target which is still present
+type targetStatsSet struct {
+	l     sync.Mutex
+	stats map[string]*TargetStats
+}
+
+// update returns the stats for the given targets, dropping any targets that
+// no longer exist
+func (s *targetStatsSet) update(targets []string) []*TargetStats {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	newStats := make(map[string]*TargetStats, len(targets))
+	ret := make([]*TargetStats, len(targets))
+	for i, target := range targets {
+		st, ok := s.stats[target]
+		if !ok {
+			st, ok = newStats[target]
+		}
+		if !ok {
+			st = &TargetStats{}
+		}
+		newStats[target] = st
+		ret[i] = st
+	}
+	s.stats = newStats
+	return ret
+}
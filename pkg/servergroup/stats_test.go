@@ -0,0 +1,31 @@
+package servergroup
+
+import "testing"
+
+func TestTargetStats(t *testing.T) {
+	var set targetStatsSet
+	stats := set.update([]string{"a", "b"})
+
+	if snap := stats[0].Snapshot(); snap.Health != HealthUnknown {
+		t.Fatalf("expected unknown health with no requests, got %v", snap.Health)
+	}
+
+	stats[0].observe("success", 1)
+	stats[0].observe("error", 2)
+	snap := stats[0].Snapshot()
+	if snap.Health != HealthDown || snap.Requests != 2 || snap.Errors != 1 {
+		t.Fatalf("unexpected snapshot: %+v", snap)
+	}
+	if snap.Latency != 1.1 || snap.ErrorRate != 0.1 {
+		t.Fatalf("unexpected moving averages: %+v", snap)
+	}
+
+	// Stats are kept for targets which remain
+	newStats := set.update([]string{"b", "c"})
+	if newStats[0] != stats[1] {
+		t.Fatalf("stats for remaining target were not kept")
+	}
+	if newStats[1] == stats[0] {
+		t.Fatalf("stats for new target were reused")
+	}
+}
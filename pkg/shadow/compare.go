@@ -0,0 +1,236 @@
+package shadow
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/jacksontj/promxy/pkg/promhttputil"
+)
+
+// maxReportedDiffs is the max number of series/values listed by Diff.String
+const maxReportedDiffs = 10
+
+// Tolerance defines how much a candidate's result may differ from the primary's
+// result while still being considered a match
+type Tolerance struct {
+	// Series is the fraction (0-1) of series which may be missing from (or only be
+	// present in) the candidate's result
+	Series float64 `yaml:"series,omitempty"`
+	// Absolute is the max absolute difference between two values
+	Absolute float64 `yaml:"absolute,omitempty"`
+	// Relative is the max difference between two values relative to the larger
+	// (absolute) of the two
+	Relative float64 `yaml:"relative,omitempty"`
+}
+
+// equal returns whether two values are equal within the tolerance
+func (t Tolerance) equal(a, b model.SampleValue) bool {
+	x, y := float64(a), float64(b)
+	if math.IsNaN(x) || math.IsNaN(y) {
+		return math.IsNaN(x) && math.IsNaN(y)
+	}
+	if x == y { // Also covers infinities
+		return true
+	}
+	d := math.Abs(x - y)
+	return d <= t.Absolute || d <= t.Relative*math.Max(math.Abs(x), math.Abs(y))
+}
+
+// ValueDiff is a sample which differs between the primary and the candidate
+type ValueDiff struct {
+	Metric    model.Metric
+	Timestamp model.Time
+	// Primary and Candidate are the values of the sample, nil if it is missing
+	Primary   *model.SampleValue
+	Candidate *model.SampleValue
+}
+
+func (d ValueDiff) String() string {
+	f := func(v *model.SampleValue) string {
+		if v == nil {
+			return "<missing>"
+		}
+		return v.String()
+	}
+	return fmt.Sprintf("%s @%s: %s != %s", d.Metric, d.Timestamp, f(d.Primary), f(d.Candidate))
+}
+
+// Diff is the difference between the primary's and the candidate's result
+type Diff struct {
+	// TypeMismatch is set if the results are of different types
+	TypeMismatch string
+	// Series is the number of distinct series in both results
+	Series int
+	// Missing are the series only present in the primary's result
+	Missing []model.Metric
+	// Extra are the series only present in the candidate's result
+	Extra []model.Metric
+	// Values are the samples of the series present in both results which differ
+	Values []ValueDiff
+	// MismatchedSeries is the number of series present in both results with
+	// differing values
+	MismatchedSeries int
+}
+
+// Mismatch returns whether the results differ by more than the tolerance
+func (d *Diff) Mismatch(t Tolerance) bool {
+	if d.TypeMismatch != "" || len(d.Values) > 0 {
+		return true
+	}
+	if n := len(d.Missing) + len(d.Extra); n > 0 {
+		return float64(n) > t.Series*float64(d.Series)
+	}
+	return false
+}
+
+func (d *Diff) String() string {
+	if d.TypeMismatch != "" {
+		return d.TypeMismatch
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d series, %d missing, %d extra, %d with differing values", d.Series, len(d.Missing), len(d.Extra), d.MismatchedSeries)
+	for _, m := range limitMetrics(d.Missing) {
+		fmt.Fprintf(&b, "\nmissing: %s", m)
+	}
+	for _, m := range limitMetrics(d.Extra) {
+		fmt.Fprintf(&b, "\nextra: %s", m)
+	}
+	for i, v := range d.Values {
+		if i == maxReportedDiffs {
+			fmt.Fprintf(&b, "\n... %d more differing values", len(d.Values)-i)
+			break
+		}
+		fmt.Fprintf(&b, "\nvalue: %s", v)
+	}
+	return b.String()
+}
+
+func limitMetrics(ms []model.Metric) []model.Metric {
+	if len(ms) > maxReportedDiffs {
+		return ms[:maxReportedDiffs]
+	}
+	return ms
+}
+
+// Compare returns the difference between the primary's and the candidate's result.
+// Values are compared with the tolerance, series are matched by their labels
+func Compare(primary, candidate model.Value, t Tolerance) *Diff {
+	if primary.Type() != candidate.Type() {
+		return &Diff{TypeMismatch: fmt.Sprintf("type mismatch: %s != %s", primary.Type(), candidate.Type())}
+	}
+
+	switch p := primary.(type) {
+	case *model.Scalar:
+		c := candidate.(*model.Scalar)
+		return compareSeries(
+			map[model.Fingerprint]*model.SampleStream{0: {Values: []model.SamplePair{{Timestamp: p.Timestamp, Value: p.Value}}}},
+			map[model.Fingerprint]*model.SampleStream{0: {Values: []model.SamplePair{{Timestamp: c.Timestamp, Value: c.Value}}}},
+			t,
+		)
+	case *model.String:
+		c := candidate.(*model.String)
+		if p.Value != c.Value || p.Timestamp != c.Timestamp {
+			return &Diff{TypeMismatch: fmt.Sprintf("string mismatch: %s != %s", p, c)}
+		}
+		return &Diff{}
+	}
+	return compareSeries(seriesOf(primary), seriesOf(candidate), t)
+}
+
+// seriesOf returns the series of a vector or matrix (of any of promxy's matrix
+// types) by fingerprint. Series with the same labels are merged
+func seriesOf(v model.Value) map[model.Fingerprint]*model.SampleStream {
+	var ret map[model.Fingerprint]*model.SampleStream
+	add := func(s *model.SampleStream) {
+		fp := s.Metric.Fingerprint()
+		if existing, ok := ret[fp]; ok {
+			if merged, err := promhttputil.MergeSampleStream(0, existing, s); err == nil {
+				s = merged
+			}
+		}
+		ret[fp] = s
+	}
+
+	switch vTyped := v.(type) {
+	case promhttputil.CompactMatrix:
+		v = vTyped.Matrix()
+	case *promhttputil.MergedMatrix:
+		v = vTyped.Matrix()
+	}
+
+	switch vTyped := v.(type) {
+	case model.Vector:
+		ret = make(map[model.Fingerprint]*model.SampleStream, len(vTyped))
+		for _, s := range vTyped {
+			add(&model.SampleStream{Metric: s.Metric, Values: []model.SamplePair{{Timestamp: s.Timestamp, Value: s.Value}}})
+		}
+	case model.Matrix:
+		ret = make(map[model.Fingerprint]*model.SampleStream, len(vTyped))
+		for _, s := range vTyped {
+			add(s)
+		}
+	}
+	return ret
+}
+
+func compareSeries(primary, candidate map[model.Fingerprint]*model.SampleStream, t Tolerance) *Diff {
+	d := &Diff{Series: len(primary)}
+	for fp, p := range primary {
+		c, ok := candidate[fp]
+		if !ok {
+			d.Missing = append(d.Missing, p.Metric)
+			continue
+		}
+		n := len(d.Values)
+		compareValues(d, p.Metric, p.Values, c.Values, t)
+		if len(d.Values) > n {
+			d.MismatchedSeries++
+		}
+	}
+	for fp, c := range candidate {
+		if _, ok := primary[fp]; !ok {
+			d.Extra = append(d.Extra, c.Metric)
+			d.Series++
+		}
+	}
+
+	// Sort for a stable (readable) output
+	sortMetrics(d.Missing)
+	sortMetrics(d.Extra)
+	sort.SliceStable(d.Values, func(i, j int) bool {
+		if a, b := d.Values[i].Metric.String(), d.Values[j].Metric.String(); a != b {
+			return a < b
+		}
+		return d.Values[i].Timestamp < d.Values[j].Timestamp
+	})
+	return d
+}
+
+// compareValues adds the differing samples of two (sorted) lists of samples to `d`
+func compareValues(d *Diff, m model.Metric, p, c []model.SamplePair, t Tolerance) {
+	i, j := 0, 0
+	for i < len(p) || j < len(c) {
+		switch {
+		case j >= len(c) || (i < len(p) && p[i].Timestamp < c[j].Timestamp):
+			d.Values = append(d.Values, ValueDiff{Metric: m, Timestamp: p[i].Timestamp, Primary: &p[i].Value})
+			i++
+		case i >= len(p) || c[j].Timestamp < p[i].Timestamp:
+			d.Values = append(d.Values, ValueDiff{Metric: m, Timestamp: c[j].Timestamp, Candidate: &c[j].Value})
+			j++
+		default:
+			if !t.equal(p[i].Value, c[j].Value) {
+				d.Values = append(d.Values, ValueDiff{Metric: m, Timestamp: p[i].Timestamp, Primary: &p[i].Value, Candidate: &c[j].Value})
+			}
+			i++
+			j++
+		}
+	}
+}
+
+func sortMetrics(ms []model.Metric) {
+	sort.Slice(ms, func(i, j int) bool { return ms[i].String() < ms[j].String() })
+}
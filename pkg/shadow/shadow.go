@@ -0,0 +1,208 @@
+// Package shadow implements mirroring of (a sample of) the requests promxy sends
+// to its servergroups to a set of candidate servergroups. The candidates' results
+// are compared to the primary's in the background, mismatches are counted and
+// logged. This is meant for validating a migration (e.g. to a different backend)
+// without affecting the users of promxy
+package shadow
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/prometheus/client_golang/api"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/sirupsen/logrus"
+
+	"github.com/jacksontj/promxy/pkg/headers"
+	"github.com/jacksontj/promxy/pkg/promclient"
+	"github.com/jacksontj/promxy/pkg/promhttputil"
+	"github.com/jacksontj/promxy/pkg/servergroup"
+)
+
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "promxy_shadow_requests_total",
+		Help: "Number of requests mirrored to the shadow servergroups by result (match, mismatch, error or dropped)",
+	}, []string{"method", "result"})
+	seriesDiffTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "promxy_shadow_series_diff_total",
+		Help: "Number of series which differ between the primary and the shadow servergroups by kind (missing, extra or value)",
+	}, []string{"method", "kind"})
+	durationSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "promxy_shadow_request_duration_seconds",
+		Help: "Duration of the requests mirrored to the shadow servergroups",
+	}, []string{"method"})
+)
+
+func init() {
+	prometheus.MustRegister(requestsTotal, seriesDiffTotal, durationSeconds)
+}
+
+// DefaultConfig is the default shadow config
+var DefaultConfig = Config{
+	SampleRatio: 0.1,
+	Timeout:     30 * time.Second,
+	MaxInflight: 10,
+	Tolerance: Tolerance{
+		Relative: 1e-9,
+	},
+}
+
+// Config configures mirroring of requests to a set of candidate servergroups
+type Config struct {
+	// ServerGroups are the candidate servergroups, they are queried the same way
+	// as the primary servergroups
+	ServerGroups []*servergroup.Config `yaml:"server_groups"`
+	// SampleRatio is the fraction (0-1) of requests which are mirrored
+	SampleRatio float64 `yaml:"sample_ratio"`
+	// Timeout is the timeout of mirrored requests
+	Timeout time.Duration `yaml:"timeout"`
+	// MaxInflight is the max number of concurrent mirrored requests, requests
+	// sampled while at the limit are dropped
+	MaxInflight int `yaml:"max_inflight"`
+	// Tolerance is the difference allowed between the candidates' and the primary's
+	// results
+	Tolerance Tolerance `yaml:"tolerance"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (c *Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*c = DefaultConfig
+	type plain Config
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+	if len(c.ServerGroups) == 0 {
+		return fmt.Errorf("shadow: at least one server_group is required")
+	}
+	if c.SampleRatio < 0 || c.SampleRatio > 1 {
+		return fmt.Errorf("shadow: sample_ratio must be between 0 and 1, got %v", c.SampleRatio)
+	}
+	if c.Timeout <= 0 {
+		return fmt.Errorf("shadow: timeout must be positive")
+	}
+	if c.MaxInflight <= 0 {
+		return fmt.Errorf("shadow: max_inflight must be positive")
+	}
+	if c.Tolerance.Series < 0 || c.Tolerance.Series > 1 {
+		return fmt.Errorf("shadow: tolerance.series must be between 0 and 1, got %v", c.Tolerance.Series)
+	}
+	if c.Tolerance.Absolute < 0 || c.Tolerance.Relative < 0 {
+		return fmt.Errorf("shadow: tolerances must not be negative")
+	}
+	return nil
+}
+
+// NewAPI returns an API which mirrors requests to `primary` to `candidate`
+// according to the config
+func NewAPI(primary, candidate promclient.API, cfg *Config) *API {
+	return &API{
+		API:       primary,
+		Candidate: candidate,
+		Cfg:       cfg,
+		inflight:  make(chan struct{}, cfg.MaxInflight),
+	}
+}
+
+// API mirrors a sample of the Query, QueryRange and GetValue requests to the API
+// it wraps to the Candidate. The requests to the candidate are only sent once the
+// primary's result is returned and are never waited for, so the latency of the
+// primary is unaffected. The primary's result is read in the background, so the
+// callers must not modify it (the ProxyStorage only reads the results)
+type API struct {
+	promclient.API
+	Candidate promclient.API
+	Cfg       *Config
+
+	inflight chan struct{}
+}
+
+// Query performs a query for the given time.
+func (s *API) Query(ctx context.Context, query string, ts time.Time) (model.Value, api.Warnings, error) {
+	v, w, err := s.API.Query(ctx, query, ts)
+	if err == nil {
+		s.mirror(ctx, "query", v, logrus.Fields{"query": query, "query_time": ts}, func(ctx context.Context) (model.Value, error) {
+			v, _, err := s.Candidate.Query(ctx, query, ts)
+			return v, err
+		})
+	}
+	return v, w, err
+}
+
+// QueryRange performs a query for the given range.
+func (s *API) QueryRange(ctx context.Context, query string, r v1.Range) (model.Value, api.Warnings, error) {
+	v, w, err := s.API.QueryRange(ctx, query, r)
+	if err == nil {
+		s.mirror(ctx, "query_range", v, logrus.Fields{"query": query, "start": r.Start, "end": r.End, "step": r.Step}, func(ctx context.Context) (model.Value, error) {
+			v, _, err := s.Candidate.QueryRange(ctx, query, r)
+			return v, err
+		})
+	}
+	return v, w, err
+}
+
+// GetValue loads the raw data for a given set of matchers in the time range
+func (s *API) GetValue(ctx context.Context, start, end time.Time, matchers []*labels.Matcher) (model.Value, api.Warnings, error) {
+	v, w, err := s.API.GetValue(ctx, start, end, matchers)
+	if err == nil {
+		selector, _ := promhttputil.MatcherToString(matchers)
+		s.mirror(ctx, "get_value", v, logrus.Fields{"selector": selector, "start": start, "end": end}, func(ctx context.Context) (model.Value, error) {
+			v, _, err := s.Candidate.GetValue(ctx, start, end, matchers)
+			return v, err
+		})
+	}
+	return v, w, err
+}
+
+// mirror (if sampled) calls `candidate` in the background and compares its result
+// with the primary's result `v`
+func (s *API) mirror(ctx context.Context, method string, v model.Value, fields logrus.Fields, candidate func(context.Context) (model.Value, error)) {
+	if s.Cfg.SampleRatio < 1 && rand.Float64() >= s.Cfg.SampleRatio {
+		return
+	}
+	select {
+	case s.inflight <- struct{}{}:
+	default:
+		requestsTotal.WithLabelValues(method, "dropped").Inc()
+		return
+	}
+
+	// The mirrored request must outlive the original one, only the headers to
+	// forward are carried over
+	mirrorCtx, cancel := context.WithTimeout(headers.NewContext(context.Background(), headers.FromContext(ctx)), s.Cfg.Timeout)
+
+	go func() {
+		defer func() { <-s.inflight }()
+		defer cancel()
+
+		// The comparison works on a copy, so that it never modifies the result
+		// the caller is using
+		primary := promhttputil.CloneValue(v)
+
+		start := time.Now()
+		c, err := candidate(mirrorCtx)
+		durationSeconds.WithLabelValues(method).Observe(time.Since(start).Seconds())
+		logger := logrus.WithFields(fields).WithField("method", method)
+		if err != nil {
+			requestsTotal.WithLabelValues(method, "error").Inc()
+			logger.Warnf("Error from shadow servergroups: %v", err)
+			return
+		}
+
+		d := Compare(primary, c, s.Cfg.Tolerance)
+		seriesDiffTotal.WithLabelValues(method, "missing").Add(float64(len(d.Missing)))
+		seriesDiffTotal.WithLabelValues(method, "extra").Add(float64(len(d.Extra)))
+		seriesDiffTotal.WithLabelValues(method, "value").Add(float64(d.MismatchedSeries))
+		if d.Mismatch(s.Cfg.Tolerance) {
+			requestsTotal.WithLabelValues(method, "mismatch").Inc()
+			logger.Warnf("Shadow servergroups result mismatch: %s", d)
+			return
+		}
+		requestsTotal.WithLabelValues(method, "match").Inc()
+	}()
+}
@@ -0,0 +1,225 @@
+package shadow
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/api"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/model"
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/jacksontj/promxy/pkg/headers"
+	"github.com/jacksontj/promxy/pkg/promclient"
+	"github.com/jacksontj/promxy/pkg/promhttputil"
+)
+
+func stream(name string, values ...float64) *model.SampleStream {
+	s := &model.SampleStream{Metric: model.Metric{model.MetricNameLabel: model.LabelValue(name)}}
+	for i, v := range values {
+		s.Values = append(s.Values, model.SamplePair{Timestamp: model.Time(i * 1000), Value: model.SampleValue(v)})
+	}
+	return s
+}
+
+func TestCompare(t *testing.T) {
+	tests := []struct {
+		name      string
+		primary   model.Value
+		candidate model.Value
+		tolerance Tolerance
+		mismatch  bool
+	}{
+		{
+			name:      "equal",
+			primary:   model.Matrix{stream("a", 1, 2), stream("b", math.NaN())},
+			candidate: model.Matrix{stream("b", math.NaN()), stream("a", 1, 2)},
+		},
+		{
+			name:      "type",
+			primary:   model.Matrix{},
+			candidate: model.Vector{},
+			mismatch:  true,
+		},
+		{
+			name:      "value",
+			primary:   model.Matrix{stream("a", 1, 2)},
+			candidate: model.Matrix{stream("a", 1, 2.1)},
+			mismatch:  true,
+		},
+		{
+			name:      "value within relative tolerance",
+			primary:   model.Matrix{stream("a", 100, 200)},
+			candidate: model.Matrix{stream("a", 100, 201)},
+			tolerance: Tolerance{Relative: 0.01},
+		},
+		{
+			name:      "value within absolute tolerance",
+			primary:   model.Matrix{stream("a", 0, 1)},
+			candidate: model.Matrix{stream("a", 0.01, 1)},
+			tolerance: Tolerance{Absolute: 0.1},
+		},
+		{
+			name:      "missing sample",
+			primary:   model.Matrix{stream("a", 1, 2)},
+			candidate: model.Matrix{stream("a", 1)},
+			tolerance: Tolerance{Series: 1},
+			mismatch:  true,
+		},
+		{
+			name:      "missing series",
+			primary:   model.Matrix{stream("a", 1), stream("b", 1)},
+			candidate: model.Matrix{stream("a", 1)},
+			mismatch:  true,
+		},
+		{
+			name:      "missing series within tolerance",
+			primary:   model.Matrix{stream("a", 1), stream("b", 1), stream("c", 1), stream("d", 1)},
+			candidate: model.Matrix{stream("a", 1), stream("b", 1), stream("c", 1), stream("e", 1)},
+			tolerance: Tolerance{Series: 0.4},
+		},
+		{
+			name:      "vector",
+			primary:   model.Vector{{Metric: model.Metric{"a": "1"}, Value: 1}},
+			candidate: model.Vector{{Metric: model.Metric{"a": "1"}, Value: 2}},
+			mismatch:  true,
+		},
+		{
+			name:      "scalar",
+			primary:   &model.Scalar{Value: 1},
+			candidate: &model.Scalar{Value: 1},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := Compare(test.primary, test.candidate, test.tolerance)
+			if d.Mismatch(test.tolerance) != test.mismatch {
+				t.Fatalf("expected mismatch=%v, diff: %s", test.mismatch, d)
+			}
+		})
+	}
+}
+
+type stubAPI struct {
+	promclient.API
+	v    model.Value
+	errs chan error
+	hdrs chan http.Header
+}
+
+func (s *stubAPI) Query(ctx context.Context, query string, ts time.Time) (model.Value, api.Warnings, error) {
+	if s.errs != nil {
+		s.errs <- ctx.Err()
+		s.hdrs <- headers.FromContext(ctx)
+	}
+	return s.v, nil, nil
+}
+
+func TestAPI(t *testing.T) {
+	cfg := DefaultConfig
+	cfg.SampleRatio = 1
+	cfg.MaxInflight = 1
+
+	primary := &stubAPI{v: model.Vector{{Metric: model.Metric{"a": "1"}, Value: 1}}}
+	candidate := &stubAPI{v: model.Vector{{Metric: model.Metric{"a": "1"}, Value: 2}}, errs: make(chan error), hdrs: make(chan http.Header)}
+	s := NewAPI(primary, candidate, &cfg)
+
+	mismatches := testutil.ToFloat64(requestsTotal.WithLabelValues("query", "mismatch"))
+	dropped := testutil.ToFloat64(requestsTotal.WithLabelValues("query", "dropped"))
+
+	ctx, cancel := context.WithCancel(headers.NewContext(context.TODO(), http.Header{"X-Scope-Orgid": []string{"tenant"}}))
+	v, _, err := s.Query(ctx, "up", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The primary's result is returned without waiting for the candidate
+	if v.(model.Vector)[0].Value != 1 {
+		t.Fatalf("unexpected result %v", v)
+	}
+	cancel()
+
+	// The candidate is queried without the cancellation of the original request
+	if err := <-candidate.errs; err != nil {
+		t.Fatalf("candidate context done: %v", err)
+	}
+
+	// Requests over max_inflight (while the candidate is blocked) are dropped
+	if _, _, err := s.Query(context.TODO(), "up", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if d := testutil.ToFloat64(requestsTotal.WithLabelValues("query", "dropped")); d != dropped+1 {
+		t.Fatalf("expected a dropped request, got %v", d-dropped)
+	}
+
+	// The headers of the original request are forwarded
+	if h := <-candidate.hdrs; h.Get("X-Scope-OrgID") != "tenant" {
+		t.Fatalf("headers not forwarded: %v", h)
+	}
+
+	// Wait for the comparison to complete (the slot is released)
+	for len(s.inflight) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if m := testutil.ToFloat64(requestsTotal.WithLabelValues("query", "mismatch")); m != mismatches+1 {
+		t.Fatalf("expected 1 mismatch, got %v", m-mismatches)
+	}
+}
+
+func TestAPIMergedMatrix(t *testing.T) {
+	cfg := DefaultConfig
+	cfg.SampleRatio = 1
+
+	// The primary's result is merged (lazily) from the results of two downstreams
+	merged, err := promhttputil.NewMergedMatrix(promhttputil.AntiAffinityMerger(0), []model.Value{
+		model.Matrix{stream("a", 1, 2, 3), stream("b", 1)},
+		promhttputil.CompactMatrix{{Metric: model.Metric{model.MetricNameLabel: "a"}, Timestamps: []int64{3000}, Values: []float64{4}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	primary := &stubAPI{v: merged}
+	candidate := &stubAPI{v: model.Matrix{stream("a", 1, 2, 3, 4), stream("b", 1)}}
+	s := NewAPI(primary, candidate, &cfg)
+
+	matches := testutil.ToFloat64(requestsTotal.WithLabelValues("query", "match"))
+	v, _, err := s.Query(context.TODO(), "up", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The caller reads the result while it is compared
+	if m := v.(*promhttputil.MergedMatrix).Matrix(); len(m) != 2 {
+		t.Fatalf("unexpected result %v", m)
+	}
+
+	// Wait for the comparison to complete (the slot is released)
+	for len(s.inflight) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if m := testutil.ToFloat64(requestsTotal.WithLabelValues("query", "match")); m != matches+1 {
+		t.Fatalf("expected 1 match, got %v", m-matches)
+	}
+}
+
+func TestConfig(t *testing.T) {
+	var cfg Config
+	if err := yaml.Unmarshal([]byte("server_groups: [{}]\ntolerance: {absolute: 0.5}"), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.SampleRatio != DefaultConfig.SampleRatio || cfg.Tolerance.Absolute != 0.5 || cfg.Tolerance.Relative != DefaultConfig.Tolerance.Relative {
+		t.Fatalf("unexpected config %+v", cfg)
+	}
+
+	for _, bad := range []string{
+		"sample_ratio: 0.5",
+		"server_groups: [{}]\nsample_ratio: 2",
+		"server_groups: [{}]\ntolerance: {series: -1}",
+	} {
+		if err := yaml.Unmarshal([]byte(bad), &Config{}); err == nil {
+			t.Fatalf("expected an error for %q", bad)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+// Package storeapi implements promxy's API over the Thanos StoreAPI (gRPC)
+package storeapi
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/api"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/tsdb/chunkenc"
+
+	"github.com/jacksontj/promxy/pkg/promclient"
+	"github.com/jacksontj/promxy/pkg/promhttputil"
+	"github.com/jacksontj/promxy/pkg/querybudget"
+	"github.com/jacksontj/promxy/pkg/storepb"
+)
+
+// Client implements promclient.API over the Thanos StoreAPI. Raw data is loaded
+// through (streamed) Series calls and Query/QueryRange are evaluated locally
+// on top of that data
+type Client struct {
+	store storepb.StoreClient
+}
+
+// NewClient returns a Client for the StoreAPI `store`
+func NewClient(store storepb.StoreClient) *Client {
+	return &Client{store: store}
+}
+
+// TimeRange returns the time range the store has data for (from its Info)
+func (c *Client) TimeRange(ctx context.Context) (start, end time.Time, err error) {
+	info, err := c.store.Info(ctx, &storepb.InfoRequest{})
+	if err != nil {
+		return start, end, err
+	}
+	// Stores use the min/max int64 for unbounded ranges
+	if info.MinTime != math.MinInt64 {
+		start = timestamp.Time(info.MinTime)
+	}
+	if info.MaxTime != math.MaxInt64 {
+		end = timestamp.Time(info.MaxTime)
+	}
+	return start, end, nil
+}
+
+// LabelNames returns all the unique label names present in the block in sorted order.
+func (c *Client) LabelNames(ctx context.Context) ([]string, api.Warnings, error) {
+	resp, err := c.store.LabelNames(ctx, &storepb.LabelNamesRequest{PartialResponseDisabled: true})
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp.Names, resp.Warnings, nil
+}
+
+// LabelValues performs a query for the values of the given label.
+func (c *Client) LabelValues(ctx context.Context, label string) (model.LabelValues, api.Warnings, error) {
+	resp, err := c.store.LabelValues(ctx, &storepb.LabelValuesRequest{Label: label, PartialResponseDisabled: true})
+	if err != nil {
+		return nil, nil, err
+	}
+	values := make(model.LabelValues, len(resp.Values))
+	for i, v := range resp.Values {
+		values[i] = model.LabelValue(v)
+	}
+	return values, resp.Warnings, nil
+}
+
+// Query performs a query for the given time.
+func (c *Client) Query(ctx context.Context, query string, ts time.Time) (model.Value, api.Warnings, error) {
+	return promclient.EvalQuery(ctx, c, query, ts)
+}
+
+// QueryRange performs a query for the given range.
+func (c *Client) QueryRange(ctx context.Context, query string, r v1.Range) (model.Value, api.Warnings, error) {
+	return promclient.EvalQueryRange(ctx, c, query, r)
+}
+
+// Series finds series by label matchers.
+func (c *Client) Series(ctx context.Context, matches []string, startTime time.Time, endTime time.Time) ([]model.LabelSet, api.Warnings, error) {
+	var (
+		ret []model.LabelSet
+		w   api.Warnings
+	)
+	for _, match := range matches {
+		matchers, err := promql.ParseMetricSelector(match)
+		if err != nil {
+			return nil, w, err
+		}
+		req, err := seriesRequest(startTime, endTime, matchers)
+		if err != nil {
+			return nil, w, err
+		}
+		req.SkipChunks = true
+
+		var labelsets []model.LabelSet
+		warnings, err := c.series(ctx, req, func(s *storepb.Series) error {
+			labelsets = append(labelsets, model.LabelSet(LabelsToMetric(s.Labels)))
+			return nil
+		})
+		w = append(w, warnings...)
+		if err != nil {
+			return nil, w, err
+		}
+		ret = promclient.MergeLabelSets(ret, labelsets)
+	}
+	return ret, w, nil
+}
+
+// GetValue loads the raw data for a given set of matchers in the time range
+func (c *Client) GetValue(ctx context.Context, start, end time.Time, matchers []*labels.Matcher) (model.Value, api.Warnings, error) {
+	req, err := seriesRequest(start, end, matchers)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// A store may send multiple frames for the same series (e.g. from different
+	// blocks), so all chunks of a series are collected before decoding them
+	type series struct {
+		metric model.Metric
+		chunks []*storepb.AggrChunk
+	}
+	seriesMap := make(map[model.Fingerprint]*series)
+	order := make([]model.Fingerprint, 0)
+
+	budget := querybudget.FromContext(ctx)
+	w, err := c.series(ctx, req, func(s *storepb.Series) error {
+		for _, chk := range s.Chunks {
+			if chk.Raw == nil {
+				return fmt.Errorf("store returned a chunk without raw data for %v", s.Labels)
+			}
+			if err := budget.AddBytes(len(chk.Raw.Data)); err != nil {
+				return err
+			}
+		}
+		metric := LabelsToMetric(s.Labels)
+		fp := metric.Fingerprint()
+		existing, ok := seriesMap[fp]
+		if !ok {
+			existing = &series{metric: metric}
+			seriesMap[fp] = existing
+			order = append(order, fp)
+		}
+		existing.chunks = append(existing.chunks, s.Chunks...)
+		return nil
+	})
+	if err != nil {
+		return nil, w, err
+	}
+
+	matrix := make(promhttputil.CompactMatrix, 0, len(order))
+	for _, fp := range order {
+		s := seriesMap[fp]
+		compact, err := decodeChunks(s.metric, s.chunks, req.MinTime, req.MaxTime)
+		if err != nil {
+			return nil, w, err
+		}
+		matrix = append(matrix, compact)
+	}
+	if err := budget.AddSamples(promhttputil.SampleCount(matrix)); err != nil {
+		return nil, w, err
+	}
+	return matrix, w, nil
+}
+
+// series does a Series call, calling `f` for each series in the stream
+func (c *Client) series(ctx context.Context, req *storepb.SeriesRequest, f func(*storepb.Series) error) (api.Warnings, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stream, err := c.store.Series(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	var w api.Warnings
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			return w, nil
+		}
+		if err != nil {
+			return w, err
+		}
+		if warning := resp.GetWarning(); warning != "" {
+			w = append(w, warning)
+			continue
+		}
+		if s := resp.GetSeries(); s != nil {
+			if err := f(s); err != nil {
+				return w, err
+			}
+		}
+	}
+}
+
+// decodeChunks decodes the (XOR) chunks of a series into a CompactSeries with
+// only the points within [mint, maxt]
+func decodeChunks(metric model.Metric, chks []*storepb.AggrChunk, mint, maxt int64) (*promhttputil.CompactSeries, error) {
+	sort.SliceStable(chks, func(i, j int) bool { return chks[i].MinTime < chks[j].MinTime })
+
+	s := &promhttputil.CompactSeries{Metric: metric}
+	for _, chk := range chks {
+		if chk.Raw.Type != storepb.Chunk_XOR {
+			return nil, fmt.Errorf("unsupported chunk encoding %v", chk.Raw.Type)
+		}
+		c, err := chunkenc.FromData(chunkenc.EncXOR, chk.Raw.Data)
+		if err != nil {
+			return nil, err
+		}
+		it := c.Iterator()
+		for it.Next() {
+			t, v := it.At()
+			if t < mint || t > maxt {
+				continue
+			}
+			// Skip points which overlap with the previous chunk
+			if n := len(s.Timestamps); n > 0 && t <= s.Timestamps[n-1] {
+				continue
+			}
+			s.Timestamps = append(s.Timestamps, t)
+			s.Values = append(s.Values, v)
+		}
+		if err := it.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// seriesRequest returns the SeriesRequest for raw data of the matchers in the time range
+func seriesRequest(start, end time.Time, matchers []*labels.Matcher) (*storepb.SeriesRequest, error) {
+	pbMatchers, err := MatchersToProto(matchers)
+	if err != nil {
+		return nil, err
+	}
+	return &storepb.SeriesRequest{
+		MinTime:                 timestamp.FromTime(start),
+		MaxTime:                 timestamp.FromTime(end),
+		Matchers:                pbMatchers,
+		Aggregates:              []storepb.Aggr{storepb.Aggr_RAW},
+		PartialResponseDisabled: true,
+		PartialResponseStrategy: storepb.PartialResponseStrategy_ABORT,
+	}, nil
+}
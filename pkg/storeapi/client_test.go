@@ -0,0 +1,176 @@
+package storeapi
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/tsdb/chunkenc"
+	"google.golang.org/grpc"
+
+	"github.com/jacksontj/promxy/pkg/promhttputil"
+	"github.com/jacksontj/promxy/pkg/storepb"
+)
+
+// fakeStore is a StoreServer serving a fixed set of series
+type fakeStore struct {
+	series   []*storepb.Series
+	warnings []string
+	lastReq  *storepb.SeriesRequest
+}
+
+func (f *fakeStore) Info(context.Context, *storepb.InfoRequest) (*storepb.InfoResponse, error) {
+	return &storepb.InfoResponse{}, nil
+}
+
+func (f *fakeStore) Series(req *storepb.SeriesRequest, srv storepb.Store_SeriesServer) error {
+	f.lastReq = req
+	for _, w := range f.warnings {
+		if err := srv.Send(storepb.NewWarnSeriesResponse(w)); err != nil {
+			return err
+		}
+	}
+	for _, s := range f.series {
+		if req.SkipChunks {
+			s = &storepb.Series{Labels: s.Labels}
+		}
+		if err := srv.Send(storepb.NewSeriesResponse(s)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *fakeStore) LabelNames(context.Context, *storepb.LabelNamesRequest) (*storepb.LabelNamesResponse, error) {
+	return &storepb.LabelNamesResponse{Names: []string{"__name__", "job"}}, nil
+}
+
+func (f *fakeStore) LabelValues(_ context.Context, req *storepb.LabelValuesRequest) (*storepb.LabelValuesResponse, error) {
+	return &storepb.LabelValuesResponse{Values: []string{req.Label + "-a", req.Label + "-b"}}, nil
+}
+
+// xorChunk returns a raw chunk of the points (timestamp -> value)
+func xorChunk(t *testing.T, points ...[2]int64) *storepb.AggrChunk {
+	c := chunkenc.NewXORChunk()
+	app, err := c.Appender()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range points {
+		app.Append(p[0], float64(p[1]))
+	}
+	return &storepb.AggrChunk{
+		MinTime: points[0][0],
+		MaxTime: points[len(points)-1][0],
+		Raw:     &storepb.Chunk{Type: storepb.Chunk_XOR, Data: c.Bytes()},
+	}
+}
+
+// newTestClient starts a grpc server for `store` and returns a Client for it
+func newTestClient(t *testing.T, store storepb.StoreServer) (*Client, func()) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer()
+	storepb.RegisterStoreServer(srv, store)
+	go srv.Serve(lis)
+
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewClient(storepb.NewStoreClient(conn)), func() {
+		conn.Close()
+		srv.Stop()
+	}
+}
+
+func TestClient(t *testing.T) {
+	lbls := []*storepb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "a"}}
+	store := &fakeStore{
+		// The second frame of the series overlaps with the first and is out of order
+		series: []*storepb.Series{
+			{Labels: lbls, Chunks: []*storepb.AggrChunk{xorChunk(t, [2]int64{60000, 3}, [2]int64{90000, 4})}},
+			{Labels: lbls, Chunks: []*storepb.AggrChunk{xorChunk(t, [2]int64{0, 1}, [2]int64{30000, 2}, [2]int64{60000, 3})}},
+		},
+		warnings: []string{"partial data"},
+	}
+	client, stop := newTestClient(t, store)
+	defer stop()
+	ctx := context.TODO()
+
+	t.Run("GetValue", func(t *testing.T) {
+		matcher, err := labels.NewMatcher(labels.MatchRegexp, "job", "a|b")
+		if err != nil {
+			t.Fatal(err)
+		}
+		matchers := []*labels.Matcher{matcher}
+		v, w, err := client.GetValue(ctx, time.Unix(0, 0), time.Unix(60, 0), matchers)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(w) != 1 || w[0] != "partial data" {
+			t.Fatalf("unexpected warnings %v", w)
+		}
+		expectedMatchers := []*storepb.LabelMatcher{{Type: storepb.LabelMatcher_RE, Name: "job", Value: "a|b"}}
+		if !reflect.DeepEqual(store.lastReq.Matchers, expectedMatchers) || store.lastReq.MaxTime != 60000 {
+			t.Fatalf("unexpected request %v", store.lastReq)
+		}
+
+		matrix := v.(promhttputil.CompactMatrix)
+		if len(matrix) != 1 {
+			t.Fatalf("expected 1 series, got %v", matrix)
+		}
+		if !reflect.DeepEqual(matrix[0].Timestamps, []int64{0, 30000, 60000}) || !reflect.DeepEqual(matrix[0].Values, []float64{1, 2, 3}) {
+			t.Fatalf("unexpected series %v", matrix[0])
+		}
+	})
+
+	t.Run("Labels", func(t *testing.T) {
+		names, _, err := client.LabelNames(ctx)
+		if err != nil || !reflect.DeepEqual(names, []string{"__name__", "job"}) {
+			t.Fatalf("unexpected label names %v %v", names, err)
+		}
+		values, _, err := client.LabelValues(ctx, "job")
+		if err != nil || !reflect.DeepEqual(values, model.LabelValues{"job-a", "job-b"}) {
+			t.Fatalf("unexpected label values %v %v", values, err)
+		}
+	})
+
+	t.Run("Series", func(t *testing.T) {
+		series, _, err := client.Series(ctx, []string{"up"}, time.Unix(0, 0), time.Unix(60, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(series) != 1 || series[0]["job"] != "a" || !store.lastReq.SkipChunks {
+			t.Fatalf("unexpected series %v", series)
+		}
+	})
+
+	t.Run("Query", func(t *testing.T) {
+		v, _, err := client.Query(ctx, "sum(up)", time.Unix(90, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		vector := v.(model.Vector)
+		if len(vector) != 1 || vector[0].Value != 4 {
+			t.Fatalf("unexpected result %v", v)
+		}
+	})
+
+	t.Run("QueryRange", func(t *testing.T) {
+		v, _, err := client.QueryRange(ctx, "up * 2", v1.Range{Start: time.Unix(0, 0), End: time.Unix(90, 0), Step: 30 * time.Second})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := promhttputil.SampleCount(v); n != 4 {
+			t.Fatalf("expected 4 samples, got %d: %v", n, v)
+		}
+	})
+}
@@ -0,0 +1,76 @@
+package storeapi
+
+import (
+	"fmt"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+
+	"github.com/jacksontj/promxy/pkg/storepb"
+)
+
+// MatchersToProto converts prometheus label matchers to StoreAPI LabelMatchers
+func MatchersToProto(matchers []*labels.Matcher) ([]*storepb.LabelMatcher, error) {
+	ret := make([]*storepb.LabelMatcher, len(matchers))
+	for i, m := range matchers {
+		var t storepb.LabelMatcher_Type
+		switch m.Type {
+		case labels.MatchEqual:
+			t = storepb.LabelMatcher_EQ
+		case labels.MatchNotEqual:
+			t = storepb.LabelMatcher_NEQ
+		case labels.MatchRegexp:
+			t = storepb.LabelMatcher_RE
+		case labels.MatchNotRegexp:
+			t = storepb.LabelMatcher_NRE
+		default:
+			return nil, fmt.Errorf("unknown matcher type %v", m.Type)
+		}
+		ret[i] = &storepb.LabelMatcher{Type: t, Name: m.Name, Value: m.Value}
+	}
+	return ret, nil
+}
+
+// MatchersFromProto converts StoreAPI LabelMatchers to prometheus label matchers
+func MatchersFromProto(matchers []*storepb.LabelMatcher) ([]*labels.Matcher, error) {
+	ret := make([]*labels.Matcher, len(matchers))
+	for i, m := range matchers {
+		var t labels.MatchType
+		switch m.Type {
+		case storepb.LabelMatcher_EQ:
+			t = labels.MatchEqual
+		case storepb.LabelMatcher_NEQ:
+			t = labels.MatchNotEqual
+		case storepb.LabelMatcher_RE:
+			t = labels.MatchRegexp
+		case storepb.LabelMatcher_NRE:
+			t = labels.MatchNotRegexp
+		default:
+			return nil, fmt.Errorf("unknown matcher type %v", m.Type)
+		}
+		matcher, err := labels.NewMatcher(t, m.Name, m.Value)
+		if err != nil {
+			return nil, err
+		}
+		ret[i] = matcher
+	}
+	return ret, nil
+}
+
+// LabelsToProto converts prometheus labels to StoreAPI labels
+func LabelsToProto(lbls labels.Labels) []*storepb.Label {
+	ret := make([]*storepb.Label, len(lbls))
+	for i, l := range lbls {
+		ret[i] = &storepb.Label{Name: l.Name, Value: l.Value}
+	}
+	return ret
+}
+
+// LabelsToMetric converts StoreAPI labels to a model.Metric
+func LabelsToMetric(lbls []*storepb.Label) model.Metric {
+	ret := make(model.Metric, len(lbls))
+	for _, l := range lbls {
+		ret[model.LabelName(l.Name)] = model.LabelValue(l.Value)
+	}
+	return ret
+}
@@ -0,0 +1,186 @@
+package storeapi
+
+import (
+	"context"
+
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/tsdb/chunkenc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/jacksontj/promxy/pkg/storepb"
+)
+
+// maxSamplesPerChunk is the max number of samples in a chunk sent by the Server
+// (this is the same as prometheus' head chunks)
+const maxSamplesPerChunk = 120
+
+// InfoFunc returns the (current) meta information of the store
+type InfoFunc func() *storepb.InfoResponse
+
+// Server implements the Thanos StoreAPI on top of a storage.Queryable, this
+// allows thanos components (e.g. Querier or Ruler) to use promxy as a store
+type Server struct {
+	queryable storage.Queryable
+	info      InfoFunc
+}
+
+// NewServer returns a Server for `queryable`, with meta information from `info`
+func NewServer(queryable storage.Queryable, info InfoFunc) *Server {
+	return &Server{queryable: queryable, info: info}
+}
+
+// Info returns meta information about the store
+func (s *Server) Info(context.Context, *storepb.InfoRequest) (*storepb.InfoResponse, error) {
+	return s.info(), nil
+}
+
+// Series streams each series (and its raw XOR chunks) matching the request
+func (s *Server) Series(req *storepb.SeriesRequest, srv storepb.Store_SeriesServer) error {
+	matchers, err := MatchersFromProto(req.Matchers)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	q, err := s.queryable.Querier(srv.Context(), req.MinTime, req.MaxTime)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	defer q.Close()
+
+	// Without SelectParams the querier only loads the labels of the series
+	var params *storage.SelectParams
+	if !req.SkipChunks {
+		params = &storage.SelectParams{Start: req.MinTime, End: req.MaxTime}
+	}
+	set, warnings, err := q.Select(params, matchers...)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	if err := s.sendWarnings(req, srv, warnings); err != nil {
+		return err
+	}
+
+	for set.Next() {
+		series := set.At()
+		resp := &storepb.Series{Labels: LabelsToProto(series.Labels())}
+		if !req.SkipChunks {
+			if resp.Chunks, err = encodeChunks(series.Iterator(), req.MinTime, req.MaxTime); err != nil {
+				return status.Error(codes.Internal, err.Error())
+			}
+			// Series without any points in the range are skipped
+			if len(resp.Chunks) == 0 {
+				continue
+			}
+		}
+		if err := srv.Send(storepb.NewSeriesResponse(resp)); err != nil {
+			return err
+		}
+	}
+	if err := set.Err(); err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	return nil
+}
+
+// sendWarnings sends `warnings` to the client, if the client disabled partial
+// responses they are returned as an error instead
+func (s *Server) sendWarnings(req *storepb.SeriesRequest, srv storepb.Store_SeriesServer, warnings storage.Warnings) error {
+	for _, w := range warnings {
+		if req.PartialResponseDisabled {
+			return status.Error(codes.Aborted, w.Error())
+		}
+		if err := srv.Send(storepb.NewWarnSeriesResponse(w.Error())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LabelNames returns all label names
+func (s *Server) LabelNames(ctx context.Context, req *storepb.LabelNamesRequest) (*storepb.LabelNamesResponse, error) {
+	q, err := s.queryable.Querier(ctx, req.Start, req.End)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	defer q.Close()
+
+	names, warnings, err := q.LabelNames()
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	w, err := warningStrings(req.PartialResponseDisabled, warnings)
+	if err != nil {
+		return nil, err
+	}
+	return &storepb.LabelNamesResponse{Names: names, Warnings: w}, nil
+}
+
+// LabelValues returns all values for the label in the request
+func (s *Server) LabelValues(ctx context.Context, req *storepb.LabelValuesRequest) (*storepb.LabelValuesResponse, error) {
+	q, err := s.queryable.Querier(ctx, req.Start, req.End)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	defer q.Close()
+
+	values, warnings, err := q.LabelValues(req.Label)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	w, err := warningStrings(req.PartialResponseDisabled, warnings)
+	if err != nil {
+		return nil, err
+	}
+	return &storepb.LabelValuesResponse{Values: values, Warnings: w}, nil
+}
+
+// warningStrings converts storage.Warnings for a response. If partial responses
+// are disabled the warnings are returned as an error instead
+func warningStrings(partialResponseDisabled bool, warnings storage.Warnings) ([]string, error) {
+	if len(warnings) == 0 {
+		return nil, nil
+	}
+	if partialResponseDisabled {
+		return nil, status.Error(codes.Aborted, warnings[0].Error())
+	}
+	ret := make([]string, len(warnings))
+	for i, w := range warnings {
+		ret[i] = w.Error()
+	}
+	return ret, nil
+}
+
+// encodeChunks encodes the points of `it` within [mint, maxt] into XOR chunks
+func encodeChunks(it storage.SeriesIterator, mint, maxt int64) ([]*storepb.AggrChunk, error) {
+	var (
+		chks []*storepb.AggrChunk
+		chk  *chunkenc.XORChunk
+		app  chunkenc.Appender
+		cur  *storepb.AggrChunk
+	)
+	ok := it.Seek(mint)
+	for ; ok; ok = it.Next() {
+		t, v := it.At()
+		if t > maxt {
+			break
+		}
+		if chk == nil || chk.NumSamples() >= maxSamplesPerChunk {
+			chk = chunkenc.NewXORChunk()
+			var err error
+			if app, err = chk.Appender(); err != nil {
+				return nil, err
+			}
+			cur = &storepb.AggrChunk{MinTime: t, Raw: &storepb.Chunk{Type: storepb.Chunk_XOR}}
+			chks = append(chks, cur)
+		}
+		app.Append(t, v)
+		cur.MaxTime = t
+		// Bytes() returns the chunk's (growing) buffer, so it is re-read after each append
+		cur.Raw.Data = chk.Bytes()
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	return chks, nil
+}
@@ -0,0 +1,88 @@
+package storeapi
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql"
+
+	"github.com/jacksontj/promxy/pkg/promhttputil"
+	"github.com/jacksontj/promxy/pkg/storepb"
+)
+
+func TestServer(t *testing.T) {
+	// 200 points, so that the series is split over multiple chunks
+	test, err := promql.NewTest(t, `
+load 30s
+	up{job="a"} 0+1x200
+	up{job="b"} 1+0x10
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer test.Close()
+	if err := test.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	info := &storepb.InfoResponse{MinTime: 1, MaxTime: 2, StoreType: storepb.StoreType_QUERY}
+	client, stop := newTestClient(t, NewServer(test.Storage(), func() *storepb.InfoResponse { return info }))
+	defer stop()
+	ctx := context.TODO()
+
+	t.Run("Info", func(t *testing.T) {
+		resp, err := client.store.Info(ctx, &storepb.InfoRequest{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.MinTime != 1 || resp.MaxTime != 2 || resp.StoreType != storepb.StoreType_QUERY {
+			t.Fatalf("unexpected info %v", resp)
+		}
+	})
+
+	t.Run("Series", func(t *testing.T) {
+		matcher, err := labels.NewMatcher(labels.MatchEqual, "job", "a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, _, err := client.GetValue(ctx, time.Unix(30, 0), time.Unix(6000, 0), []*labels.Matcher{matcher})
+		if err != nil {
+			t.Fatal(err)
+		}
+		matrix := v.(promhttputil.CompactMatrix)
+		if len(matrix) != 1 || matrix[0].Metric["job"] != "a" {
+			t.Fatalf("unexpected result %v", matrix)
+		}
+		if n := len(matrix[0].Timestamps); n != 200 {
+			t.Fatalf("expected 200 points, got %d", n)
+		}
+		if matrix[0].Timestamps[0] != 30000 || matrix[0].Values[199] != 200 {
+			t.Fatalf("unexpected points %v", matrix[0])
+		}
+	})
+
+	t.Run("Labels", func(t *testing.T) {
+		names, _, err := client.LabelNames(ctx)
+		if err != nil || !reflect.DeepEqual(names, []string{"__name__", "job"}) {
+			t.Fatalf("unexpected label names %v %v", names, err)
+		}
+		values, _, err := client.LabelValues(ctx, "job")
+		if err != nil || !reflect.DeepEqual(values, model.LabelValues{"a", "b"}) {
+			t.Fatalf("unexpected label values %v %v", values, err)
+		}
+	})
+
+	t.Run("Query", func(t *testing.T) {
+		v, _, err := client.Query(ctx, "sum(up)", time.Unix(300, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if vector := v.(model.Vector); len(vector) != 1 || vector[0].Value != 11 {
+			t.Fatalf("unexpected result %v", v)
+		}
+	})
+}
@@ -0,0 +1,390 @@
+package storepb
+
+import (
+	"context"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+)
+
+// StoreType is the type of component serving the StoreAPI
+type StoreType int32
+
+// Available StoreTypes
+const (
+	StoreType_UNKNOWN StoreType = 0
+	StoreType_QUERY   StoreType = 1
+	StoreType_RULE    StoreType = 2
+	StoreType_SIDECAR StoreType = 3
+	StoreType_STORE   StoreType = 4
+	StoreType_RECEIVE StoreType = 5
+)
+
+// Aggr is the type of aggregate of downsampled data
+type Aggr int32
+
+// Available Aggrs
+const (
+	Aggr_RAW     Aggr = 0
+	Aggr_COUNT   Aggr = 1
+	Aggr_SUM     Aggr = 2
+	Aggr_MIN     Aggr = 3
+	Aggr_MAX     Aggr = 4
+	Aggr_COUNTER Aggr = 5
+)
+
+// PartialResponseStrategy defines what a store does if some of its data is unavailable
+type PartialResponseStrategy int32
+
+// Available PartialResponseStrategys
+const (
+	PartialResponseStrategy_WARN  PartialResponseStrategy = 0
+	PartialResponseStrategy_ABORT PartialResponseStrategy = 1
+)
+
+// InfoRequest is the request of the Info call
+type InfoRequest struct{}
+
+func (m *InfoRequest) Reset()         { *m = InfoRequest{} }
+func (m *InfoRequest) String() string { return proto.CompactTextString(m) }
+func (*InfoRequest) ProtoMessage()    {}
+
+// InfoResponse describes the data a store has
+type InfoResponse struct {
+	Labels    []*Label  `protobuf:"bytes,1,rep,name=labels,proto3" json:"labels"`
+	MinTime   int64     `protobuf:"varint,2,opt,name=min_time,json=minTime,proto3" json:"min_time,omitempty"`
+	MaxTime   int64     `protobuf:"varint,3,opt,name=max_time,json=maxTime,proto3" json:"max_time,omitempty"`
+	StoreType StoreType `protobuf:"varint,4,opt,name=storeType,proto3,enum=thanos.StoreType" json:"storeType,omitempty"`
+	// LabelSets are the label sets of all the sources of the store
+	LabelSets []*LabelSet `protobuf:"bytes,5,rep,name=label_sets,json=labelSets,proto3" json:"label_sets"`
+}
+
+func (m *InfoResponse) Reset()         { *m = InfoResponse{} }
+func (m *InfoResponse) String() string { return proto.CompactTextString(m) }
+func (*InfoResponse) ProtoMessage()    {}
+
+// SeriesRequest is the request of the Series call
+type SeriesRequest struct {
+	MinTime                 int64                   `protobuf:"varint,1,opt,name=min_time,json=minTime,proto3" json:"min_time,omitempty"`
+	MaxTime                 int64                   `protobuf:"varint,2,opt,name=max_time,json=maxTime,proto3" json:"max_time,omitempty"`
+	Matchers                []*LabelMatcher         `protobuf:"bytes,3,rep,name=matchers,proto3" json:"matchers"`
+	MaxResolutionWindow     int64                   `protobuf:"varint,4,opt,name=max_resolution_window,json=maxResolutionWindow,proto3" json:"max_resolution_window,omitempty"`
+	Aggregates              []Aggr                  `protobuf:"varint,5,rep,packed,name=aggregates,proto3,enum=thanos.Aggr" json:"aggregates,omitempty"`
+	PartialResponseDisabled bool                    `protobuf:"varint,6,opt,name=partial_response_disabled,json=partialResponseDisabled,proto3" json:"partial_response_disabled,omitempty"`
+	PartialResponseStrategy PartialResponseStrategy `protobuf:"varint,7,opt,name=partial_response_strategy,json=partialResponseStrategy,proto3,enum=thanos.PartialResponseStrategy" json:"partial_response_strategy,omitempty"`
+	// SkipChunks asks the store to only return the labels of the series
+	SkipChunks bool `protobuf:"varint,8,opt,name=skip_chunks,json=skipChunks,proto3" json:"skip_chunks,omitempty"`
+}
+
+func (m *SeriesRequest) Reset()         { *m = SeriesRequest{} }
+func (m *SeriesRequest) String() string { return proto.CompactTextString(m) }
+func (*SeriesRequest) ProtoMessage()    {}
+
+// SeriesResponse is a single frame of the Series stream, which is either a
+// series or a warning
+type SeriesResponse struct {
+	Result isSeriesResponse_Result `protobuf_oneof:"result"`
+}
+
+func (m *SeriesResponse) Reset()         { *m = SeriesResponse{} }
+func (m *SeriesResponse) String() string { return proto.CompactTextString(m) }
+func (*SeriesResponse) ProtoMessage()    {}
+
+type isSeriesResponse_Result interface {
+	isSeriesResponse_Result()
+}
+
+// SeriesResponse_Series is a series in a SeriesResponse
+type SeriesResponse_Series struct {
+	Series *Series `protobuf:"bytes,1,opt,name=series,proto3,oneof"`
+}
+
+// SeriesResponse_Warning is a warning in a SeriesResponse
+type SeriesResponse_Warning struct {
+	Warning string `protobuf:"bytes,2,opt,name=warning,proto3,oneof"`
+}
+
+func (*SeriesResponse_Series) isSeriesResponse_Result()  {}
+func (*SeriesResponse_Warning) isSeriesResponse_Result() {}
+
+// GetSeries returns the series of the response (or nil if it is a warning)
+func (m *SeriesResponse) GetSeries() *Series {
+	if x, ok := m.Result.(*SeriesResponse_Series); ok {
+		return x.Series
+	}
+	return nil
+}
+
+// GetWarning returns the warning of the response (or "" if it is a series)
+func (m *SeriesResponse) GetWarning() string {
+	if x, ok := m.Result.(*SeriesResponse_Warning); ok {
+		return x.Warning
+	}
+	return ""
+}
+
+// XXX_OneofWrappers is for the internal use of the proto package.
+func (*SeriesResponse) XXX_OneofWrappers() []interface{} {
+	return []interface{}{
+		(*SeriesResponse_Series)(nil),
+		(*SeriesResponse_Warning)(nil),
+	}
+}
+
+// NewSeriesResponse returns a SeriesResponse for the series
+func NewSeriesResponse(series *Series) *SeriesResponse {
+	return &SeriesResponse{Result: &SeriesResponse_Series{Series: series}}
+}
+
+// NewWarnSeriesResponse returns a SeriesResponse for the warning
+func NewWarnSeriesResponse(warning string) *SeriesResponse {
+	return &SeriesResponse{Result: &SeriesResponse_Warning{Warning: warning}}
+}
+
+// LabelNamesRequest is the request of the LabelNames call
+type LabelNamesRequest struct {
+	PartialResponseDisabled bool                    `protobuf:"varint,1,opt,name=partial_response_disabled,json=partialResponseDisabled,proto3" json:"partial_response_disabled,omitempty"`
+	PartialResponseStrategy PartialResponseStrategy `protobuf:"varint,2,opt,name=partial_response_strategy,json=partialResponseStrategy,proto3,enum=thanos.PartialResponseStrategy" json:"partial_response_strategy,omitempty"`
+	Start                   int64                   `protobuf:"varint,3,opt,name=start,proto3" json:"start,omitempty"`
+	End                     int64                   `protobuf:"varint,4,opt,name=end,proto3" json:"end,omitempty"`
+}
+
+func (m *LabelNamesRequest) Reset()         { *m = LabelNamesRequest{} }
+func (m *LabelNamesRequest) String() string { return proto.CompactTextString(m) }
+func (*LabelNamesRequest) ProtoMessage()    {}
+
+// LabelNamesResponse is the response of the LabelNames call
+type LabelNamesResponse struct {
+	Names    []string `protobuf:"bytes,1,rep,name=names,proto3" json:"names,omitempty"`
+	Warnings []string `protobuf:"bytes,2,rep,name=warnings,proto3" json:"warnings,omitempty"`
+}
+
+func (m *LabelNamesResponse) Reset()         { *m = LabelNamesResponse{} }
+func (m *LabelNamesResponse) String() string { return proto.CompactTextString(m) }
+func (*LabelNamesResponse) ProtoMessage()    {}
+
+// LabelValuesRequest is the request of the LabelValues call
+type LabelValuesRequest struct {
+	Label                   string                  `protobuf:"bytes,1,opt,name=label,proto3" json:"label,omitempty"`
+	PartialResponseDisabled bool                    `protobuf:"varint,2,opt,name=partial_response_disabled,json=partialResponseDisabled,proto3" json:"partial_response_disabled,omitempty"`
+	PartialResponseStrategy PartialResponseStrategy `protobuf:"varint,3,opt,name=partial_response_strategy,json=partialResponseStrategy,proto3,enum=thanos.PartialResponseStrategy" json:"partial_response_strategy,omitempty"`
+	Start                   int64                   `protobuf:"varint,4,opt,name=start,proto3" json:"start,omitempty"`
+	End                     int64                   `protobuf:"varint,5,opt,name=end,proto3" json:"end,omitempty"`
+}
+
+func (m *LabelValuesRequest) Reset()         { *m = LabelValuesRequest{} }
+func (m *LabelValuesRequest) String() string { return proto.CompactTextString(m) }
+func (*LabelValuesRequest) ProtoMessage()    {}
+
+// LabelValuesResponse is the response of the LabelValues call
+type LabelValuesResponse struct {
+	Values   []string `protobuf:"bytes,1,rep,name=values,proto3" json:"values,omitempty"`
+	Warnings []string `protobuf:"bytes,2,rep,name=warnings,proto3" json:"warnings,omitempty"`
+}
+
+func (m *LabelValuesResponse) Reset()         { *m = LabelValuesResponse{} }
+func (m *LabelValuesResponse) String() string { return proto.CompactTextString(m) }
+func (*LabelValuesResponse) ProtoMessage()    {}
+
+// StoreClient is the client API for the Store service.
+type StoreClient interface {
+	// Info returns meta information about a store e.g labels that makes that store unique as well as time range that is
+	// available.
+	Info(ctx context.Context, in *InfoRequest, opts ...grpc.CallOption) (*InfoResponse, error)
+	// Series streams each Series (Labels and chunk/downsampling chunk) for given label matchers and time range.
+	Series(ctx context.Context, in *SeriesRequest, opts ...grpc.CallOption) (Store_SeriesClient, error)
+	// LabelNames returns all label names that is available.
+	LabelNames(ctx context.Context, in *LabelNamesRequest, opts ...grpc.CallOption) (*LabelNamesResponse, error)
+	// LabelValues returns all label values for given label name.
+	LabelValues(ctx context.Context, in *LabelValuesRequest, opts ...grpc.CallOption) (*LabelValuesResponse, error)
+}
+
+type storeClient struct {
+	cc *grpc.ClientConn
+}
+
+// NewStoreClient returns a StoreClient using the connection
+func NewStoreClient(cc *grpc.ClientConn) StoreClient {
+	return &storeClient{cc}
+}
+
+func (c *storeClient) Info(ctx context.Context, in *InfoRequest, opts ...grpc.CallOption) (*InfoResponse, error) {
+	out := new(InfoResponse)
+	err := c.cc.Invoke(ctx, "/thanos.Store/Info", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *storeClient) Series(ctx context.Context, in *SeriesRequest, opts ...grpc.CallOption) (Store_SeriesClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_Store_serviceDesc.Streams[0], "/thanos.Store/Series", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &storeSeriesClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// Store_SeriesClient is the client side of the Series stream
+type Store_SeriesClient interface {
+	Recv() (*SeriesResponse, error)
+	grpc.ClientStream
+}
+
+type storeSeriesClient struct {
+	grpc.ClientStream
+}
+
+func (x *storeSeriesClient) Recv() (*SeriesResponse, error) {
+	m := new(SeriesResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *storeClient) LabelNames(ctx context.Context, in *LabelNamesRequest, opts ...grpc.CallOption) (*LabelNamesResponse, error) {
+	out := new(LabelNamesResponse)
+	err := c.cc.Invoke(ctx, "/thanos.Store/LabelNames", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *storeClient) LabelValues(ctx context.Context, in *LabelValuesRequest, opts ...grpc.CallOption) (*LabelValuesResponse, error) {
+	out := new(LabelValuesResponse)
+	err := c.cc.Invoke(ctx, "/thanos.Store/LabelValues", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// StoreServer is the server API for the Store service.
+type StoreServer interface {
+	// Info returns meta information about a store e.g labels that makes that store unique as well as time range that is
+	// available.
+	Info(context.Context, *InfoRequest) (*InfoResponse, error)
+	// Series streams each Series (Labels and chunk/downsampling chunk) for given label matchers and time range.
+	Series(*SeriesRequest, Store_SeriesServer) error
+	// LabelNames returns all label names that is available.
+	LabelNames(context.Context, *LabelNamesRequest) (*LabelNamesResponse, error)
+	// LabelValues returns all label values for given label name.
+	LabelValues(context.Context, *LabelValuesRequest) (*LabelValuesResponse, error)
+}
+
+// RegisterStoreServer registers the StoreServer on the grpc.Server
+func RegisterStoreServer(s *grpc.Server, srv StoreServer) {
+	s.RegisterService(&_Store_serviceDesc, srv)
+}
+
+func _Store_Info_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(InfoRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(StoreServer).Info(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/thanos.Store/Info",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(StoreServer).Info(ctx, req.(*InfoRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Store_Series_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(SeriesRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(StoreServer).Series(m, &storeSeriesServer{stream})
+}
+
+// Store_SeriesServer is the server side of the Series stream
+type Store_SeriesServer interface {
+	Send(*SeriesResponse) error
+	grpc.ServerStream
+}
+
+type storeSeriesServer struct {
+	grpc.ServerStream
+}
+
+func (x *storeSeriesServer) Send(m *SeriesResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Store_LabelNames_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(LabelNamesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(StoreServer).LabelNames(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/thanos.Store/LabelNames",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(StoreServer).LabelNames(ctx, req.(*LabelNamesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Store_LabelValues_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(LabelValuesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(StoreServer).LabelValues(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/thanos.Store/LabelValues",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(StoreServer).LabelValues(ctx, req.(*LabelValuesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+var _Store_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "thanos.Store",
+	HandlerType: (*StoreServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Info",
+			Handler:    _Store_Info_Handler,
+		},
+		{
+			MethodName: "LabelNames",
+			Handler:    _Store_LabelNames_Handler,
+		},
+		{
+			MethodName: "LabelValues",
+			Handler:    _Store_LabelValues_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Series",
+			Handler:       _Store_Series_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "rpc.proto",
+}
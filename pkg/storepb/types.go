@@ -0,0 +1,100 @@
+// Package storepb contains the messages and gRPC service of the Thanos StoreAPI
+// (https://github.com/thanos-io/thanos/tree/master/pkg/store/storepb).
+//
+// The types are written by hand (instead of generated and vendored from thanos,
+// which would pull in all of its dependencies) but use the same protobuf field
+// numbers and service/method names as thanos' rpc.proto and types.proto, so they
+// are wire-compatible with the Store Gateway, Sidecar and Querier. Unlike thanos'
+// (gogoproto) types repeated messages are slices of pointers, as that is what
+// golang/protobuf's marshaler requires.
+package storepb
+
+import (
+	"github.com/golang/protobuf/proto"
+)
+
+// Label is a single label of a series
+type Label struct {
+	Name  string `protobuf:"bytes,1,opt,name=name,proto3" json:"name"`
+	Value string `protobuf:"bytes,2,opt,name=value,proto3" json:"value"`
+}
+
+func (m *Label) Reset()         { *m = Label{} }
+func (m *Label) String() string { return proto.CompactTextString(m) }
+func (*Label) ProtoMessage()    {}
+
+// LabelSet is a set of labels
+type LabelSet struct {
+	Labels []*Label `protobuf:"bytes,1,rep,name=labels,proto3" json:"labels"`
+}
+
+func (m *LabelSet) Reset()         { *m = LabelSet{} }
+func (m *LabelSet) String() string { return proto.CompactTextString(m) }
+func (*LabelSet) ProtoMessage()    {}
+
+// Chunk_Encoding is the encoding of a Chunk
+type Chunk_Encoding int32
+
+// Available Chunk_Encodings
+const (
+	Chunk_XOR Chunk_Encoding = 0
+)
+
+// Chunk is an encoded chunk of samples
+type Chunk struct {
+	Type Chunk_Encoding `protobuf:"varint,1,opt,name=type,proto3,enum=thanos.Chunk_Encoding" json:"type,omitempty"`
+	Data []byte         `protobuf:"bytes,2,opt,name=data,proto3" json:"data,omitempty"`
+}
+
+func (m *Chunk) Reset()         { *m = Chunk{} }
+func (m *Chunk) String() string { return proto.CompactTextString(m) }
+func (*Chunk) ProtoMessage()    {}
+
+// Series is a single series and its chunks
+type Series struct {
+	Labels []*Label     `protobuf:"bytes,1,rep,name=labels,proto3" json:"labels"`
+	Chunks []*AggrChunk `protobuf:"bytes,2,rep,name=chunks,proto3" json:"chunks"`
+}
+
+func (m *Series) Reset()         { *m = Series{} }
+func (m *Series) String() string { return proto.CompactTextString(m) }
+func (*Series) ProtoMessage()    {}
+
+// AggrChunk is a chunk of a series for the time range [MinTime, MaxTime]. Raw
+// data is in Raw, downsampled data is in the aggregate chunks
+type AggrChunk struct {
+	MinTime int64  `protobuf:"varint,1,opt,name=min_time,json=minTime,proto3" json:"min_time,omitempty"`
+	MaxTime int64  `protobuf:"varint,2,opt,name=max_time,json=maxTime,proto3" json:"max_time,omitempty"`
+	Raw     *Chunk `protobuf:"bytes,3,opt,name=raw,proto3" json:"raw,omitempty"`
+	Count   *Chunk `protobuf:"bytes,4,opt,name=count,proto3" json:"count,omitempty"`
+	Sum     *Chunk `protobuf:"bytes,5,opt,name=sum,proto3" json:"sum,omitempty"`
+	Min     *Chunk `protobuf:"bytes,6,opt,name=min,proto3" json:"min,omitempty"`
+	Max     *Chunk `protobuf:"bytes,7,opt,name=max,proto3" json:"max,omitempty"`
+	Counter *Chunk `protobuf:"bytes,8,opt,name=counter,proto3" json:"counter,omitempty"`
+}
+
+func (m *AggrChunk) Reset()         { *m = AggrChunk{} }
+func (m *AggrChunk) String() string { return proto.CompactTextString(m) }
+func (*AggrChunk) ProtoMessage()    {}
+
+// LabelMatcher_Type is the type of a LabelMatcher
+type LabelMatcher_Type int32
+
+// Available LabelMatcher_Types
+const (
+	LabelMatcher_EQ  LabelMatcher_Type = 0
+	LabelMatcher_NEQ LabelMatcher_Type = 1
+	LabelMatcher_RE  LabelMatcher_Type = 2
+	LabelMatcher_NRE LabelMatcher_Type = 3
+)
+
+// LabelMatcher is a matcher on the labels of series
+type LabelMatcher struct {
+	Type  LabelMatcher_Type `protobuf:"varint,1,opt,name=type,proto3,enum=thanos.LabelMatcher_Type" json:"type,omitempty"`
+	Name  string            `protobuf:"bytes,2,opt,name=name,proto3" json:"name,omitempty"`
+	Value string            `protobuf:"bytes,3,opt,name=value,proto3" json:"value,omitempty"`
+}
+
+func (m *LabelMatcher) Reset()         { *m = LabelMatcher{} }
+func (m *LabelMatcher) String() string { return proto.CompactTextString(m) }
+func (*LabelMatcher) ProtoMessage()    {}
@@ -0,0 +1,112 @@
+package tracing
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// FinishedSpan is the representation of a span handed to an Exporter
+type FinishedSpan struct {
+	TraceID   string                 `json:"traceID"`
+	SpanID    string                 `json:"spanID"`
+	ParentID  string                 `json:"parentID,omitempty"`
+	Operation string                 `json:"operation"`
+	Start     time.Time              `json:"start"`
+	Duration  time.Duration          `json:"duration"`
+	Tags      map[string]interface{} `json:"tags,omitempty"`
+	Logs      []LogRecord            `json:"logs,omitempty"`
+}
+
+// Exporter is responsible for shipping finished spans somewhere
+type Exporter interface {
+	Export(*FinishedSpan)
+}
+
+// LogExporter exports spans as debug log lines
+type LogExporter struct{}
+
+// Export exports the given span
+func (LogExporter) Export(s *FinishedSpan) {
+	fields := logrus.Fields{
+		"traceID":   s.TraceID,
+		"spanID":    s.SpanID,
+		"operation": s.Operation,
+		"duration":  s.Duration,
+	}
+	if s.ParentID != "" {
+		fields["parentID"] = s.ParentID
+	}
+	for k, v := range s.Tags {
+		fields["tag."+k] = v
+	}
+	logrus.WithFields(fields).Debug("span")
+}
+
+// jaegerLogger logs the errors of the jaeger client through logrus
+type jaegerLogger struct{}
+
+func (jaegerLogger) Error(msg string) { logrus.Errorf("jaeger: %s", msg) }
+
+func (jaegerLogger) Infof(msg string, args ...interface{}) {
+	logrus.Debugf("jaeger: "+msg, args...)
+}
+
+// NewFileExporter returns an exporter which writes one JSON line per span to `path`
+func NewFileExporter(path string) (*WriterExporter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return NewWriterExporter(f), nil
+}
+
+// NewWriterExporter returns an exporter which writes one JSON line per span to `w`
+func NewWriterExporter(w io.Writer) *WriterExporter {
+	return &WriterExporter{w: w}
+}
+
+// WriterExporter writes spans as JSON lines to an io.Writer
+type WriterExporter struct {
+	l sync.Mutex
+	w io.Writer
+}
+
+// Export exports the given span
+func (e *WriterExporter) Export(s *FinishedSpan) {
+	// errors aren't JSON-able, so we convert them to strings
+	for k, v := range s.Tags {
+		if err, ok := v.(error); ok {
+			s.Tags[k] = err.Error()
+		}
+	}
+	for _, lr := range s.Logs {
+		for k, v := range lr.Fields {
+			if err, ok := v.(error); ok {
+				lr.Fields[k] = err.Error()
+			}
+		}
+	}
+
+	b, err := json.Marshal(s)
+	if err != nil {
+		logrus.Errorf("Unable to marshal span: %v", err)
+		return
+	}
+
+	e.l.Lock()
+	defer e.l.Unlock()
+	e.w.Write(append(b, '\n'))
+}
+
+// Close closes the underlying writer (if it is closable)
+func (e *WriterExporter) Close() error {
+	if c, ok := e.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
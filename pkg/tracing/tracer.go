@@ -0,0 +1,342 @@
+package tracing
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/log"
+)
+
+// TraceParentHeader is the W3C trace-context header we use to propagate
+// spans between processes (https://www.w3.org/TR/trace-context/)
+const TraceParentHeader = "traceparent"
+
+// NewTracer returns a Tracer that sends all finished spans to the given Exporter
+func NewTracer(exporter Exporter) *Tracer {
+	return &Tracer{
+		exporter: exporter,
+		rand:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Tracer is a minimal opentracing.Tracer implementation which hands finished
+// spans off to an Exporter
+type Tracer struct {
+	exporter Exporter
+
+	l    sync.Mutex
+	rand *rand.Rand
+}
+
+func (t *Tracer) randomID() uint64 {
+	t.l.Lock()
+	defer t.l.Unlock()
+	for {
+		if id := t.rand.Uint64(); id != 0 {
+			return id
+		}
+	}
+}
+
+// StartSpan creates, starts, and returns a new Span with the given `operationName`
+func (t *Tracer) StartSpan(operationName string, opts ...opentracing.StartSpanOption) opentracing.Span {
+	sso := opentracing.StartSpanOptions{}
+	for _, o := range opts {
+		o.Apply(&sso)
+	}
+
+	s := &Span{
+		tracer:    t,
+		operation: operationName,
+		start:     sso.StartTime,
+		tags:      make(map[string]interface{}, len(sso.Tags)),
+	}
+	if s.start.IsZero() {
+		s.start = time.Now()
+	}
+	for k, v := range sso.Tags {
+		s.tags[k] = v
+	}
+
+	for _, ref := range sso.References {
+		if parent, ok := ref.ReferencedContext.(SpanContext); ok {
+			s.context.TraceIDHigh = parent.TraceIDHigh
+			s.context.TraceIDLow = parent.TraceIDLow
+			s.parentID = parent.SpanID
+			if len(parent.Baggage) > 0 {
+				s.context.Baggage = make(map[string]string, len(parent.Baggage))
+				for k, v := range parent.Baggage {
+					s.context.Baggage[k] = v
+				}
+			}
+			break
+		}
+	}
+
+	// If we have no parent, we are the start of a new trace
+	if s.parentID == 0 {
+		s.context.TraceIDHigh = t.randomID()
+		s.context.TraceIDLow = t.randomID()
+	}
+	s.context.SpanID = t.randomID()
+
+	return s
+}
+
+// Inject takes the `sm` SpanContext instance and injects it for
+// propagation within `carrier`.
+func (t *Tracer) Inject(sm opentracing.SpanContext, format interface{}, carrier interface{}) error {
+	sc, ok := sm.(SpanContext)
+	if !ok {
+		return opentracing.ErrInvalidSpanContext
+	}
+
+	switch format {
+	case opentracing.TextMap, opentracing.HTTPHeaders:
+		writer, ok := carrier.(opentracing.TextMapWriter)
+		if !ok {
+			return opentracing.ErrInvalidCarrier
+		}
+		writer.Set(TraceParentHeader, sc.traceParent())
+		return nil
+	}
+
+	return opentracing.ErrUnsupportedFormat
+}
+
+// Extract returns a SpanContext instance given `format` and `carrier`.
+func (t *Tracer) Extract(format interface{}, carrier interface{}) (opentracing.SpanContext, error) {
+	switch format {
+	case opentracing.TextMap, opentracing.HTTPHeaders:
+		reader, ok := carrier.(opentracing.TextMapReader)
+		if !ok {
+			return nil, opentracing.ErrInvalidCarrier
+		}
+
+		var sc *SpanContext
+		err := reader.ForeachKey(func(k, v string) error {
+			if strings.ToLower(k) == TraceParentHeader {
+				tmp, err := parseTraceParent(v)
+				if err != nil {
+					return err
+				}
+				sc = &tmp
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if sc == nil {
+			return nil, opentracing.ErrSpanContextNotFound
+		}
+		return *sc, nil
+	}
+
+	return nil, opentracing.ErrUnsupportedFormat
+}
+
+// SpanContext holds the identifiers of a span
+type SpanContext struct {
+	TraceIDHigh uint64
+	TraceIDLow  uint64
+	SpanID      uint64
+	Baggage     map[string]string
+}
+
+// ForeachBaggageItem grants access to all baggage items stored in the SpanContext
+func (c SpanContext) ForeachBaggageItem(handler func(k, v string) bool) {
+	for k, v := range c.Baggage {
+		if !handler(k, v) {
+			return
+		}
+	}
+}
+
+// TraceID returns the hex-encoded trace ID
+func (c SpanContext) TraceID() string {
+	return fmt.Sprintf("%016x%016x", c.TraceIDHigh, c.TraceIDLow)
+}
+
+func (c SpanContext) traceParent() string {
+	return fmt.Sprintf("00-%s-%016x-01", c.TraceID(), c.SpanID)
+}
+
+func parseTraceParent(v string) (SpanContext, error) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(v), "-")
+	if len(parts) < 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return sc, opentracing.ErrSpanContextCorrupted
+	}
+	if _, err := fmt.Sscanf(parts[1][:16], "%x", &sc.TraceIDHigh); err != nil {
+		return sc, opentracing.ErrSpanContextCorrupted
+	}
+	if _, err := fmt.Sscanf(parts[1][16:], "%x", &sc.TraceIDLow); err != nil {
+		return sc, opentracing.ErrSpanContextCorrupted
+	}
+	if _, err := fmt.Sscanf(parts[2], "%x", &sc.SpanID); err != nil {
+		return sc, opentracing.ErrSpanContextCorrupted
+	}
+	return sc, nil
+}
+
+// Span is the opentracing.Span implementation for Tracer
+type Span struct {
+	tracer *Tracer
+
+	l         sync.Mutex
+	context   SpanContext
+	parentID  uint64
+	operation string
+	start     time.Time
+	tags      map[string]interface{}
+	logs      []LogRecord
+	finished  bool
+}
+
+// LogRecord is a single log entry on a span
+type LogRecord struct {
+	Time   time.Time              `json:"time"`
+	Fields map[string]interface{} `json:"fields"`
+}
+
+// Finish sets the end timestamp and finalizes Span state.
+func (s *Span) Finish() {
+	s.FinishWithOptions(opentracing.FinishOptions{})
+}
+
+// FinishWithOptions is like Finish() but with explicit control over
+// timestamps and log data.
+func (s *Span) FinishWithOptions(opts opentracing.FinishOptions) {
+	finish := opts.FinishTime
+	if finish.IsZero() {
+		finish = time.Now()
+	}
+
+	s.l.Lock()
+	if s.finished {
+		s.l.Unlock()
+		return
+	}
+	s.finished = true
+	for _, lr := range opts.LogRecords {
+		s.logs = append(s.logs, newLogRecord(lr.Timestamp, lr.Fields))
+	}
+
+	finished := &FinishedSpan{
+		TraceID:   s.context.TraceID(),
+		SpanID:    fmt.Sprintf("%016x", s.context.SpanID),
+		Operation: s.operation,
+		Start:     s.start,
+		Duration:  finish.Sub(s.start),
+		Tags:      s.tags,
+		Logs:      s.logs,
+	}
+	if s.parentID != 0 {
+		finished.ParentID = fmt.Sprintf("%016x", s.parentID)
+	}
+	s.l.Unlock()
+
+	s.tracer.exporter.Export(finished)
+}
+
+// Context yields the SpanContext for this Span.
+func (s *Span) Context() opentracing.SpanContext {
+	s.l.Lock()
+	defer s.l.Unlock()
+	return s.context
+}
+
+// SetOperationName sets or changes the operation name.
+func (s *Span) SetOperationName(operationName string) opentracing.Span {
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.operation = operationName
+	return s
+}
+
+// SetTag adds a tag to the span.
+func (s *Span) SetTag(key string, value interface{}) opentracing.Span {
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.tags[key] = value
+	return s
+}
+
+// LogFields is an efficient and type-checked way to record key:value
+// logging data about a Span.
+func (s *Span) LogFields(fields ...log.Field) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.logs = append(s.logs, newLogRecord(time.Now(), fields))
+}
+
+// LogKV is a concise, readable way to record key:value logging data about
+// a Span.
+func (s *Span) LogKV(alternatingKeyValues ...interface{}) {
+	fields, err := log.InterleavedKVToFields(alternatingKeyValues...)
+	if err != nil {
+		s.LogFields(log.Error(err), log.String("function", "LogKV"))
+		return
+	}
+	s.LogFields(fields...)
+}
+
+// SetBaggageItem sets a key:value pair on this Span and its SpanContext
+// that also propagates to descendants of this Span.
+func (s *Span) SetBaggageItem(restrictedKey, value string) opentracing.Span {
+	s.l.Lock()
+	defer s.l.Unlock()
+	if s.context.Baggage == nil {
+		s.context.Baggage = make(map[string]string)
+	}
+	s.context.Baggage[restrictedKey] = value
+	return s
+}
+
+// BaggageItem gets the value for a baggage item given its key.
+func (s *Span) BaggageItem(restrictedKey string) string {
+	s.l.Lock()
+	defer s.l.Unlock()
+	return s.context.Baggage[restrictedKey]
+}
+
+// Tracer provides access to the Tracer that created this Span.
+func (s *Span) Tracer() opentracing.Tracer {
+	return s.tracer
+}
+
+// LogEvent is deprecated: use LogFields or LogKV
+func (s *Span) LogEvent(event string) {
+	s.LogFields(log.String("event", event))
+}
+
+// LogEventWithPayload is deprecated: use LogFields or LogKV
+func (s *Span) LogEventWithPayload(event string, payload interface{}) {
+	s.LogFields(log.String("event", event), log.Object("payload", payload))
+}
+
+// Log is deprecated: use LogFields or LogKV
+func (s *Span) Log(ld opentracing.LogData) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.logs = append(s.logs, newLogRecord(ld.Timestamp, ld.ToLogRecord().Fields))
+}
+
+func newLogRecord(ts time.Time, fields []log.Field) LogRecord {
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	lr := LogRecord{
+		Time:   ts,
+		Fields: make(map[string]interface{}, len(fields)),
+	}
+	for _, f := range fields {
+		lr.Fields[f.Key()] = f.Value()
+	}
+	return lr
+}
@@ -0,0 +1,151 @@
+// Package tracing contains promxy's distributed tracing support. Promxy (and the
+// vendored prometheus code) is instrumented using opentracing; this package provides
+// a minimal opentracing Tracer which hands finished spans to a configurable Exporter
+// as well as helpers to propagate the trace to downstream HTTP requests.
+package tracing
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	jaegercfg "github.com/uber/jaeger-client-go/config"
+)
+
+// Span tags used by promxy
+const (
+	TagServerGroup = "promxy.servergroup"
+	TagTarget      = "promxy.target"
+	TagQuery       = "promxy.query"
+	TagSeries      = "promxy.series"
+	TagBytes       = "promxy.bytes"
+	// TagCoalesced is set on the spans of requests which joined another request's
+	// downstream call (see promclient.CoalesceAPI)
+	TagCoalesced = "promxy.coalesced"
+)
+
+// Configure creates the Tracer for the given exporter and installs it as the
+// opentracing global tracer. The returned closer should be called on shutdown.
+// Supported exporters are:
+//   - none: tracing is disabled (noop tracer)
+//   - log: spans are logged through logrus (at debug level)
+//   - file: spans are written as JSON lines to `path`
+//   - jaeger: spans are sent to jaeger by the jaeger client, which is configured
+//     through its JAEGER_* environment variables (e.g. JAEGER_AGENT_HOST)
+func Configure(exporter, path string) (io.Closer, error) {
+	switch exporter {
+	case "", "none":
+		opentracing.SetGlobalTracer(opentracing.NoopTracer{})
+		return ioutil.NopCloser(nil), nil
+	case "log":
+		opentracing.SetGlobalTracer(NewTracer(LogExporter{}))
+		return ioutil.NopCloser(nil), nil
+	case "file":
+		if path == "" {
+			return nil, fmt.Errorf("file tracing exporter requires a path")
+		}
+		e, err := NewFileExporter(path)
+		if err != nil {
+			return nil, err
+		}
+		opentracing.SetGlobalTracer(NewTracer(e))
+		return e, nil
+	case "jaeger":
+		cfg, err := jaegercfg.FromEnv()
+		if err != nil {
+			return nil, err
+		}
+		if cfg.ServiceName == "" {
+			cfg.ServiceName = "promxy"
+		}
+		tracer, closer, err := cfg.NewTracer(jaegercfg.Logger(jaegerLogger{}))
+		if err != nil {
+			return nil, err
+		}
+		opentracing.SetGlobalTracer(tracer)
+		return closer, nil
+	default:
+		return nil, fmt.Errorf("unknown tracing exporter %q", exporter)
+	}
+}
+
+// NewRoundTripper returns an http.RoundTripper which creates a span for each
+// request and propagates the trace context to the downstream via headers
+func NewRoundTripper(rt http.RoundTripper) http.RoundTripper {
+	return &roundTripper{rt}
+}
+
+type roundTripper struct {
+	rt http.RoundTripper
+}
+
+func (r *roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	parent := opentracing.SpanFromContext(req.Context())
+	if parent == nil {
+		return r.rt.RoundTrip(req)
+	}
+
+	tracer := parent.Tracer()
+	span := tracer.StartSpan("HTTP "+req.Method, opentracing.ChildOf(parent.Context()))
+	ext.SpanKindRPCClient.Set(span)
+	ext.HTTPMethod.Set(span, req.Method)
+	ext.HTTPUrl.Set(span, req.URL.String())
+
+	// RoundTrippers shouldn't modify the request, so we make a copy of the headers
+	req = req.WithContext(opentracing.ContextWithSpan(req.Context(), span))
+	req.Header = cloneHeader(req.Header)
+	if err := tracer.Inject(span.Context(), opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(req.Header)); err != nil {
+		span.LogKV("event", "inject error", "error", err)
+	}
+
+	resp, err := r.rt.RoundTrip(req)
+	if err != nil {
+		ext.Error.Set(span, true)
+		span.LogKV("error", err)
+		span.Finish()
+		return resp, err
+	}
+	ext.HTTPStatusCode.Set(span, uint16(resp.StatusCode))
+	if resp.StatusCode >= 500 {
+		ext.Error.Set(span, true)
+	}
+	resp.Body = &spanBody{ReadCloser: resp.Body, span: span}
+	return resp, nil
+}
+
+// spanBody finishes the span once the body has been consumed, recording the
+// number of bytes read
+type spanBody struct {
+	io.ReadCloser
+	span opentracing.Span
+	n    int64
+}
+
+func (b *spanBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+func (b *spanBody) Close() error {
+	err := b.ReadCloser.Close()
+	if b.span != nil {
+		b.span.SetTag(TagBytes, b.n)
+		b.span.Finish()
+		b.span = nil
+	}
+	return err
+}
+
+func cloneHeader(h http.Header) http.Header {
+	h2 := make(http.Header, len(h))
+	for k, vv := range h {
+		vv2 := make([]string, len(vv))
+		copy(vv2, vv)
+		h2[k] = vv2
+	}
+	return h2
+}
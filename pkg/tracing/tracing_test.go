@@ -0,0 +1,152 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	opentracing "github.com/opentracing/opentracing-go"
+)
+
+type memExporter struct {
+	l     sync.Mutex
+	spans []*FinishedSpan
+}
+
+func (m *memExporter) Export(s *FinishedSpan) {
+	m.l.Lock()
+	defer m.l.Unlock()
+	m.spans = append(m.spans, s)
+}
+
+func TestInjectExtract(t *testing.T) {
+	tracer := NewTracer(&memExporter{})
+	span := tracer.StartSpan("test")
+
+	carrier := opentracing.HTTPHeadersCarrier(http.Header{})
+	if err := tracer.Inject(span.Context(), opentracing.HTTPHeaders, carrier); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	extracted, err := tracer.Extract(opentracing.HTTPHeaders, carrier)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := span.Context().(SpanContext)
+	actual := extracted.(SpanContext)
+	if expected.TraceIDHigh != actual.TraceIDHigh || expected.TraceIDLow != actual.TraceIDLow || expected.SpanID != actual.SpanID {
+		t.Fatalf("mismatch in extracted context expected=%v actual=%v", expected, actual)
+	}
+
+	if _, err := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(http.Header{})); err != opentracing.ErrSpanContextNotFound {
+		t.Fatalf("expected ErrSpanContextNotFound, got %v", err)
+	}
+
+	badCarrier := opentracing.HTTPHeadersCarrier(http.Header{})
+	badCarrier.Set(TraceParentHeader, "garbage")
+	if _, err := tracer.Extract(opentracing.HTTPHeaders, badCarrier); err != opentracing.ErrSpanContextCorrupted {
+		t.Fatalf("expected ErrSpanContextCorrupted, got %v", err)
+	}
+}
+
+func TestRoundTripper(t *testing.T) {
+	exporter := &memExporter{}
+	tracer := NewTracer(exporter)
+
+	var received string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Get(TraceParentHeader)
+		w.Write([]byte("hello"))
+	}))
+	defer srv.Close()
+
+	parent := tracer.StartSpan("parent")
+	ctx := opentracing.ContextWithSpan(context.Background(), parent)
+
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	resp, err := (&http.Client{Transport: NewRoundTripper(http.DefaultTransport)}).Do(req.WithContext(ctx))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	parent.Finish()
+
+	if len(exporter.spans) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(exporter.spans))
+	}
+	child := exporter.spans[0]
+	parentSpan := exporter.spans[1]
+
+	if child.ParentID != parentSpan.SpanID || child.TraceID != parentSpan.TraceID {
+		t.Fatalf("child span not linked to parent: child=%+v parent=%+v", child, parentSpan)
+	}
+	if !strings.Contains(received, child.TraceID) || !strings.Contains(received, child.SpanID) {
+		t.Fatalf("trace context not propagated downstream: %s", received)
+	}
+	if child.Tags[TagBytes] != int64(5) {
+		t.Fatalf("expected bytes tag of 5, got %v", child.Tags[TagBytes])
+	}
+}
+
+func TestWriterExporter(t *testing.T) {
+	buf := &bytes.Buffer{}
+	tracer := NewTracer(NewWriterExporter(buf))
+
+	span := tracer.StartSpan("test")
+	span.SetTag(TagQuery, "up")
+	span.Finish()
+
+	var finished FinishedSpan
+	if err := json.Unmarshal(buf.Bytes(), &finished); err != nil {
+		t.Fatalf("unable to unmarshal span: %v", err)
+	}
+	if finished.Operation != "test" || finished.Tags[TagQuery] != "up" {
+		t.Fatalf("unexpected span: %+v", finished)
+	}
+}
+
+func TestJaegerExporter(t *testing.T) {
+	received := make(chan string, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		received <- r.URL.Path + " " + string(b)
+	}))
+	defer srv.Close()
+
+	for k, v := range map[string]string{
+		"JAEGER_ENDPOINT":      srv.URL + "/api/traces",
+		"JAEGER_SAMPLER_TYPE":  "const",
+		"JAEGER_SAMPLER_PARAM": "1",
+	} {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+	defer opentracing.SetGlobalTracer(opentracing.NoopTracer{})
+
+	closer, err := Configure("jaeger", "")
+	if err != nil {
+		t.Fatalf("unable to configure jaeger: %v", err)
+	}
+	span := opentracing.GlobalTracer().StartSpan("jaeger-test-span")
+	span.Finish()
+	// Closing flushes the spans to the collector
+	closer.Close()
+
+	select {
+	case r := <-received:
+		if !strings.HasPrefix(r, "/api/traces ") || !strings.Contains(r, "jaeger-test-span") || !strings.Contains(r, "promxy") {
+			t.Fatalf("unexpected request to the collector: %q", r)
+		}
+	default:
+		t.Fatal("no spans were sent to the collector")
+	}
+}
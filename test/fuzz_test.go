@@ -0,0 +1,280 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/promql"
+)
+
+// fuzzDataset is the data the fuzzed expressions are evaluated over: counters
+// (one with a reset) and gauges (one with a gap) of a few jobs and instances.
+// No two series of a metric have the same value at any (30s aligned) step, so
+// which series topk and bottomk return is well defined
+const fuzzDataset = `
+load 15s
+  fuzz_requests_total{job="api", instance="0"} 0+10x120
+  fuzz_requests_total{job="api", instance="1"} 1+7x60 0+7x59
+  fuzz_requests_total{job="db", instance="0"} 2+3x120
+  fuzz_requests_total{job="db", instance="1"} 100+1x120
+  fuzz_temperature{job="api", instance="0"} 20.25+0.5x120
+  fuzz_temperature{job="api", instance="1"} 81-0.25x120
+  fuzz_temperature{job="db", instance="0"} 5+1x40 _x20 45-1x59
+  fuzz_temperature{job="db", instance="1"} 1 -1 2 -2 3 -3 0.5+0x114
+`
+
+// fuzzLayout spreads the series of the fuzzDataset across servergroups of HA pairs
+var fuzzLayout = harnessLayout{ServerGroups: 3, Replicas: 2, Partition: true}
+
+// maxFuzzDepth is the max nesting of the generated expressions
+const maxFuzzDepth = 3
+
+var (
+	fuzzEvalTimes  = []time.Duration{10 * time.Minute, 20 * time.Minute, 30 * time.Minute}
+	fuzzMetrics    = []string{"fuzz_requests_total", "fuzz_temperature"}
+	fuzzMatchers   = []string{"", `{job="api"}`, `{instance!="0"}`, `{job=~"api|db", instance="1"}`}
+	fuzzOffsets    = []string{"", " offset 1m", " offset 5m"}
+	fuzzRanges     = []string{"1m", "5m"}
+	fuzzGroupings  = []string{"", " by (job)", " without (instance)", " by (instance, job)"}
+	fuzzAggregates = []string{"sum", "min", "max", "avg", "count", "stddev", "stdvar", "quantile", "count_values", "topk", "bottomk"}
+	fuzzFunctions  = []string{"abs", "ceil", "floor", "round", "clamp_max", "clamp_min", "label_replace"}
+	fuzzRangeFuncs = []string{"rate", "increase", "delta", "irate", "deriv", "changes", "resets", "avg_over_time", "min_over_time", "max_over_time", "sum_over_time", "count_over_time", "stddev_over_time"}
+	fuzzArithmetic = []string{"+", "-", "*", "%"}
+	// / and ^ are only generated with a vector and one of these literals, as
+	// other operands can result in ±Inf. The engine's avg and stddev of ±Inf
+	// depend on the order of the series (Inf - Inf is NaN), which differs
+	// between promxy and direct evaluation
+	fuzzDivisors   = []string{"2.5", "-3", "100"}
+	fuzzExponents  = []string{"2", "0.5"}
+	fuzzComparison = []string{"==", "!=", ">", "<", ">=", "<="}
+	fuzzSetOps     = []string{"and", "or", "unless"}
+	fuzzMatching   = []string{"", " on (job, instance)", " ignoring (instance)"}
+	fuzzNumbers    = []string{"0", "1", "2.5", "-3", "100"}
+)
+
+// exprGenerator generates well-typed PromQL expressions over the fuzzDataset.
+// Its choices are read from the fuzzer's input, once that is exhausted the
+// first (simplest) option is chosen, so every input generates an expression
+type exprGenerator struct {
+	data []byte
+}
+
+// choose returns the next choice between n options
+func (g *exprGenerator) choose(n int) int {
+	if len(g.data) == 0 {
+		return 0
+	}
+	c := int(g.data[0]) % n
+	g.data = g.data[1:]
+	return c
+}
+
+func (g *exprGenerator) pick(options []string) string {
+	return options[g.choose(len(options))]
+}
+
+// vector returns an instant vector expression
+func (g *exprGenerator) vector(depth int) string {
+	if depth <= 0 {
+		return g.selector() + g.pick(fuzzOffsets)
+	}
+	switch g.choose(6) {
+	case 1:
+		return g.aggregate(depth)
+	case 2:
+		return fmt.Sprintf("%s(%s)", g.pick(fuzzRangeFuncs), g.matrix(depth-1))
+	case 3:
+		return g.function(depth)
+	case 4:
+		// Vector/scalar binary op
+		op := g.pick(append(append(fuzzArithmetic, fuzzComparison...), "/", "^"))
+		switch op {
+		case "/":
+			return fmt.Sprintf("(%s / %s)", g.vector(depth-1), g.pick(fuzzDivisors))
+		case "^":
+			return fmt.Sprintf("(%s ^ %s)", g.vector(depth-1), g.pick(fuzzExponents))
+		}
+		v, s := g.vector(depth-1), g.scalar(depth-1)
+		if g.choose(2) == 1 {
+			return fmt.Sprintf("(%s %s %s)", s, op, v)
+		}
+		return fmt.Sprintf("(%s %s %s)", v, op, s)
+	case 5:
+		// Vector/vector binary op
+		op := g.pick(append(append(fuzzArithmetic, fuzzComparison...), fuzzSetOps...))
+		matching := g.pick(fuzzMatching)
+		return fmt.Sprintf("(%s %s%s %s)", g.vector(depth-1), op, matching, g.vector(depth-1))
+	default:
+		return g.selector() + g.pick(fuzzOffsets)
+	}
+}
+
+// selector returns a vector selector (without offset)
+func (g *exprGenerator) selector() string {
+	return g.pick(fuzzMetrics) + g.pick(fuzzMatchers)
+}
+
+// matrix returns a range vector expression
+func (g *exprGenerator) matrix(depth int) string {
+	if depth > 0 && g.choose(2) == 1 {
+		return fmt.Sprintf("(%s)[%s:%s]%s", g.vector(depth-1), g.pick(fuzzRanges), g.pick([]string{"", "30s", "1m"}), g.pick(fuzzOffsets))
+	}
+	return fmt.Sprintf("%s[%s]%s", g.selector(), g.pick(fuzzRanges), g.pick(fuzzOffsets))
+}
+
+// scalar returns a scalar expression
+func (g *exprGenerator) scalar(depth int) string {
+	if depth > 0 && g.choose(2) == 1 {
+		return fmt.Sprintf("scalar(%s)", g.vector(depth-1))
+	}
+	return g.pick(fuzzNumbers)
+}
+
+func (g *exprGenerator) aggregate(depth int) string {
+	op, grouping := g.pick(fuzzAggregates), g.pick(fuzzGroupings)
+	switch op {
+	case "quantile":
+		return fmt.Sprintf("%s%s(0.%d, %s)", op, grouping, g.choose(10), g.vector(depth-1))
+	case "count_values":
+		// The values become labels, so rounding errors of calculated values
+		// (e.g. of the avg rewrite) would be reported as mismatches
+		return fmt.Sprintf(`%s%s("value", %s)`, op, grouping, g.vector(0))
+	case "topk", "bottomk":
+		// Only the selected series are free of ties (see fuzzDataset), calculated
+		// values may well be equal
+		return fmt.Sprintf("%s%s(%d, %s)", op, grouping, 1+g.choose(2), g.vector(0))
+	}
+	return fmt.Sprintf("%s%s(%s)", op, grouping, g.vector(depth-1))
+}
+
+func (g *exprGenerator) function(depth int) string {
+	switch f := g.pick(fuzzFunctions); f {
+	case "clamp_max", "clamp_min":
+		return fmt.Sprintf("%s(%s, %s)", f, g.vector(depth-1), g.pick(fuzzNumbers))
+	case "label_replace":
+		return fmt.Sprintf(`label_replace(%s, "dst", "$1", "job", "(.*)")`, g.vector(depth-1))
+	default:
+		return fmt.Sprintf("%s(%s)", f, g.vector(depth-1))
+	}
+}
+
+// check compares the evaluation of expr through promxy and directly, a panic
+// is a mismatch as well
+func (h *harness) check(expr string, ts time.Time) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return h.compare(expr, ts)
+}
+
+// visitorFunc is a promql.Visitor calling the func for each node
+type visitorFunc func(node promql.Node, path []promql.Node)
+
+func (f visitorFunc) Visit(node promql.Node, path []promql.Node) (promql.Visitor, error) {
+	f(node, path)
+	return f, nil
+}
+
+// shrink returns the simplifications of expr (smallest first): its
+// subexpressions of the same type and expr without offsets
+func shrink(expr string) []string {
+	root, err := promql.ParseExpr(expr)
+	if err != nil {
+		return nil
+	}
+
+	var ret []string
+	noOffsets := visitorFunc(func(node promql.Node, _ []promql.Node) {
+		switch n := node.(type) {
+		case *promql.VectorSelector:
+			n.Offset = 0
+		case *promql.MatrixSelector:
+			n.Offset = 0
+		case *promql.SubqueryExpr:
+			n.Offset = 0
+		}
+	})
+	subexpressions := visitorFunc(func(node promql.Node, path []promql.Node) {
+		if e, ok := node.(promql.Expr); ok && len(path) > 0 && e.Type() == root.Type() {
+			ret = append(ret, e.String())
+		}
+	})
+	stmt := &promql.EvalStmt{Expr: root}
+	// The subexpressions are collected before the offsets are removed
+	promql.Walk(context.Background(), subexpressions, stmt, root, nil, nil)
+	promql.Walk(context.Background(), noOffsets, stmt, root, nil, nil)
+	ret = append(ret, root.String())
+
+	sort.SliceStable(ret, func(i, j int) bool { return len(ret[i]) < len(ret[j]) })
+	return ret
+}
+
+// minimise returns the smallest simplification of expr which still fails
+func minimise(expr string, fails func(string) bool) string {
+	for {
+		smaller := ""
+		for _, candidate := range shrink(expr) {
+			if len(candidate) < len(expr) && fails(candidate) {
+				smaller = candidate
+				break
+			}
+		}
+		if smaller == "" {
+			return expr
+		}
+		expr = smaller
+	}
+}
+
+// fuzzSeeds are inputs covering each kind of expression of the exprGenerator
+var fuzzSeeds = [][]byte{
+	{},
+	{0, 0, 1},
+	{1, 1, 1, 0, 1, 2},
+	{2, 2, 0, 1, 1, 1, 0, 0},
+	{1, 2, 1, 3, 2, 2, 1, 1, 1, 1, 2, 0, 1, 1},
+	{2, 1, 1, 1, 5, 1, 0, 0, 0, 1},
+	{0, 4, 0, 2, 1, 2, 1, 3},
+	{1, 5, 2, 1, 1, 0, 1, 2, 0, 1, 1, 1},
+	{2, 3, 5, 0, 0, 1, 3},
+	{0, 1, 10, 2, 2, 2, 1, 0, 2},
+}
+
+// FuzzNodeReplacer evaluates random expressions through promxy (in front of
+// partitioned downstreams) and directly, mismatches are minimised and reported.
+// Run with `go test ./test -run '^$' -fuzz FuzzNodeReplacer`
+func FuzzNodeReplacer(f *testing.F) {
+	for _, seed := range fuzzSeeds {
+		f.Add(seed)
+	}
+
+	seed := *harnessSeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	f.Logf("harness seed: %d", seed)
+
+	h := newHarness(f, fuzzLayout)
+	defer h.stop()
+	h.reset("fuzz", seed)
+	if err := h.runCommand(testBlock{text: strings.TrimSpace(fuzzDataset)}); err != nil {
+		f.Fatalf("loading the dataset: %v", err)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		h.t = t
+		g := &exprGenerator{data: data}
+		ts := time.Unix(0, 0).Add(fuzzEvalTimes[g.choose(len(fuzzEvalTimes))])
+		expr := g.vector(maxFuzzDepth)
+		if err := h.check(expr, ts); err != nil {
+			smallest := minimise(expr, func(e string) bool { return h.check(e, ts) != nil })
+			t.Fatalf("mismatch at %s for %s: %v\nminimised from: %s", ts.UTC().Format(time.RFC3339), smallest, h.check(smallest, ts), expr)
+		}
+	})
+}
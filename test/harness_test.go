@@ -0,0 +1,519 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/util/testutil"
+
+	"github.com/jacksontj/promxy/pkg/proxystorage"
+)
+
+var harnessSeed = flag.Int64("harness.seed", 1, "seed of the random partitioning of the harness (0 picks a random seed)")
+
+var (
+	patCommand     = regexp.MustCompile(`^(load|clear|eval)`)
+	patEvalInstant = regexp.MustCompile(`^eval(?:_(fail|ordered))?\s+instant\s+(?:at\s+(.+?))?\s+(.+)$`)
+	patTopK        = regexp.MustCompile(`\b(topk|bottomk)\b`)
+)
+
+// partitionLabel is the label distinguishing the servergroups of a partitioned
+// layout
+const partitionLabel = "promxy_sg"
+
+// harnessLayout is how the series of a test are spread across the downstreams
+type harnessLayout struct {
+	// ServerGroups is the number of servergroups
+	ServerGroups int
+	// Replicas is the number of downstreams (targets) of each servergroup
+	Replicas int
+	// Partition stores each series in one (random) servergroup, the servergroups
+	// are distinguished by the partitionLabel. Otherwise all servergroups have
+	// all series (they are HA pairs)
+	Partition bool
+	// DropRatio is the fraction of samples dropped to simulate gaps. A sample is
+	// dropped from all downstreams of the series and from the reference (pushed
+	// down queries are evaluated by each downstream on its own data, so the
+	// replicas must have the same gaps for the results to be comparable)
+	DropRatio float64
+	// RemoteRead configures promxy to load raw data through the remote_read API
+	RemoteRead bool
+}
+
+func (l harnessLayout) String() string {
+	return fmt.Sprintf("sg=%d,replicas=%d,partition=%v,drop=%v,remote_read=%v", l.ServerGroups, l.Replicas, l.Partition, l.DropRatio, l.RemoteRead)
+}
+
+// harnessLayouts are the layouts each .test file is run with
+var harnessLayouts = []harnessLayout{
+	{ServerGroups: 1, Replicas: 1},
+	{ServerGroups: 1, Replicas: 1, RemoteRead: true},
+	{ServerGroups: 2, Replicas: 2, DropRatio: 0.2},
+	{ServerGroups: 2, Replicas: 2, DropRatio: 0.2, RemoteRead: true},
+	{ServerGroups: 3, Replicas: 1, Partition: true},
+	{ServerGroups: 3, Replicas: 1, Partition: true, RemoteRead: true},
+	{ServerGroups: 2, Replicas: 2, Partition: true, DropRatio: 0.2, RemoteRead: true},
+}
+
+// harness runs promql .test files against promxy in front of in-process fake
+// downstreams. The loaded series are spread across the downstreams, each eval
+// is checked against the direct evaluation of all of the data (and against the
+// expectations of the file, unless the series are partitioned, as that adds
+// the partitionLabel, or samples are dropped)
+type harness struct {
+	t      testing.TB
+	layout harnessLayout
+	rng    *rand.Rand
+
+	// reference has all of the loaded data (with the partitionLabel if the
+	// series are partitioned), for direct evaluation
+	reference *SwappableStorage
+	// downstreams are the storages of each replica of each servergroup
+	downstreams [][]*SwappableStorage
+	servers     []*httptest.Server
+	// queries are the queries (or the paths of other API requests) sent to the
+	// downstreams
+	queries     []string
+	queriesLock sync.Mutex
+	// groups is the servergroup of each series
+	groups map[string]int
+
+	ps       *proxystorage.ProxyStorage
+	engine   *promql.Engine
+	psEngine *promql.Engine
+}
+
+func newHarness(t testing.TB, layout harnessLayout) *harness {
+	h := &harness{
+		t:         t,
+		layout:    layout,
+		reference: &SwappableStorage{testutil.NewStorage(t)},
+		groups:    make(map[string]int),
+	}
+
+	var cfg bytes.Buffer
+	cfg.WriteString("promxy:\n  server_groups:\n")
+	for i := 0; i < layout.ServerGroups; i++ {
+		replicas := make([]*SwappableStorage, layout.Replicas)
+		cfg.WriteString("    - static_configs:\n        - targets:\n")
+		for j := range replicas {
+			replicas[j] = &SwappableStorage{testutil.NewStorage(t)}
+			srv := httptest.NewServer(h.recordQueries(newAPIHandler(replicas[j])))
+			h.servers = append(h.servers, srv)
+			u, _ := url.Parse(srv.URL)
+			fmt.Fprintf(&cfg, "          - %s\n", u.Host)
+		}
+		fmt.Fprintf(&cfg, "      remote_read: %v\n", layout.RemoteRead)
+		if layout.Partition {
+			fmt.Fprintf(&cfg, "      labels:\n        %s: %d\n", partitionLabel, i)
+		}
+		h.downstreams = append(h.downstreams, replicas)
+	}
+	h.ps = getProxyStorage(cfg.String())
+
+	opts := promql.EngineOpts{
+		MaxConcurrent: 20,
+		MaxSamples:    50000000,
+		Timeout:       100 * time.Second,
+	}
+	h.engine = promql.NewEngine(opts)
+	h.psEngine = promql.NewEngine(opts)
+	h.psEngine.NodeReplacer = h.ps.NodeReplacer
+	return h
+}
+
+// recordQueries records the requests to a downstream in queries
+func (h *harness) recordQueries(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.FormValue("query")
+		if q == "" {
+			q = r.URL.Path
+		}
+		h.queriesLock.Lock()
+		h.queries = append(h.queries, q)
+		h.queriesLock.Unlock()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// recordedQueries returns (and resets) the recorded queries
+func (h *harness) recordedQueries() []string {
+	h.queriesLock.Lock()
+	defer h.queriesLock.Unlock()
+	ret := h.queries
+	h.queries = nil
+	return ret
+}
+
+// stop stops promxy and the downstreams and removes their data
+func (h *harness) stop() {
+	for _, sg := range h.ps.ServerGroups() {
+		sg.Cancel()
+	}
+	for _, srv := range h.servers {
+		srv.Close()
+	}
+	for _, s := range h.storages() {
+		s.Close()
+	}
+}
+
+func (h *harness) storages() []*SwappableStorage {
+	ret := []*SwappableStorage{h.reference}
+	for _, replicas := range h.downstreams {
+		ret = append(ret, replicas...)
+	}
+	return ret
+}
+
+// reset removes all data and reseeds the partitioning for the file `fn`
+func (h *harness) reset(fn string, seed int64) {
+	h.clear()
+	hash := fnv.New64a()
+	hash.Write([]byte(fn))
+	h.rng = rand.New(rand.NewSource(seed ^ int64(hash.Sum64())))
+}
+
+// clear removes all data
+func (h *harness) clear() {
+	for _, s := range h.storages() {
+		if err := s.Close(); err != nil {
+			h.t.Fatalf("closing storage: %v", err)
+		}
+		s.s = testutil.NewStorage(h.t)
+	}
+	h.groups = make(map[string]int)
+}
+
+// group returns the (randomly assigned) servergroup of a series
+func (h *harness) group(l labels.Labels) int {
+	key := l.String()
+	g, ok := h.groups[key]
+	if !ok {
+		g = h.rng.Intn(h.layout.ServerGroups)
+		h.groups[key] = g
+	}
+	return g
+}
+
+// Querier returns a querier of promxy, the harness is the storage of the
+// promql.Tests it runs
+func (h *harness) Querier(ctx context.Context, mint, maxt int64) (storage.Querier, error) {
+	return h.ps.Querier(ctx, mint, maxt)
+}
+
+func (h *harness) StartTime() (int64, error) {
+	return h.reference.StartTime()
+}
+
+// Appender returns an appender which partitions the samples across the downstreams
+func (h *harness) Appender() (storage.Appender, error) {
+	a := &partitionAppender{h: h}
+	for _, s := range h.storages() {
+		app, err := s.Appender()
+		if err != nil {
+			return nil, err
+		}
+		a.apps = append(a.apps, app)
+	}
+	return a, nil
+}
+
+func (h *harness) Close() error { return nil }
+
+type partitionAppender struct {
+	h *harness
+	// apps are the appenders of the reference followed by those of the
+	// downstreams (in the order of harness.storages)
+	apps []storage.Appender
+}
+
+func (a *partitionAppender) Add(l labels.Labels, t int64, v float64) (uint64, error) {
+	layout := a.h.layout
+	if a.h.rng.Float64() < layout.DropRatio {
+		return 0, nil
+	}
+
+	// The indexes (in apps) of the downstreams the series is stored in
+	targets := make([]int, 0, layout.ServerGroups*layout.Replicas)
+	ref := l
+	for g := 0; g < layout.ServerGroups; g++ {
+		if layout.Partition {
+			if g != a.h.group(l) {
+				continue
+			}
+			ref = labels.NewBuilder(l).Set(partitionLabel, strconv.Itoa(g)).Labels()
+		}
+		for r := 0; r < layout.Replicas; r++ {
+			targets = append(targets, 1+g*layout.Replicas+r)
+		}
+	}
+
+	if _, err := a.apps[0].Add(ref, t, v); err != nil {
+		return 0, err
+	}
+	for _, i := range targets {
+		if _, err := a.apps[i].Add(l, t, v); err != nil {
+			return 0, err
+		}
+	}
+	return 0, nil
+}
+
+func (a *partitionAppender) AddFast(l labels.Labels, ref uint64, t int64, v float64) error {
+	_, err := a.Add(l, t, v)
+	return err
+}
+
+func (a *partitionAppender) Commit() error {
+	for _, app := range a.apps {
+		if err := app.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *partitionAppender) Rollback() error {
+	for _, app := range a.apps {
+		if err := app.Rollback(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// testBlock is a single command (with its lines) of a .test file
+type testBlock struct {
+	line int // line (0-based) of the command
+	text string
+}
+
+// splitTest splits the content of a .test file into its commands
+func splitTest(content string) []testBlock {
+	var blocks []testBlock
+	for i, l := range strings.Split(content, "\n") {
+		if patCommand.MatchString(strings.TrimSpace(l)) {
+			blocks = append(blocks, testBlock{line: i})
+		}
+		if len(blocks) > 0 {
+			blocks[len(blocks)-1].text += l + "\n"
+		}
+	}
+	return blocks
+}
+
+// Run runs the .test file
+func (h *harness) Run(fn string) {
+	content, err := ioutil.ReadFile(fn)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+
+	for _, block := range splitTest(string(content)) {
+		if err := h.runCommand(block); err != nil {
+			h.t.Errorf("%s:%d: %v", filepath.Base(fn), block.line+1, err)
+		}
+	}
+}
+
+// runCommand runs a single command of a .test file
+func (h *harness) runCommand(block testBlock) (err error) {
+	// A panic of promxy (or the engine) only fails the command
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+
+	command := strings.TrimSpace(block.text)
+	if strings.HasPrefix(command, "clear") {
+		h.clear()
+		return nil
+	}
+
+	// Each command runs as its own promql.Test, prefixed with empty lines so
+	// that errors have the line numbers of the file
+	test, err := promql.NewTest(h.t, strings.Repeat("\n", block.line)+block.text)
+	if err != nil {
+		return err
+	}
+	test.Storage().Close()
+	test.SetStorage(h)
+	test.QueryEngine().NodeReplacer = h.ps.NodeReplacer
+	if !strings.HasPrefix(command, "eval") || !(h.layout.Partition || h.layout.DropRatio > 0) {
+		if err := test.Run(); err != nil {
+			return err
+		}
+	}
+
+	parts := patEvalInstant.FindStringSubmatch(strings.SplitN(command, "\n", 2)[0])
+	if parts == nil || parts[1] == "fail" {
+		return nil
+	}
+	// Gaps can make the values of series equal, which of those topk and bottomk
+	// select is arbitrary
+	if h.layout.DropRatio > 0 && patTopK.MatchString(parts[3]) {
+		return nil
+	}
+	offset, err := model.ParseDuration(parts[2])
+	if err != nil {
+		return err
+	}
+	if err := h.compare(parts[3], time.Unix(0, 0).Add(time.Duration(offset))); err != nil {
+		return fmt.Errorf("%s: %v", parts[3], err)
+	}
+	return nil
+}
+
+// compare evaluates the expression through promxy and directly, as an instant
+// query and as a range query around `ts`, and compares the results
+func (h *harness) compare(expr string, ts time.Time) error {
+	ctx := context.Background()
+	// The points of a result are only valid until its query is closed
+	run := func(ng *promql.Engine, q storage.Queryable, rangeQuery bool) (promql.Query, *promql.Result, error) {
+		if rangeQuery {
+			query, err := ng.NewRangeQuery(q, expr, ts.Add(-5*time.Minute), ts.Add(5*time.Minute), time.Minute)
+			if err != nil {
+				return nil, nil, err
+			}
+			return query, query.Exec(ctx), nil
+		}
+		query, err := ng.NewInstantQuery(q, expr, ts)
+		if err != nil {
+			return nil, nil, err
+		}
+		return query, query.Exec(ctx), nil
+	}
+
+	for _, rangeQuery := range []bool{false, true} {
+		expectedQuery, expected, err := run(h.engine, h.reference, rangeQuery)
+		if err != nil {
+			return err
+		}
+		defer expectedQuery.Close()
+		actualQuery, actual, err := run(h.psEngine, h, rangeQuery)
+		if err != nil {
+			return err
+		}
+		defer actualQuery.Close()
+
+		if (expected.Err == nil) != (actual.Err == nil) {
+			return fmt.Errorf("range=%v: direct error %v, promxy error %v", rangeQuery, expected.Err, actual.Err)
+		}
+		if expected.Err != nil {
+			continue
+		}
+		if err := compareValues(expected.Value, actual.Value); err != nil {
+			return fmt.Errorf("range=%v: %v", rangeQuery, err)
+		}
+	}
+	return nil
+}
+
+// compareValues compares the series (in any order) of two results
+func compareValues(expected, actual promql.Value) error {
+	e, a := valueSeries(expected), valueSeries(actual)
+	if expected.Type() != actual.Type() {
+		return fmt.Errorf("expected %s, got %s", expected.Type(), actual.Type())
+	}
+	if len(e) != len(a) {
+		return fmt.Errorf("expected %d series, got %d\nexpected: %v\nactual:   %v", len(e), len(a), expected, actual)
+	}
+	for i := range e {
+		if !labels.Equal(e[i].Metric, a[i].Metric) {
+			return fmt.Errorf("expected series %s, got %s", e[i].Metric, a[i].Metric)
+		}
+		if len(e[i].Points) != len(a[i].Points) {
+			return fmt.Errorf("%s: expected %v, got %v", e[i].Metric, e[i].Points, a[i].Points)
+		}
+		for j, p := range e[i].Points {
+			if p.T != a[i].Points[j].T || !almostEqual(p.V, a[i].Points[j].V) {
+				return fmt.Errorf("%s: expected %v, got %v", e[i].Metric, e[i].Points, a[i].Points)
+			}
+		}
+	}
+	return nil
+}
+
+// valueSeries returns the series of a result sorted by their labels
+func valueSeries(v promql.Value) promql.Matrix {
+	var m promql.Matrix
+	switch vTyped := v.(type) {
+	case promql.Scalar:
+		m = promql.Matrix{{Points: []promql.Point{{T: vTyped.T, V: vTyped.V}}}}
+	case promql.Vector:
+		for _, s := range vTyped {
+			m = append(m, promql.Series{Metric: s.Metric, Points: []promql.Point{s.Point}})
+		}
+	case promql.Matrix:
+		m = vTyped
+	}
+	sort.Slice(m, func(i, j int) bool { return labels.Compare(m[i].Metric, m[j].Metric) < 0 })
+	return m
+}
+
+// almostEqual returns whether two values only differ by a small relative error
+// (the same as promql.Test)
+func almostEqual(a, b float64) bool {
+	if math.IsNaN(a) && math.IsNaN(b) {
+		return true
+	}
+	if a == b {
+		return true
+	}
+	diff := math.Abs(a - b)
+	if a == 0 || b == 0 || diff < math.SmallestNonzeroFloat64 {
+		return diff < 0.000001*math.SmallestNonzeroFloat64
+	}
+	return diff/(math.Abs(a)+math.Abs(b)) < 0.000001
+}
+
+// runHarness runs the .test files with each of the harnessLayouts. skip, if set,
+// is called to skip files which can't be run with a layout
+func runHarness(t *testing.T, files []string, skip func(harnessLayout, string) bool) {
+	seed := *harnessSeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	t.Logf("harness seed: %d", seed)
+
+	for _, layout := range harnessLayouts {
+		t.Run(layout.String(), func(t *testing.T) {
+			h := newHarness(t, layout)
+			defer h.stop()
+			for _, fn := range files {
+				if skip != nil && skip(layout, fn) {
+					continue
+				}
+				t.Run(filepath.Base(fn), func(t *testing.T) {
+					// Every file gets its own (reproducible) partitioning
+					h.t = t
+					h.reset(fn, seed)
+					h.Run(fn)
+				})
+			}
+		})
+	}
+}
@@ -5,7 +5,6 @@ import (
 	"io/ioutil"
 	"net/http"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -24,29 +23,6 @@ import (
 	"github.com/jacksontj/promxy/pkg/proxystorage"
 )
 
-const rawPSConfig = `
-promxy:
-  http_client:
-    tls_config:
-      insecure_skip_verify: true
-  server_groups:
-    - static_configs:
-        - targets:
-          - localhost:8083
-`
-
-const rawPSRemoteReadConfig = `
-promxy:
-  server_groups:
-    - static_configs:
-        - targets:
-          - localhost:8083
-      remote_read: true
-      http_client:
-        tls_config:
-          insecure_skip_verify: true
-`
-
 const rawDoublePSConfig = `
 promxy:
   server_groups:
@@ -108,8 +84,9 @@ func getProxyStorage(cfg string) *proxystorage.ProxyStorage {
 	return ps
 }
 
-func startAPIForTest(s storage.Storage, listen string) (*http.Server, chan struct{}) {
-	// Start up API server for engine
+// newAPIHandler returns a handler serving the prometheus v1 API (including
+// remote_read) of the storage
+func newAPIHandler(s storage.Storage) http.Handler {
 	cfgFunc := func() config.Config { return config.DefaultConfig }
 	// Return 503 until ready (for us there isn't much startup, so this might not need to be implemented
 	readyFunc := func(f http.HandlerFunc) http.HandlerFunc { return f }
@@ -137,10 +114,14 @@ func startAPIForTest(s storage.Storage, listen string) (*http.Server, chan struc
 
 	apiRouter := route.New()
 	api.Register(apiRouter.WithPrefix("/api/v1"))
+	return apiRouter
+}
 
+func startAPIForTest(s storage.Storage, listen string) (*http.Server, chan struct{}) {
+	// Start up API server for engine
 	startChan := make(chan struct{})
 	stopChan := make(chan struct{})
-	srv := &http.Server{Addr: listen, Handler: apiRouter}
+	srv := &http.Server{Addr: listen, Handler: newAPIHandler(s)}
 
 	go func() {
 		defer close(stopChan)
@@ -153,53 +134,26 @@ func startAPIForTest(s storage.Storage, listen string) (*http.Server, chan struc
 	return srv, stopChan
 }
 
-func TestUpstreamEvaluations(t *testing.T) {
+// upstreamTestdata returns the promql .test files of the vendored prometheus
+func upstreamTestdata(t *testing.T) []string {
 	files, err := filepath.Glob("../vendor/github.com/prometheus/prometheus/promql/testdata/*.test")
 	if err != nil {
 		t.Fatal(err)
 	}
-	for i, psConfig := range []string{rawPSConfig, rawPSRemoteReadConfig} {
-		for _, fn := range files {
-
-			// Upstream prom is using a StaleNan to determine if a given timeseries has gone
-			// NaN -- the problem being that for range vectors they filter out all "stale" samples
-			// meaning that it isn't possible to get a "raw" dump of data through the v1 API
-			// The only option that exists in reality is the "remote read" API -- which suffers
-			// from the same memory-balooning problems that the HTTP+JSON API originally had.
-			// It has **less** of a problem (its 2x memory instead of 14x) so it is a viable option.
-			// NOTE: Skipped only when promxy isn't configured to use the remote_read API
-			if psConfig == rawPSConfig && strings.Contains(fn, "staleness.test") {
-				continue
-			}
-			t.Run(strconv.Itoa(i)+fn, func(t *testing.T) {
-				test, err := newTestFromFile(t, fn)
-				if err != nil {
-					t.Errorf("error creating test for %s: %s", fn, err)
-				}
-
-				// Create API for the storage engine
-				srv, stopChan := startAPIForTest(test.Storage(), ":8083")
-
-				ps := getProxyStorage(psConfig)
-				lStorage := &LayeredStorage{ps, test.Storage()}
-				// Replace the test storage with the promxy one
-				test.SetStorage(lStorage)
-				test.QueryEngine().NodeReplacer = ps.NodeReplacer
-
-				err = test.Run()
-				if err != nil {
-					t.Errorf("error running test %s: %s", fn, err)
-				}
-				test.Close()
+	return files
+}
 
-				// stop server
-				ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
-				defer cancel()
-				srv.Shutdown(ctx)
-				<-stopChan
-			})
-		}
-	}
+func TestUpstreamEvaluations(t *testing.T) {
+	runHarness(t, upstreamTestdata(t), func(layout harnessLayout, fn string) bool {
+		// Upstream prom is using a StaleNan to determine if a given timeseries has gone
+		// NaN -- the problem being that for range vectors they filter out all "stale" samples
+		// meaning that it isn't possible to get a "raw" dump of data through the v1 API
+		// The only option that exists in reality is the "remote read" API -- which suffers
+		// from the same memory-balooning problems that the HTTP+JSON API originally had.
+		// It has **less** of a problem (its 2x memory instead of 14x) so it is a viable option.
+		// NOTE: Skipped only when promxy isn't configured to use the remote_read API
+		return !layout.RemoteRead && strings.HasSuffix(fn, "staleness.test")
+	})
 }
 
 func TestEvaluations(t *testing.T) {
@@ -207,42 +161,7 @@ func TestEvaluations(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	for i, psConfig := range []string{rawDoublePSConfig, rawDoublePSConfigRR} {
-		for _, fn := range files {
-			t.Run(strconv.Itoa(i)+fn, func(t *testing.T) {
-				test, err := newTestFromFile(t, fn)
-				if err != nil {
-					t.Errorf("error creating test for %s: %s", fn, err)
-				}
-
-				// Create API for the storage engine
-				srv, stopChan := startAPIForTest(test.Storage(), ":8083")
-				srv2, stopChan2 := startAPIForTest(test.Storage(), ":8084")
-
-				ps := getProxyStorage(psConfig)
-				lStorage := &LayeredStorage{ps, test.Storage()}
-				// Replace the test storage with the promxy one
-				test.SetStorage(lStorage)
-				test.QueryEngine().NodeReplacer = ps.NodeReplacer
-
-				err = test.Run()
-				if err != nil {
-					t.Errorf("error running test %s: %s", fn, err)
-				}
-
-				test.Close()
-
-				// stop server
-				ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
-				defer cancel()
-				srv.Shutdown(ctx)
-				srv2.Shutdown(ctx)
-
-				<-stopChan
-				<-stopChan2
-			})
-		}
-	}
+	runHarness(t, files, nil)
 }
 
 func newTestFromFile(t testutil.T, filename string) (*promql.Test, error) {
@@ -273,3 +192,42 @@ func (p *LayeredStorage) Appender() (storage.Appender, error) {
 func (p *LayeredStorage) Close() error {
 	return p.baseStorage.Close()
 }
+
+// TestMixedOffsetPushdown checks that each side of a binary op with differing
+// offsets (e.g. week-over-week) is pushed down on its own, rather than promxy
+// fetching the data of the selectors
+func TestMixedOffsetPushdown(t *testing.T) {
+	h := newHarness(t, harnessLayout{ServerGroups: 2, Replicas: 1, Partition: true})
+	defer h.stop()
+	h.reset(t.Name(), *harnessSeed)
+
+	load := `
+load 1m
+  requests_total{instance="0"} 0+10x180
+  requests_total{instance="1"} 0+20x90 0+20x89
+  requests_total{instance="2"} 0+5x180
+`
+	if err := h.runCommand(testBlock{text: strings.TrimSpace(load)}); err != nil {
+		t.Fatal(err)
+	}
+	h.recordedQueries()
+
+	for _, expr := range []string{
+		"rate(requests_total[5m]) - rate(requests_total[5m] offset 1h)",
+		"sum(rate(requests_total[5m])) / sum(rate(requests_total[5m] offset 1h))",
+	} {
+		if err := h.compare(expr, time.Unix(0, 0).Add(2*time.Hour)); err != nil {
+			t.Fatalf("%s: %v", expr, err)
+		}
+		queries := h.recordedQueries()
+		if len(queries) == 0 {
+			t.Fatalf("%s: nothing pushed down", expr)
+		}
+		for _, q := range queries {
+			// The offset is removed (the query is shifted instead)
+			if strings.Contains(q, "offset") || !strings.Contains(q, "rate(requests_total[5m])") {
+				t.Fatalf("%s: unexpected downstream query %q", expr, q)
+			}
+		}
+	}
+}